@@ -0,0 +1,221 @@
+package marasi
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/google/martian/mitm"
+	"github.com/tfkr-ae/marasi/domain"
+)
+
+// CertCache stores the leaf certificates generated by the MITM authority so they can be reused for repeated hosts.
+// It is consulted by the GetCertificate function of the MITM config, see cachedCertificate.
+type CertCache interface {
+	// Get returns the cached certificate for the host, it returns false if no certificate is cached.
+	Get(host string) (*tls.Certificate, bool)
+	// Put stores the certificate for the host.
+	Put(host string, cert *tls.Certificate) error
+}
+
+// MemoryCertCache is an in-memory CertCache, it is the default cache of the proxy.
+type MemoryCertCache struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// NewMemoryCertCache creates an empty MemoryCertCache.
+func NewMemoryCertCache() *MemoryCertCache {
+	return &MemoryCertCache{
+		certs: make(map[string]*tls.Certificate),
+	}
+}
+
+// Get returns the cached certificate for the host.
+func (cache *MemoryCertCache) Get(host string) (*tls.Certificate, bool) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	cert, ok := cache.certs[host]
+	return cert, ok
+}
+
+// Put stores the certificate for the host.
+func (cache *MemoryCertCache) Put(host string, cert *tls.Certificate) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.certs[host] = cert
+	return nil
+}
+
+// RepositoryCertCache is a CertCache backed by a domain.CertificateRepository so generated certificates persist across restarts.
+// Certificates are also kept in memory to avoid decoding them on every connection.
+// The private keys of the leaf certificates are stored in the repository, so it is never set by default and has to be
+// enabled explicitly with WithCertCache.
+type RepositoryCertCache struct {
+	repo   domain.CertificateRepository
+	memory *MemoryCertCache
+}
+
+// NewRepositoryCertCache creates a RepositoryCertCache that stores the certificates in repo.
+func NewRepositoryCertCache(repo domain.CertificateRepository) *RepositoryCertCache {
+	return &RepositoryCertCache{
+		repo:   repo,
+		memory: NewMemoryCertCache(),
+	}
+}
+
+// Get returns the cached certificate for the host, loading it from the repository if it is not in memory.
+func (cache *RepositoryCertCache) Get(host string) (*tls.Certificate, bool) {
+	if cert, ok := cache.memory.Get(host); ok {
+		return cert, true
+	}
+
+	stored, err := cache.repo.GetCertificate(host)
+	if err != nil {
+		return nil, false
+	}
+
+	cert, err := tls.X509KeyPair(stored.CertPEM, stored.KeyPEM)
+	if err != nil {
+		log.Printf("decoding cached certificate for %s : %v", host, err)
+		return nil, false
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.Printf("parsing cached certificate for %s : %v", host, err)
+			return nil, false
+		}
+	}
+
+	cache.memory.Put(host, &cert)
+	return &cert, true
+}
+
+// Put stores the certificate for the host in memory and in the repository.
+func (cache *RepositoryCertCache) Put(host string, cert *tls.Certificate) error {
+	cache.memory.Put(host, cert)
+
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("certificate for %s has no chain", host)
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parsing certificate for %s : %w", host, err)
+		}
+	}
+
+	var certPEM bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return fmt.Errorf("encoding certificate for %s : %w", host, err)
+		}
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("marshalling private key for %s : %w", host, err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
+
+	err = cache.repo.SaveCertificate(&domain.Certificate{
+		Host:     host,
+		CertPEM:  certPEM.Bytes(),
+		KeyPEM:   keyPEM,
+		NotAfter: leaf.NotAfter,
+	})
+	if err != nil {
+		return fmt.Errorf("saving certificate for %s : %w", host, err)
+	}
+	return nil
+}
+
+// cachedCertificate wraps the GetCertificate function of the MITM config so generated certificates are looked up in
+// and stored to proxy.CertCache. Cached certificates that are expired or were not issued by ca are generated again.
+func (proxy *Proxy) cachedCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), ca *x509.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		host := clientHello.ServerName
+		if proxy.CertCache == nil || host == "" {
+			return getCertificate(clientHello)
+		}
+
+		if cert, ok := proxy.CertCache.Get(host); ok && cert.Leaf != nil {
+			if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err == nil {
+				return cert, nil
+			}
+		}
+
+		cert, err := getCertificate(clientHello)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := proxy.CertCache.Put(host, cert); err != nil {
+			log.Printf("caching certificate : %v", err)
+		}
+		return cert, nil
+	}
+}
+
+// primeCertificate looks up the certificate of the CONNECT host through cachedCertificate and places it in the cache of
+// the martian MITM config. martian mints the certificate of a CONNECT request from its own cache during the handshake,
+// so the certificate has to be there before the CONNECT request is answered. Clients sending an SNI other than the
+// CONNECT host are served by martian's cache alone.
+func (proxy *Proxy) primeCertificate(hostPort string) {
+	if proxy.martianMITM == nil || proxy.mitmConfig == nil || proxy.CertCache == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+
+	cert, err := proxy.mitmConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+	if err != nil {
+		log.Printf("getting certificate for %s : %v", host, err)
+		return
+	}
+	if !setMITMCertificate(proxy.martianMITM, host, cert) {
+		log.Printf("caching certificate for %s : unsupported martian MITM config", host)
+	}
+}
+
+// setMITMCertificate stores the certificate of the host in the cache of the martian MITM config.
+// martian does not export its cache, so the certmu and certs fields are reached through reflection. It returns false
+// if the config does not have the expected fields or the certificate has no parsed leaf, martian verifies the leaf of cached certificates.
+func setMITMCertificate(config *mitm.Config, host string, cert *tls.Certificate) bool {
+	if cert.Leaf == nil {
+		return false
+	}
+	value := reflect.ValueOf(config).Elem()
+	mu := value.FieldByName("certmu")
+	certs := value.FieldByName("certs")
+	if !mu.IsValid() || mu.Type() != reflect.TypeFor[sync.RWMutex]() ||
+		!certs.IsValid() || certs.Type() != reflect.TypeFor[map[string]*tls.Certificate]() {
+		return false
+	}
+
+	certmu := (*sync.RWMutex)(unsafe.Pointer(mu.UnsafeAddr()))
+	certmu.Lock()
+	defer certmu.Unlock()
+	cache := *(*map[string]*tls.Certificate)(unsafe.Pointer(certs.UnsafeAddr()))
+	if cache == nil {
+		return false
+	}
+	cache[host] = cert
+	return true
+}
@@ -0,0 +1,236 @@
+package marasi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/martian/mitm"
+	"github.com/tfkr-ae/marasi/domain"
+)
+
+// testCertificateRepo is an in-memory domain.CertificateRepository
+type testCertificateRepo struct {
+	mu    sync.Mutex
+	certs map[string]*domain.Certificate
+	saves int
+}
+
+func (repo *testCertificateRepo) GetCertificate(host string) (*domain.Certificate, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	cert, ok := repo.certs[host]
+	if !ok {
+		return nil, errors.New("certificate not found")
+	}
+	return cert, nil
+}
+
+func (repo *testCertificateRepo) SaveCertificate(cert *domain.Certificate) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.saves++
+	repo.certs[cert.Host] = cert
+	return nil
+}
+
+// testMITMCertificate returns the CA and a GetCertificate function that counts how many certificates it generated
+func testMITMCertificate(t *testing.T) (*x509.Certificate, func(*tls.ClientHelloInfo) (*tls.Certificate, error), *int) {
+	t.Helper()
+	ca, priv, err := mitm.NewAuthority("Marasi", "Marasi Authority", time.Hour)
+	if err != nil {
+		t.Fatalf("creating mitm authority : %v", err)
+	}
+	config, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("creating mitm config : %v", err)
+	}
+
+	calls := 0
+	getCertificate := config.TLS().GetCertificate
+	return ca, func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		calls++
+		return getCertificate(clientHello)
+	}, &calls
+}
+
+func TestCachedCertificate(t *testing.T) {
+	t.Run("second request to the same host should reuse the cached certificate", func(t *testing.T) {
+		ca, generate, calls := testMITMCertificate(t)
+		proxy := &Proxy{CertCache: NewMemoryCertCache()}
+		getCertificate := proxy.cachedCertificate(generate, ca)
+
+		first, err := getCertificate(&tls.ClientHelloInfo{ServerName: "marasi.app"})
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		second, err := getCertificate(&tls.ClientHelloInfo{ServerName: "marasi.app"})
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if *calls != 1 {
+			t.Fatalf("wanted: 1 generated certificate\ngot: %d", *calls)
+		}
+		if first != second {
+			t.Fatalf("wanted: same certificate\ngot: different certificates")
+		}
+
+		if _, err := getCertificate(&tls.ClientHelloInfo{ServerName: "api.marasi.app"}); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if *calls != 2 {
+			t.Fatalf("wanted: 2 generated certificates\ngot: %d", *calls)
+		}
+	})
+
+	t.Run("cached certificate issued by another authority should be generated again", func(t *testing.T) {
+		_, otherGenerate, _ := testMITMCertificate(t)
+		staleCert, err := otherGenerate(&tls.ClientHelloInfo{ServerName: "marasi.app"})
+		if err != nil {
+			t.Fatalf("generating certificate : %v", err)
+		}
+
+		ca, generate, calls := testMITMCertificate(t)
+		cache := NewMemoryCertCache()
+		cache.Put("marasi.app", staleCert)
+		proxy := &Proxy{CertCache: cache}
+		getCertificate := proxy.cachedCertificate(generate, ca)
+
+		got, err := getCertificate(&tls.ClientHelloInfo{ServerName: "marasi.app"})
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if got == staleCert || *calls != 1 {
+			t.Fatalf("wanted: new certificate\ngot: stale certificate")
+		}
+
+		cached, _ := cache.Get("marasi.app")
+		if cached != got {
+			t.Fatalf("wanted: new certificate to be cached\ngot: %v", cached)
+		}
+	})
+}
+
+func TestRepositoryCertCache(t *testing.T) {
+	t.Run("certificate should be loaded from the repository by a new cache", func(t *testing.T) {
+		_, generate, _ := testMITMCertificate(t)
+		cert, err := generate(&tls.ClientHelloInfo{ServerName: "marasi.app"})
+		if err != nil {
+			t.Fatalf("generating certificate : %v", err)
+		}
+
+		repo := &testCertificateRepo{certs: make(map[string]*domain.Certificate)}
+		err = NewRepositoryCertCache(repo).Put("marasi.app", cert)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		got, ok := NewRepositoryCertCache(repo).Get("marasi.app")
+		if !ok {
+			t.Fatalf("wanted: true\ngot: %t", ok)
+		}
+		if !bytes.Equal(got.Leaf.Raw, cert.Leaf.Raw) {
+			t.Fatalf("wanted: same leaf certificate\ngot: different leaf certificate")
+		}
+		if len(got.Certificate) != len(cert.Certificate) {
+			t.Fatalf("wanted: %d certificates in chain\ngot: %d", len(cert.Certificate), len(got.Certificate))
+		}
+	})
+
+	t.Run("missing certificate should not be found", func(t *testing.T) {
+		repo := &testCertificateRepo{certs: make(map[string]*domain.Certificate)}
+		if _, ok := NewRepositoryCertCache(repo).Get("marasi.app"); ok {
+			t.Fatalf("wanted: false\ngot: %t", ok)
+		}
+	})
+}
+
+func TestCONNECTCertificateCache(t *testing.T) {
+	ca, priv, err := mitm.NewAuthority("Marasi", "Marasi Authority", time.Hour)
+	if err != nil {
+		t.Fatalf("creating mitm authority : %v", err)
+	}
+	repo := &testCertificateRepo{certs: make(map[string]*domain.Certificate)}
+
+	// startProxy serves a proxy using the repository certificate cache, like a proxy started again with the same database
+	startProxy := func(t *testing.T) string {
+		t.Helper()
+		proxy, err := New(WithBasePipeline(), WithDefaultModifierPipeline(), WithCertCache(NewRepositoryCertCache(repo)))
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		if err := proxy.setMITM(ca, priv); err != nil {
+			t.Fatalf("setting mitm : %v", err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("creating listener : %v", err)
+		}
+		go proxy.Serve(listener)
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			proxy.Shutdown(ctx)
+		})
+		return listener.Addr().String()
+	}
+
+	// connect sends a CONNECT request for marasi.app through the proxy and returns the leaf certificate of the MITM handshake
+	connect := func(t *testing.T, proxyAddr string) *x509.Certificate {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("connecting to proxy : %v", err)
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, "CONNECT marasi.app:443 HTTP/1.1\r\nHost: marasi.app:443\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("reading CONNECT response : %v", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("wanted: %d\ngot: %d", http.StatusOK, res.StatusCode)
+		}
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: "marasi.app", InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("performing tls handshake : %v", err)
+		}
+		return tlsConn.ConnectionState().PeerCertificates[0]
+	}
+
+	proxyAddr := startProxy(t)
+	first := connect(t, proxyAddr)
+	second := connect(t, proxyAddr)
+
+	if !bytes.Equal(first.Raw, second.Raw) {
+		t.Fatalf("wanted: second CONNECT to reuse the cached certificate\ngot: different certificates")
+	}
+	repo.mu.Lock()
+	saves, stored := repo.saves, repo.certs["marasi.app"]
+	repo.mu.Unlock()
+	if saves != 1 {
+		t.Fatalf("wanted: 1 certificate written to the repository\ngot: %d", saves)
+	}
+	if stored == nil || !bytes.Contains(stored.CertPEM, []byte("CERTIFICATE")) {
+		t.Fatalf("wanted: certificate of marasi.app stored in the repository\ngot: %v", stored)
+	}
+
+	// A new martian MITM config has an empty cache, the certificate comes from the repository
+	restarted := connect(t, startProxy(t))
+	if !bytes.Equal(first.Raw, restarted.Raw) {
+		t.Fatalf("wanted: restarted proxy to serve the persisted certificate\ngot: different certificates")
+	}
+}
@@ -2,25 +2,207 @@ package compass
 
 import (
 	"fmt"
+	"maps"
+	"net"
 	"net/http"
+	"net/netip"
 	"regexp"
+	"regexp/syntax"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// versionCounter generates scope versions, it is shared between all scopes so a version is never reused by another scope
+var versionCounter atomic.Uint64
+
 // Rule represents a single filtering rule in the scope system.
 // It contains a compiled regular expression and the type of matching to perform.
+// For "cidr" rules, Pattern is nil and the host is matched against Prefix instead.
 type Rule struct {
-	Pattern   *regexp.Regexp // Compiled regular expression pattern
-	MatchType string         // Type of matching: "host" or "url"
+	Pattern   *regexp.Regexp // Compiled regular expression pattern, nil for "cidr" rules
+	MatchType string         // Type of matching: "host", "url" or "cidr"
+	Priority  int            // Rules with a higher priority are evaluated first, see Scope.Matches
+	Prefix    netip.Prefix   // Network of "cidr" rules
+}
+
+// String returns the pattern of the rule, the network for "cidr" rules
+func (r Rule) String() string {
+	if r.MatchType == "cidr" {
+		return r.Prefix.String()
+	}
+	return r.Pattern.String()
+}
+
+// validMatchType reports whether matchType is one of the supported match types
+func validMatchType(matchType string) bool {
+	return matchType == "host" || matchType == "url" || matchType == "cidr"
+}
+
+// target returns the host for "host" and "cidr" rules and the URL for "url" rules
+func (r Rule) target(host, url string) string {
+	if r.MatchType == "url" {
+		return url
+	}
+	return host
+}
+
+// matches reports whether the rule matches the target.
+// "cidr" rules only match hosts that are IP addresses within the network, hostnames are not resolved.
+func (r Rule) matches(target string) bool {
+	if r.MatchType == "cidr" {
+		addr, ok := hostAddr(target)
+		return ok && r.Prefix.Contains(addr)
+	}
+	return r.Pattern.MatchString(target)
+}
+
+// matchCIDR reports whether the host is an IP address within the network of one of the "cidr" rules.
+// The hit counter of the first matching rule is incremented when count is set.
+func matchCIDR(rules []prioritizedRule, host string, count bool) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	addr, ok := hostAddr(host)
+	if !ok {
+		return false
+	}
+	for _, rule := range rules {
+		if rule.Prefix.Contains(addr) {
+			if count && rule.hits != nil {
+				rule.hits.Add(1)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// combinedRegex is an alternation of rules. Once a match has to be credited to a rule, the alternation is split
+// in two halves compiled the same way, so the first matching rule is found with a regex per level instead of testing every rule.
+type combinedRegex struct {
+	*regexp.Regexp
+	prefix       string        // Prefix of the alternation, "^" for anchored rules
+	alternatives []alternative // Rules of the alternation, in key order
+
+	splitOnce   sync.Once
+	left, right *combinedRegex // Halves of the alternatives, nil until split or when the halves cannot be compiled
+}
+
+// newCombinedRegex compiles the alternatives into an alternation with prefix
+func newCombinedRegex(prefix string, alternatives []alternative) (*combinedRegex, error) {
+	exprs := make([]string, 0, len(alternatives))
+	for _, alt := range alternatives {
+		exprs = append(exprs, "(?:"+alt.expr+")")
+	}
+	re, err := regexp.Compile(prefix + `(?:` + strings.Join(exprs, "|") + `)`)
+	if err != nil {
+		return nil, err
+	}
+	return &combinedRegex{Regexp: re, prefix: prefix, alternatives: alternatives}, nil
+}
+
+// match reports whether the combined regex matches the target.
+// When count is set, the hit counter of the first rule that matches the target is incremented.
+func (re *combinedRegex) match(target string, count bool) bool {
+	if !re.MatchString(target) {
+		return false
+	}
+	if count {
+		re.credit(target)
+	}
+	return true
+}
+
+// credit increments the hit counter of the first rule that matches the target, the combined regex must match the target
+func (re *combinedRegex) credit(target string) {
+	for len(re.alternatives) > 1 {
+		re.split()
+		if re.left == nil {
+			return
+		}
+		if re.left.MatchString(target) {
+			re = re.left
+		} else {
+			re = re.right
+		}
+	}
+	if hits := re.alternatives[0].hits; hits != nil {
+		hits.Add(1)
+	}
+}
+
+// split compiles the two halves of the alternatives the first time they are needed
+func (re *combinedRegex) split() {
+	re.splitOnce.Do(func() {
+		half := len(re.alternatives) / 2
+		left, err := newCombinedRegex(re.prefix, re.alternatives[:half])
+		if err != nil {
+			return
+		}
+		right, err := newCombinedRegex(re.prefix, re.alternatives[half:])
+		if err != nil {
+			return
+		}
+		re.left, re.right = left, right
+	})
+}
+
+// hostAddr parses the IP address of a host, with or without a port
+func hostAddr(host string) (netip.Addr, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// prioritizedRule is a rule with its verdict, used to evaluate the rules in priority order
+type prioritizedRule struct {
+	Rule
+	exclude bool
+	hits    *atomic.Uint64 // Hit counter of the rule, nil when the rule is not counted
+}
+
+// RuleStat reports how many times a rule decided a match, see Scope.RuleStats
+type RuleStat struct {
+	Pattern   string // Regular expression pattern
+	MatchType string // Type of matching: "host", "url" or "cidr"
+	Exclude   bool   // True for exclude rules
+	Hits      uint64 // Number of times Matches was decided by the rule since it was added or the stats were reset
 }
 
 // Scope represents the inclusion/exclusion rules and default behavior for filtering
 // HTTP requests and responses. It manages sets of rules and determines whether
 // traffic should be processed based on host or URL patterns.
+// The methods of a Scope are safe for concurrent use, the exported fields must not be changed directly while the scope is in use.
 type Scope struct {
 	IncludeRules map[string]Rule // Map of inclusion rules, key format: "pattern|matchType"
 	ExcludeRules map[string]Rule // Map of exclusion rules, key format: "pattern|matchType"
 	DefaultAllow bool            // Default behavior for items not matching any rule
+
+	mu      sync.RWMutex // Guards the rules, DefaultAllow and the state derived from them in the methods of the scope
+	version uint64       // Version of the rule set, bumped whenever the rules or the default behavior change
+
+	// Combined alternations of the rules per match type, rebuilt whenever the rules change.
+	// A nil map or a missing match type falls back to testing each rule separately.
+	combinedInclude map[string][]*combinedRegex
+	combinedExclude map[string][]*combinedRegex
+
+	// "cidr" rules, rebuilt with the combined regexes and checked separately as they match networks instead of patterns
+	includeCIDR []prioritizedRule
+	excludeCIDR []prioritizedRule
+
+	// Rules ordered by priority, only set when at least one rule has a non-zero priority
+	prioritized []prioritizedRule
+
+	// Hit counters of the rules, keyed like IncludeRules and ExcludeRules
+	includeHits map[string]*atomic.Uint64
+	excludeHits map[string]*atomic.Uint64
 }
 
 // NewScope creates a new Scope with the specified default behavior.
@@ -35,38 +217,78 @@ func NewScope(defaultAllow bool) *Scope {
 		IncludeRules: make(map[string]Rule),
 		ExcludeRules: make(map[string]Rule),
 		DefaultAllow: defaultAllow,
+		version:      versionCounter.Add(1),
 	}
 }
 
+// Clone returns an independent copy of the scope with the same rules and default behavior.
+// Changes to the clone do not affect the original scope, the clone gets its own version and hit counters starting from the current counts.
+func (s *Scope) Clone() *Scope {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	clone := &Scope{
+		IncludeRules: maps.Clone(s.IncludeRules),
+		ExcludeRules: maps.Clone(s.ExcludeRules),
+		DefaultAllow: s.DefaultAllow,
+		version:      versionCounter.Add(1),
+		includeHits:  copyHits(s.includeHits),
+		excludeHits:  copyHits(s.excludeHits),
+	}
+	if clone.IncludeRules == nil {
+		clone.IncludeRules = make(map[string]Rule)
+	}
+	if clone.ExcludeRules == nil {
+		clone.ExcludeRules = make(map[string]Rule)
+	}
+	clone.rebuildCombined()
+	return clone
+}
+
+// Version returns the current version of the scope. The version changes whenever a rule is added or removed,
+// the rules are cleared or the default behavior is changed through SetDefaultAllow, so it can be used to
+// check if a previously cached scope decision is still valid.
+func (s *Scope) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// SetDefaultAllow sets the default behavior for items not matching any rule
+func (s *Scope) SetDefaultAllow(allow bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DefaultAllow = allow
+	s.version = versionCounter.Add(1)
+}
+
 // MatchesString determines if a given string is in scope based on matchType
 func (s *Scope) MatchesString(input string, matchType string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	matchType = strings.ToLower(matchType)
 
 	// Validate matchType
-	if matchType != "host" && matchType != "url" {
+	if !validMatchType(matchType) {
 		return s.DefaultAllow
 	}
 
-	target := input
+	if s.prioritized != nil {
+		for _, rule := range s.prioritized {
+			if rule.MatchType == matchType && rule.matches(input) {
+				return !rule.exclude
+			}
+		}
+		return s.DefaultAllow
+	}
 
 	// Check exclusion rules first
-	for _, rule := range s.ExcludeRules {
-		if rule.MatchType != matchType {
-			continue
-		}
-		if rule.Pattern.MatchString(target) {
-			return false // Denied by exclude rule
-		}
+	if s.matchSide(true, matchType, input, false) {
+		return false // Denied by exclude rule
 	}
 
 	// Check inclusion rules
-	for _, rule := range s.IncludeRules {
-		if rule.MatchType != matchType {
-			continue
-		}
-		if rule.Pattern.MatchString(target) {
-			return true // Allowed by include rule
-		}
+	if s.matchSide(false, matchType, input, false) {
+		return true // Allowed by include rule
 	}
 
 	// Default behavior
@@ -75,27 +297,68 @@ func (s *Scope) MatchesString(input string, matchType string) bool {
 
 // ClearRules clears all inclusion and exclusion rules from the scope
 func (s *Scope) ClearRules() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.IncludeRules = make(map[string]Rule)
 	s.ExcludeRules = make(map[string]Rule)
+	s.rebuildCombined()
+	s.version = versionCounter.Add(1)
 }
 
-// AddRule adds a rule to the scope
-func (s *Scope) AddRule(pattern, matchType string, exclude bool) error {
+// RemoveAllOfType removes every inclusion and exclusion rule of the given match type, rules of the other type are kept
+func (s *Scope) RemoveAllOfType(matchType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	matchType = strings.ToLower(matchType)
-	if matchType != "host" && matchType != "url" {
+	if !validMatchType(matchType) {
 		return fmt.Errorf("invalid match type: %s", matchType)
 	}
 
-	trimmedPattern := strings.TrimPrefix(pattern, "-")
-	compiled, err := regexp.Compile(trimmedPattern)
-	if err != nil {
-		return fmt.Errorf("invalid regex pattern: %w", err)
+	for _, rules := range []map[string]Rule{s.IncludeRules, s.ExcludeRules} {
+		maps.DeleteFunc(rules, func(_ string, rule Rule) bool {
+			return rule.MatchType == matchType
+		})
+	}
+
+	s.rebuildCombined()
+	s.version = versionCounter.Add(1)
+	return nil
+}
+
+// AddRule adds a rule with the default priority of 0 to the scope
+func (s *Scope) AddRule(pattern, matchType string, exclude bool) error {
+	return s.AddRuleWithPriority(pattern, matchType, exclude, 0)
+}
+
+// AddRuleWithPriority adds a rule with the given priority to the scope.
+// The pattern of a "cidr" rule is a network such as "10.0.0.0/8" that the request host must be an IP address of.
+func (s *Scope) AddRuleWithPriority(pattern, matchType string, exclude bool, priority int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matchType = strings.ToLower(matchType)
+	if !validMatchType(matchType) {
+		return fmt.Errorf("invalid match type: %s", matchType)
 	}
+
 	rule := Rule{
-		Pattern:   compiled,
 		MatchType: matchType,
+		Priority:  priority,
+	}
+	trimmedPattern := strings.TrimPrefix(pattern, "-")
+	if matchType == "cidr" {
+		prefix, err := netip.ParsePrefix(trimmedPattern)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR: %w", err)
+		}
+		rule.Prefix = prefix
+	} else {
+		compiled, err := regexp.Compile(trimmedPattern)
+		if err != nil {
+			return fmt.Errorf("invalid regex pattern: %w", err)
+		}
+		rule.Pattern = compiled
 	}
-	key := fmt.Sprintf("%s|%s", compiled.String(), matchType)
+	key := fmt.Sprintf("%s|%s", rule.String(), matchType)
 
 	if exclude {
 		if _, exists := s.ExcludeRules[key]; exists {
@@ -109,13 +372,22 @@ func (s *Scope) AddRule(pattern, matchType string, exclude bool) error {
 		s.IncludeRules[key] = rule
 	}
 
+	s.rebuildCombined()
+	s.version = versionCounter.Add(1)
 	return nil
 }
 
 // RemoveRule removes a rule from the scope
 func (s *Scope) RemoveRule(pattern, matchType string, exclude bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	matchType = strings.ToLower(matchType)
-	key := fmt.Sprintf("%s|%s", strings.TrimPrefix(pattern, "-"), matchType)
+	pattern = strings.TrimPrefix(pattern, "-")
+	// The key of a "cidr" rule holds the network as formatted by netip
+	if prefix, err := netip.ParsePrefix(pattern); err == nil && matchType == "cidr" {
+		pattern = prefix.String()
+	}
+	key := fmt.Sprintf("%s|%s", pattern, matchType)
 
 	if exclude {
 		if _, exists := s.ExcludeRules[key]; !exists {
@@ -129,11 +401,20 @@ func (s *Scope) RemoveRule(pattern, matchType string, exclude bool) error {
 		delete(s.IncludeRules, key)
 	}
 
+	s.rebuildCombined()
+	s.version = versionCounter.Add(1)
 	return nil
 }
 
-// Matches determines if a *http.Request or *http.Response is in scope
+// Matches determines if a *http.Request or *http.Response is in scope.
+// When all rules have a priority of 0, exclude rules override include rules.
+// Otherwise the rules are evaluated from the highest to the lowest priority and the first matching rule decides,
+// exclude rules are evaluated before include rules of the same priority.
+// If no rule matches, DefaultAllow is returned.
+// The hit counter of the deciding rule is incremented, see RuleStats.
 func (s *Scope) Matches(input interface{}) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var host, url string
 	switch v := input.(type) {
 	case *http.Request:
@@ -152,38 +433,321 @@ func (s *Scope) Matches(input interface{}) bool {
 		return s.DefaultAllow
 	}
 
+	if s.prioritized != nil {
+		for _, rule := range s.prioritized {
+			if rule.matches(rule.target(host, url)) {
+				if rule.hits != nil {
+					rule.hits.Add(1)
+				}
+				return !rule.exclude
+			}
+		}
+		return s.DefaultAllow
+	}
+
 	// Check exclusion rules first
-	for _, rule := range s.ExcludeRules {
-		var target string
-		switch rule.MatchType {
-		case "host":
-			target = host
-		case "url":
-			target = url
-		default:
-			continue // Skip unknown match types
+	if s.matchSide(true, "host", host, true) || s.matchSide(true, "url", url, true) || s.matchSide(true, "cidr", host, true) {
+		return false // Denied by exclude rule
+	}
+
+	// Check inclusion rules
+	if s.matchSide(false, "host", host, true) || s.matchSide(false, "url", url, true) || s.matchSide(false, "cidr", host, true) {
+		return true // Allowed by include rule
+	}
+
+	// Default behavior
+	return s.DefaultAllow
+}
+
+// MatchSide is the side of the scope that decided a match, see MatchResult
+type MatchSide string
+
+const (
+	MatchSideInclude MatchSide = "include" // An include rule matched
+	MatchSideExclude MatchSide = "exclude" // An exclude rule matched
+	MatchSideDefault MatchSide = "default" // No rule matched and DefaultAllow was used
+)
+
+// MatchResult explains a scope decision made by MatchesDetailed
+type MatchResult struct {
+	InScope bool      // Whether the input is in scope, always the same as Matches
+	Side    MatchSide // The side that decided the match
+	Rule    string    // Key of the deciding rule ("pattern|matchType"), empty when the default was used
+	Target  string    // The host or URL the deciding rule matched, empty when the default was used
+}
+
+// String returns a short description of the decision, used when logging why an item was skipped
+func (r MatchResult) String() string {
+	if r.Side == MatchSideDefault {
+		return fmt.Sprintf("in scope: %t (default)", r.InScope)
+	}
+	return fmt.Sprintf("in scope: %t (%s rule %q matched %q)", r.InScope, r.Side, r.Rule, r.Target)
+}
+
+// MatchesDetailed determines if a *http.Request or *http.Response is in scope like Matches, and returns which side decided it.
+// A response is evaluated against the host and URL of its request, a response without a request or any other input uses the default.
+// Each rule is tested separately to find the deciding rule, so MatchesDetailed is slower than Matches and is meant for explaining decisions.
+func (s *Scope) MatchesDetailed(input interface{}) MatchResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var req *http.Request
+	switch v := input.(type) {
+	case *http.Request:
+		req = v
+	case *http.Response:
+		req = v.Request
+	}
+	if req == nil {
+		return MatchResult{InScope: s.DefaultAllow, Side: MatchSideDefault}
+	}
+
+	targets := map[string]string{
+		"host": req.Host,
+		"url":  req.URL.String(),
+		"cidr": req.Host,
+	}
+	result := func(rule prioritizedRule, key string) MatchResult {
+		side := MatchSideInclude
+		if rule.exclude {
+			side = MatchSideExclude
 		}
-		if rule.Pattern.MatchString(target) {
-			return false // Denied by exclude rule
+		return MatchResult{InScope: !rule.exclude, Side: side, Rule: key, Target: targets[rule.MatchType]}
+	}
+
+	if s.prioritized != nil {
+		for _, rule := range s.prioritized {
+			if rule.matches(targets[rule.MatchType]) {
+				return result(rule, rule.String()+"|"+rule.MatchType)
+			}
 		}
+		return MatchResult{InScope: s.DefaultAllow, Side: MatchSideDefault}
 	}
 
-	// Check inclusion rules
-	for _, rule := range s.IncludeRules {
-		var target string
-		switch rule.MatchType {
-		case "host":
-			target = host
-		case "url":
-			target = url
-		default:
-			continue // Skip unknown match types
+	// Exclude rules override include rules
+	for _, side := range []struct {
+		rules   map[string]Rule
+		exclude bool
+	}{{s.ExcludeRules, true}, {s.IncludeRules, false}} {
+		for _, key := range slices.Sorted(maps.Keys(side.rules)) {
+			rule := side.rules[key]
+			if target, ok := targets[rule.MatchType]; ok && rule.matches(target) {
+				return result(prioritizedRule{Rule: rule, exclude: side.exclude}, key)
+			}
 		}
-		if rule.Pattern.MatchString(target) {
-			return true // Allowed by include rule
+	}
+	return MatchResult{InScope: s.DefaultAllow, Side: MatchSideDefault}
+}
+
+// RuleStats returns the hit counts of the rules, exclude rules first and each side sorted by pattern and match type.
+// Only the decisions made by Matches are counted, MatchesString and MatchesDetailed do not change the counts.
+func (s *Scope) RuleStats() []RuleStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := make([]RuleStat, 0, len(s.ExcludeRules)+len(s.IncludeRules))
+	for _, side := range []struct {
+		rules   map[string]Rule
+		hits    map[string]*atomic.Uint64
+		exclude bool
+	}{{s.ExcludeRules, s.excludeHits, true}, {s.IncludeRules, s.includeHits, false}} {
+		for _, key := range slices.Sorted(maps.Keys(side.rules)) {
+			rule := side.rules[key]
+			stat := RuleStat{Pattern: rule.String(), MatchType: rule.MatchType, Exclude: side.exclude}
+			if counter, ok := side.hits[key]; ok {
+				stat.Hits = counter.Load()
+			}
+			stats = append(stats, stat)
 		}
 	}
+	return stats
+}
 
-	// Default behavior
-	return s.DefaultAllow
+// ResetStats sets the hit counts of every rule back to zero
+func (s *Scope) ResetStats() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, hits := range []map[string]*atomic.Uint64{s.includeHits, s.excludeHits} {
+		for _, counter := range hits {
+			counter.Store(0)
+		}
+	}
+}
+
+// matchSide reports whether any of the exclude or include rules of matchType matches the target.
+// "cidr" rules are checked against the precomputed networks, or tested separately when the scope was not rebuilt.
+// The hit counter of the matching rule is incremented when count is set.
+func (s *Scope) matchSide(exclude bool, matchType string, target string, count bool) bool {
+	rules, combined, hits, cidr := s.IncludeRules, s.combinedInclude, s.includeHits, s.includeCIDR
+	if exclude {
+		rules, combined, hits, cidr = s.ExcludeRules, s.combinedExclude, s.excludeHits, s.excludeCIDR
+	}
+	if matchType == "cidr" && combined != nil {
+		return matchCIDR(cidr, target, count)
+	}
+	return matchRules(rules, combined, hits, matchType, target, count)
+}
+
+// matchRules reports whether any of the rules of matchType matches the target.
+// It uses the combined regexes of the match type when they are available and tests each rule otherwise.
+// The hit counter of the matching rule is incremented when count is set.
+func matchRules(rules map[string]Rule, combined map[string][]*combinedRegex, hits map[string]*atomic.Uint64, matchType string, target string, count bool) bool {
+	if regexes, ok := combined[matchType]; ok {
+		for _, re := range regexes {
+			if re.match(target, count) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for key, rule := range rules {
+		if rule.MatchType != matchType {
+			continue
+		}
+		if rule.matches(target) {
+			if counter, ok := hits[key]; ok && count {
+				counter.Add(1)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildCombined rebuilds the combined include and exclude regexes, the hit counters and the prioritized rules from the current rules.
+// Rules that are kept keep their hit counts.
+func (s *Scope) rebuildCombined() {
+	s.includeHits = keepHits(s.includeHits, s.IncludeRules)
+	s.excludeHits = keepHits(s.excludeHits, s.ExcludeRules)
+	s.combinedInclude = combineRules(s.IncludeRules, s.includeHits)
+	s.combinedExclude = combineRules(s.ExcludeRules, s.excludeHits)
+
+	// Exclude rules followed by include rules, each sorted by key
+	ordered := make([]prioritizedRule, 0, len(s.IncludeRules)+len(s.ExcludeRules))
+	for _, key := range slices.Sorted(maps.Keys(s.ExcludeRules)) {
+		ordered = append(ordered, prioritizedRule{Rule: s.ExcludeRules[key], exclude: true, hits: s.excludeHits[key]})
+	}
+	for _, key := range slices.Sorted(maps.Keys(s.IncludeRules)) {
+		ordered = append(ordered, prioritizedRule{Rule: s.IncludeRules[key], hits: s.includeHits[key]})
+	}
+	s.prioritized = prioritizeRules(ordered)
+
+	s.includeCIDR, s.excludeCIDR = nil, nil
+	for _, rule := range ordered {
+		if rule.MatchType != "cidr" {
+			continue
+		}
+		if rule.exclude {
+			s.excludeCIDR = append(s.excludeCIDR, rule)
+		} else {
+			s.includeCIDR = append(s.includeCIDR, rule)
+		}
+	}
+}
+
+// keepHits returns a hit counter for each rule, reusing the counters in hits for the rules that already had one
+func keepHits(hits map[string]*atomic.Uint64, rules map[string]Rule) map[string]*atomic.Uint64 {
+	kept := make(map[string]*atomic.Uint64, len(rules))
+	for key := range rules {
+		if counter, ok := hits[key]; ok {
+			kept[key] = counter
+		} else {
+			kept[key] = &atomic.Uint64{}
+		}
+	}
+	return kept
+}
+
+// copyHits returns new hit counters holding the current counts of hits
+func copyHits(hits map[string]*atomic.Uint64) map[string]*atomic.Uint64 {
+	copied := make(map[string]*atomic.Uint64, len(hits))
+	for key, counter := range hits {
+		copied[key] = &atomic.Uint64{}
+		copied[key].Store(counter.Load())
+	}
+	return copied
+}
+
+// prioritizeRules orders the rules from the highest to the lowest priority, with exclude rules first for the same priority.
+// The rules must be ordered with the exclude rules first, as done by rebuildCombined.
+// It returns nil when every rule has a priority of 0 so the combined regexes can be used.
+func prioritizeRules(ordered []prioritizedRule) []prioritizedRule {
+	hasPriority := false
+	for _, rule := range ordered {
+		hasPriority = hasPriority || rule.Priority != 0
+	}
+	if !hasPriority {
+		return nil
+	}
+
+	prioritized := slices.Clone(ordered)
+
+	// Stable sort keeps exclude rules ahead of include rules with the same priority
+	slices.SortStableFunc(prioritized, func(a, b prioritizedRule) int {
+		return b.Priority - a.Priority
+	})
+	return prioritized
+}
+
+// alternative is a rule of a combined regex
+type alternative struct {
+	expr string         // Pattern of the rule, without its leading anchor for anchored rules
+	hits *atomic.Uint64 // Hit counter of the rule
+}
+
+// combineRules compiles the rules of each match type into alternations.
+// Rules anchored to the start of the input are combined under a single leading anchor so non-matching
+// inputs are still rejected on the first characters, the remaining rules are combined into an unanchored alternation.
+// A match is credited to the first matching rule of the alternation through its counter in hits.
+// A match type whose alternation cannot be built is left out so its rules are tested separately.
+func combineRules(rules map[string]Rule, hits map[string]*atomic.Uint64) map[string][]*combinedRegex {
+	anchored := map[string][]alternative{}
+	unanchored := map[string][]alternative{}
+	failed := map[string]bool{}
+
+	for _, key := range slices.Sorted(maps.Keys(rules)) {
+		rule := rules[key]
+		if rule.MatchType != "host" && rule.MatchType != "url" {
+			continue
+		}
+
+		parsed, err := syntax.Parse(rule.Pattern.String(), syntax.Perl)
+		if err != nil {
+			failed[rule.MatchType] = true
+			continue
+		}
+
+		alt := alternative{expr: parsed.String(), hits: hits[key]}
+		if parsed.Op == syntax.OpConcat && len(parsed.Sub) > 0 && parsed.Sub[0].Op == syntax.OpBeginText {
+			rest := &syntax.Regexp{Op: syntax.OpConcat, Flags: parsed.Flags, Sub: parsed.Sub[1:]}
+			alt.expr = rest.String()
+			anchored[rule.MatchType] = append(anchored[rule.MatchType], alt)
+			continue
+		}
+		unanchored[rule.MatchType] = append(unanchored[rule.MatchType], alt)
+	}
+
+	combined := make(map[string][]*combinedRegex)
+	for _, matchType := range []string{"host", "url"} {
+		if failed[matchType] {
+			continue
+		}
+
+		regexes := make([]*combinedRegex, 0, 2)
+		if alternatives := anchored[matchType]; len(alternatives) > 0 {
+			re, err := newCombinedRegex(`^`, alternatives)
+			if err != nil {
+				continue
+			}
+			regexes = append(regexes, re)
+		}
+		if alternatives := unanchored[matchType]; len(alternatives) > 0 {
+			re, err := newCombinedRegex(``, alternatives)
+			if err != nil {
+				continue
+			}
+			regexes = append(regexes, re)
+		}
+		combined[matchType] = regexes
+	}
+	return combined
 }
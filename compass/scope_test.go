@@ -0,0 +1,676 @@
+package compass
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// slowPath returns a copy of the scope without the combined regexes so every rule is tested separately
+func slowPath(s *Scope) *Scope {
+	return &Scope{
+		IncludeRules: s.IncludeRules,
+		ExcludeRules: s.ExcludeRules,
+		DefaultAllow: s.DefaultAllow,
+		version:      s.version,
+	}
+}
+
+func TestScopeCombinedRegex(t *testing.T) {
+	rules := []struct {
+		pattern   string
+		matchType string
+		exclude   bool
+	}{
+		{pattern: `^marasi\.app$`, matchType: "host"},
+		{pattern: `(?i)^API\.example\.com$`, matchType: "host"},
+		{pattern: `\.internal$`, matchType: "host"},
+		{pattern: `^cdn\.`, matchType: "host", exclude: true},
+		{pattern: `/admin/`, matchType: "url"},
+		{pattern: `\.(png|jpg|gif)$`, matchType: "url", exclude: true},
+		{pattern: `-^static\.marasi\.app$`, matchType: "host", exclude: true},
+	}
+
+	inputs := []string{
+		"https://marasi.app/",
+		"https://marasi.app/logo.png",
+		"https://MARASI.APP/",
+		"https://api.example.com/v1/users",
+		"https://Api.Example.com/v1/users",
+		"https://api.example.com.evil/v1/users",
+		"https://db.internal/",
+		"https://cdn.marasi.app/app.js",
+		"https://static.marasi.app/",
+		"https://other.app/admin/users",
+		"https://other.app/admin/logo.jpg",
+		"https://other.app/",
+	}
+
+	for _, defaultAllow := range []bool{true, false} {
+		scope := NewScope(defaultAllow)
+		for _, rule := range rules {
+			if err := scope.AddRule(rule.pattern, rule.matchType, rule.exclude); err != nil {
+				t.Fatalf("adding rule %s : %v", rule.pattern, err)
+			}
+		}
+		slow := slowPath(scope)
+
+		for _, input := range inputs {
+			t.Run(fmt.Sprintf("default %t %s", defaultAllow, input), func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, input, nil)
+
+				want := slow.Matches(req)
+				got := scope.Matches(req)
+				if got != want {
+					t.Errorf("Matches\nwanted:\n%t\ngot:\n%t", want, got)
+				}
+
+				for _, matchType := range []string{"host", "url"} {
+					target := req.Host
+					if matchType == "url" {
+						target = req.URL.String()
+					}
+
+					want := slow.MatchesString(target, matchType)
+					got := scope.MatchesString(target, matchType)
+					if got != want {
+						t.Errorf("MatchesString %s\nwanted:\n%t\ngot:\n%t", matchType, want, got)
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("removing a rule should rebuild the combined regex", func(t *testing.T) {
+		scope := NewScope(false)
+		if err := scope.AddRule(`^marasi\.app$`, "host", false); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if !scope.MatchesString("marasi.app", "host") {
+			t.Fatalf("wanted: true\ngot: false")
+		}
+
+		if err := scope.RemoveRule(`^marasi\.app$`, "host", false); err != nil {
+			t.Fatalf("removing rule : %v", err)
+		}
+		if scope.MatchesString("marasi.app", "host") {
+			t.Fatalf("wanted: false\ngot: true")
+		}
+	})
+
+	t.Run("clearing the rules should rebuild the combined regex", func(t *testing.T) {
+		scope := NewScope(true)
+		if err := scope.AddRule(`^marasi\.app$`, "host", true); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if scope.MatchesString("marasi.app", "host") {
+			t.Fatalf("wanted: false\ngot: true")
+		}
+
+		scope.ClearRules()
+		if !scope.MatchesString("marasi.app", "host") {
+			t.Fatalf("wanted: true\ngot: false")
+		}
+	})
+}
+
+func benchmarkScope(b *testing.B) *Scope {
+	b.Helper()
+	scope := NewScope(false)
+	for i := range 500 {
+		if err := scope.AddRule(fmt.Sprintf(`^app%d\.marasi\.app$`, i), "host", false); err != nil {
+			b.Fatalf("adding rule : %v", err)
+		}
+		if err := scope.AddRule(fmt.Sprintf(`/api/v%d/`, i), "url", false); err != nil {
+			b.Fatalf("adding rule : %v", err)
+		}
+	}
+	return scope
+}
+
+func BenchmarkScopeMatches(b *testing.B) {
+	req := httptest.NewRequest(http.MethodGet, "https://unknown.marasi.app/path", nil)
+
+	b.Run("combined", func(b *testing.B) {
+		scope := benchmarkScope(b)
+		for b.Loop() {
+			scope.Matches(req)
+		}
+	})
+
+	b.Run("per-rule", func(b *testing.B) {
+		scope := slowPath(benchmarkScope(b))
+		for b.Loop() {
+			scope.Matches(req)
+		}
+	})
+
+	inScope := httptest.NewRequest(http.MethodGet, "https://app250.marasi.app/path", nil)
+	b.Run("combined in scope", func(b *testing.B) {
+		scope := benchmarkScope(b)
+		for b.Loop() {
+			scope.Matches(inScope)
+		}
+	})
+}
+
+func TestScopeRulePriority(t *testing.T) {
+	t.Run("a higher priority include should override a lower priority exclude", func(t *testing.T) {
+		scope := NewScope(false)
+		if err := scope.AddRuleWithPriority(`\.marasi\.app$`, "host", true, 1); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := scope.AddRuleWithPriority(`^api\.marasi\.app$`, "host", false, 10); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+
+		tests := []struct {
+			url  string
+			want bool
+		}{
+			{url: "https://api.marasi.app/", want: true},
+			{url: "https://cdn.marasi.app/", want: false},
+			{url: "https://other.app/", want: false},
+		}
+
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if got := scope.Matches(req); got != tt.want {
+				t.Errorf("Matches %s\nwanted:\n%t\ngot:\n%t", tt.url, tt.want, got)
+			}
+			if got := scope.MatchesString(req.Host, "host"); got != tt.want {
+				t.Errorf("MatchesString %s\nwanted:\n%t\ngot:\n%t", req.Host, tt.want, got)
+			}
+		}
+	})
+
+	t.Run("a higher priority exclude should override a lower priority include", func(t *testing.T) {
+		scope := NewScope(false)
+		if err := scope.AddRuleWithPriority(`marasi\.app`, "host", false, 1); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := scope.AddRuleWithPriority(`/logout`, "url", true, 5); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+
+		if scope.Matches(httptest.NewRequest(http.MethodGet, "https://marasi.app/logout", nil)) {
+			t.Errorf("wanted: false\ngot: true")
+		}
+		if !scope.Matches(httptest.NewRequest(http.MethodGet, "https://marasi.app/home", nil)) {
+			t.Errorf("wanted: true\ngot: false")
+		}
+	})
+
+	t.Run("exclude rules should win over include rules with the same priority", func(t *testing.T) {
+		scope := NewScope(true)
+		if err := scope.AddRuleWithPriority(`^marasi\.app$`, "host", false, 3); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := scope.AddRuleWithPriority(`^marasi\.app$`, "host", true, 3); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+
+		if scope.MatchesString("marasi.app", "host") {
+			t.Errorf("wanted: false\ngot: true")
+		}
+	})
+
+	t.Run("removing the prioritized rules should restore the exclude over include behavior", func(t *testing.T) {
+		scope := NewScope(false)
+		if err := scope.AddRule(`\.marasi\.app$`, "host", true); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := scope.AddRuleWithPriority(`^api\.marasi\.app$`, "host", false, 10); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if !scope.MatchesString("api.marasi.app", "host") {
+			t.Fatalf("wanted: true\ngot: false")
+		}
+
+		if err := scope.RemoveRule(`^api\.marasi\.app$`, "host", false); err != nil {
+			t.Fatalf("removing rule : %v", err)
+		}
+		if err := scope.AddRule(`^api\.marasi\.app$`, "host", false); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if scope.MatchesString("api.marasi.app", "host") {
+			t.Errorf("wanted: false\ngot: true")
+		}
+	})
+}
+
+func TestScopeClone(t *testing.T) {
+	scope := NewScope(false)
+	if err := scope.AddRule(`^marasi\.app$`, "host", false); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+	if err := scope.AddRule(`/logout`, "url", true); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+
+	clone := scope.Clone()
+	if clone.Version() == scope.Version() {
+		t.Errorf("wanted: a new version\ngot: %d", clone.Version())
+	}
+	if !clone.MatchesString("marasi.app", "host") || clone.MatchesString("https://marasi.app/logout", "url") {
+		t.Fatalf("wanted: clone to have the original rules\ngot: %v %v", clone.IncludeRules, clone.ExcludeRules)
+	}
+
+	t.Run("mutating the clone should not affect the original", func(t *testing.T) {
+		version := scope.Version()
+
+		clone.SetDefaultAllow(true)
+		if err := clone.AddRule(`^evil\.app$`, "host", true); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := clone.RemoveRule(`^marasi\.app$`, "host", false); err != nil {
+			t.Fatalf("removing rule : %v", err)
+		}
+
+		if scope.DefaultAllow {
+			t.Errorf("wanted: false\ngot: true")
+		}
+		if len(scope.IncludeRules) != 1 || len(scope.ExcludeRules) != 1 {
+			t.Errorf("wanted: 1 include and 1 exclude rule\ngot: %d include and %d exclude rules", len(scope.IncludeRules), len(scope.ExcludeRules))
+		}
+		if !scope.MatchesString("marasi.app", "host") {
+			t.Errorf("wanted: true\ngot: false")
+		}
+		if scope.Version() != version {
+			t.Errorf("wanted: %d\ngot: %d", version, scope.Version())
+		}
+	})
+
+	t.Run("mutating the original should not affect the clone", func(t *testing.T) {
+		scope.ClearRules()
+		if len(clone.ExcludeRules) != 2 {
+			t.Errorf("wanted: 2 exclude rules\ngot: %d", len(clone.ExcludeRules))
+		}
+	})
+}
+
+func TestScopeRemoveAllOfType(t *testing.T) {
+	scope := NewScope(false)
+	for _, rule := range []struct {
+		pattern   string
+		matchType string
+		exclude   bool
+	}{
+		{`^marasi\.app$`, "host", false},
+		{`^evil\.app$`, "host", true},
+		{`/api/`, "url", false},
+		{`/logout`, "url", true},
+	} {
+		if err := scope.AddRule(rule.pattern, rule.matchType, rule.exclude); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+	}
+	version := scope.Version()
+
+	if err := scope.RemoveAllOfType("HOST"); err != nil {
+		t.Fatalf("wanted: nil\ngot: %v", err)
+	}
+
+	if _, ok := scope.IncludeRules["/api/|url"]; !ok || len(scope.IncludeRules) != 1 {
+		t.Errorf("wanted: only the url include rule\ngot: %v", scope.IncludeRules)
+	}
+	if _, ok := scope.ExcludeRules["/logout|url"]; !ok || len(scope.ExcludeRules) != 1 {
+		t.Errorf("wanted: only the url exclude rule\ngot: %v", scope.ExcludeRules)
+	}
+	if scope.Version() == version {
+		t.Errorf("wanted: a new version\ngot: %d", scope.Version())
+	}
+	if scope.MatchesString("marasi.app", "host") {
+		t.Errorf("wanted: false\ngot: true")
+	}
+	if !scope.MatchesString("https://marasi.app/api/users", "url") || scope.MatchesString("https://marasi.app/api/logout", "url") {
+		t.Errorf("wanted: url rules to still apply\ngot: %v %v", scope.IncludeRules, scope.ExcludeRules)
+	}
+
+	if err := scope.RemoveAllOfType("path"); err == nil {
+		t.Errorf("wanted: error\ngot: nil")
+	}
+}
+
+func TestScopeMatchesDetailed(t *testing.T) {
+	scope := NewScope(false)
+	if err := scope.AddRule(`marasi\.app`, "host", false); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+	if err := scope.AddRule(`/logout`, "url", true); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+
+	response := func(url string) *http.Response {
+		return &http.Response{Request: httptest.NewRequest(http.MethodGet, url, nil)}
+	}
+
+	tests := []struct {
+		name  string
+		input any
+		want  MatchResult
+	}{
+		{
+			name:  "response matching an include rule",
+			input: response("https://marasi.app/home"),
+			want:  MatchResult{InScope: true, Side: MatchSideInclude, Rule: `marasi\.app|host`, Target: "marasi.app"},
+		},
+		{
+			name:  "response matching an exclude rule",
+			input: response("https://marasi.app/logout"),
+			want:  MatchResult{InScope: false, Side: MatchSideExclude, Rule: `/logout|url`, Target: "https://marasi.app/logout"},
+		},
+		{
+			name:  "response matching no rule",
+			input: response("https://other.app/"),
+			want:  MatchResult{InScope: false, Side: MatchSideDefault},
+		},
+		{
+			name:  "response without a request",
+			input: &http.Response{},
+			want:  MatchResult{InScope: false, Side: MatchSideDefault},
+		},
+		{
+			name:  "request matching an include rule",
+			input: httptest.NewRequest(http.MethodGet, "https://marasi.app/home", nil),
+			want:  MatchResult{InScope: true, Side: MatchSideInclude, Rule: `marasi\.app|host`, Target: "marasi.app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scope.MatchesDetailed(tt.input)
+			if got != tt.want {
+				t.Fatalf("\nwanted:\n%+v\ngot:\n%+v", tt.want, got)
+			}
+			if got.InScope != scope.Matches(tt.input) {
+				t.Fatalf("wanted: the same decision as Matches\ngot: %t", got.InScope)
+			}
+		})
+	}
+
+	t.Run("prioritized rules should report the deciding rule", func(t *testing.T) {
+		scope := NewScope(false)
+		if err := scope.AddRuleWithPriority(`\.marasi\.app$`, "host", true, 1); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := scope.AddRuleWithPriority(`^api\.marasi\.app$`, "host", false, 10); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+
+		got := scope.MatchesDetailed(response("https://api.marasi.app/"))
+		want := MatchResult{InScope: true, Side: MatchSideInclude, Rule: `^api\.marasi\.app$|host`, Target: "api.marasi.app"}
+		if got != want {
+			t.Fatalf("\nwanted:\n%+v\ngot:\n%+v", want, got)
+		}
+
+		got = scope.MatchesDetailed(response("https://cdn.marasi.app/"))
+		if got.InScope || got.Side != MatchSideExclude {
+			t.Fatalf("wanted: excluded\ngot: %+v", got)
+		}
+	})
+
+	t.Run("default decision should use DefaultAllow", func(t *testing.T) {
+		got := NewScope(true).MatchesDetailed(response("https://marasi.app/"))
+		if !got.InScope || got.Side != MatchSideDefault {
+			t.Fatalf("wanted: in scope by default\ngot: %+v", got)
+		}
+		if got.String() != "in scope: true (default)" {
+			t.Fatalf("wanted: %q\ngot: %q", "in scope: true (default)", got.String())
+		}
+	})
+}
+
+func TestScopeRuleStats(t *testing.T) {
+	hits := func(s *Scope) map[string]uint64 {
+		got := make(map[string]uint64)
+		for _, stat := range s.RuleStats() {
+			key := stat.Pattern + "|" + stat.MatchType
+			if stat.Exclude {
+				key = "-" + key
+			}
+			got[key] = stat.Hits
+		}
+		return got
+	}
+
+	newScope := func(t *testing.T, priority int) *Scope {
+		t.Helper()
+		s := NewScope(false)
+		if err := s.AddRuleWithPriority(`marasi\.app$`, "host", false, 0); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := s.AddRuleWithPriority(`^cdn\.`, "host", true, priority); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := s.AddRuleWithPriority(`/admin/`, "url", false, 0); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		return s
+	}
+
+	for _, priority := range []int{0, 10} {
+		t.Run(fmt.Sprintf("matches should count the deciding rule with priority %d", priority), func(t *testing.T) {
+			s := newScope(t, priority)
+
+			for _, url := range []string{
+				"https://marasi.app/",
+				"https://marasi.app/login",
+				"https://cdn.marasi.app/logo.png",
+				"https://example.com/admin/",
+				"https://example.com/",
+			} {
+				s.Matches(httptest.NewRequest(http.MethodGet, url, nil))
+			}
+			s.MatchesString("marasi.app", "host")
+
+			want := map[string]uint64{
+				`marasi\.app$|host`: 2,
+				`-^cdn\.|host`:      1,
+				`/admin/|url`:       1,
+			}
+			if got := hits(s); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+			}
+		})
+	}
+
+	t.Run("reset should set the counts to zero", func(t *testing.T) {
+		s := newScope(t, 0)
+		s.Matches(httptest.NewRequest(http.MethodGet, "https://marasi.app/", nil))
+		s.ResetStats()
+
+		for key, count := range hits(s) {
+			if count != 0 {
+				t.Errorf("\nwanted:\n0 hits for %s\ngot:\n%d", key, count)
+			}
+		}
+	})
+
+	t.Run("counts should be kept when other rules change", func(t *testing.T) {
+		s := newScope(t, 0)
+		s.Matches(httptest.NewRequest(http.MethodGet, "https://marasi.app/", nil))
+		if err := s.RemoveRule(`/admin/`, "url", false); err != nil {
+			t.Fatalf("removing rule : %v", err)
+		}
+
+		if got := hits(s)[`marasi\.app$|host`]; got != 1 {
+			t.Errorf("\nwanted:\n1\ngot:\n%d", got)
+		}
+	})
+
+	t.Run("combined regexes should credit the rule that matched", func(t *testing.T) {
+		s := NewScope(false)
+		for _, pattern := range []string{`^(api|www)\.marasi\.app$`, `^(?P<sub>cdn)\.marasi\.app$`, `(docs)\.(marasi)\.dev$`, `example\.com$`} {
+			if err := s.AddRule(pattern, "host", false); err != nil {
+				t.Fatalf("adding rule : %v", err)
+			}
+		}
+
+		for _, url := range []string{"https://cdn.marasi.app/", "https://www.marasi.app/", "https://example.com/", "https://docs.marasi.dev/", "https://cdn.marasi.app/"} {
+			if !s.Matches(httptest.NewRequest(http.MethodGet, url, nil)) {
+				t.Fatalf("wanted: %s in scope\ngot: false", url)
+			}
+		}
+
+		want := map[string]uint64{
+			`^(api|www)\.marasi\.app$|host`:    1,
+			`^(?P<sub>cdn)\.marasi\.app$|host`: 2,
+			`(docs)\.(marasi)\.dev$|host`:      1,
+			`example\.com$|host`:               1,
+		}
+		if got := hits(s); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("clone should not share the counters", func(t *testing.T) {
+		s := newScope(t, 0)
+		s.Matches(httptest.NewRequest(http.MethodGet, "https://marasi.app/", nil))
+		clone := s.Clone()
+		clone.Matches(httptest.NewRequest(http.MethodGet, "https://marasi.app/", nil))
+
+		if got := hits(s)[`marasi\.app$|host`]; got != 1 {
+			t.Errorf("\nwanted:\n1\ngot:\n%d", got)
+		}
+		if got := hits(clone)[`marasi\.app$|host`]; got != 2 {
+			t.Errorf("\nwanted:\n2\ngot:\n%d", got)
+		}
+	})
+}
+
+func TestScopeCIDR(t *testing.T) {
+	scope := NewScope(false)
+	if err := scope.AddRule("10.0.0.0/8", "cidr", false); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+	if err := scope.AddRule("10.13.0.0/16", "cidr", true); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+	if err := scope.AddRule("2001:db8::/32", "CIDR", false); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{"an IP host in range", "http://10.1.2.3/", true},
+		{"an IP host with a port in range", "http://10.1.2.3:8080/", true},
+		{"an IPv6 host in range", "http://[2001:db8::1]:443/", true},
+		{"an IP host out of range", "http://192.168.1.1/", false},
+		{"an IP host in an excluded range", "http://10.13.0.1/", false},
+		{"a hostname", "http://marasi.app/", false},
+	}
+
+	for _, s := range []*Scope{scope, slowPath(scope)} {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+				if got := s.Matches(req); got != tt.want {
+					t.Errorf("wanted: %t\ngot: %t", tt.want, got)
+				}
+				if got := s.MatchesDetailed(req).InScope; got != tt.want {
+					t.Errorf("wanted: %t\ngot: %t", tt.want, got)
+				}
+			})
+		}
+	}
+
+	if rule := scope.IncludeRules["10.0.0.0/8|cidr"]; rule.Pattern != nil || rule.String() != "10.0.0.0/8" {
+		t.Errorf("wanted: the network without a compiled pattern\ngot: %v %q", rule.Pattern, rule.String())
+	}
+	if len(scope.includeCIDR) != 2 || len(scope.excludeCIDR) != 1 {
+		t.Errorf("wanted: 2 include and 1 exclude networks\ngot: %d and %d", len(scope.includeCIDR), len(scope.excludeCIDR))
+	}
+
+	if !scope.MatchesString("10.255.255.255", "cidr") || scope.MatchesString("11.0.0.1", "cidr") {
+		t.Errorf("wanted: MatchesString to check the network\ngot: %v", scope.IncludeRules)
+	}
+
+	if err := scope.AddRule("10.0.0.0/33", "cidr", false); err == nil {
+		t.Errorf("wanted: error\ngot: nil")
+	}
+	if err := scope.AddRule("marasi.app", "cidr", false); err == nil {
+		t.Errorf("wanted: error\ngot: nil")
+	}
+
+	if err := scope.RemoveRule("10.0.0.0/8", "cidr", false); err != nil {
+		t.Fatalf("wanted: nil\ngot: %v", err)
+	}
+	if scope.Matches(httptest.NewRequest(http.MethodGet, "http://10.1.2.3/", nil)) {
+		t.Errorf("wanted: false\ngot: true")
+	}
+}
+
+func TestScopeCIDRPriority(t *testing.T) {
+	scope := NewScope(true)
+	if err := scope.AddRuleWithPriority("192.168.0.0/16", "cidr", true, 10); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+	if err := scope.AddRuleWithPriority(`^192\.168\.1\.1$`, "host", false, 20); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+
+	if !scope.Matches(httptest.NewRequest(http.MethodGet, "http://192.168.1.1/", nil)) {
+		t.Errorf("wanted: the higher priority host rule to include the host\ngot: false")
+	}
+	if scope.Matches(httptest.NewRequest(http.MethodGet, "http://192.168.1.2/", nil)) {
+		t.Errorf("wanted: the cidr rule to exclude the host\ngot: true")
+	}
+	if stats := scope.RuleStats(); stats[0].MatchType != "cidr" || stats[0].Hits != 1 {
+		t.Errorf("wanted: 1 hit for the cidr rule\ngot: %+v", stats)
+	}
+}
+
+func TestScopeConcurrentChanges(t *testing.T) {
+	scope := NewScope(false)
+	if err := scope.AddRule(`marasi\.app$`, "host", false); err != nil {
+		t.Fatalf("adding rule : %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://marasi.app/", nil)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				scope.Matches(req)
+				scope.MatchesString("marasi.app", "host")
+				scope.Version()
+				scope.RuleStats()
+			}
+		}()
+	}
+
+	for i := range 100 {
+		pattern := fmt.Sprintf(`^app%d\.marasi\.app$`, i)
+		before := scope.Version()
+		if err := scope.AddRule(pattern, "host", i%2 == 0); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		scope.SetDefaultAllow(i%2 == 0)
+		if err := scope.RemoveRule(pattern, "host", i%2 == 0); err != nil {
+			t.Fatalf("removing rule : %v", err)
+		}
+		if scope.Version() == before {
+			t.Fatalf("wanted: a new version\ngot: %d", before)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if !scope.Matches(req) {
+		t.Errorf("wanted: true\ngot: false")
+	}
+}
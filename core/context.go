@@ -31,6 +31,26 @@ const (
 	RequestTimeKey contextKey = "RequestTime"
 	// ResponseTimeKey is the context key for the response timestamp (time.Time)
 	ResponseTimeKey contextKey = "ResponseTime"
+	// ScopeDecisionKey is the context key for the scope decision (ScopeDecision) made for the request
+	ScopeDecisionKey contextKey = "ScopeDecision"
+	// HeaderOrderKey is the context key for the original header order ([]string) of the request, it is only set when the raw request was available
+	HeaderOrderKey contextKey = "HeaderOrder"
+	// TagsKey is the context key for the tags ([]string) extensions added to the request, they are stored with the request and the response
+	TagsKey contextKey = "Tags"
+	// NoteKey is the context key for the note (string) an extension set on the request, it is stored with the request and the response
+	NoteKey contextKey = "Note"
+	// RawHeaderKey is the context key for the raw request line and headers ([]byte) of the request as read from the connection, it is only set
+	// for the plain HTTP/1 requests recorded by the listener
+	RawHeaderKey contextKey = "RawHeader"
+	// ProxyAuthUserKey is the context key for the username (string) the client authenticated to the proxy with
+	ProxyAuthUserKey contextKey = "ProxyAuthUser"
+	// SNIKey is the context key for the server name (string) to use in the upstream TLS handshake instead of the request host
+	SNIKey contextKey = "SNI"
+	// RedirectChainKey is the context key for the redirects ([]any) proxy.Client followed before sending the request
+	RedirectChainKey contextKey = "RedirectChain"
+	// RedirectPolicyKey is the context key for the function (func(*http.Request) error) proxy.Client calls with each redirect of the request
+	// before following it, the redirect is not followed when it returns an error
+	RedirectPolicyKey contextKey = "RedirectPolicy"
 	// MartianSessionKey is the context key to store the martian session (*martian.Session). This is used to hijack connection and control the response
 	MartianSessionKey contextKey = "SessionKey"
 )
@@ -154,3 +174,118 @@ func DroppedFlagFromContext(ctx context.Context) (bool, bool) {
 	dropped, ok := ctx.Value(DropKey).(bool)
 	return dropped, ok
 }
+
+// ContextWithHeaderOrder returns a new request with the original header order in the context.
+func ContextWithHeaderOrder(req *http.Request, order []string) *http.Request {
+	ctx := context.WithValue(req.Context(), HeaderOrderKey, order)
+	return req.WithContext(ctx)
+}
+
+// HeaderOrderFromContext returns the original header order from the context if it exists.
+func HeaderOrderFromContext(ctx context.Context) ([]string, bool) {
+	order, ok := ctx.Value(HeaderOrderKey).([]string)
+	return order, ok
+}
+
+// ContextWithTags returns a new request with the tags in the context.
+func ContextWithTags(req *http.Request, tags []string) *http.Request {
+	ctx := context.WithValue(req.Context(), TagsKey, tags)
+	return req.WithContext(ctx)
+}
+
+// TagsFromContext returns the tags from the context if they exist.
+func TagsFromContext(ctx context.Context) ([]string, bool) {
+	tags, ok := ctx.Value(TagsKey).([]string)
+	return tags, ok
+}
+
+// ContextWithNote returns a new request with the note in the context.
+func ContextWithNote(req *http.Request, note string) *http.Request {
+	ctx := context.WithValue(req.Context(), NoteKey, note)
+	return req.WithContext(ctx)
+}
+
+// NoteFromContext returns the note from the context if it exists.
+func NoteFromContext(ctx context.Context) (string, bool) {
+	note, ok := ctx.Value(NoteKey).(string)
+	return note, ok
+}
+
+// ContextWithRawHeader returns a new request with the raw request line and headers in the context.
+func ContextWithRawHeader(req *http.Request, raw []byte) *http.Request {
+	ctx := context.WithValue(req.Context(), RawHeaderKey, raw)
+	return req.WithContext(ctx)
+}
+
+// RawHeaderFromContext returns the raw request line and headers from the context if they exist.
+func RawHeaderFromContext(ctx context.Context) ([]byte, bool) {
+	raw, ok := ctx.Value(RawHeaderKey).([]byte)
+	return raw, ok
+}
+
+// ContextWithRedirectPolicy returns a new request with the policy checking the redirects of the request in the context.
+func ContextWithRedirectPolicy(req *http.Request, policy func(*http.Request) error) *http.Request {
+	ctx := context.WithValue(req.Context(), RedirectPolicyKey, policy)
+	return req.WithContext(ctx)
+}
+
+// RedirectPolicyFromContext returns the policy checking the redirects of the request from the context if it exists.
+func RedirectPolicyFromContext(ctx context.Context) (func(*http.Request) error, bool) {
+	policy, ok := ctx.Value(RedirectPolicyKey).(func(*http.Request) error)
+	return policy, ok
+}
+
+// ContextWithSNI returns a new request with the TLS server name override in the context.
+func ContextWithSNI(req *http.Request, sni string) *http.Request {
+	ctx := context.WithValue(req.Context(), SNIKey, sni)
+	return req.WithContext(ctx)
+}
+
+// SNIFromContext returns the TLS server name override from the context if it exists.
+func SNIFromContext(ctx context.Context) (string, bool) {
+	sni, ok := ctx.Value(SNIKey).(string)
+	return sni, ok && sni != ""
+}
+
+// ContextWithRedirectChain returns a new request with the followed redirects in the context.
+func ContextWithRedirectChain(req *http.Request, chain []any) *http.Request {
+	ctx := context.WithValue(req.Context(), RedirectChainKey, chain)
+	return req.WithContext(ctx)
+}
+
+// RedirectChainFromContext returns the followed redirects from the context if they exist.
+func RedirectChainFromContext(ctx context.Context) ([]any, bool) {
+	chain, ok := ctx.Value(RedirectChainKey).([]any)
+	return chain, ok
+}
+
+// ContextWithProxyAuthUser returns a new request with the proxy authentication username in the context.
+func ContextWithProxyAuthUser(req *http.Request, username string) *http.Request {
+	ctx := context.WithValue(req.Context(), ProxyAuthUserKey, username)
+	return req.WithContext(ctx)
+}
+
+// ProxyAuthUserFromContext returns the proxy authentication username from the context if it exists.
+func ProxyAuthUserFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(ProxyAuthUserKey).(string)
+	return username, ok
+}
+
+// ScopeDecision is the cached result of matching a request against the scope.
+// Version is the scope version at the time of the decision, the decision is only valid while the scope version is unchanged.
+type ScopeDecision struct {
+	Version uint64 // Scope version when the decision was made
+	InScope bool   // Whether the request matched the scope
+}
+
+// ContextWithScopeDecision returns a new request with the scope decision in the context.
+func ContextWithScopeDecision(req *http.Request, decision ScopeDecision) *http.Request {
+	ctx := context.WithValue(req.Context(), ScopeDecisionKey, decision)
+	return req.WithContext(ctx)
+}
+
+// ScopeDecisionFromContext returns the scope decision from the context if it exists.
+func ScopeDecisionFromContext(ctx context.Context) (ScopeDecision, bool) {
+	decision, ok := ctx.Value(ScopeDecisionKey).(ScopeDecision)
+	return decision, ok
+}
@@ -0,0 +1,23 @@
+package core
+
+import "net/http"
+
+// RedirectChain returns the redirects that were followed to create req, starting with the first one.
+// Each redirect holds the url that was requested, the status_code of the redirect response and its location.
+// It returns nil if req was not created by following a redirect.
+func RedirectChain(req *http.Request) []map[string]any {
+	var chain []map[string]any
+	for req != nil && req.Response != nil {
+		res := req.Response
+		hop := map[string]any{
+			"status_code": res.StatusCode,
+			"location":    res.Header.Get("Location"),
+		}
+		if res.Request != nil && res.Request.URL != nil {
+			hop["url"] = res.Request.URL.String()
+		}
+		chain = append([]map[string]any{hop}, chain...)
+		req = res.Request
+	}
+	return chain
+}
@@ -0,0 +1,18 @@
+package core
+
+import "crypto/tls"
+
+// TLSInfo returns the negotiated TLS parameters of a connection as a map that can be stored in the metadata.
+// It returns nil if the connection state is nil (plain HTTP).
+func TLSInfo(state *tls.ConnectionState) map[string]any {
+	if state == nil {
+		return nil
+	}
+	return map[string]any{
+		"version":      tls.VersionName(state.Version),
+		"cipher_suite": tls.CipherSuiteName(state.CipherSuite),
+		"alpn":         state.NegotiatedProtocol,
+		"resumed":      state.DidResume,
+		"server_name":  state.ServerName,
+	}
+}
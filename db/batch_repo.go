@@ -0,0 +1,71 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/tfkr-ae/marasi/domain"
+)
+
+var _ domain.BatchRepository = (*Repository)(nil)
+
+// execer runs write queries, it is implemented by both *sqlx.DB and *sqlx.Tx so the writes can be grouped in a transaction.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	NamedExec(query string, arg any) (sql.Result, error)
+}
+
+// batchWriter implements the domain.BatchWriter interface on a transaction.
+type batchWriter struct {
+	tx *sqlx.Tx // tx is the transaction of the batch.
+}
+
+// Batch implements the domain.BatchRepository interface.
+func (repo *Repository) Batch(fn func(writer domain.BatchWriter) error) error {
+	tx, err := repo.dbConn.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning batch transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(&batchWriter{tx: tx}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing batch: %w", err)
+	}
+	return nil
+}
+
+// InsertRequest inserts a new domain.ProxyRequest in the batch.
+func (writer *batchWriter) InsertRequest(req *domain.ProxyRequest) error {
+	return insertRequest(writer.tx, req)
+}
+
+// InsertResponse updates the request entry of resp in the batch.
+func (writer *batchWriter) InsertResponse(resp *domain.ProxyResponse) error {
+	return insertResponse(writer.tx, resp)
+}
+
+// LinkRequestToLaunchpad associates a request with a launchpad in the batch.
+func (writer *batchWriter) LinkRequestToLaunchpad(requestID uuid.UUID, launchpadID uuid.UUID) error {
+	return linkRequestToLaunchpad(writer.tx, requestID, launchpadID)
+}
+
+// AddTag adds a tag to a request in the batch.
+func (writer *batchWriter) AddTag(requestID uuid.UUID, tag string) error {
+	return addTag(writer.tx, requestID, tag)
+}
+
+// UpdateNote creates or updates the note of a request in the batch.
+func (writer *batchWriter) UpdateNote(requestID uuid.UUID, note string) error {
+	return updateNote(writer.tx, requestID, note)
+}
+
+// InsertLog saves a new log entry in the batch.
+func (writer *batchWriter) InsertLog(log *domain.Log) error {
+	return insertLog(writer.tx, log)
+}
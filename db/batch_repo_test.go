@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tfkr-ae/marasi/domain"
+)
+
+// batchRequest returns a new request that is not yet written to the database
+func batchRequest(tb testing.TB) *domain.ProxyRequest {
+	tb.Helper()
+	id, err := uuid.NewV7()
+	if err != nil {
+		tb.Fatalf("creating uuid: %v", err)
+	}
+
+	rawReq := []byte("GET / HTTP/1.1\r\nHost: marasi.app\r\n\r\n")
+	return &domain.ProxyRequest{
+		ID:          id,
+		Scheme:      "https",
+		Method:      "GET",
+		Host:        "marasi.app",
+		Path:        "/",
+		Raw:         rawReq,
+		RawLength:   int64(len(rawReq)),
+		Metadata:    make(map[string]any),
+		RequestedAt: time.Now(),
+	}
+}
+
+func TestRepository_Batch(t *testing.T) {
+	t.Run("should commit every write of the batch", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		req := batchRequest(t)
+		rawResp := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+		res := &domain.ProxyResponse{
+			ID:          req.ID,
+			Status:      "200 OK",
+			StatusCode:  200,
+			Raw:         rawResp,
+			RawLength:   int64(len(rawResp)),
+			Metadata:    make(map[string]any),
+			RespondedAt: time.Now(),
+		}
+		logID := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+
+		err := repo.Batch(func(writer domain.BatchWriter) error {
+			if err := writer.InsertRequest(req); err != nil {
+				return err
+			}
+			if err := writer.InsertResponse(res); err != nil {
+				return err
+			}
+			if err := writer.AddTag(req.ID, "batched"); err != nil {
+				return err
+			}
+			if err := writer.UpdateNote(req.ID, "written in a batch"); err != nil {
+				return err
+			}
+			return writer.InsertLog(&domain.Log{ID: logID, Timestamp: time.Now(), Level: "INFO", Message: "batched", RequestID: &req.ID})
+		})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.GetResponse(req.ID)
+		if err != nil {
+			t.Fatalf("getting response: %v", err)
+		}
+		if got.StatusCode != 200 {
+			t.Errorf("\nwanted:\n200\ngot:\n%d", got.StatusCode)
+		}
+
+		tagged, err := repo.ListByTag("batched")
+		if err != nil {
+			t.Fatalf("listing tags: %v", err)
+		}
+		if len(tagged) != 1 || tagged[0].ID != req.ID {
+			t.Errorf("\nwanted:\n%s tagged\ngot:\n%v", req.ID, tagged)
+		}
+
+		note, err := repo.GetNote(req.ID)
+		if err != nil {
+			t.Fatalf("getting note: %v", err)
+		}
+		if note != "written in a batch" {
+			t.Errorf("\nwanted:\nwritten in a batch\ngot:\n%s", note)
+		}
+
+		logs, err := repo.GetLogsByRequest(req.ID)
+		if err != nil {
+			t.Fatalf("getting logs: %v", err)
+		}
+		if len(logs) != 1 || logs[0].ID != logID {
+			t.Errorf("\nwanted:\nlog %s\ngot:\n%v", logID, logs)
+		}
+	})
+
+	t.Run("should write nothing if the batch fails", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		req := batchRequest(t)
+		wantErr := errors.New("forced error")
+		err := repo.Batch(func(writer domain.BatchWriter) error {
+			if err := writer.InsertRequest(req); err != nil {
+				return err
+			}
+			return wantErr
+		})
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", wantErr, err)
+		}
+
+		if _, err := repo.GetRawRequest(req.ID); err == nil {
+			t.Errorf("\nwanted:\nrequest not written\ngot:\nrequest found")
+		}
+	})
+
+	t.Run("a failed write should not undo the other writes", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		req := batchRequest(t)
+		err := repo.Batch(func(writer domain.BatchWriter) error {
+			if err := writer.InsertResponse(&domain.ProxyResponse{ID: req.ID, Metadata: map[string]any{}}); err == nil {
+				t.Errorf("\nwanted:\nerror for a response without a request\ngot:\nnil")
+			}
+			return writer.InsertRequest(req)
+		})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if _, err := repo.GetRawRequest(req.ID); err != nil {
+			t.Errorf("\nwanted:\nrequest written\ngot:\n%v", err)
+		}
+	})
+}
+
+func BenchmarkRepository_InsertRequest(b *testing.B) {
+	const burst = 100
+
+	b.Run("individual", func(b *testing.B) {
+		repo, teardown := setupTestDB(b)
+		defer teardown()
+
+		for b.Loop() {
+			for range burst {
+				if err := repo.InsertRequest(batchRequest(b)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		repo, teardown := setupTestDB(b)
+		defer teardown()
+
+		for b.Loop() {
+			err := repo.Batch(func(writer domain.BatchWriter) error {
+				for range burst {
+					if err := writer.InsertRequest(batchRequest(b)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tfkr-ae/marasi/domain"
+)
+
+var _ domain.CertificateRepository = (*Repository)(nil)
+
+// dbCertificate represents a generated leaf certificate as stored in the database.
+type dbCertificate struct {
+	Host     string    `db:"host"`
+	CertPEM  []byte    `db:"cert_pem"`
+	KeyPEM   []byte    `db:"key_pem"`
+	NotAfter time.Time `db:"not_after"`
+}
+
+// GetCertificate retrieves the stored certificate for the given host.
+func (repo *Repository) GetCertificate(host string) (*domain.Certificate, error) {
+	var dbCert dbCertificate
+	query := `SELECT host, cert_pem, key_pem, not_after FROM certificates WHERE host = ?`
+
+	err := repo.dbConn.Get(&dbCert, query, host)
+	if err != nil {
+		return nil, fmt.Errorf("getting certificate for %s : %w", host, err)
+	}
+
+	return &domain.Certificate{
+		Host:     dbCert.Host,
+		CertPEM:  dbCert.CertPEM,
+		KeyPEM:   dbCert.KeyPEM,
+		NotAfter: dbCert.NotAfter,
+	}, nil
+}
+
+// SaveCertificate creates or replaces the stored certificate for cert.Host.
+func (repo *Repository) SaveCertificate(cert *domain.Certificate) error {
+	query := `INSERT INTO certificates (host, cert_pem, key_pem, not_after)
+			  VALUES (?, ?, ?, ?)
+			  ON CONFLICT(host) DO UPDATE SET
+				cert_pem = excluded.cert_pem,
+				key_pem = excluded.key_pem,
+				not_after = excluded.not_after`
+
+	_, err := repo.dbConn.Exec(query, cert.Host, cert.CertPEM, cert.KeyPEM, cert.NotAfter)
+	if err != nil {
+		return fmt.Errorf("saving certificate for %s : %w", cert.Host, err)
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package db
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 
+	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/domain"
 )
 
@@ -62,3 +65,92 @@ func (repo *Repository) SetFilters(filters []string) error {
 
 	return nil
 }
+
+// Get implements the domain.ConfigRepository interface.
+// It retrieves the value of the key from the 'config' table.
+func (repo *Repository) Get(key string) (string, error) {
+	var value string
+	query := `SELECT value FROM config WHERE key = ?`
+	err := repo.dbConn.Get(&value, query, key)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("getting config key %s : %w : %w", key, domain.ErrConfigKeyNotFound, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("getting config key %s : %w", key, err)
+	}
+
+	return value, nil
+}
+
+// Set implements the domain.ConfigRepository interface.
+// It inserts the key into the 'config' table or updates its value if it already exists.
+func (repo *Repository) Set(key string, value string) error {
+	query := `INSERT INTO config (key, value) VALUES (?, ?)
+			  ON CONFLICT(key) DO UPDATE SET value = excluded.value`
+	_, err := repo.dbConn.Exec(query, key, value)
+
+	if err != nil {
+		return fmt.Errorf("setting config key %s : %w", key, err)
+	}
+
+	return nil
+}
+
+// Delete implements the domain.ConfigRepository interface.
+// It removes the key from the 'config' table.
+func (repo *Repository) Delete(key string) error {
+	query := `DELETE FROM config WHERE key = ?`
+	_, err := repo.dbConn.Exec(query, key)
+
+	if err != nil {
+		return fmt.Errorf("deleting config key %s : %w", key, err)
+	}
+
+	return nil
+}
+
+// Keys implements the domain.ConfigRepository interface.
+// It returns the keys of the 'config' table ordered alphabetically.
+func (repo *Repository) Keys() ([]string, error) {
+	keys := []string{}
+	query := `SELECT key FROM config ORDER BY key`
+	err := repo.dbConn.Select(&keys, query)
+
+	if err != nil {
+		return nil, fmt.Errorf("listing config keys : %w", err)
+	}
+
+	return keys, nil
+}
+
+// GetExtensionConfig implements the domain.ConfigRepository interface.
+// It retrieves the configuration of the extension from the 'extension_config' table.
+func (repo *Repository) GetExtensionConfig(extensionID uuid.UUID) (map[string]any, error) {
+	var config Metadata
+	query := `SELECT config FROM extension_config WHERE extension_id = ?`
+	err := repo.dbConn.Get(&config, query, extensionID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return make(map[string]any), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting config of extension %s : %w", extensionID, err)
+	}
+
+	return map[string]any(config), nil
+}
+
+// SetExtensionConfig implements the domain.ConfigRepository interface.
+// It inserts the configuration of the extension into the 'extension_config' table or replaces the existing one.
+func (repo *Repository) SetExtensionConfig(extensionID uuid.UUID, config map[string]any) error {
+	query := `INSERT INTO extension_config (extension_id, config) VALUES (?, ?)
+			  ON CONFLICT(extension_id) DO UPDATE SET config = excluded.config`
+	_, err := repo.dbConn.Exec(query, extensionID, Metadata(config))
+
+	if err != nil {
+		return fmt.Errorf("setting config of extension %s : %w", extensionID, err)
+	}
+
+	return nil
+}
@@ -1,9 +1,14 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
 	"reflect"
 	"slices"
 	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tfkr-ae/marasi/domain"
 )
 
 func TestConfigRepo_SPKI(t *testing.T) {
@@ -89,3 +94,184 @@ func TestConfigRepo_Filters(t *testing.T) {
 		}
 	})
 }
+
+func TestConfigRepo_Values(t *testing.T) {
+	t.Run("should set and get a value", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		err := repo.Set("theme", "dark")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		err = repo.Set("theme", "light")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.Get("theme")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if got != "light" {
+			t.Fatalf("\nwanted:\nlight\ngot:\n%s", got)
+		}
+	})
+
+	t.Run("should return an error for a missing key", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		_, err := repo.Get("missing")
+		if !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("\nwanted:\nsql.ErrNoRows\ngot:\n%v", err)
+		}
+		if !errors.Is(err, domain.ErrConfigKeyNotFound) {
+			t.Fatalf("\nwanted:\ndomain.ErrConfigKeyNotFound\ngot:\n%v", err)
+		}
+	})
+
+	t.Run("deleted keys should be missing", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		err := repo.Set("theme", "dark")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		err = repo.Delete("theme")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		_, err = repo.Get("theme")
+		if !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("\nwanted:\nsql.ErrNoRows\ngot:\n%v", err)
+		}
+
+		err = repo.Delete("theme")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil when deleting a missing key\ngot:\n%v", err)
+		}
+	})
+
+	t.Run("should list keys in alphabetical order", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		got, err := repo.Keys()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if len(got) != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", len(got))
+		}
+
+		for _, key := range []string{"zoom", "theme", "font"} {
+			if err := repo.Set(key, "value"); err != nil {
+				t.Fatalf("setting %s : %v", key, err)
+			}
+		}
+
+		if err := repo.Delete("zoom"); err != nil {
+			t.Fatalf("deleting zoom : %v", err)
+		}
+
+		got, err = repo.Keys()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := []string{"font", "theme"}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+}
+
+func TestConfigRepo_ExtensionConfig(t *testing.T) {
+	t.Run("should return an empty config for an extension without config", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		got, err := repo.GetExtensionConfig(uuid.Must(uuid.NewV7()))
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if got == nil || len(got) != 0 {
+			t.Fatalf("\nwanted:\nempty map\ngot:\n%v", got)
+		}
+	})
+
+	t.Run("should set, get and replace the config of an extension", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		extensionID := uuid.Must(uuid.NewV7())
+		want := map[string]any{"wordlist": "common.txt", "threads": float64(4), "verbose": true}
+
+		if err := repo.SetExtensionConfig(extensionID, want); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.GetExtensionConfig(extensionID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+
+		want = map[string]any{"threads": float64(8)}
+		if err := repo.SetExtensionConfig(extensionID, want); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err = repo.GetExtensionConfig(extensionID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("should keep the config of each extension and the config keys apart", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		first := uuid.Must(uuid.NewV7())
+		second := uuid.Must(uuid.NewV7())
+
+		if err := repo.SetExtensionConfig(first, map[string]any{"mode": "passive"}); err != nil {
+			t.Fatalf("setting first config : %v", err)
+		}
+		if err := repo.SetExtensionConfig(second, map[string]any{"mode": "active"}); err != nil {
+			t.Fatalf("setting second config : %v", err)
+		}
+		if err := repo.Set("mode", "global"); err != nil {
+			t.Fatalf("setting config key : %v", err)
+		}
+
+		for id, want := range map[uuid.UUID]string{first: "passive", second: "active"} {
+			got, err := repo.GetExtensionConfig(id)
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+			if got["mode"] != want {
+				t.Fatalf("\nwanted:\n%s\ngot:\n%v", want, got["mode"])
+			}
+		}
+
+		keys, err := repo.Keys()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if !reflect.DeepEqual([]string{"mode"}, keys) {
+			t.Fatalf("\nwanted:\n[mode]\ngot:\n%v", keys)
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pressly/goose/v3"
@@ -39,6 +40,17 @@ func (repo *Repository) Close() error {
 	return nil
 }
 
+// DefaultMaxOpenConns is the number of open connections used when PoolConfig.MaxOpenConns is 0.
+// A single connection serializes the writes, which avoids SQLITE_BUSY errors for write-heavy workloads.
+const DefaultMaxOpenConns = 1
+
+// PoolConfig configures the connection pool of the database, zero values keep the defaults.
+type PoolConfig struct {
+	MaxOpenConns    int           // Maximum number of open connections, DefaultMaxOpenConns when 0
+	MaxIdleConns    int           // Maximum number of idle connections, the database/sql default when 0
+	ConnMaxLifetime time.Duration // Maximum time a connection is reused, connections are reused forever when 0
+}
+
 // New establishes a new connection to a SQLite database file and applies all pending migrations.
 // It configures the connection for optimal performance and data integrity by enabling WAL mode and foreign keys.
 //
@@ -46,6 +58,18 @@ func (repo *Repository) Close() error {
 //
 // It returns a ready-to-use sqlx.DB connection pool or an error if the connection or migrations fail.
 func New(name string, logger *slog.Logger) (*sqlx.DB, error) {
+	return NewWithPool(name, logger, PoolConfig{})
+}
+
+// NewWithPool is like New and applies the pool configuration to the returned connection pool.
+func NewWithPool(name string, logger *slog.Logger, pool PoolConfig) (*sqlx.DB, error) {
+	if pool.MaxOpenConns < 0 || pool.MaxIdleConns < 0 || pool.ConnMaxLifetime < 0 {
+		return nil, fmt.Errorf("pool config must not be negative : %+v", pool)
+	}
+	if pool.MaxOpenConns == 0 {
+		pool.MaxOpenConns = DefaultMaxOpenConns
+	}
+
 	if logger == nil {
 		logger = slog.Default()
 	}
@@ -53,14 +77,19 @@ func New(name string, logger *slog.Logger) (*sqlx.DB, error) {
 	dbLogger := logger.With("component", "db")
 	dbLogger.Info("Connecting to SQLite...", "path", name)
 
-	db, err := sqlx.Connect("sqlite", fmt.Sprintf("%s?_journal=WAL&_timeout=5000&_fk=true", name))
+	// foreign_keys is set per connection, the pragma in the DSN applies it to every connection of the pool
+	db, err := sqlx.Connect("sqlite", fmt.Sprintf("%s?_journal=WAL&_timeout=5000&_fk=true&_pragma=foreign_keys(1)", name))
 
 	if err != nil {
 		dbLogger.Error("Failed to connect to database", "error", err)
 		return nil, fmt.Errorf("connecting to db : %w", err)
 	}
 
-	db.SetMaxOpenConns(1)
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
 
 	_, err = db.Exec("PRAGMA foreign_keys = ON;")
 	if err != nil {
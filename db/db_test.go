@@ -1,17 +1,21 @@
 package db
 
 import (
+	"context"
+	"database/sql"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 	"github.com/tfkr-ae/marasi/domain"
 )
 
-func setupTestDB(t *testing.T) (*Repository, func()) {
+func setupTestDB(t testing.TB) (*Repository, func()) {
 	t.Helper()
 
 	tempFile, err := os.CreateTemp(t.TempDir(), "test_*.db")
@@ -47,13 +51,17 @@ func testRequest(t *testing.T, repo *Repository, metadata map[string]any) uuid.U
 		metadata = make(map[string]any)
 	}
 
+	rawReq := []byte("GET / HTTP/1.1\r\nHost: marasi.app\r\n\r\n")
+
 	req := &domain.ProxyRequest{
 		ID:          id,
 		Scheme:      "https",
 		Method:      "GET",
 		Host:        "marasi.app",
 		Path:        "/",
-		Raw:         []byte("GET / HTTP/1.1\r\nHost: marasi.app\r\n\r\n"),
+		Proto:       "HTTP/1.1",
+		Raw:         rawReq,
+		RawLength:   int64(len(rawReq)),
 		Metadata:    metadata,
 		RequestedAt: time.Now(),
 	}
@@ -75,14 +83,16 @@ func insertTestResponseAndGet(t *testing.T, repo *Repository, reqID uuid.UUID, m
 	rawResp := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nHello Marasi")
 
 	resp := &domain.ProxyResponse{
-		ID:          reqID,
-		Status:      "200 OK",
-		StatusCode:  200,
-		ContentType: "text/plain",
-		Length:      "12",
-		Raw:         rawResp,
-		Metadata:    metadata,
-		RespondedAt: time.Now().UTC().Truncate(time.Millisecond),
+		ID:           reqID,
+		Status:       "200 OK",
+		StatusCode:   200,
+		ContentType:  "text/plain",
+		Length:       "12",
+		Raw:          rawResp,
+		RawLength:    int64(len(rawResp)),
+		Metadata:     metadata,
+		RespondedAt:  time.Now().UTC().Truncate(time.Millisecond),
+		UpstreamAddr: "203.0.113.10:443",
 	}
 
 	err := repo.InsertResponse(resp)
@@ -91,3 +101,91 @@ func insertTestResponseAndGet(t *testing.T, repo *Repository, reqID uuid.UUID, m
 	}
 	return resp
 }
+
+func TestNewWithPool(t *testing.T) {
+	newDB := func(t *testing.T, pool PoolConfig) *sqlx.DB {
+		t.Helper()
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		dbConn, err := NewWithPool(filepath.Join(t.TempDir(), "pool.db"), logger, pool)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		t.Cleanup(func() { dbConn.Close() })
+		return dbConn
+	}
+
+	t.Run("should default to a single open connection", func(t *testing.T) {
+		dbConn := newDB(t, PoolConfig{})
+
+		if got := dbConn.Stats().MaxOpenConnections; got != DefaultMaxOpenConns {
+			t.Errorf("\nwanted:\n%d\ngot:\n%d", DefaultMaxOpenConns, got)
+		}
+	})
+
+	t.Run("should apply the pool config", func(t *testing.T) {
+		dbConn := newDB(t, PoolConfig{MaxOpenConns: 4, MaxIdleConns: 2, ConnMaxLifetime: 50 * time.Millisecond})
+
+		if got := dbConn.Stats().MaxOpenConnections; got != 4 {
+			t.Errorf("\nwanted:\n4 max open connections\ngot:\n%d", got)
+		}
+
+		ctx := context.Background()
+		conns := make([]*sql.Conn, 4)
+		for i := range conns {
+			conn, err := dbConn.Conn(ctx)
+			if err != nil {
+				t.Fatalf("getting connection : %v", err)
+			}
+			conns[i] = conn
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		stats := dbConn.Stats()
+		if stats.Idle != 2 || stats.MaxIdleClosed != 2 {
+			t.Errorf("\nwanted:\n2 idle and 2 closed connections\ngot:\n%d idle and %d closed connections", stats.Idle, stats.MaxIdleClosed)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if err := dbConn.Ping(); err != nil {
+			t.Fatalf("pinging database : %v", err)
+		}
+		if got := dbConn.Stats().MaxLifetimeClosed; got == 0 {
+			t.Errorf("\nwanted:\nexpired connections closed\ngot:\n%d", got)
+		}
+	})
+
+	t.Run("should enforce foreign keys on every connection", func(t *testing.T) {
+		dbConn := newDB(t, PoolConfig{MaxOpenConns: 2})
+
+		ctx := context.Background()
+		first, err := dbConn.Conn(ctx)
+		if err != nil {
+			t.Fatalf("getting connection : %v", err)
+		}
+		defer first.Close()
+		second, err := dbConn.Conn(ctx)
+		if err != nil {
+			t.Fatalf("getting connection : %v", err)
+		}
+		defer second.Close()
+
+		for _, conn := range []*sql.Conn{first, second} {
+			var enabled int
+			if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&enabled); err != nil {
+				t.Fatalf("reading pragma : %v", err)
+			}
+			if enabled != 1 {
+				t.Errorf("\nwanted:\n1\ngot:\n%d", enabled)
+			}
+		}
+	})
+
+	t.Run("should reject negative values", func(t *testing.T) {
+		_, err := NewWithPool(filepath.Join(t.TempDir(), "pool.db"), nil, PoolConfig{MaxIdleConns: -1})
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+}
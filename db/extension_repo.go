@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -22,6 +23,7 @@ type dbExtension struct {
 	Description string    `db:"description"`
 	Settings    Metadata  `db:"settings"`
 	UpdatedAt   time.Time `db:"update_at"`
+	LoadOrder   int       `db:"load_order"`
 }
 
 // toDomainExtension converts a dbExtension struct to its domain.Extension representation.
@@ -36,14 +38,15 @@ func toDomainExtension(dbExt *dbExtension) *domain.Extension {
 		Description: dbExt.Description,
 		Settings:    map[string]any(dbExt.Settings),
 		UpdatedAt:   dbExt.UpdatedAt,
+		LoadOrder:   dbExt.LoadOrder,
 	}
 }
 
 // GetExtensions implements the domain.ExtensionRepository interface.
-// It retrieves all extensions from the database and converts them to domain.Extension objects.
+// It retrieves all extensions from the database in their load order and converts them to domain.Extension objects.
 func (repo *Repository) GetExtensions() ([]*domain.Extension, error) {
 	var dbExts []*dbExtension
-	query := `SELECT * FROM extensions ORDER BY id ASC`
+	query := `SELECT * FROM extensions ORDER BY load_order ASC, id ASC`
 
 	err := repo.dbConn.Select(&dbExts, query)
 	if err != nil {
@@ -127,3 +130,110 @@ func (repo *Repository) SetExtensionSettingsByUUID(id uuid.UUID, settings map[st
 
 	return nil
 }
+
+// UpsertExtension implements the domain.ExtensionRepository interface.
+// It inserts the extension or updates the stored extension with the same ID, the update time is set to the current time.
+// The load order of an existing extension is kept, new extensions are placed last.
+func (repo *Repository) UpsertExtension(extension *domain.Extension) error {
+	settings := Metadata(extension.Settings)
+	if settings == nil {
+		settings = Metadata{}
+	}
+
+	query := `INSERT INTO extensions (id, name, source_url, author, lua_content, update_at, enabled, description, settings, load_order)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(load_order) + 1, 0) FROM extensions))
+              ON CONFLICT(id) DO UPDATE SET
+                  name = excluded.name,
+                  source_url = excluded.source_url,
+                  author = excluded.author,
+                  lua_content = excluded.lua_content,
+                  update_at = excluded.update_at,
+                  enabled = excluded.enabled,
+                  description = excluded.description,
+                  settings = excluded.settings`
+
+	_, err := repo.dbConn.Exec(query, extension.ID, extension.Name, extension.SourceURL, extension.Author, extension.LuaContent,
+		time.Now(), extension.Enabled, extension.Description, settings)
+	if err != nil {
+		return fmt.Errorf("upserting extension %s: %w", extension.Name, err)
+	}
+
+	return nil
+}
+
+// DeleteExtension implements the domain.ExtensionRepository interface.
+// It removes the extension with the given ID, the logs and the config of the extension are removed with it.
+func (repo *Repository) DeleteExtension(id uuid.UUID) error {
+	tx, err := repo.dbConn.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM extensions WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("deleting extension %s: %w", id, err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("getting affected rows: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("extension %s not found", id)
+	}
+
+	// extension_config has no foreign key to extensions, the config is removed here
+	if _, err := tx.Exec(`DELETE FROM extension_config WHERE extension_id = ?`, id); err != nil {
+		return fmt.Errorf("deleting config of extension %s: %w", id, err)
+	}
+
+	return tx.Commit()
+}
+
+// SetExtensionOrder implements the domain.ExtensionRepository interface.
+// It sets the load order of the extensions to the order of the given IDs, extensions that are not listed
+// keep their relative order after the listed ones. It returns an error for unknown or repeated IDs.
+func (repo *Repository) SetExtensionOrder(ids []uuid.UUID) error {
+	tx, err := repo.dbConn.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current []uuid.UUID
+	err = tx.Select(&current, `SELECT id FROM extensions ORDER BY load_order ASC, id ASC`)
+	if err != nil {
+		return fmt.Errorf("getting extension ids: %w", err)
+	}
+
+	order := make([]uuid.UUID, 0, len(current))
+	for _, id := range ids {
+		if !slices.Contains(current, id) {
+			return fmt.Errorf("extension %s not found", id)
+		}
+		if slices.Contains(order, id) {
+			return fmt.Errorf("extension %s is listed more than once", id)
+		}
+		order = append(order, id)
+	}
+	for _, id := range current {
+		if !slices.Contains(order, id) {
+			order = append(order, id)
+		}
+	}
+
+	stmt, err := tx.Preparex(`UPDATE extensions SET load_order = ? WHERE id = ?`)
+	if err != nil {
+		return fmt.Errorf("preparing order statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for loadOrder, id := range order {
+		if _, err := stmt.Exec(loadOrder, id); err != nil {
+			return fmt.Errorf("setting load order of extension %s: %w", id, err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/tfkr-ae/marasi/domain"
 )
 
 var (
@@ -309,3 +310,180 @@ func TestExtensionRepo_GetExtensionsOrdering(t *testing.T) {
 		}
 	})
 }
+
+func TestExtensionRepo_UpsertExtension(t *testing.T) {
+	t.Run("should insert a new extension after the existing ones", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		want := &domain.Extension{
+			ID:          uuid.Must(uuid.NewV7()),
+			Name:        "upserted",
+			SourceURL:   "https://marasi.app",
+			Author:      "marasi",
+			LuaContent:  "version = 1",
+			Enabled:     true,
+			Description: "upserted extension",
+			Settings:    map[string]any{"key": "value"},
+		}
+
+		if err := repo.UpsertExtension(want); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.GetExtensionByName("upserted")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if got.ID != want.ID || got.LuaContent != want.LuaContent || got.SourceURL != want.SourceURL ||
+			got.Author != want.Author || got.Enabled != want.Enabled || got.Description != want.Description {
+			t.Fatalf("\nwanted:\n%+v\ngot:\n%+v", want, got)
+		}
+		if !reflect.DeepEqual(got.Settings, want.Settings) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want.Settings, got.Settings)
+		}
+		if got.UpdatedAt.IsZero() {
+			t.Fatalf("\nwanted:\nupdate time\ngot:\nzero time")
+		}
+
+		extensions, err := repo.GetExtensions()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if last := extensions[len(extensions)-1]; last.ID != want.ID {
+			t.Fatalf("\nwanted:\n%s last\ngot:\n%s last", want.Name, last.Name)
+		}
+	})
+
+	t.Run("should update an existing extension and keep its load order", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		compass, err := repo.GetExtensionByName("compass")
+		if err != nil {
+			t.Fatalf("getting compass extension: %v", err)
+		}
+
+		compass.LuaContent = "version = 2"
+		compass.Enabled = false
+		if err := repo.UpsertExtension(compass); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.GetExtensionByName("compass")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if got.LuaContent != "version = 2" || got.Enabled {
+			t.Fatalf("\nwanted:\nupdated code and disabled\ngot:\n%q enabled %v", got.LuaContent, got.Enabled)
+		}
+		if got.LoadOrder != compass.LoadOrder {
+			t.Fatalf("\nwanted:\n%d\ngot:\n%d", compass.LoadOrder, got.LoadOrder)
+		}
+	})
+}
+
+func TestExtensionRepo_DeleteExtension(t *testing.T) {
+	t.Run("should delete an existing extension", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		if err := repo.DeleteExtension(workshopID); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if _, err := repo.GetExtensionByName("workshop"); err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+
+		extensions, err := repo.GetExtensions()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if len(extensions) != 2 {
+			t.Fatalf("\nwanted:\n2\ngot:\n%d", len(extensions))
+		}
+	})
+
+	t.Run("should delete the config of the extension", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		if err := repo.SetExtensionConfig(workshopID, map[string]any{"mode": "active"}); err != nil {
+			t.Fatalf("setting workshop config : %v", err)
+		}
+		if err := repo.SetExtensionConfig(compassID, map[string]any{"mode": "passive"}); err != nil {
+			t.Fatalf("setting compass config : %v", err)
+		}
+
+		if err := repo.DeleteExtension(workshopID); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		var count int
+		if err := repo.dbConn.Get(&count, `SELECT COUNT(*) FROM extension_config WHERE extension_id = ?`, workshopID); err != nil {
+			t.Fatalf("counting workshop config : %v", err)
+		}
+		if count != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", count)
+		}
+
+		got, err := repo.GetExtensionConfig(compassID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if got["mode"] != "passive" {
+			t.Fatalf("\nwanted:\npassive\ngot:\n%v", got["mode"])
+		}
+	})
+
+	t.Run("should return an error for a non-existent extension", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		if err := repo.DeleteExtension(uuid.Must(uuid.NewV7())); err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+}
+
+func TestExtensionRepo_SetExtensionOrder(t *testing.T) {
+	t.Run("should order the listed extensions first", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		if err := repo.SetExtensionOrder([]uuid.UUID{workshopID, compassID}); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		extensions, err := repo.GetExtensions()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := []uuid.UUID{workshopID, compassID, checkpointID}
+		for i, ext := range extensions {
+			if ext.ID != want[i] {
+				t.Errorf("index %d\nwanted:\n%s\ngot:\n%s", i, want[i], ext.ID)
+			}
+			if ext.LoadOrder != i {
+				t.Errorf("index %d\nwanted:\nload order %d\ngot:\n%d", i, i, ext.LoadOrder)
+			}
+		}
+	})
+
+	t.Run("should return an error for unknown or repeated extensions", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		if err := repo.SetExtensionOrder([]uuid.UUID{uuid.Must(uuid.NewV7())}); err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+
+		if err := repo.SetExtensionOrder([]uuid.UUID{compassID, compassID}); err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tfkr-ae/marasi/domain"
+)
+
+var _ domain.HealthRepository = (*Repository)(nil)
+
+// Ping implements the domain.HealthRepository interface.
+func (repo *Repository) Ping(ctx context.Context) error {
+	if err := repo.dbConn.PingContext(ctx); err != nil {
+		return fmt.Errorf("pinging database: %w", err)
+	}
+	return nil
+}
+
+// HealthCheck implements the domain.HealthRepository interface.
+// The write test inserts a config key in a transaction that is always rolled back.
+func (repo *Repository) HealthCheck(ctx context.Context) (domain.DBHealth, error) {
+	var health domain.DBHealth
+
+	if err := repo.Ping(ctx); err != nil {
+		return health, err
+	}
+
+	var journalMode string
+	if err := repo.dbConn.GetContext(ctx, &journalMode, `PRAGMA journal_mode`); err != nil {
+		return health, fmt.Errorf("getting journal mode: %w", err)
+	}
+	health.JournalMode = strings.ToLower(journalMode)
+	health.WAL = health.JournalMode == "wal"
+
+	tx, err := repo.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return health, fmt.Errorf("beginning write test: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO config (key, value) VALUES ('marasi_health_check', 'ok')
+			  ON CONFLICT(key) DO UPDATE SET value = excluded.value`)
+	if err != nil {
+		return health, fmt.Errorf("writing to database: %w", err)
+	}
+	health.Writable = true
+
+	// Read after the transaction is rolled back so the connection used by the write test is counted
+	if err := tx.Rollback(); err != nil {
+		return health, fmt.Errorf("rolling back write test: %w", err)
+	}
+	health.OpenConnections = repo.dbConn.Stats().OpenConnections
+
+	return health, nil
+}
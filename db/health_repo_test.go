@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHealthRepo_HealthCheck(t *testing.T) {
+	t.Run("should report a healthy database", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		if err := repo.Ping(context.Background()); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		health, err := repo.HealthCheck(context.Background())
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if !health.Writable {
+			t.Errorf("\nwanted:\nwritable\ngot:\n%+v", health)
+		}
+		if health.JournalMode == "" {
+			t.Errorf("\nwanted:\njournal mode\ngot:\n%+v", health)
+		}
+		if health.OpenConnections < 1 {
+			t.Errorf("\nwanted:\nat least 1 open connection\ngot:\n%d", health.OpenConnections)
+		}
+
+		if _, err := repo.Get("marasi_health_check"); err == nil {
+			t.Errorf("\nwanted:\nthe write test to be rolled back\ngot:\nmarasi_health_check key")
+		}
+	})
+
+	t.Run("should return an error on a closed database", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+		repo.Close()
+
+		if err := repo.Ping(context.Background()); err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+		if _, err := repo.HealthCheck(context.Background()); err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+}
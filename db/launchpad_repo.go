@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"slices"
 
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/domain"
@@ -14,6 +15,7 @@ type dbLaunchpad struct {
 	ID          uuid.UUID `db:"id"`          // Unique identifier for the launchpad.
 	Description string    `db:"description"` // Description of the launchpad.
 	Name        string    `db:"name"`        // Name of the launchpad.
+	Variables   Variables `db:"variables"`   // Variables substituted into the launchpad's requests.
 }
 
 // toDomainLaunchpad converts a dbLaunchpad to a domain.Launchpad.
@@ -22,6 +24,7 @@ func toDomainLaunchpad(dbLaunchpad *dbLaunchpad) *domain.Launchpad {
 		ID:          dbLaunchpad.ID,
 		Description: dbLaunchpad.Description,
 		Name:        dbLaunchpad.Name,
+		Variables:   dbLaunchpad.Variables,
 	}
 }
 
@@ -106,10 +109,11 @@ func (repo *Repository) DeleteLaunchpad(launchpadID uuid.UUID) error {
 // GetLaunchpadRequests retrieves all requests associated with a specific launchpad.
 func (repo *Repository) GetLaunchpadRequests(id uuid.UUID) ([]*domain.ProxyRequest, error) {
 	var dbRequests []*dbRequestResponse
-	query := `SELECT r.id, r.scheme, r.method, r.host, r.path, r.request_raw, r.metadata, r.requested_at
+	query := `SELECT r.id, r.scheme, r.method, r.host, r.path, r.proto, r.request_raw, r.request_raw_length, r.metadata, r.requested_at
 		      FROM request r
 		      JOIN launchpad_request lr ON r.id = lr.request_id
-		      WHERE lr.launchpad_id = ?`
+		      WHERE lr.launchpad_id = ?
+		      ORDER BY lr.sequence ASC, r.id ASC`
 
 	err := repo.dbConn.Select(&dbRequests, query, id)
 	if err != nil {
@@ -126,12 +130,124 @@ func (repo *Repository) GetLaunchpadRequests(id uuid.UUID) ([]*domain.ProxyReque
 
 // LinkRequestToLaunchpad creates an association between a request and a launchpad.
 func (repo *Repository) LinkRequestToLaunchpad(requestID uuid.UUID, launchpadID uuid.UUID) error {
-	query := `INSERT INTO launchpad_request (request_id, launchpad_id) VALUES (?, ?)`
+	return linkRequestToLaunchpad(repo.dbConn, requestID, launchpadID)
+}
 
-	_, err := repo.dbConn.Exec(query, requestID, launchpadID)
+// linkRequestToLaunchpad creates an association between a request and a launchpad with exec.
+func linkRequestToLaunchpad(exec execer, requestID uuid.UUID, launchpadID uuid.UUID) error {
+	query := `INSERT INTO launchpad_request (request_id, launchpad_id, sequence)
+			  VALUES (?, ?, (SELECT COALESCE(MAX(sequence) + 1, 0) FROM launchpad_request WHERE launchpad_id = ?))`
+
+	_, err := exec.Exec(query, requestID, launchpadID, launchpadID)
 	if err != nil {
 		return fmt.Errorf("linking request with launchpad: %w", err)
 	}
 
 	return nil
 }
+
+// AttachRequest adds a request to a launchpad, ignoring the request if it is already attached.
+func (repo *Repository) AttachRequest(launchpadID uuid.UUID, requestID uuid.UUID) error {
+	query := `INSERT OR IGNORE INTO launchpad_request (request_id, launchpad_id, sequence)
+			  VALUES (?, ?, (SELECT COALESCE(MAX(sequence) + 1, 0) FROM launchpad_request WHERE launchpad_id = ?))`
+
+	_, err := repo.dbConn.Exec(query, requestID, launchpadID, launchpadID)
+	if err != nil {
+		return fmt.Errorf("attaching request %s to launchpad %s: %w", requestID, launchpadID, err)
+	}
+
+	return nil
+}
+
+// DetachRequest removes a request from a launchpad, it does nothing if the request is not attached.
+func (repo *Repository) DetachRequest(launchpadID uuid.UUID, requestID uuid.UUID) error {
+	query := `DELETE FROM launchpad_request WHERE request_id = ? AND launchpad_id = ?`
+
+	_, err := repo.dbConn.Exec(query, requestID, launchpadID)
+	if err != nil {
+		return fmt.Errorf("detaching request %s from launchpad %s: %w", requestID, launchpadID, err)
+	}
+
+	return nil
+}
+
+// GetLaunchpadVariables retrieves the variables of a launchpad.
+func (repo *Repository) GetLaunchpadVariables(launchpadID uuid.UUID) (map[string]string, error) {
+	var variables Variables
+	query := `SELECT variables FROM launchpad WHERE id = ?`
+
+	err := repo.dbConn.Get(&variables, query, launchpadID)
+	if err != nil {
+		return nil, fmt.Errorf("getting variables for launchpad %s: %w", launchpadID, err)
+	}
+
+	return variables, nil
+}
+
+// SetLaunchpadVariables replaces the variables of a launchpad.
+func (repo *Repository) SetLaunchpadVariables(launchpadID uuid.UUID, variables map[string]string) error {
+	query := `UPDATE launchpad SET variables = ? WHERE id = ?`
+
+	result, err := repo.dbConn.Exec(query, Variables(variables), launchpadID)
+	if err != nil {
+		return fmt.Errorf("setting variables for launchpad %s: %w", launchpadID, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return fmt.Errorf("fetching rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no launchpad with id %s", launchpadID)
+	}
+
+	return nil
+}
+
+// ReorderLaunchpad rewrites the sequence of the launchpad's requests in a single transaction.
+// The requests that are not part of orderedRequestIDs are placed after the ordered ones, keeping their relative order.
+func (repo *Repository) ReorderLaunchpad(launchpadID uuid.UUID, orderedRequestIDs []uuid.UUID) error {
+	tx, err := repo.dbConn.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction : %w", err)
+	}
+	defer tx.Rollback()
+
+	var current []uuid.UUID
+	err = tx.Select(&current, `SELECT request_id FROM launchpad_request WHERE launchpad_id = ? ORDER BY sequence ASC, request_id ASC`, launchpadID)
+	if err != nil {
+		return fmt.Errorf("getting requests of launchpad %s : %w", launchpadID, err)
+	}
+
+	order := make([]uuid.UUID, 0, len(current))
+	for _, requestID := range orderedRequestIDs {
+		if !slices.Contains(current, requestID) {
+			return fmt.Errorf("request %s is not part of launchpad %s", requestID, launchpadID)
+		}
+		if slices.Contains(order, requestID) {
+			return fmt.Errorf("request %s is listed more than once", requestID)
+		}
+		order = append(order, requestID)
+	}
+	for _, requestID := range current {
+		if !slices.Contains(order, requestID) {
+			order = append(order, requestID)
+		}
+	}
+
+	stmt, err := tx.Preparex(`UPDATE launchpad_request SET sequence = ? WHERE launchpad_id = ? AND request_id = ?`)
+	if err != nil {
+		return fmt.Errorf("preparing reorder statement : %w", err)
+	}
+	defer stmt.Close()
+
+	for sequence, requestID := range order {
+		if _, err := stmt.Exec(sequence, launchpadID, requestID); err != nil {
+			return fmt.Errorf("setting sequence of request %s : %w", requestID, err)
+		}
+	}
+
+	return tx.Commit()
+}
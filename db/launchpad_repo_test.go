@@ -448,3 +448,371 @@ func TestLaunchpadRepo_LinkRequestToLaunchpad(t *testing.T) {
 		}
 	})
 }
+
+func TestLaunchpadRepo_AttachRequest(t *testing.T) {
+	t.Run("should attach a request to launchpad", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+		reqID := testRequest(t, repo, nil)
+
+		err = repo.AttachRequest(launchpadID, reqID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		requests, err := repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(requests) != 1 {
+			t.Fatalf("\nwanted:\n1\ngot:\n%d", len(requests))
+		}
+		if requests[0].ID != reqID {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", reqID, requests[0].ID)
+		}
+	})
+
+	t.Run("should not return an error or duplicate the request when attached twice", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+		reqID := testRequest(t, repo, nil)
+
+		for range 2 {
+			err = repo.AttachRequest(launchpadID, reqID)
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+		}
+
+		requests, err := repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(requests) != 1 {
+			t.Fatalf("\nwanted:\n1\ngot:\n%d", len(requests))
+		}
+	})
+
+	t.Run("should return an error if launchpad ID doesn't exist", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		nonExistentLpID := uuid.MustParse("01937f56-2a78-7568-a477-5060d4b68452")
+		reqID := testRequest(t, repo, nil)
+
+		err := repo.AttachRequest(nonExistentLpID, reqID)
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+		if !strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+			t.Fatalf("\nwanted:\nerror containing 'FOREIGN KEY constraint failed'\ngot:\n%v", err)
+		}
+	})
+}
+
+func TestLaunchpadRepo_DetachRequest(t *testing.T) {
+	t.Run("should detach a request from launchpad", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+		reqID := testRequest(t, repo, nil)
+		otherReqID := testRequest(t, repo, nil)
+
+		for _, id := range []uuid.UUID{reqID, otherReqID} {
+			err = repo.AttachRequest(launchpadID, id)
+			if err != nil {
+				t.Fatalf("attaching request: %v", err)
+			}
+		}
+
+		err = repo.DetachRequest(launchpadID, reqID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		requests, err := repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(requests) != 1 {
+			t.Fatalf("\nwanted:\n1\ngot:\n%d", len(requests))
+		}
+		if requests[0].ID != otherReqID {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", otherReqID, requests[0].ID)
+		}
+	})
+
+	t.Run("should not return an error if the request is not attached", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+		reqID := testRequest(t, repo, nil)
+
+		err = repo.DetachRequest(launchpadID, reqID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+	})
+}
+
+func TestLaunchpadRepo_LaunchpadVariables(t *testing.T) {
+	t.Run("should return nil variables for a new launchpad", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+
+		got, err := repo.GetLaunchpadVariables(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if got != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", got)
+		}
+	})
+
+	t.Run("should persist and return the variables", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+
+		want := map[string]string{"token": "secret-token", "version": "v2"}
+		err = repo.SetLaunchpadVariables(launchpadID, want)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.GetLaunchpadVariables(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+
+		launchpads, err := repo.GetLaunchpads()
+		if err != nil {
+			t.Fatalf("getting launchpads: %v", err)
+		}
+
+		if len(launchpads) != 1 || !reflect.DeepEqual(want, launchpads[0].Variables) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, launchpads)
+		}
+	})
+
+	t.Run("setting empty variables should clear them", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+
+		err = repo.SetLaunchpadVariables(launchpadID, map[string]string{"token": "secret-token"})
+		if err != nil {
+			t.Fatalf("setting variables: %v", err)
+		}
+
+		err = repo.SetLaunchpadVariables(launchpadID, map[string]string{})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.GetLaunchpadVariables(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(got) != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", len(got))
+		}
+	})
+
+	t.Run("should return an error for a non-existent launchpad", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		fakeID, _ := uuid.NewV7()
+		err := repo.SetLaunchpadVariables(fakeID, map[string]string{"token": "secret-token"})
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+
+		if !strings.Contains(err.Error(), "no launchpad with id") {
+			t.Fatalf("\nwanted:\nno launchpad with id\ngot:\n%v", err)
+		}
+
+		_, err = repo.GetLaunchpadVariables(fakeID)
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+}
+
+func TestLaunchpadRepo_ReorderLaunchpad(t *testing.T) {
+	requestIDs := func(requests []*domain.ProxyRequest) []uuid.UUID {
+		ids := make([]uuid.UUID, 0, len(requests))
+		for _, req := range requests {
+			ids = append(ids, req.ID)
+		}
+		return ids
+	}
+
+	t.Run("should list requests in the order they were attached", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+		reqID1 := testRequest(t, repo, nil)
+		reqID2 := testRequest(t, repo, nil)
+		reqID3 := testRequest(t, repo, nil)
+
+		want := []uuid.UUID{reqID3, reqID1, reqID2}
+		for _, id := range want {
+			err = repo.AttachRequest(launchpadID, id)
+			if err != nil {
+				t.Fatalf("attaching request: %v", err)
+			}
+		}
+
+		requests, err := repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got := requestIDs(requests)
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("should persist the new order and keep unlisted requests at the end", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+		reqID1 := testRequest(t, repo, nil)
+		reqID2 := testRequest(t, repo, nil)
+		reqID3 := testRequest(t, repo, nil)
+		reqID4 := testRequest(t, repo, nil)
+
+		for _, id := range []uuid.UUID{reqID1, reqID2, reqID3, reqID4} {
+			err = repo.AttachRequest(launchpadID, id)
+			if err != nil {
+				t.Fatalf("attaching request: %v", err)
+			}
+		}
+
+		err = repo.ReorderLaunchpad(launchpadID, []uuid.UUID{reqID3, reqID1})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		requests, err := repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := []uuid.UUID{reqID3, reqID1, reqID2, reqID4}
+		got := requestIDs(requests)
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+
+		// newly attached requests go after the reordered ones
+		reqID5 := testRequest(t, repo, nil)
+		err = repo.AttachRequest(launchpadID, reqID5)
+		if err != nil {
+			t.Fatalf("attaching request: %v", err)
+		}
+
+		requests, err = repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want = append(want, reqID5)
+		got = requestIDs(requests)
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("should return an error and keep the order if a request is not attached", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+		reqID1 := testRequest(t, repo, nil)
+		reqID2 := testRequest(t, repo, nil)
+		detachedID := testRequest(t, repo, nil)
+
+		for _, id := range []uuid.UUID{reqID1, reqID2} {
+			err = repo.AttachRequest(launchpadID, id)
+			if err != nil {
+				t.Fatalf("attaching request: %v", err)
+			}
+		}
+
+		err = repo.ReorderLaunchpad(launchpadID, []uuid.UUID{reqID2, detachedID})
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+
+		err = repo.ReorderLaunchpad(launchpadID, []uuid.UUID{reqID2, reqID2})
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+
+		requests, err := repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := []uuid.UUID{reqID1, reqID2}
+		got := requestIDs(requests)
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+}
@@ -70,11 +70,16 @@ func fromDomainLog(log *domain.Log) *dbLog {
 
 // InsertLog saves a new log entry to the database.
 func (repo *Repository) InsertLog(log *domain.Log) error {
+	return insertLog(repo.dbConn, log)
+}
+
+// insertLog saves a new log entry with exec.
+func insertLog(exec execer, log *domain.Log) error {
 	dbLog := fromDomainLog(log)
 	query := `INSERT INTO logs (id, level, timestamp, message, context, request_id, extension_id)
 	          VALUES (:id, :level, :timestamp, :message, :context, :request_id, :extension_id)`
 
-	_, err := repo.dbConn.NamedExec(query, dbLog)
+	_, err := exec.NamedExec(query, dbLog)
 	if err != nil {
 		return fmt.Errorf("inserting log %s: %w", log.ID, err)
 	}
@@ -99,3 +104,21 @@ func (repo *Repository) GetLogs() ([]*domain.Log, error) {
 
 	return domainLogs, nil
 }
+
+// GetLogsByRequest retrieves the log entries associated with requestID, ordered by timestamp.
+func (repo *Repository) GetLogsByRequest(requestID uuid.UUID) ([]*domain.Log, error) {
+	var dbLogs []*dbLog
+	query := `SELECT * FROM logs WHERE request_id = ? ORDER BY timestamp ASC, id ASC`
+
+	err := repo.dbConn.Select(&dbLogs, query, requestID.String())
+	if err != nil {
+		return nil, fmt.Errorf("fetching logs for request %s: %w", requestID, err)
+	}
+
+	domainLogs := make([]*domain.Log, len(dbLogs))
+	for i, dbLog := range dbLogs {
+		domainLogs[i] = toDomainLog(dbLog)
+	}
+
+	return domainLogs, nil
+}
@@ -110,28 +110,67 @@ func TestLogRepo_GetLogs(t *testing.T) {
 		}
 	})
 
-	t.Run("should fail to insert log if the request ID doesn't exist", func(t *testing.T) {
+	t.Run("should insert a log for a request that is not stored", func(t *testing.T) {
 		repo, teardown := setupTestDB(t)
 		defer teardown()
 
-		invalidReqID := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+		reqID := uuid.MustParse("00000000-0000-0000-0000-000000000002")
 
 		log := &domain.Log{
 			ID:        uuid.MustParse("00000000-0000-0000-0000-000000000001"),
 			Timestamp: time.Now(),
 			Level:     "INFO",
-			Message:   "Log with invalid request ID",
+			Message:   "Log for a skipped request",
 			Context:   nil,
-			RequestID: &invalidReqID,
+			RequestID: &reqID,
 		}
 
 		err := repo.InsertLog(log)
-		if err == nil {
-			t.Fatalf("\nwanted:\non-nil\ngot:\n%v", err)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
 		}
 
-		if !strings.Contains(err.Error(), "FOREIGN KEY") {
-			t.Fatalf("\nwanted:\nerror containing 'FOREIGN KEY'\ngot:\n%v", err)
+		got, err := repo.GetLogsByRequest(reqID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(got) != 1 {
+			t.Fatalf("\nwanted:\n1\ngot:\n%d", len(got))
+		}
+	})
+
+	t.Run("should insert a log batched before its request", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		req := batchRequest(t)
+		log := &domain.Log{
+			ID:        uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+			Timestamp: time.Now(),
+			Level:     "INFO",
+			Message:   "Log written by processRequest",
+			Context:   make(map[string]any),
+			RequestID: &req.ID,
+		}
+
+		err := repo.Batch(func(writer domain.BatchWriter) error {
+			if err := writer.InsertLog(log); err != nil {
+				return err
+			}
+			return writer.InsertRequest(req)
+		})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.GetLogsByRequest(req.ID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(got) != 1 {
+			t.Fatalf("\nwanted:\n1\ngot:\n%d", len(got))
 		}
 	})
 
@@ -161,3 +200,62 @@ func TestLogRepo_GetLogs(t *testing.T) {
 	})
 
 }
+
+func TestLogRepo_GetLogsByRequest(t *testing.T) {
+	repo, teardown := setupTestDB(t)
+	defer teardown()
+
+	fixedTime := time.Date(2025, 10, 20, 12, 0, 0, 0, time.UTC)
+	reqID := testRequest(t, repo, nil)
+	otherReqID := testRequest(t, repo, nil)
+
+	logs := []*domain.Log{
+		{
+			ID:        uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+			Timestamp: fixedTime.Add(time.Second),
+			Level:     "INFO",
+			Message:   "second",
+			Context:   make(map[string]any),
+			RequestID: &reqID,
+		},
+		{
+			ID:        uuid.MustParse("00000000-0000-0000-0000-000000000002"),
+			Timestamp: fixedTime,
+			Level:     "INFO",
+			Message:   "first",
+			Context:   make(map[string]any),
+			RequestID: &reqID,
+		},
+		{
+			ID:        uuid.MustParse("00000000-0000-0000-0000-000000000003"),
+			Timestamp: fixedTime,
+			Level:     "INFO",
+			Message:   "other request",
+			Context:   make(map[string]any),
+			RequestID: &otherReqID,
+		},
+		{
+			ID:        uuid.MustParse("00000000-0000-0000-0000-000000000004"),
+			Timestamp: fixedTime,
+			Level:     "INFO",
+			Message:   "no request",
+			Context:   make(map[string]any),
+		},
+	}
+
+	for _, logEntry := range logs {
+		if err := repo.InsertLog(logEntry); err != nil {
+			t.Fatalf("inserting log: %v", err)
+		}
+	}
+
+	got, err := repo.GetLogsByRequest(reqID)
+	if err != nil {
+		t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+	}
+
+	want := []*domain.Log{logs[1], logs[0]}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+	}
+}
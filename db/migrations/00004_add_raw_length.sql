@@ -0,0 +1,13 @@
+-- +goose Up
+
+ALTER TABLE request ADD COLUMN request_raw_length INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE request ADD COLUMN response_raw_length INTEGER NOT NULL DEFAULT 0;
+
+UPDATE request SET
+    request_raw_length = COALESCE(length(request_raw), 0),
+    response_raw_length = COALESCE(length(response_raw), 0);
+
+-- +goose Down
+
+ALTER TABLE request DROP COLUMN response_raw_length;
+ALTER TABLE request DROP COLUMN request_raw_length;
@@ -0,0 +1,16 @@
+-- +goose Up
+
+CREATE TABLE IF NOT EXISTS request_tags (
+    request_id TEXT NOT NULL,
+    tag TEXT NOT NULL CHECK (tag <> ''),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (request_id, tag),
+    FOREIGN KEY (request_id) REFERENCES request(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_request_tags_tag ON request_tags(tag);
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_request_tags_tag;
+DROP TABLE IF EXISTS request_tags;
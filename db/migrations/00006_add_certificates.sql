@@ -0,0 +1,12 @@
+-- +goose Up
+
+CREATE TABLE IF NOT EXISTS certificates (
+    host TEXT PRIMARY KEY,
+    cert_pem TEXT NOT NULL,
+    key_pem TEXT NOT NULL,
+    not_after DATETIME NOT NULL
+);
+
+-- +goose Down
+
+DROP TABLE IF EXISTS certificates;
@@ -0,0 +1,10 @@
+-- +goose Up
+
+CREATE TABLE IF NOT EXISTS config (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+
+-- +goose Down
+
+DROP TABLE IF EXISTS config;
@@ -0,0 +1,7 @@
+-- +goose Up
+
+ALTER TABLE launchpad ADD COLUMN variables TEXT;
+
+-- +goose Down
+
+ALTER TABLE launchpad DROP COLUMN variables;
@@ -0,0 +1,13 @@
+-- +goose Up
+
+ALTER TABLE launchpad_request ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0;
+
+-- Existing requests keep the order they were linked in
+UPDATE launchpad_request SET sequence = (
+    SELECT COUNT(*) FROM launchpad_request lr
+    WHERE lr.launchpad_id = launchpad_request.launchpad_id AND lr.rowid < launchpad_request.rowid
+);
+
+-- +goose Down
+
+ALTER TABLE launchpad_request DROP COLUMN sequence;
@@ -0,0 +1,7 @@
+-- +goose Up
+
+ALTER TABLE request ADD COLUMN upstream_addr TEXT;
+
+-- +goose Down
+
+ALTER TABLE request DROP COLUMN upstream_addr;
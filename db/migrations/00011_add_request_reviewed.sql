@@ -0,0 +1,7 @@
+-- +goose Up
+
+ALTER TABLE request ADD COLUMN reviewed BOOLEAN NOT NULL DEFAULT 0;
+
+-- +goose Down
+
+ALTER TABLE request DROP COLUMN reviewed;
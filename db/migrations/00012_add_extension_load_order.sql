@@ -0,0 +1,12 @@
+-- +goose Up
+
+ALTER TABLE extensions ADD COLUMN load_order INTEGER NOT NULL DEFAULT 0;
+
+-- Existing extensions keep the order they were loaded in
+UPDATE extensions SET load_order = (
+    SELECT COUNT(*) FROM extensions e WHERE e.id < extensions.id
+);
+
+-- +goose Down
+
+ALTER TABLE extensions DROP COLUMN load_order;
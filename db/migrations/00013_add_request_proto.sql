@@ -0,0 +1,7 @@
+-- +goose Up
+
+ALTER TABLE request ADD COLUMN proto TEXT;
+
+-- +goose Down
+
+ALTER TABLE request DROP COLUMN proto;
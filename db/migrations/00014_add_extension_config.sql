@@ -0,0 +1,10 @@
+-- +goose Up
+
+CREATE TABLE IF NOT EXISTS extension_config (
+    extension_id TEXT PRIMARY KEY,
+    config JSON NOT NULL DEFAULT '{}'
+);
+
+-- +goose Down
+
+DROP TABLE IF EXISTS extension_config;
@@ -0,0 +1,56 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Logs written while a request is processed can reach the database before the request
+-- or belong to a request that is never stored (skipped or dropped), so request_id is no longer a foreign key.
+CREATE TABLE logs_new (
+    id TEXT PRIMARY KEY,
+    timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+    level TEXT NOT NULL CHECK (level IN ('DEBUG', 'INFO', 'WARN', 'ERROR', 'FATAL')),
+    message TEXT NOT NULL,
+    context JSON DEFAULT '{}',
+    request_id TEXT,
+    extension_id TEXT,
+    FOREIGN KEY (extension_id) REFERENCES extensions(id) ON DELETE CASCADE
+);
+
+INSERT INTO logs_new (id, timestamp, level, message, context, request_id, extension_id)
+SELECT id, timestamp, level, message, context, request_id, extension_id FROM logs;
+
+DROP TABLE logs;
+ALTER TABLE logs_new RENAME TO logs;
+
+CREATE INDEX IF NOT EXISTS idx_logs_request_id ON logs(request_id);
+
+-- Trigger replacing the ON DELETE CASCADE of the dropped foreign key
+CREATE TRIGGER IF NOT EXISTS request_deleted_logs
+AFTER DELETE ON request
+FOR EACH ROW
+BEGIN
+    DELETE FROM logs WHERE request_id = OLD.id;
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS request_deleted_logs;
+DROP INDEX IF EXISTS idx_logs_request_id;
+
+CREATE TABLE logs_old (
+    id TEXT PRIMARY KEY,
+    timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+    level TEXT NOT NULL CHECK (level IN ('DEBUG', 'INFO', 'WARN', 'ERROR', 'FATAL')),
+    message TEXT NOT NULL,
+    context JSON DEFAULT '{}',
+    request_id TEXT,
+    extension_id TEXT,
+    FOREIGN KEY (request_id) REFERENCES request(id) ON DELETE CASCADE,
+    FOREIGN KEY (extension_id) REFERENCES extensions(id) ON DELETE CASCADE
+);
+
+INSERT INTO logs_old (id, timestamp, level, message, context, request_id, extension_id)
+SELECT id, timestamp, level, message, context, request_id, extension_id FROM logs
+WHERE request_id IS NULL OR request_id IN (SELECT id FROM request);
+
+DROP TABLE logs;
+ALTER TABLE logs_old RENAME TO logs;
+-- +goose StatementEnd
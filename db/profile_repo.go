@@ -0,0 +1,166 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tfkr-ae/marasi/domain"
+)
+
+var _ domain.ProfileRepository = (*Repository)(nil)
+
+// ExportProfile implements the domain.ProfileRepository interface.
+// It reads the waypoints, the extensions in their load order and the configuration keys.
+func (repo *Repository) ExportProfile() (*domain.Profile, error) {
+	profile := &domain.Profile{
+		Version:    domain.ProfileVersion,
+		Waypoints:  []domain.ProfileWaypoint{},
+		Extensions: []domain.ProfileExtension{},
+		Config:     map[string]string{},
+	}
+
+	waypoints, err := repo.GetWaypoints()
+	if err != nil {
+		return nil, fmt.Errorf("exporting waypoints: %w", err)
+	}
+	for _, waypoint := range waypoints {
+		profile.Waypoints = append(profile.Waypoints, domain.ProfileWaypoint{
+			Hostname: waypoint.Hostname,
+			Override: waypoint.Override,
+		})
+	}
+
+	extensions, err := repo.GetExtensions()
+	if err != nil {
+		return nil, fmt.Errorf("exporting extensions: %w", err)
+	}
+	for _, extension := range extensions {
+		profile.Extensions = append(profile.Extensions, domain.ProfileExtension{
+			ID:          extension.ID,
+			Name:        extension.Name,
+			SourceURL:   extension.SourceURL,
+			Author:      extension.Author,
+			Description: extension.Description,
+			Enabled:     extension.Enabled,
+			Settings:    extension.Settings,
+			LuaContent:  extension.LuaContent,
+		})
+	}
+
+	var config []struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	err = repo.dbConn.Select(&config, `SELECT key, value FROM config ORDER BY key`)
+	if err != nil {
+		return nil, fmt.Errorf("exporting config: %w", err)
+	}
+	for _, entry := range config {
+		profile.Config[entry.Key] = entry.Value
+	}
+
+	return profile, nil
+}
+
+// ImportProfile implements the domain.ProfileRepository interface.
+// The waypoint and config tables are replaced and the extensions are upserted by name in a single transaction.
+func (repo *Repository) ImportProfile(profile *domain.Profile) error {
+	if profile.Version != domain.ProfileVersion {
+		return fmt.Errorf("unsupported profile version %d", profile.Version)
+	}
+
+	tx, err := repo.dbConn.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM waypoint`); err != nil {
+		return fmt.Errorf("clearing waypoints: %w", err)
+	}
+	for _, waypoint := range profile.Waypoints {
+		_, err := tx.Exec(`INSERT INTO waypoint (hostname, override) VALUES (?, ?)`, waypoint.Hostname, waypoint.Override)
+		if err != nil {
+			return fmt.Errorf("importing waypoint %s: %w", waypoint.Hostname, err)
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM config`); err != nil {
+		return fmt.Errorf("clearing config: %w", err)
+	}
+	for key, value := range profile.Config {
+		if _, err := tx.Exec(`INSERT INTO config (key, value) VALUES (?, ?)`, key, value); err != nil {
+			return fmt.Errorf("importing config key %s: %w", key, err)
+		}
+	}
+
+	profileNames := make(map[string]int, len(profile.Extensions))
+	for i, extension := range profile.Extensions {
+		if _, exists := profileNames[extension.Name]; exists {
+			return fmt.Errorf("extension %s is listed more than once", extension.Name)
+		}
+		profileNames[extension.Name] = i
+
+		id := extension.ID
+		if id == uuid.Nil {
+			id, err = uuid.NewV7()
+			if err != nil {
+				return fmt.Errorf("generating uuid for extension %s: %w", extension.Name, err)
+			}
+		}
+		settings := Metadata(extension.Settings)
+		if settings == nil {
+			settings = Metadata{}
+		}
+
+		query := `INSERT INTO extensions (id, name, source_url, author, lua_content, update_at, enabled, description, settings)
+                  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+                  ON CONFLICT(name) DO UPDATE SET
+                      source_url = excluded.source_url,
+                      author = excluded.author,
+                      lua_content = excluded.lua_content,
+                      update_at = excluded.update_at,
+                      enabled = excluded.enabled,
+                      description = excluded.description,
+                      settings = excluded.settings`
+		_, err := tx.Exec(query, id, extension.Name, extension.SourceURL, extension.Author, extension.LuaContent,
+			time.Now(), extension.Enabled, extension.Description, settings)
+		if err != nil {
+			return fmt.Errorf("importing extension %s: %w", extension.Name, err)
+		}
+	}
+
+	// The extensions of the profile are loaded first in the profile order, the others keep their order after them
+	var current []struct {
+		ID   uuid.UUID `db:"id"`
+		Name string    `db:"name"`
+	}
+	err = tx.Select(&current, `SELECT id, name FROM extensions ORDER BY load_order ASC, id ASC`)
+	if err != nil {
+		return fmt.Errorf("getting extensions: %w", err)
+	}
+
+	order := make([]uuid.UUID, len(profile.Extensions), len(current))
+	for _, extension := range current {
+		if i, ok := profileNames[extension.Name]; ok {
+			order[i] = extension.ID
+		} else {
+			order = append(order, extension.ID)
+		}
+	}
+
+	stmt, err := tx.Preparex(`UPDATE extensions SET load_order = ? WHERE id = ?`)
+	if err != nil {
+		return fmt.Errorf("preparing order statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for loadOrder, id := range order {
+		if _, err := stmt.Exec(loadOrder, id); err != nil {
+			return fmt.Errorf("setting load order of extension %s: %w", id, err)
+		}
+	}
+
+	return tx.Commit()
+}
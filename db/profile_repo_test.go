@@ -0,0 +1,121 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tfkr-ae/marasi/domain"
+)
+
+func TestProfileRepo_RoundTrip(t *testing.T) {
+	source, teardownSource := setupTestDB(t)
+	defer teardownSource()
+
+	if err := source.CreateOrUpdateWaypoint("marasi.app:443", "127.0.0.1:8443"); err != nil {
+		t.Fatalf("creating waypoint : %v", err)
+	}
+	if err := source.Set("theme", "dark"); err != nil {
+		t.Fatalf("setting config key : %v", err)
+	}
+	custom := &domain.Extension{
+		ID:          uuid.MustParse("0193802f-f0e7-73d9-a764-06d21e367809"),
+		Name:        "custom",
+		Author:      "marasi",
+		Description: "custom extension",
+		LuaContent:  `function processRequest(req) end`,
+		Enabled:     true,
+		Settings:    map[string]any{"threshold": 5.0},
+	}
+	if err := source.UpsertExtension(custom); err != nil {
+		t.Fatalf("creating extension : %v", err)
+	}
+	extensions, err := source.GetExtensions()
+	if err != nil {
+		t.Fatalf("getting extensions : %v", err)
+	}
+	ids := []uuid.UUID{custom.ID}
+	for _, extension := range extensions {
+		if extension.ID != custom.ID {
+			ids = append(ids, extension.ID)
+		}
+	}
+	if err := source.SetExtensionOrder(ids); err != nil {
+		t.Fatalf("ordering extensions : %v", err)
+	}
+
+	exported, err := source.ExportProfile()
+	if err != nil {
+		t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+	}
+
+	destination, teardownDestination := setupTestDB(t)
+	defer teardownDestination()
+
+	if err := destination.CreateOrUpdateWaypoint("stale.marasi.app:80", "127.0.0.1:80"); err != nil {
+		t.Fatalf("creating waypoint : %v", err)
+	}
+	if err := destination.Set("stale", "value"); err != nil {
+		t.Fatalf("setting config key : %v", err)
+	}
+
+	if err := destination.ImportProfile(exported); err != nil {
+		t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+	}
+
+	imported, err := destination.ExportProfile()
+	if err != nil {
+		t.Fatalf("exporting imported profile : %v", err)
+	}
+
+	if !reflect.DeepEqual(exported, imported) {
+		t.Fatalf("\nwanted:\n%+v\ngot:\n%+v", exported, imported)
+	}
+
+	if imported.Extensions[0].Name != "custom" {
+		t.Fatalf("\nwanted:\ncustom loaded first\ngot:\n%s", imported.Extensions[0].Name)
+	}
+}
+
+func TestProfileRepo_ImportProfile(t *testing.T) {
+	t.Run("should reject an unsupported version", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		err := repo.ImportProfile(&domain.Profile{Version: domain.ProfileVersion + 1})
+		if err == nil || !strings.Contains(err.Error(), "unsupported profile version") {
+			t.Fatalf("\nwanted:\nunsupported profile version\ngot:\n%v", err)
+		}
+	})
+
+	t.Run("should not change anything if the import fails", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		if err := repo.CreateOrUpdateWaypoint("marasi.app:443", "127.0.0.1:8443"); err != nil {
+			t.Fatalf("creating waypoint : %v", err)
+		}
+
+		profile := &domain.Profile{
+			Version:   domain.ProfileVersion,
+			Waypoints: []domain.ProfileWaypoint{{Hostname: "other.marasi.app:443", Override: "127.0.0.1:9443"}},
+			Extensions: []domain.ProfileExtension{
+				{Name: "duplicate", LuaContent: ""},
+				{Name: "duplicate", LuaContent: ""},
+			},
+		}
+		if err := repo.ImportProfile(profile); err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+
+		waypoints, err := repo.GetWaypoints()
+		if err != nil {
+			t.Fatalf("getting waypoints : %v", err)
+		}
+		want := []*domain.Waypoint{{Hostname: "marasi.app:443", Override: "127.0.0.1:8443"}}
+		if !reflect.DeepEqual(want, waypoints) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, waypoints)
+		}
+	})
+}
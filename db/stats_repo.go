@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/tfkr-ae/marasi/domain"
 )
@@ -61,3 +62,97 @@ func (repo *Repository) CountIntercepted() (int, error) {
 
 	return count, nil
 }
+
+// TotalBytes returns the total size in bytes of the stored raw requests and responses.
+func (repo *Repository) TotalBytes() (int64, error) {
+	var total int64
+	query := `SELECT COALESCE(SUM(request_raw_length + response_raw_length), 0) FROM request`
+
+	err := repo.dbConn.Get(&total, query)
+	if err != nil {
+		return 0, fmt.Errorf("getting total bytes: %w", err)
+	}
+
+	return total, nil
+}
+
+// requestedAtUnix is the SQL expression for requested_at in seconds since the Unix epoch. requested_at is stored in the format of
+// time.Time.String ("2006-01-02 15:04:05.999999999 -0700 MST") which SQLite's date functions can't parse, so only the date and time are
+// parsed and the fraction and the zone offset that follow are added separately.
+const requestedAtUnix = `(unixepoch(substr(requested_at, 1, 19))
+	+ CAST(substr(requested_at, 20, instr(substr(requested_at, 20), ' ') - 1) AS REAL)
+	- (CASE substr(requested_at, instr(substr(requested_at, 20), ' ') + 20, 1) WHEN '-' THEN -1 ELSE 1 END)
+	* (CAST(substr(requested_at, instr(substr(requested_at, 20), ' ') + 21, 2) AS INTEGER) * 3600
+	+ CAST(substr(requested_at, instr(substr(requested_at, 20), ' ') + 23, 2) AS INTEGER) * 60))`
+
+// unixSeconds returns t in seconds since the Unix epoch, as compared with requestedAtUnix
+func unixSeconds(t time.Time) float64 {
+	return float64(t.Unix()) + float64(t.Nanosecond())/float64(time.Second)
+}
+
+// Timeline returns the number of requests in contiguous buckets of the given size, starting at since and ending at the current time.
+// The requests are filtered and counted per bucket by SQLite, it returns an error when more than domain.MaxTimelineBuckets buckets are needed.
+func (repo *Repository) Timeline(bucket time.Duration, since time.Time) ([]domain.TimeBucket, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("bucket size must be positive, got %s", bucket)
+	}
+
+	elapsed := time.Since(since)
+	if elapsed < 0 {
+		return []domain.TimeBucket{}, nil
+	}
+	if buckets := elapsed / bucket; buckets >= domain.MaxTimelineBuckets {
+		return nil, fmt.Errorf("timeline of %s in buckets of %s exceeds %d buckets", elapsed, bucket, domain.MaxTimelineBuckets)
+	}
+
+	timeline := make([]domain.TimeBucket, int(elapsed/bucket)+1)
+	for i := range timeline {
+		timeline[i].Start = since.Add(time.Duration(i) * bucket)
+	}
+
+	var rows []struct {
+		Index int `db:"idx"`
+		Count int `db:"count"`
+	}
+	query := `SELECT CAST((requested_at_unix - ?) / ? AS INTEGER) AS idx, COUNT(*) AS count
+              FROM (SELECT ` + requestedAtUnix + ` AS requested_at_unix FROM request)
+              WHERE requested_at_unix >= ?
+              GROUP BY idx`
+
+	err := repo.dbConn.Select(&rows, query, unixSeconds(since), bucket.Seconds(), unixSeconds(since))
+	if err != nil {
+		return nil, fmt.Errorf("getting request timeline: %w", err)
+	}
+
+	for _, row := range rows {
+		if row.Index < len(timeline) {
+			timeline[row.Index].Count += row.Count
+		}
+	}
+
+	return timeline, nil
+}
+
+// MethodCounts returns the number of requests made at or after since grouped by HTTP method.
+func (repo *Repository) MethodCounts(since time.Time) (map[string]int, error) {
+	var rows []struct {
+		Method string `db:"method"`
+		Count  int    `db:"count"`
+	}
+	query := `SELECT method, COUNT(*) AS count
+              FROM request
+              WHERE ` + requestedAtUnix + ` >= ?
+              GROUP BY method`
+
+	err := repo.dbConn.Select(&rows, query, unixSeconds(since))
+	if err != nil {
+		return nil, fmt.Errorf("getting request methods: %w", err)
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Method] = row.Count
+	}
+
+	return counts, nil
+}
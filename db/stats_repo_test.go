@@ -2,6 +2,10 @@ package db
 
 import (
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tfkr-ae/marasi/domain"
 )
 
 func TestStatsRepo_CountRows(t *testing.T) {
@@ -165,3 +169,268 @@ func TestStatsRepo_CountIntercepted(t *testing.T) {
 		}
 	})
 }
+
+func TestStatsRepo_TotalBytes(t *testing.T) {
+	t.Run("should return 0 when no requests exist", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		got, err := repo.TotalBytes()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if got != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", got)
+		}
+	})
+
+	t.Run("should sum the raw request and response lengths", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, nil)
+		resp := insertTestResponseAndGet(t, repo, reqID, nil)
+		testRequest(t, repo, nil)
+
+		req, err := repo.GetRequestResponseRow(reqID)
+		if err != nil {
+			t.Fatalf("fetching request row: %v", err)
+		}
+
+		if req.Request.RawLength != int64(len(req.Request.Raw)) {
+			t.Fatalf("\nwanted:\n%d\ngot:\n%d", len(req.Request.Raw), req.Request.RawLength)
+		}
+		if req.Response.RawLength != int64(len(resp.Raw)) {
+			t.Fatalf("\nwanted:\n%d\ngot:\n%d", len(resp.Raw), req.Response.RawLength)
+		}
+
+		want := 2*req.Request.RawLength + req.Response.RawLength
+		got, err := repo.TotalBytes()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if got != want {
+			t.Fatalf("\nwanted:\n%d\ngot:\n%d", want, got)
+		}
+	})
+}
+
+func TestStatsRepo_Timeline(t *testing.T) {
+	insertRequestAt := func(t *testing.T, repo *Repository, requestedAt time.Time) {
+		t.Helper()
+		id, err := uuid.NewV7()
+		if err != nil {
+			t.Fatalf("creating uuid: %v", err)
+		}
+
+		err = repo.InsertRequest(&domain.ProxyRequest{
+			ID:          id,
+			Scheme:      "https",
+			Method:      "GET",
+			Host:        "marasi.app",
+			Path:        "/",
+			Raw:         []byte("GET / HTTP/1.1\r\nHost: marasi.app\r\n\r\n"),
+			Metadata:    make(map[string]any),
+			RequestedAt: requestedAt,
+		})
+		if err != nil {
+			t.Fatalf("inserting request: %v", err)
+		}
+	}
+
+	t.Run("should group requests into buckets and zero fill empty buckets", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		since := time.Now().Add(-150 * time.Minute)
+		insertRequestAt(t, repo, since.Add(-10*time.Minute))
+		insertRequestAt(t, repo, since.Add(10*time.Minute))
+		insertRequestAt(t, repo, since.Add(20*time.Minute))
+		insertRequestAt(t, repo, since.Add(130*time.Minute))
+
+		got, err := repo.Timeline(time.Hour, since)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := []int{2, 0, 1}
+		if len(got) != len(want) {
+			t.Fatalf("\nwanted:\n%d buckets\ngot:\n%d", len(want), len(got))
+		}
+
+		for i, bucket := range got {
+			if bucket.Count != want[i] {
+				t.Errorf("bucket %d\nwanted:\n%d\ngot:\n%d", i, want[i], bucket.Count)
+			}
+
+			wantStart := since.Add(time.Duration(i) * time.Hour)
+			if !bucket.Start.Equal(wantStart) {
+				t.Errorf("bucket %d\nwanted:\n%v\ngot:\n%v", i, wantStart, bucket.Start)
+			}
+		}
+	})
+
+	t.Run("should return zero filled buckets when there are no requests", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		got, err := repo.Timeline(time.Minute, time.Now().Add(-90*time.Second))
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(got) != 2 {
+			t.Fatalf("\nwanted:\n2 buckets\ngot:\n%d", len(got))
+		}
+		for i, bucket := range got {
+			if bucket.Count != 0 {
+				t.Errorf("bucket %d\nwanted:\n0\ngot:\n%d", i, bucket.Count)
+			}
+		}
+	})
+
+	t.Run("should return an error for a non-positive bucket size", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		_, err := repo.Timeline(0, time.Now())
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+
+	t.Run("should return an error when the timeline needs too many buckets", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		tests := []struct {
+			name   string
+			bucket time.Duration
+			since  time.Time
+		}{
+			{name: "zero since", bucket: time.Hour, since: time.Time{}},
+			{name: "nanosecond bucket", bucket: time.Nanosecond, since: time.Now().Add(-time.Minute)},
+		}
+		for _, tt := range tests {
+			if _, err := repo.Timeline(tt.bucket, tt.since); err == nil {
+				t.Errorf("%s\nwanted:\nerror\ngot:\nnil", tt.name)
+			}
+		}
+	})
+
+	t.Run("should compare requests stored in other time zones by their instant", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		since := time.Now().Add(-90 * time.Minute)
+		dubai := time.FixedZone("GST", 4*60*60)
+		newYork := time.FixedZone("EST", -5*60*60)
+		insertRequestAt(t, repo, since.Add(-time.Minute).In(dubai))
+		insertRequestAt(t, repo, since.Add(time.Minute).In(dubai))
+		insertRequestAt(t, repo, since.Add(61*time.Minute).In(newYork))
+		insertRequestAt(t, repo, since.Add(-time.Minute).In(newYork))
+
+		got, err := repo.Timeline(time.Hour, since)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := []int{1, 1}
+		if len(got) != len(want) {
+			t.Fatalf("\nwanted:\n%d buckets\ngot:\n%d", len(want), len(got))
+		}
+		for i, bucket := range got {
+			if bucket.Count != want[i] {
+				t.Errorf("bucket %d\nwanted:\n%d\ngot:\n%d", i, want[i], bucket.Count)
+			}
+		}
+	})
+}
+
+func TestStatsRepo_MethodCounts(t *testing.T) {
+	insertRequestAt := func(t *testing.T, repo *Repository, method string, requestedAt time.Time) {
+		t.Helper()
+		id, err := uuid.NewV7()
+		if err != nil {
+			t.Fatalf("creating uuid: %v", err)
+		}
+
+		err = repo.InsertRequest(&domain.ProxyRequest{
+			ID:          id,
+			Scheme:      "https",
+			Method:      method,
+			Host:        "marasi.app",
+			Path:        "/",
+			Raw:         []byte(method + " / HTTP/1.1\r\nHost: marasi.app\r\n\r\n"),
+			Metadata:    make(map[string]any),
+			RequestedAt: requestedAt,
+		})
+		if err != nil {
+			t.Fatalf("inserting request: %v", err)
+		}
+	}
+
+	t.Run("should group requests made since the given time by method", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		since := time.Now().Add(-time.Hour)
+		insertRequestAt(t, repo, "GET", since.Add(-time.Minute))
+		insertRequestAt(t, repo, "GET", since.Add(time.Minute))
+		insertRequestAt(t, repo, "GET", since.Add(2*time.Minute))
+		insertRequestAt(t, repo, "POST", since.Add(3*time.Minute))
+		insertRequestAt(t, repo, "TRACE", since.Add(4*time.Minute))
+		insertRequestAt(t, repo, "PATCH", since.Add(-2*time.Minute))
+
+		got, err := repo.MethodCounts(since)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := map[string]int{"GET": 2, "POST": 1, "TRACE": 1}
+		if len(got) != len(want) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+		for method, count := range want {
+			if got[method] != count {
+				t.Errorf("method %s\nwanted:\n%d\ngot:\n%d", method, count, got[method])
+			}
+		}
+	})
+
+	t.Run("should compare sub-second timestamps", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		since := time.Now().Add(-time.Hour).Truncate(time.Second).Add(500 * time.Millisecond)
+		insertRequestAt(t, repo, "GET", since.Add(-time.Millisecond))
+		insertRequestAt(t, repo, "GET", since)
+		insertRequestAt(t, repo, "POST", since.Add(time.Millisecond))
+
+		got, err := repo.MethodCounts(since)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := map[string]int{"GET": 1, "POST": 1}
+		if len(got) != len(want) || got["GET"] != want["GET"] || got["POST"] != want["POST"] {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("should return an empty map when there are no requests", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		got, err := repo.MethodCounts(time.Time{})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(got) != 0 {
+			t.Fatalf("\nwanted:\nempty map\ngot:\n%v", got)
+		}
+	})
+}
@@ -2,6 +2,8 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -17,26 +19,31 @@ var _ domain.TrafficRepository = (*Repository)(nil)
 // and combines both request and response data into a single struct for database operations.
 type dbRequestResponse struct {
 	// Request
-	ID          uuid.UUID `db:"id"`
-	Scheme      string    `db:"scheme"`
-	Method      string    `db:"method"`
-	Host        string    `db:"host"`
-	Path        string    `db:"path"`
-	RequestRaw  []byte    `db:"request_raw"`
-	RequestedAt time.Time `db:"requested_at"`
+	ID               uuid.UUID      `db:"id"`
+	Scheme           string         `db:"scheme"`
+	Method           string         `db:"method"`
+	Host             string         `db:"host"`
+	Path             string         `db:"path"`
+	Proto            sql.NullString `db:"proto"`
+	RequestRaw       []byte         `db:"request_raw"`
+	RequestRawLength int64          `db:"request_raw_length"`
+	RequestedAt      time.Time      `db:"requested_at"`
 
 	// Response
 	// TODO: DB will set default values for these columns so they will not be "null". Need to revist and either remove that DB restriction / keep these as normal fields
-	Status      sql.NullString `db:"status"`
-	StatusCode  sql.NullInt64  `db:"status_code"`
-	ResponseRaw []byte         `db:"response_raw"`
-	ContentType sql.NullString `db:"content_type"`
-	Length      sql.NullString `db:"length"`
-	RespondedAt sql.NullTime   `db:"responded_at"`
+	Status            sql.NullString `db:"status"`
+	StatusCode        sql.NullInt64  `db:"status_code"`
+	ResponseRaw       []byte         `db:"response_raw"`
+	ResponseRawLength int64          `db:"response_raw_length"`
+	ContentType       sql.NullString `db:"content_type"`
+	Length            sql.NullString `db:"length"`
+	RespondedAt       sql.NullTime   `db:"responded_at"`
+	UpstreamAddr      sql.NullString `db:"upstream_addr"`
 
 	// Common
 	Metadata Metadata       `db:"metadata"`
 	Note     sql.NullString `db:"note"`
+	Reviewed bool           `db:"reviewed"`
 }
 
 // dbRequestResponseSummary represents a summarized version of a request and response entry
@@ -60,19 +67,25 @@ type dbRequestResponseSummary struct {
 
 	// Common
 	Metadata Metadata `db:"metadata"`
+	Reviewed bool     `db:"reviewed"`
 }
 
 // fromDomainProxyRequest converts a domain.ProxyRequest into a dbRequestResponse for database insertion.
 func fromDomainProxyRequest(preq *domain.ProxyRequest) *dbRequestResponse {
 	return &dbRequestResponse{
-		ID:          preq.ID,
-		Scheme:      preq.Scheme,
-		Method:      preq.Method,
-		Host:        preq.Host,
-		Path:        preq.Path,
-		RequestRaw:  preq.Raw,
-		RequestedAt: preq.RequestedAt,
-		Metadata:    Metadata(preq.Metadata),
+		ID:               preq.ID,
+		Scheme:           preq.Scheme,
+		Method:           preq.Method,
+		Host:             preq.Host,
+		Path:             preq.Path,
+		RequestRaw:       preq.Raw,
+		RequestRawLength: preq.RawLength,
+		RequestedAt:      preq.RequestedAt,
+		Metadata:         Metadata(preq.Metadata),
+		Proto: sql.NullString{
+			String: preq.Proto,
+			Valid:  preq.Proto != "",
+		},
 	}
 }
 
@@ -84,7 +97,9 @@ func toDomainProxyRequest(dbReqRes *dbRequestResponse) *domain.ProxyRequest {
 		Method:      dbReqRes.Method,
 		Host:        dbReqRes.Host,
 		Path:        dbReqRes.Path,
+		Proto:       dbReqRes.Proto.String,
 		Raw:         dbReqRes.RequestRaw,
+		RawLength:   dbReqRes.RequestRawLength,
 		RequestedAt: dbReqRes.RequestedAt,
 		Metadata:    map[string]any(dbReqRes.Metadata),
 	}
@@ -103,7 +118,8 @@ func fromDomainProxyResponse(presp *domain.ProxyResponse) *dbRequestResponse {
 			Int64: int64(presp.StatusCode),
 			Valid: presp.StatusCode > 0,
 		},
-		ResponseRaw: presp.Raw,
+		ResponseRaw:       presp.Raw,
+		ResponseRawLength: presp.RawLength,
 		ContentType: sql.NullString{
 			String: presp.ContentType,
 			Valid:  presp.ContentType != "",
@@ -116,6 +132,10 @@ func fromDomainProxyResponse(presp *domain.ProxyResponse) *dbRequestResponse {
 			Time:  presp.RespondedAt,
 			Valid: !presp.RespondedAt.IsZero(),
 		},
+		UpstreamAddr: sql.NullString{
+			String: presp.UpstreamAddr,
+			Valid:  presp.UpstreamAddr != "",
+		},
 		Metadata: Metadata(presp.Metadata),
 	}
 }
@@ -124,9 +144,10 @@ func fromDomainProxyResponse(presp *domain.ProxyResponse) *dbRequestResponse {
 // It safely extracts values from sql.Null* types.
 func toDomainProxyResponse(dbReqRes *dbRequestResponse) *domain.ProxyResponse {
 	resp := &domain.ProxyResponse{
-		ID:       dbReqRes.ID,
-		Raw:      dbReqRes.ResponseRaw,
-		Metadata: map[string]any(dbReqRes.Metadata),
+		ID:        dbReqRes.ID,
+		Raw:       dbReqRes.ResponseRaw,
+		RawLength: dbReqRes.ResponseRawLength,
+		Metadata:  map[string]any(dbReqRes.Metadata),
 	}
 
 	if dbReqRes.Status.Valid {
@@ -148,6 +169,10 @@ func toDomainProxyResponse(dbReqRes *dbRequestResponse) *domain.ProxyResponse {
 	if dbReqRes.RespondedAt.Valid {
 		resp.RespondedAt = dbReqRes.RespondedAt.Time
 	}
+
+	if dbReqRes.UpstreamAddr.Valid {
+		resp.UpstreamAddr = dbReqRes.UpstreamAddr.String
+	}
 	return resp
 }
 
@@ -181,6 +206,7 @@ func toDomainRequestResponseSummary(dbSummary *dbRequestResponseSummary) *domain
 		Path:        dbSummary.Path,
 		RequestedAt: dbSummary.RequestedAt,
 		Metadata:    map[string]any(dbSummary.Metadata),
+		Reviewed:    dbSummary.Reviewed,
 	}
 
 	if dbSummary.Status.Valid {
@@ -208,10 +234,15 @@ func toDomainRequestResponseSummary(dbSummary *dbRequestResponseSummary) *domain
 
 // InsertRequest inserts a new domain.ProxyRequest into the database.
 func (repo *Repository) InsertRequest(req *domain.ProxyRequest) error {
+	return insertRequest(repo.dbConn, req)
+}
+
+// insertRequest inserts a new domain.ProxyRequest with exec.
+func insertRequest(exec execer, req *domain.ProxyRequest) error {
 	dbRequest := fromDomainProxyRequest(req)
-	query := `INSERT INTO request(id, scheme, method, host, path, request_raw, requested_at, metadata)
-			  VALUES(:id, :scheme, :method, :host, :path, :request_raw, :requested_at, :metadata)`
-	_, err := repo.dbConn.NamedExec(query, dbRequest)
+	query := `INSERT INTO request(id, scheme, method, host, path, proto, request_raw, request_raw_length, requested_at, metadata)
+			  VALUES(:id, :scheme, :method, :host, :path, :proto, :request_raw, :request_raw_length, :requested_at, :metadata)`
+	_, err := exec.NamedExec(query, dbRequest)
 	if err != nil {
 		return fmt.Errorf("inserting request %d : %w", req.ID, err)
 	}
@@ -221,17 +252,24 @@ func (repo *Repository) InsertRequest(req *domain.ProxyRequest) error {
 // InsertResponse updates an existing request entry with response details.
 // It expects a domain.ProxyResponse and uses its ID to locate and update the corresponding row.
 func (repo *Repository) InsertResponse(resp *domain.ProxyResponse) error {
+	return insertResponse(repo.dbConn, resp)
+}
+
+// insertResponse updates the request entry of resp with exec.
+func insertResponse(exec execer, resp *domain.ProxyResponse) error {
 	dbResponse := fromDomainProxyResponse(resp)
 	query := `UPDATE request SET
 				status = :status,
 				status_code = :status_code,
 				response_raw = :response_raw,
+				response_raw_length = :response_raw_length,
 				content_type = :content_type,
 				length = :length,
 				responded_at = :responded_at,
+				upstream_addr = :upstream_addr,
 				metadata = :metadata
 			  WHERE id = :id`
-	result, err := repo.dbConn.NamedExec(query, dbResponse)
+	result, err := exec.NamedExec(query, dbResponse)
 	if err != nil {
 		return fmt.Errorf("inserting request %d : %w", resp.ID, err)
 	}
@@ -251,7 +289,7 @@ func (repo *Repository) InsertResponse(resp *domain.ProxyResponse) error {
 // It returns a domain.ProxyResponse or an error if the ID is not found.
 func (repo *Repository) GetResponse(id uuid.UUID) (*domain.ProxyResponse, error) {
 	var dbRow dbRequestResponse
-	query := `SELECT id, status, status_code, response_raw, content_type, length, responded_at, metadata
+	query := `SELECT id, status, status_code, response_raw, response_raw_length, content_type, length, responded_at, upstream_addr, metadata
 		      FROM request
 			  WHERE id = ?`
 
@@ -263,14 +301,38 @@ func (repo *Repository) GetResponse(id uuid.UUID) (*domain.ProxyResponse, error)
 	return toDomainProxyResponse(&dbRow), nil
 }
 
+// GetRawRequest retrieves the stored raw request bytes for the given request ID without re-serializing them.
+func (repo *Repository) GetRawRequest(id uuid.UUID) ([]byte, error) {
+	var raw []byte
+	query := `SELECT request_raw FROM request WHERE id = ?`
+
+	err := repo.dbConn.Get(&raw, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("getting raw request with id %s : %w", id, err)
+	}
+	return raw, nil
+}
+
+// GetRawResponse retrieves the stored raw response bytes for the given request ID without re-serializing them.
+func (repo *Repository) GetRawResponse(id uuid.UUID) ([]byte, error) {
+	var raw []byte
+	query := `SELECT COALESCE(response_raw, '') FROM request WHERE id = ?`
+
+	err := repo.dbConn.Get(&raw, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("getting raw response with id %s : %w", id, err)
+	}
+	return raw, nil
+}
+
 // GetRequestResponseRow retrieves a complete request-response pair, including any associated note,
 // for a given request ID. It returns a domain.RequestResponseRow.
 func (repo *Repository) GetRequestResponseRow(id uuid.UUID) (*domain.RequestResponseRow, error) {
 	var dbRow dbRequestResponse
 	query := `SELECT
-			  r.id, r.scheme, r.method, r.host, r.path, r.request_raw, r.requested_at,
-			  r.status, r.status_code, r.response_raw, r.content_type, r.length, r.responded_at,
-			  r.metadata, n.note
+			  r.id, r.scheme, r.method, r.host, r.path, r.proto, r.request_raw, r.request_raw_length, r.requested_at,
+			  r.status, r.status_code, r.response_raw, r.response_raw_length, r.content_type, r.length, r.responded_at,
+			  r.upstream_addr, r.metadata, n.note
 			  FROM request r
 			  LEFT JOIN notes n ON r.id = n.request_id
 			  WHERE r.id = ?`
@@ -289,7 +351,7 @@ func (repo *Repository) GetRequestResponseSummary() ([]*domain.RequestResponseSu
 	var dbSummary []*dbRequestResponseSummary
 	query := `SELECT
 			  id, scheme, method, host, path, requested_at,
-			  status, status_code, content_type, length, responded_at,
+			  status, status_code, content_type, length, responded_at, reviewed,
 			  json_remove(metadata, '$.prettified-request', '$.prettified-response') AS metadata
 			  FROM request
 			  ORDER BY id ASC`
@@ -333,9 +395,39 @@ func (repo *Repository) UpdateMetadata(metadata map[string]any, ids ...uuid.UUID
 	return nil
 }
 
+// MergeMetadata merges the metadata into the stored metadata of the request identified by requestID.
+// The merge is done by SQLite's json_patch, so existing keys are preserved and keys with a nil value are removed.
+func (repo *Repository) MergeMetadata(requestID uuid.UUID, metadata map[string]any) error {
+	patch := []byte("{}")
+	if len(metadata) > 0 {
+		var err error
+		patch, err = json.Marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("marshalling metadata patch : %w", err)
+		}
+	}
+	query := `UPDATE request SET metadata = json_patch(COALESCE(metadata, '{}'), ?) WHERE id = ?`
+
+	result, err := repo.dbConn.Exec(query, string(patch), requestID)
+	if err != nil {
+		return fmt.Errorf("merging metadata %s for %v : %w", patch, requestID, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("checking rows affected for %s : %w", requestID, err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no request found with id %s to update", requestID)
+	}
+	return nil
+}
+
 // GetNote retrieves the user-created note associated with a specific request ID.
+// A cleared note is returned as an empty string.
 func (repo *Repository) GetNote(requestID uuid.UUID) (string, error) {
-	var note string
+	var note sql.NullString
 	query := `SELECT note FROM notes WHERE request_id = ?`
 
 	err := repo.dbConn.Get(&note, query, requestID)
@@ -344,20 +436,26 @@ func (repo *Repository) GetNote(requestID uuid.UUID) (string, error) {
 		return "", fmt.Errorf("getting note for request %s: %w", requestID, err)
 	}
 
-	return note, nil
+	return note.String, nil
 }
 
 // UpdateNote creates or updates a user-created note for a specific request ID.
 // If a note already exists for the request, it will be updated; otherwise, a new note will be inserted.
+// An empty note clears the note, it is stored as NULL.
 func (repo *Repository) UpdateNote(requestID uuid.UUID, note string) error {
+	return updateNote(repo.dbConn, requestID, note)
+}
+
+// updateNote creates or updates the note of a request with exec.
+func updateNote(exec execer, requestID uuid.UUID, note string) error {
 	query := `INSERT INTO notes (request_id, note, created_at)
-              VALUES (?, ?, CURRENT_TIMESTAMP)
+              VALUES (?, NULLIF(?, ''), CURRENT_TIMESTAMP)
               ON CONFLICT(request_id) 
 			  DO UPDATE SET
 				note = excluded.note,
 				created_at = CURRENT_TIMESTAMP;`
 
-	_, err := repo.dbConn.Exec(query, requestID, note)
+	_, err := exec.Exec(query, requestID, note)
 
 	if err != nil {
 		return fmt.Errorf("updating note for request %s: %w", requestID, err)
@@ -371,7 +469,7 @@ func (repo *Repository) SearchByMetadata(path string, value any) ([]*domain.Requ
 	var dbSummary []*dbRequestResponseSummary
 	query := `SELECT
 			  id, scheme, method, host, path, requested_at,
-			  status, status_code, content_type, length, responded_at,
+			  status, status_code, content_type, length, responded_at, reviewed,
 			  json_remove(metadata, '$.prettified-request', '$.prettified-response') AS metadata
 			  FROM request
 			  WHERE json_extract(metadata, ?) = ?
@@ -388,3 +486,178 @@ func (repo *Repository) SearchByMetadata(path string, value any) ([]*domain.Requ
 	}
 	return reqResSummary, nil
 }
+
+// AddTag adds a tag to a specific request ID.
+// Adding a tag that is already set on the request is ignored.
+func (repo *Repository) AddTag(requestID uuid.UUID, tag string) error {
+	return addTag(repo.dbConn, requestID, tag)
+}
+
+// addTag adds a tag to a request with exec.
+func addTag(exec execer, requestID uuid.UUID, tag string) error {
+	query := `INSERT OR IGNORE INTO request_tags (request_id, tag) VALUES (?, ?)`
+
+	_, err := exec.Exec(query, requestID, tag)
+	if err != nil {
+		return fmt.Errorf("adding tag %s to request %s : %w", tag, requestID, err)
+	}
+	return nil
+}
+
+// RemoveTag removes a tag from a specific request ID.
+func (repo *Repository) RemoveTag(requestID uuid.UUID, tag string) error {
+	query := `DELETE FROM request_tags WHERE request_id = ? AND tag = ?`
+
+	_, err := repo.dbConn.Exec(query, requestID, tag)
+	if err != nil {
+		return fmt.Errorf("removing tag %s from request %s : %w", tag, requestID, err)
+	}
+	return nil
+}
+
+// ListByTag retrieves the summarized request-response entries that have the given tag.
+func (repo *Repository) ListByTag(tag string) ([]*domain.RequestResponseSummary, error) {
+	var dbSummary []*dbRequestResponseSummary
+	query := `SELECT
+			  r.id, r.scheme, r.method, r.host, r.path, r.requested_at,
+			  r.status, r.status_code, r.content_type, r.length, r.responded_at, r.reviewed,
+			  json_remove(r.metadata, '$.prettified-request', '$.prettified-response') AS metadata
+			  FROM request r
+			  JOIN request_tags t ON r.id = t.request_id
+			  WHERE t.tag = ?
+			  ORDER BY r.id ASC`
+
+	err := repo.dbConn.Select(&dbSummary, query, tag)
+	if err != nil {
+		return nil, fmt.Errorf("listing requests with tag %s : %w", tag, err)
+	}
+
+	reqResSummary := make([]*domain.RequestResponseSummary, len(dbSummary))
+	for i, row := range dbSummary {
+		reqResSummary[i] = toDomainRequestResponseSummary(row)
+	}
+	return reqResSummary, nil
+}
+
+// MarkReviewed sets the reviewed flag of a request.
+func (repo *Repository) MarkReviewed(requestID uuid.UUID, reviewed bool) error {
+	query := `UPDATE request SET reviewed = ? WHERE id = ?`
+
+	result, err := repo.dbConn.Exec(query, reviewed, requestID)
+	if err != nil {
+		return fmt.Errorf("marking request %s as reviewed : %w", requestID, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("checking rows affected for request %s : %w", requestID, err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no request found with id %s to mark as reviewed", requestID)
+	}
+	return nil
+}
+
+// ListTraffic retrieves the summarized request-response entries that match the filter.
+func (repo *Repository) ListTraffic(filter domain.TrafficFilter) ([]*domain.RequestResponseSummary, error) {
+	where, err := trafficFilterWhere(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var dbSummary []*dbRequestResponseSummary
+	query := fmt.Sprintf(`SELECT
+			  id, scheme, method, host, path, requested_at,
+			  status, status_code, content_type, length, responded_at, reviewed,
+			  json_remove(metadata, '$.prettified-request', '$.prettified-response') AS metadata
+			  FROM request
+			  %s
+			  ORDER BY id ASC`, where)
+
+	err = repo.dbConn.Select(&dbSummary, query)
+	if err != nil {
+		return nil, fmt.Errorf("listing traffic : %w", err)
+	}
+
+	reqResSummary := make([]*domain.RequestResponseSummary, len(dbSummary))
+	for i, row := range dbSummary {
+		reqResSummary[i] = toDomainRequestResponseSummary(row)
+	}
+	return reqResSummary, nil
+}
+
+// GetNeighbors retrieves the IDs of the requests before and after requestID in the ListTraffic ordering of the filter.
+// prevID or nextID is nil when requestID is the first or last request.
+func (repo *Repository) GetNeighbors(requestID uuid.UUID, filter domain.TrafficFilter) (prevID, nextID *uuid.UUID, err error) {
+	where, err := trafficFilterWhere(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var neighbors struct {
+		PrevID *uuid.UUID `db:"prev_id"`
+		NextID *uuid.UUID `db:"next_id"`
+	}
+	query := fmt.Sprintf(`SELECT prev_id, next_id FROM (
+			  SELECT id,
+			  LAG(id) OVER (ORDER BY id ASC) AS prev_id,
+			  LEAD(id) OVER (ORDER BY id ASC) AS next_id
+			  FROM request
+			  %s
+			  ) WHERE id = ?`, where)
+
+	err = repo.dbConn.Get(&neighbors, query, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, fmt.Errorf("no request found with id %s matching the filter", requestID)
+		}
+		return nil, nil, fmt.Errorf("getting neighbors of request %s : %w", requestID, err)
+	}
+	return neighbors.PrevID, neighbors.NextID, nil
+}
+
+// trafficFilterWhere returns the WHERE clause that applies the filter to the request table.
+func trafficFilterWhere(filter domain.TrafficFilter) (string, error) {
+	if filter.ReviewedOnly && filter.UnreviewedOnly {
+		return "", fmt.Errorf("reviewed only and unreviewed only filters are mutually exclusive")
+	}
+
+	switch {
+	case filter.ReviewedOnly:
+		return "WHERE reviewed = 1", nil
+	case filter.UnreviewedOnly:
+		return "WHERE reviewed = 0", nil
+	}
+	return "", nil
+}
+
+// ClearTraffic deletes the captured traffic in a single transaction.
+// Notes and tags of the deleted requests are removed through the ON DELETE CASCADE constraints,
+// logs through the request_deleted_logs trigger.
+func (repo *Repository) ClearTraffic(preserveLaunchpad bool) error {
+	tx, err := repo.dbConn.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction : %w", err)
+	}
+	defer tx.Rollback()
+
+	if preserveLaunchpad {
+		_, err = tx.Exec(`DELETE FROM request WHERE id NOT IN (SELECT request_id FROM launchpad_request)`)
+		if err != nil {
+			return fmt.Errorf("clearing traffic not linked to a launchpad : %w", err)
+		}
+		return tx.Commit()
+	}
+
+	_, err = tx.Exec(`DELETE FROM launchpad_request`)
+	if err != nil {
+		return fmt.Errorf("clearing launchpad requests : %w", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM request`)
+	if err != nil {
+		return fmt.Errorf("clearing traffic : %w", err)
+	}
+	return tx.Commit()
+}
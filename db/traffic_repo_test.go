@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"database/sql"
 	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
@@ -11,6 +14,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/domain"
+	"github.com/tfkr-ae/marasi/rawhttp"
 )
 
 func TestTrafficRepo_InsertRequest(t *testing.T) {
@@ -33,6 +37,7 @@ func TestTrafficRepo_InsertRequest(t *testing.T) {
 			Method:      "GET",
 			Host:        "marasi.app",
 			Path:        "/",
+			Proto:       "HTTP/2.0",
 			Raw:         wantRaw,
 			Metadata:    wantMeta,
 			RequestedAt: wantTime,
@@ -55,6 +60,9 @@ func TestTrafficRepo_InsertRequest(t *testing.T) {
 		if got.Host != "marasi.app" {
 			t.Fatalf("\nwanted:\nmarasi.app\ngot:\n%s", got.Host)
 		}
+		if got.Proto.String != "HTTP/2.0" {
+			t.Fatalf("\nwanted:\nHTTP/2.0\ngot:\n%s", got.Proto.String)
+		}
 		if !reflect.DeepEqual(got.Metadata, Metadata(wantMeta)) {
 			t.Fatalf("\nwanted:\n%v\ngot:\n%v", wantMeta, got.Metadata)
 		}
@@ -99,14 +107,15 @@ func TestTrafficRepo_InsertResponse(t *testing.T) {
 
 		reqID := testRequest(t, repo, nil)
 		want := &domain.ProxyResponse{
-			ID:          reqID,
-			Status:      "200 OK",
-			StatusCode:  200,
-			ContentType: "text/plain",
-			Length:      "12",
-			Raw:         []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nHello Marasi"),
-			Metadata:    map[string]any{"key": "value"},
-			RespondedAt: time.Now().UTC().Truncate(time.Millisecond),
+			ID:           reqID,
+			Status:       "200 OK",
+			StatusCode:   200,
+			ContentType:  "text/plain",
+			Length:       "12",
+			Raw:          []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nHello Marasi"),
+			Metadata:     map[string]any{"key": "value"},
+			RespondedAt:  time.Now().UTC().Truncate(time.Millisecond),
+			UpstreamAddr: "203.0.113.10:443",
 		}
 
 		err := repo.InsertResponse(want)
@@ -135,6 +144,9 @@ func TestTrafficRepo_InsertResponse(t *testing.T) {
 		if !reflect.DeepEqual(got.Metadata, Metadata(want.Metadata)) {
 			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want.Metadata, got.Metadata)
 		}
+		if got.UpstreamAddr.String != want.UpstreamAddr {
+			t.Fatalf("\nwanted:\n%s\ngot:\n%s", want.UpstreamAddr, got.UpstreamAddr.String)
+		}
 	})
 
 	t.Run("should return an error if request ID doesn't exist", func(t *testing.T) {
@@ -214,6 +226,113 @@ func TestTrafficRepo_GetResponse(t *testing.T) {
 	})
 }
 
+func TestTrafficRepo_GetRaw(t *testing.T) {
+	t.Run("should return the exact bytes dumped at capture time", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		req := httptest.NewRequest("POST", "https://marasi.app/login?next=%2F", strings.NewReader(`{"user":"marasi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Weird", "  spaced\tvalue ")
+		rawReq, _, err := rawhttp.DumpRequest(req)
+		if err != nil {
+			t.Fatalf("dumping request: %v", err)
+		}
+
+		res := &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("Hello\x00Marasi\r\n")),
+			Request:    req,
+		}
+		rawRes, _, err := rawhttp.DumpResponse(res)
+		if err != nil {
+			t.Fatalf("dumping response: %v", err)
+		}
+
+		id, err := uuid.NewV7()
+		if err != nil {
+			t.Fatalf("creating uuid: %v", err)
+		}
+		err = repo.InsertRequest(&domain.ProxyRequest{
+			ID:          id,
+			Scheme:      "https",
+			Method:      "POST",
+			Host:        "marasi.app",
+			Path:        "/login?next=%2F",
+			Raw:         rawReq,
+			RawLength:   int64(len(rawReq)),
+			Metadata:    make(map[string]any),
+			RequestedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("inserting request: %v", err)
+		}
+		err = repo.InsertResponse(&domain.ProxyResponse{
+			ID:          id,
+			Status:      "200 OK",
+			StatusCode:  200,
+			ContentType: "text/plain",
+			Raw:         rawRes,
+			RawLength:   int64(len(rawRes)),
+			Metadata:    make(map[string]any),
+			RespondedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("inserting response: %v", err)
+		}
+
+		gotReq, err := repo.GetRawRequest(id)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if !bytes.Equal(gotReq, rawReq) {
+			t.Fatalf("\nwanted:\n%q\ngot:\n%q", rawReq, gotReq)
+		}
+
+		gotRes, err := repo.GetRawResponse(id)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if !bytes.Equal(gotRes, rawRes) {
+			t.Fatalf("\nwanted:\n%q\ngot:\n%q", rawRes, gotRes)
+		}
+	})
+
+	t.Run("should return an empty response for a request with no response", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, nil)
+
+		got, err := repo.GetRawResponse(reqID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if len(got) != 0 {
+			t.Fatalf("\nwanted:\nempty\ngot:\n%q", got)
+		}
+	})
+
+	t.Run("should return an error for a non-existent ID", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		nonExistentID := uuid.MustParse("01938032-1b17-7243-b035-e6a9f4645904")
+
+		if _, err := repo.GetRawRequest(nonExistentID); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("\nwanted:\nsql.ErrNoRows\ngot:\n%v", err)
+		}
+		if _, err := repo.GetRawResponse(nonExistentID); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("\nwanted:\nsql.ErrNoRows\ngot:\n%v", err)
+		}
+	})
+}
+
 func TestTrafficRepo_GetRequestResponseRow(t *testing.T) {
 	t.Run("should get a full row with request, response, and note", func(t *testing.T) {
 		repo, teardown := setupTestDB(t)
@@ -251,6 +370,9 @@ func TestTrafficRepo_GetRequestResponseRow(t *testing.T) {
 		if !reflect.DeepEqual(want, got) {
 			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
 		}
+		if got.Request.Proto != "HTTP/1.1" {
+			t.Fatalf("\nwanted:\nHTTP/1.1\ngot:\n%s", got.Request.Proto)
+		}
 	})
 
 	t.Run("should get a row with request but no response and no note", func(t *testing.T) {
@@ -477,6 +599,85 @@ func TestTrafficRepo_UpdateMetadata(t *testing.T) {
 	})
 }
 
+func TestTrafficRepo_MergeMetadata(t *testing.T) {
+	t.Run("should merge metadata and keep existing keys", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, map[string]any{"initial": "value", "overwrite": "old"})
+
+		err := repo.MergeMetadata(reqID, map[string]any{"overwrite": "new", "added": float64(42)})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := map[string]any{"initial": "value", "overwrite": "new", "added": float64(42)}
+		got, err := repo.GetMetadata(reqID)
+		if err != nil {
+			t.Fatalf("getting metadata after merge: %v", err)
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("should remove keys set to nil", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, map[string]any{"keep": "value", "remove": "value"})
+
+		err := repo.MergeMetadata(reqID, map[string]any{"remove": nil})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		want := map[string]any{"keep": "value"}
+		got, err := repo.GetMetadata(reqID)
+		if err != nil {
+			t.Fatalf("getting metadata after merge: %v", err)
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("post-hoc merge should be reflected in the request response row", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, map[string]any{"phase": "request"})
+		insertTestResponseAndGet(t, repo, reqID, map[string]any{"phase": "response"})
+
+		err := repo.MergeMetadata(reqID, map[string]any{"reviewed": true})
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		row, err := repo.GetRequestResponseRow(reqID)
+		if err != nil {
+			t.Fatalf("fetching request row: %v", err)
+		}
+
+		want := map[string]any{"phase": "response", "reviewed": true}
+		if !reflect.DeepEqual(want, row.Metadata) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", want, row.Metadata)
+		}
+	})
+
+	t.Run("should return error for non-existent request", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		err := repo.MergeMetadata(uuid.New(), map[string]any{"key": "value"})
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+}
+
 func TestTrafficRepo_GetNotes(t *testing.T) {
 	t.Run("should return error if no note exists", func(t *testing.T) {
 		repo, teardown := setupTestDB(t)
@@ -544,6 +745,46 @@ func TestTrafficRepo_Notes(t *testing.T) {
 			t.Fatalf("\nwanted:\n%q\ngot:\n%q", wantNote, got)
 		}
 	})
+
+	t.Run("should clear a note with an empty string", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, nil)
+		insertTestResponseAndGet(t, repo, reqID, nil)
+
+		if err := repo.UpdateNote(reqID, "Initial note"); err != nil {
+			t.Fatalf("inserting initial note: %v", err)
+		}
+
+		if err := repo.UpdateNote(reqID, ""); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		var note sql.NullString
+		if err := repo.dbConn.Get(&note, `SELECT note FROM notes WHERE request_id = ?`, reqID); err != nil {
+			t.Fatalf("getting stored note: %v", err)
+		}
+		if note.Valid {
+			t.Fatalf("\nwanted:\nNULL\ngot:\n%q", note.String)
+		}
+
+		got, err := repo.GetNote(reqID)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if got != "" {
+			t.Fatalf("\nwanted:\nempty note\ngot:\n%q", got)
+		}
+
+		row, err := repo.GetRequestResponseRow(reqID)
+		if err != nil {
+			t.Fatalf("getting request response row: %v", err)
+		}
+		if row.Note != "" {
+			t.Fatalf("\nwanted:\nempty note\ngot:\n%q", row.Note)
+		}
+	})
 }
 
 func TestTrafficRepo_NoteTriggers(t *testing.T) {
@@ -672,3 +913,396 @@ func TestTrafficRepo_SearchByMetadata(t *testing.T) {
 		}
 	})
 }
+
+func TestTrafficRepo_Tags(t *testing.T) {
+	t.Run("ListByTag should return the tagged requests", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID1 := testRequest(t, repo, nil)
+		reqID2 := testRequest(t, repo, nil)
+		reqID3 := testRequest(t, repo, nil)
+
+		for _, id := range []uuid.UUID{reqID1, reqID3} {
+			if err := repo.AddTag(id, "sqli-candidate"); err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+		}
+		if err := repo.AddTag(reqID2, "reviewed"); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.ListByTag("sqli-candidate")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(got) != 2 {
+			t.Fatalf("\nwanted:\n2\ngot:\n%d", len(got))
+		}
+		if got[0].ID != reqID1 {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", reqID1, got[0].ID)
+		}
+		if got[1].ID != reqID3 {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", reqID3, got[1].ID)
+		}
+	})
+
+	t.Run("adding the same tag twice should not duplicate the request", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, nil)
+
+		for range 2 {
+			if err := repo.AddTag(reqID, "reviewed"); err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+		}
+
+		got, err := repo.ListByTag("reviewed")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(got) != 1 {
+			t.Fatalf("\nwanted:\n1\ngot:\n%d", len(got))
+		}
+	})
+
+	t.Run("RemoveTag should remove the request from the tag", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, nil)
+
+		if err := repo.AddTag(reqID, "reviewed"); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if err := repo.RemoveTag(reqID, "reviewed"); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		got, err := repo.ListByTag("reviewed")
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(got) != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", len(got))
+		}
+	})
+
+	t.Run("AddTag should return an error for a non-existent request", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		nonExistentID, _ := uuid.NewV7()
+
+		err := repo.AddTag(nonExistentID, "reviewed")
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+}
+
+func TestTrafficRepo_ClearTraffic(t *testing.T) {
+	setup := func(t *testing.T) (*Repository, func(), uuid.UUID, uuid.UUID) {
+		t.Helper()
+		repo, teardown := setupTestDB(t)
+
+		linkedID := testRequest(t, repo, nil)
+		insertTestResponseAndGet(t, repo, linkedID, nil)
+		otherID := testRequest(t, repo, nil)
+		insertTestResponseAndGet(t, repo, otherID, nil)
+
+		if err := repo.UpdateNote(otherID, "note"); err != nil {
+			t.Fatalf("updating note: %v", err)
+		}
+		if err := repo.AddTag(otherID, "tag"); err != nil {
+			t.Fatalf("adding tag: %v", err)
+		}
+		if err := repo.InsertLog(&domain.Log{
+			ID:        uuid.Must(uuid.NewV7()),
+			Timestamp: time.Now(),
+			Level:     "INFO",
+			Message:   "log",
+			RequestID: &otherID,
+		}); err != nil {
+			t.Fatalf("inserting log: %v", err)
+		}
+
+		launchpadID, err := repo.CreateLaunchpad("Test Launchpad", "Test Description")
+		if err != nil {
+			t.Fatalf("creating launchpad: %v", err)
+		}
+		if err := repo.LinkRequestToLaunchpad(linkedID, launchpadID); err != nil {
+			t.Fatalf("linking request: %v", err)
+		}
+		return repo, teardown, linkedID, launchpadID
+	}
+
+	t.Run("should delete all traffic", func(t *testing.T) {
+		repo, teardown, _, launchpadID := setup(t)
+		defer teardown()
+
+		if err := repo.ClearTraffic(false); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		rows, err := repo.CountRows()
+		if err != nil {
+			t.Fatalf("counting rows: %v", err)
+		}
+		if rows != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", rows)
+		}
+
+		notes, err := repo.CountNotes()
+		if err != nil {
+			t.Fatalf("counting notes: %v", err)
+		}
+		if notes != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", notes)
+		}
+
+		tagged, err := repo.ListByTag("tag")
+		if err != nil {
+			t.Fatalf("listing by tag: %v", err)
+		}
+		if len(tagged) != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", len(tagged))
+		}
+
+		logs, err := repo.GetLogs()
+		if err != nil {
+			t.Fatalf("getting logs: %v", err)
+		}
+		if len(logs) != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", len(logs))
+		}
+
+		requests, err := repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("getting launchpad requests: %v", err)
+		}
+		if len(requests) != 0 {
+			t.Fatalf("\nwanted:\n0\ngot:\n%d", len(requests))
+		}
+	})
+
+	t.Run("should preserve launchpad requests", func(t *testing.T) {
+		repo, teardown, linkedID, launchpadID := setup(t)
+		defer teardown()
+
+		if err := repo.ClearTraffic(true); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		rows, err := repo.CountRows()
+		if err != nil {
+			t.Fatalf("counting rows: %v", err)
+		}
+		if rows != 1 {
+			t.Fatalf("\nwanted:\n1\ngot:\n%d", rows)
+		}
+
+		requests, err := repo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("getting launchpad requests: %v", err)
+		}
+		if len(requests) != 1 || requests[0].ID != linkedID {
+			t.Fatalf("\nwanted:\n%s\ngot:\n%v", linkedID, requests)
+		}
+	})
+}
+
+func TestTrafficRepo_MarkReviewed(t *testing.T) {
+	t.Run("should toggle the reviewed flag", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		reqID := testRequest(t, repo, nil)
+
+		for _, want := range []bool{true, false} {
+			err := repo.MarkReviewed(reqID, want)
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+
+			summaries, err := repo.GetRequestResponseSummary()
+			if err != nil {
+				t.Fatalf("getting summary : %v", err)
+			}
+			if len(summaries) != 1 {
+				t.Fatalf("\nwanted:\n1\ngot:\n%d", len(summaries))
+			}
+			if summaries[0].Reviewed != want {
+				t.Fatalf("\nwanted:\n%t\ngot:\n%t", want, summaries[0].Reviewed)
+			}
+		}
+	})
+
+	t.Run("should return an error if request ID doesn't exist", func(t *testing.T) {
+		repo, teardown := setupTestDB(t)
+		defer teardown()
+
+		nonExistentID := uuid.MustParse("0193802f-f0e7-73d9-a764-06d21e367809")
+
+		err := repo.MarkReviewed(nonExistentID, true)
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+
+		if !strings.Contains(err.Error(), "no request found") {
+			t.Fatalf("\nwanted:\nerror containing 'no request found'\ngot:\n%v", err)
+		}
+	})
+}
+
+func TestTrafficRepo_ListTraffic(t *testing.T) {
+	repo, teardown := setupTestDB(t)
+	defer teardown()
+
+	reviewedID := testRequest(t, repo, nil)
+	unreviewedID := testRequest(t, repo, nil)
+
+	err := repo.MarkReviewed(reviewedID, true)
+	if err != nil {
+		t.Fatalf("marking request as reviewed : %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		filter  domain.TrafficFilter
+		want    []uuid.UUID
+		wantErr bool
+	}{
+		{
+			name:   "empty filter should return all requests",
+			filter: domain.TrafficFilter{},
+			want:   []uuid.UUID{reviewedID, unreviewedID},
+		},
+		{
+			name:   "reviewed only should return the reviewed requests",
+			filter: domain.TrafficFilter{ReviewedOnly: true},
+			want:   []uuid.UUID{reviewedID},
+		},
+		{
+			name:   "unreviewed only should return the requests that were not reviewed",
+			filter: domain.TrafficFilter{UnreviewedOnly: true},
+			want:   []uuid.UUID{unreviewedID},
+		},
+		{
+			name:    "reviewed only and unreviewed only should return an error",
+			filter:  domain.TrafficFilter{ReviewedOnly: true, UnreviewedOnly: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summaries, err := repo.ListTraffic(tt.filter)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+
+			got := make([]uuid.UUID, 0, len(summaries))
+			for _, summary := range summaries {
+				got = append(got, summary.ID)
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Fatalf("\nwanted:\n%v\ngot:\n%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTrafficRepo_GetNeighbors(t *testing.T) {
+	repo, teardown := setupTestDB(t)
+	defer teardown()
+
+	firstID := testRequest(t, repo, nil)
+	secondID := testRequest(t, repo, nil)
+	thirdID := testRequest(t, repo, nil)
+	fourthID := testRequest(t, repo, nil)
+
+	for _, id := range []uuid.UUID{firstID, thirdID, fourthID} {
+		err := repo.MarkReviewed(id, true)
+		if err != nil {
+			t.Fatalf("marking request as reviewed : %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		requestID uuid.UUID
+		filter    domain.TrafficFilter
+		wantPrev  *uuid.UUID
+		wantNext  *uuid.UUID
+		wantErr   bool
+	}{
+		{
+			name:      "first request should only have a next request",
+			requestID: firstID,
+			wantNext:  &secondID,
+		},
+		{
+			name:      "middle request should have both neighbors",
+			requestID: secondID,
+			wantPrev:  &firstID,
+			wantNext:  &thirdID,
+		},
+		{
+			name:      "last request should only have a previous request",
+			requestID: fourthID,
+			wantPrev:  &thirdID,
+		},
+		{
+			name:      "filter should skip the requests that do not match",
+			requestID: firstID,
+			filter:    domain.TrafficFilter{ReviewedOnly: true},
+			wantNext:  &thirdID,
+		},
+		{
+			name:      "request that does not match the filter should return an error",
+			requestID: secondID,
+			filter:    domain.TrafficFilter{ReviewedOnly: true},
+			wantErr:   true,
+		},
+		{
+			name:      "invalid filter should return an error",
+			requestID: firstID,
+			filter:    domain.TrafficFilter{ReviewedOnly: true, UnreviewedOnly: true},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPrev, gotNext, err := repo.GetNeighbors(tt.requestID, tt.filter)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+
+			if !reflect.DeepEqual(tt.wantPrev, gotPrev) {
+				t.Errorf("\nwanted previous:\n%v\ngot:\n%v", tt.wantPrev, gotPrev)
+			}
+			if !reflect.DeepEqual(tt.wantNext, gotNext) {
+				t.Errorf("\nwanted next:\n%v\ngot:\n%v", tt.wantNext, gotNext)
+			}
+		})
+	}
+}
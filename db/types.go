@@ -63,3 +63,32 @@ func (a StringArray) Value() (driver.Value, error) {
 	}
 	return json.Marshal(a)
 }
+
+// Variables represents the launchpad variables, stored as a JSON object in the database.
+// Launchpads without variables are stored as NULL and scanned as a nil map.
+type Variables map[string]string
+
+// Scan implements the sql.Scanner interface.
+func (v *Variables) Scan(value interface{}) error {
+	if value == nil {
+		*v = nil
+		return nil
+	}
+
+	switch val := value.(type) {
+	case []byte:
+		return json.Unmarshal(val, v)
+	case string:
+		return json.Unmarshal([]byte(val), v)
+	default:
+		return fmt.Errorf("unsupported type %T", val)
+	}
+}
+
+// Value implements the driver.Valuer interface.
+func (v Variables) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
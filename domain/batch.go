@@ -0,0 +1,27 @@
+package domain
+
+import "github.com/google/uuid"
+
+// BatchRepository defines the interface for grouping the writes of the proxy in a single transaction.
+type BatchRepository interface {
+	// Batch calls fn with a BatchWriter whose writes are committed together once fn returns nil.
+	// Nothing is written if fn or the commit fails.
+	Batch(fn func(writer BatchWriter) error) error
+}
+
+// BatchWriter defines the writes that can be grouped by a BatchRepository.
+// The writes are applied in the order they are made, a failed write does not undo the other writes of the batch.
+type BatchWriter interface {
+	// InsertRequest saves a new request.
+	InsertRequest(req *ProxyRequest) error
+	// InsertResponse saves the response of an existing request.
+	InsertResponse(res *ProxyResponse) error
+	// LinkRequestToLaunchpad associates a request with a launchpad.
+	LinkRequestToLaunchpad(requestID uuid.UUID, launchpadID uuid.UUID) error
+	// AddTag adds a tag to a request.
+	AddTag(requestID uuid.UUID, tag string) error
+	// UpdateNote creates or updates the note of a request.
+	UpdateNote(requestID uuid.UUID, note string) error
+	// InsertLog saves a new log entry.
+	InsertLog(log *Log) error
+}
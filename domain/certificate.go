@@ -0,0 +1,22 @@
+package domain
+
+import "time"
+
+// CertificateRepository defines the interface for persisting the leaf certificates generated by the MITM authority,
+// so they can be reused across restarts instead of being generated again for every host.
+type CertificateRepository interface {
+	// GetCertificate retrieves the stored certificate for the given host.
+	// It returns an error if no certificate is stored for that host.
+	GetCertificate(host string) (*Certificate, error)
+
+	// SaveCertificate creates or replaces the stored certificate for cert.Host.
+	SaveCertificate(cert *Certificate) error
+}
+
+// Certificate represents a generated leaf certificate for a single host.
+type Certificate struct {
+	Host     string    // The host (without port) the certificate was generated for
+	CertPEM  []byte    // PEM encoded certificate chain, starting with the leaf certificate
+	KeyPEM   []byte    // PEM encoded PKCS #8 private key of the leaf certificate
+	NotAfter time.Time // Expiry of the leaf certificate
+}
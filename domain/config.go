@@ -1,5 +1,14 @@
 package domain
 
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ErrConfigKeyNotFound is returned by ConfigRepository.Get when the configuration key does not exist.
+var ErrConfigKeyNotFound = errors.New("config key not found")
+
 // ConfigRepository defines the interface for managing application-level configuration settings.
 // It provides methods to interact with persistent configuration data, such as security keys and UI filters.
 type ConfigRepository interface {
@@ -17,4 +26,24 @@ type ConfigRepository interface {
 	// This allows users to customize the traffic visibility in the UI.
 	// Note: This functionality may be relocated to a more UI-specific configuration in the future.
 	SetFilters(filters []string) error
+
+	// Get retrieves the value stored under the given configuration key.
+	// It returns an error wrapping ErrConfigKeyNotFound if the key does not exist.
+	Get(key string) (string, error)
+
+	// Set creates or replaces the value stored under the given configuration key.
+	Set(key string, value string) error
+
+	// Delete removes the given configuration key, deleting a key that does not exist is not an error.
+	Delete(key string) error
+
+	// Keys returns all of the stored configuration keys in alphabetical order.
+	Keys() ([]string, error)
+
+	// GetExtensionConfig retrieves the configuration of an extension, which is stored apart from the configuration keys.
+	// It returns an empty map if the extension has no configuration.
+	GetExtensionConfig(extensionID uuid.UUID) (map[string]any, error)
+
+	// SetExtensionConfig creates or replaces the configuration of an extension.
+	SetExtensionConfig(extensionID uuid.UUID, config map[string]any) error
 }
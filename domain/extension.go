@@ -34,6 +34,18 @@ type ExtensionRepository interface {
 	// SetExtensionSettingsByUUID sets the settings for a specific extension using its UUID.
 	// Extension settings are provided as a map[string]any.
 	SetExtensionSettingsByUUID(id uuid.UUID, settings map[string]any) error
+
+	// UpsertExtension inserts the extension, or updates the stored extension with the same ID.
+	// New extensions are placed after the existing ones in the load order.
+	UpsertExtension(extension *Extension) error
+
+	// DeleteExtension removes the extension with the given ID.
+	// It returns an error if the extension is not found.
+	DeleteExtension(id uuid.UUID) error
+
+	// SetExtensionOrder sets the load order of the extensions to the order of the given IDs.
+	// Extensions that are not listed keep their relative order after the listed ones.
+	SetExtensionOrder(ids []uuid.UUID) error
 }
 
 // Extension represents the domain model for a Lua-based extension in Marasi.
@@ -49,4 +61,5 @@ type Extension struct {
 	Description string         // A brief description of the extension's functionality.
 	Settings    map[string]any // A map of user-defined settings for the extension.
 	UpdatedAt   time.Time      // The timestamp of the last update to the extension.
+	LoadOrder   int            // The position of the extension in the load order.
 }
@@ -0,0 +1,21 @@
+package domain
+
+import "context"
+
+// HealthRepository defines the interface for checking that the database is reachable and writable.
+type HealthRepository interface {
+	// Ping checks that the database connection is alive.
+	Ping(ctx context.Context) error
+
+	// HealthCheck reports the state of the database connection.
+	// It returns the health gathered so far along with an error if one of the checks fails.
+	HealthCheck(ctx context.Context) (DBHealth, error)
+}
+
+// DBHealth describes the state of the database connection.
+type DBHealth struct {
+	OpenConnections int    // Number of open connections in the pool, both in use and idle
+	JournalMode     string // SQLite journal mode (e.g. wal, delete, memory)
+	WAL             bool   // Whether the database uses write-ahead logging
+	Writable        bool   // Whether a test write succeeded, the write is rolled back
+}
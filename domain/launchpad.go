@@ -23,24 +23,49 @@ type LaunchpadRepository interface {
 	DeleteLaunchpad(launchpadID uuid.UUID) error
 
 	// GetLaunchpadRequests retrieves all requests linked to a specific launchpad, identified by its UUID.
+	// The requests are ordered by their sequence in the launchpad.
 	// It returns a slice of ProxyRequest pointers. If the launchpad has no requests, it returns an empty slice.
 	GetLaunchpadRequests(id uuid.UUID) ([]*ProxyRequest, error)
 
 	// LinkRequestToLaunchpad associates a request with a launchpad using their respective UUIDs.
-	// This allows for organizing requests into collections.
+	// This allows for organizing requests into collections. The request is added at the end of the launchpad's sequence.
 	// It returns an error if either the request or the launchpad does not exist.
 	LinkRequestToLaunchpad(requestID uuid.UUID, launchpadID uuid.UUID) error
+
+	// AttachRequest adds a captured request to the end of a launchpad.
+	// Attaching a request that is already part of the launchpad is a no-op.
+	// It returns an error if either the request or the launchpad does not exist.
+	AttachRequest(launchpadID uuid.UUID, requestID uuid.UUID) error
+
+	// DetachRequest removes a request from a launchpad.
+	// Detaching a request that is not part of the launchpad is a no-op.
+	DetachRequest(launchpadID uuid.UUID, requestID uuid.UUID) error
+
+	// GetLaunchpadVariables retrieves the variables substituted into the {{name}} placeholders of the launchpad's requests.
+	// It returns an error if the launchpad does not exist.
+	GetLaunchpadVariables(launchpadID uuid.UUID) (map[string]string, error)
+
+	// SetLaunchpadVariables replaces the variables of a launchpad.
+	// It returns an error if the launchpad does not exist.
+	SetLaunchpadVariables(launchpadID uuid.UUID, variables map[string]string) error
+
+	// ReorderLaunchpad sets the order of the launchpad's requests.
+	// The requests that are not part of orderedRequestIDs keep their relative order after the ordered ones.
+	// It returns an error if any of the request IDs is not part of the launchpad.
+	ReorderLaunchpad(launchpadID uuid.UUID, orderedRequestIDs []uuid.UUID) error
 }
 
 // Launchpad represents a collection of saved requests, allowing users to group and organize them.
 type Launchpad struct {
-	ID          uuid.UUID // Unique identifier for the launchpad.
-	Name        string    // The name of the launchpad.
-	Description string    // A brief description of the launchpad's purpose.
+	ID          uuid.UUID         // Unique identifier for the launchpad.
+	Name        string            // The name of the launchpad.
+	Description string            // A brief description of the launchpad's purpose.
+	Variables   map[string]string // Values substituted into the {{name}} placeholders of the requests when they are launched.
 }
 
 // LaunchpadRequest represents the association between a Launchpad and a ProxyRequest.
 type LaunchpadRequest struct {
 	LaunchpadID uuid.UUID // The ID of the launchpad.
 	RequestID   uuid.UUID // The ID of the request linked to the launchpad.
+	Sequence    int       // Position of the request in the launchpad, requests are listed in ascending order.
 }
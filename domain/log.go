@@ -13,6 +13,8 @@ type LogRepository interface {
 	InsertLog(log *Log) error
 	// GetLogs retrieves all log entries from the repository.
 	GetLogs() ([]*Log, error)
+	// GetLogsByRequest retrieves the log entries associated with a request, oldest first.
+	GetLogsByRequest(requestID uuid.UUID) ([]*Log, error)
 }
 
 // Log represents a single log entry, containing information about an event that occurred in the application.
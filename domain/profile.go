@@ -0,0 +1,59 @@
+package domain
+
+import "github.com/google/uuid"
+
+// ProfileVersion is the version of the profile format, profiles with a different version are rejected on import.
+const ProfileVersion = 1
+
+// ProfileRepository defines the interface for exporting and importing the stored configuration as a Profile.
+type ProfileRepository interface {
+	// ExportProfile returns the waypoints, extensions and configuration keys stored in the repository.
+	// The scope of the returned profile is nil as the scope is not stored in the repository.
+	ExportProfile() (*Profile, error)
+
+	// ImportProfile applies the profile in a single transaction, nothing is changed if it fails.
+	// The waypoints and configuration keys are replaced with the ones in the profile.
+	// Extensions are created or updated by name and follow the order of the profile, other extensions are kept after them.
+	ImportProfile(profile *Profile) error
+}
+
+// Profile is a portable copy of the Marasi configuration that can be shared between installations.
+type Profile struct {
+	Version    int                `json:"version"`         // Version of the profile format, see ProfileVersion
+	Scope      *ProfileScope      `json:"scope,omitempty"` // Scope of the proxy
+	Waypoints  []ProfileWaypoint  `json:"waypoints"`       // Host overrides
+	Extensions []ProfileExtension `json:"extensions"`      // Extensions in load order, including their Lua source
+	Config     map[string]string  `json:"config"`          // Configuration keys and their values
+}
+
+// ProfileScope is the scope of the proxy in a Profile.
+type ProfileScope struct {
+	DefaultAllow bool               `json:"default_allow"` // Default behavior for items not matching any rule
+	Rules        []ProfileScopeRule `json:"rules"`         // Include and exclude rules
+}
+
+// ProfileScopeRule is a single include or exclude rule of a ProfileScope.
+type ProfileScopeRule struct {
+	Pattern   string `json:"pattern"`            // Regular expression pattern
+	MatchType string `json:"match_type"`         // Type of matching: "host", "url" or "cidr"
+	Exclude   bool   `json:"exclude"`            // True for exclude rules
+	Priority  int    `json:"priority,omitempty"` // Rules with a higher priority are evaluated first
+}
+
+// ProfileWaypoint is a waypoint in a Profile.
+type ProfileWaypoint struct {
+	Hostname string `json:"hostname"` // The original "host:port" to match on incoming requests
+	Override string `json:"override"` // The "host:port" the request is redirected to
+}
+
+// ProfileExtension is an extension in a Profile.
+type ProfileExtension struct {
+	ID          uuid.UUID      `json:"id"`          // Identifier used when the extension is created by the import
+	Name        string         `json:"name"`        // Unique name of the extension, used to match existing extensions
+	SourceURL   string         `json:"source_url"`  // URL of the extension's source code repository
+	Author      string         `json:"author"`      // Author of the extension
+	Description string         `json:"description"` // Description of the extension's functionality
+	Enabled     bool           `json:"enabled"`     // Whether the extension is active
+	Settings    map[string]any `json:"settings"`    // User-defined settings of the extension
+	LuaContent  string         `json:"lua_content"` // Lua source code of the extension
+}
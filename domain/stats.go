@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 // StatsRepository defines the interface for retrieving various statistics about the application's data.
 // It provides methods for counting different types of entities within the repository.
 type StatsRepository interface {
@@ -11,4 +13,20 @@ type StatsRepository interface {
 	CountLaunchpads() (int, error)
 	// CountIntercepted returns the total number of intercepted requests.
 	CountIntercepted() (int, error)
+	// TotalBytes returns the total size in bytes of the stored raw requests and responses.
+	TotalBytes() (int64, error)
+	// Timeline returns the number of requests in contiguous buckets of the given size, starting at since and ending at the current time.
+	// Buckets without requests are included with a count of 0, an error is returned when more than MaxTimelineBuckets buckets are needed.
+	Timeline(bucket time.Duration, since time.Time) ([]TimeBucket, error)
+	// MethodCounts returns the number of requests made at or after since grouped by HTTP method.
+	MethodCounts(since time.Time) (map[string]int, error)
+}
+
+// MaxTimelineBuckets is the maximum number of buckets a timeline can have
+const MaxTimelineBuckets = 10000
+
+// TimeBucket holds the number of requests made in the bucket that starts at Start.
+type TimeBucket struct {
+	Start time.Time // Start of the bucket (inclusive)
+	Count int       // Number of requests made in the bucket
 }
@@ -46,6 +46,14 @@ type TrafficRepository interface {
 	*/
 	GetResponse(id uuid.UUID) (*ProxyResponse, error)
 
+	// GetRawRequest returns the raw request bytes exactly as they were stored at capture time.
+	// It returns an error if the request ID doesn't exist
+	GetRawRequest(id uuid.UUID) ([]byte, error)
+
+	// GetRawResponse returns the raw response bytes exactly as they were stored at capture time.
+	// It returns an empty slice if the request does not have response data, and an error if the request ID doesn't exist
+	GetRawResponse(id uuid.UUID) ([]byte, error)
+
 	// GetRequestResponseRow will return the entire request - response data for a row given from the ID
 	// If the row doesn't exist it will return an error
 	// If there is a note on that request ID it will fetch the note contents as well.
@@ -61,15 +69,54 @@ type TrafficRepository interface {
 	// UpdateMetadata updates the metadata for one or more requests.
 	UpdateMetadata(metadata map[string]any, ids ...uuid.UUID) error
 
+	// MergeMetadata merges the given keys into the stored metadata of a request after it was persisted.
+	// Existing keys that are not part of metadata are kept, keys set to nil are removed.
+	// It returns an error if the request does not exist.
+	MergeMetadata(requestID uuid.UUID, metadata map[string]any) error
+
 	// GetNote retrieves the user-created note for a specific request ID.
 	// It returns an error if no note is found.
 	GetNote(requestID uuid.UUID) (string, error)
 
 	// UpdateNote creates or updates the user-created note for a specific request ID.
+	// An empty note clears the note of the request.
 	UpdateNote(requestID uuid.UUID, note string) error
 
 	// SearchByMetadata retrieves requests where the value at the specified JSON path matches the provided value.
 	SearchByMetadata(path string, value any) ([]*RequestResponseSummary, error)
+
+	// AddTag adds a tag to a specific request ID, adding a tag that already exists is a no-op.
+	// It returns an error if the request ID does not exist.
+	AddTag(requestID uuid.UUID, tag string) error
+
+	// RemoveTag removes a tag from a specific request ID.
+	RemoveTag(requestID uuid.UUID, tag string) error
+
+	// ListByTag retrieves the requests that have the given tag.
+	ListByTag(tag string) ([]*RequestResponseSummary, error)
+
+	// ClearTraffic deletes the captured requests and responses along with their notes, tags and launchpad links.
+	// When preserveLaunchpad is true, the requests that are linked to a launchpad are kept.
+	ClearTraffic(preserveLaunchpad bool) error
+
+	// MarkReviewed sets whether a request has been reviewed by the user.
+	// It returns an error if the request ID does not exist.
+	MarkReviewed(requestID uuid.UUID, reviewed bool) error
+
+	// ListTraffic retrieves the request-response summaries that match the filter.
+	// It returns an error if the filter is invalid.
+	ListTraffic(filter TrafficFilter) ([]*RequestResponseSummary, error)
+
+	// GetNeighbors retrieves the IDs of the requests before and after requestID in the ListTraffic ordering of the filter.
+	// prevID or nextID is nil at the start or end of the result set.
+	// It returns an error if the request ID does not exist or does not match the filter.
+	GetNeighbors(requestID uuid.UUID, filter TrafficFilter) (prevID, nextID *uuid.UUID, err error)
+}
+
+// TrafficFilter restricts the requests returned by ListTraffic, the zero value returns all requests.
+type TrafficFilter struct {
+	ReviewedOnly   bool // Only return the requests that were marked as reviewed
+	UnreviewedOnly bool // Only return the requests that were not marked as reviewed
 }
 
 // ProxyRequest represents the data captured from an HTTP request.
@@ -79,21 +126,29 @@ type ProxyRequest struct {
 	Method      string         // HTTP method (GET, POST, etc.)
 	Host        string         // Request host
 	Path        string         // Request path including query parameters
+	Proto       string         // HTTP protocol version the request was received with (e.g., "HTTP/1.1", "HTTP/2.0")
 	Raw         RawField       // Complete raw HTTP request
+	RawLength   int64          // Length of the raw HTTP request in bytes
 	Metadata    map[string]any // Additional metadata and extension data
+	Tags        []string       // Tags added by extensions
+	Note        *string        // Note set by an extension, nil when no note was set and empty to clear the note
 	RequestedAt time.Time      // Timestamp when request was made
 }
 
 // ProxyResponse represents the data captured from an HTTP response.
 type ProxyResponse struct {
-	ID          uuid.UUID      // Unique identifier matching the associated request
-	Status      string         // HTTP status text (e.g., "200 OK")
-	StatusCode  int            // HTTP status code (e.g., 200, 404)
-	ContentType string         // Response content type
-	Length      string         // Content length
-	Raw         RawField       // Complete raw HTTP response
-	Metadata    map[string]any // Additional metadata and extension data
-	RespondedAt time.Time      // Timestamp when response was received
+	ID           uuid.UUID      // Unique identifier matching the associated request
+	Status       string         // HTTP status text (e.g., "200 OK")
+	StatusCode   int            // HTTP status code (e.g., 200, 404)
+	ContentType  string         // Response content type
+	Length       string         // Content length
+	Raw          RawField       // Complete raw HTTP response
+	RawLength    int64          // Length of the raw HTTP response in bytes
+	Metadata     map[string]any // Additional metadata and extension data
+	Tags         []string       // Tags added by extensions to the request, including the ones added while handling the response
+	Note         *string        // Note set by an extension on the request, including while handling the response
+	RespondedAt  time.Time      // Timestamp when response was received
+	UpstreamAddr string         // Remote address (ip:port) of the upstream connection that served the response
 }
 
 // Row represents a complete request-response pair with associated metadata,
@@ -120,5 +175,6 @@ type RequestResponseSummary struct {
 	Metadata    map[string]any
 	RequestedAt time.Time
 	RespondedAt time.Time
+	Reviewed    bool
 	// TODO CHECK IF NOTE WILL BE ADDED
 }
@@ -0,0 +1,64 @@
+package extensions
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// decodeContent reverses the Content-Encoding of a body. Multiple codings are
+// removed in the reverse order they were applied, identity and empty codings
+// are ignored and unknown codings return an error.
+func decodeContent(body []byte, contentEncoding string) ([]byte, error) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		var reader io.Reader
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("creating gzip reader : %w", err)
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		case "br":
+			reader = brotli.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// deflate is zlib wrapped per the RFC but some servers send raw deflate streams
+			zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				reader = flate.NewReader(bytes.NewReader(body))
+			} else {
+				defer zlibReader.Close()
+				reader = zlibReader
+			}
+		case "zstd":
+			zstdReader, err := zstd.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("creating zstd reader : %w", err)
+			}
+			defer zstdReader.Close()
+			reader = zstdReader
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", coding)
+		}
+
+		decoded, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s content : %w", coding, err)
+		}
+		body = decoded
+	}
+	return body, nil
+}
@@ -58,35 +58,17 @@ func cryptoLibrary() []lua.RegistryFunction {
 		//
 		// @param input string The string to hash.
 		// @return string The MD5 hash encoded as a hexadecimal string.
-		{Name: "md5", Function: func(l *lua.State) int {
-			inputString := lua.CheckString(l, 2)
-
-			hash := md5.Sum([]byte(inputString))
-			l.PushString(hex.EncodeToString(hash[:]))
-			return 1
-		}},
+		{Name: "md5", Function: md5Hex},
 		// sha1 calculates the SHA1 hash of a given string.
 		//
 		// @param input string The string to hash.
 		// @return string The SHA1 hash encoded as a hexadecimal string.
-		{Name: "sha1", Function: func(l *lua.State) int {
-			inputString := lua.CheckString(l, 2)
-
-			hash := sha1.Sum([]byte(inputString))
-			l.PushString(hex.EncodeToString(hash[:]))
-			return 1
-		}},
+		{Name: "sha1", Function: sha1Hex},
 		// sha256 calculates the SHA256 hash of a given string.
 		//
 		// @param input string The string to hash.
 		// @return string The SHA256 hash encoded as a hexadecimal string.
-		{Name: "sha256", Function: func(l *lua.State) int {
-			inputString := lua.CheckString(l, 2)
-
-			hash := sha256.Sum256([]byte(inputString))
-			l.PushString(hex.EncodeToString(hash[:]))
-			return 1
-		}},
+		{Name: "sha256", Function: sha256Hex},
 		// hmac_sha256 calculates the HMAC-SHA256 of a message with a given secret.
 		//
 		// @param secret string The secret key.
@@ -595,3 +577,33 @@ func ed25519Library() []lua.RegistryFunction {
 		}},
 	}
 }
+
+// md5Hex pushes the MD5 hash of the string argument encoded as a hexadecimal string.
+// It is shared by `marasi.crypto` and `marasi.utils`.
+func md5Hex(l *lua.State) int {
+	inputString := lua.CheckString(l, 2)
+
+	hash := md5.Sum([]byte(inputString))
+	l.PushString(hex.EncodeToString(hash[:]))
+	return 1
+}
+
+// sha1Hex pushes the SHA1 hash of the string argument encoded as a hexadecimal string.
+// It is shared by `marasi.crypto` and `marasi.utils`.
+func sha1Hex(l *lua.State) int {
+	inputString := lua.CheckString(l, 2)
+
+	hash := sha1.Sum([]byte(inputString))
+	l.PushString(hex.EncodeToString(hash[:]))
+	return 1
+}
+
+// sha256Hex pushes the SHA256 hash of the string argument encoded as a hexadecimal string.
+// It is shared by `marasi.crypto` and `marasi.utils`.
+func sha256Hex(l *lua.State) int {
+	inputString := lua.CheckString(l, 2)
+
+	hash := sha256.Sum256([]byte(inputString))
+	l.PushString(hex.EncodeToString(hash[:]))
+	return 1
+}
@@ -113,28 +113,37 @@ func hexLibrary() []lua.RegistryFunction {
 		//
 		// @param input string The string to encode.
 		// @return string The hexadecimal encoded string.
-		{Name: "encode", Function: func(l *lua.State) int {
-			inputString := lua.CheckString(l, 2)
-
-			l.PushString(hex.EncodeToString([]byte(inputString)))
-			return 1
-		}},
+		{Name: "encode", Function: hexEncode},
 		// decode decodes a hexadecimal encoded string.
 		//
 		// @param input string The hexadecimal encoded string to decode.
 		// @return string The decoded string.
-		{Name: "decode", Function: func(l *lua.State) int {
-			encodedString := lua.CheckString(l, 2)
+		{Name: "decode", Function: hexDecode},
+	}
+}
 
-			decoded, err := hex.DecodeString(encodedString)
-			if err != nil {
-				lua.Errorf(l, "decoding hex %s: %s", encodedString, err.Error())
-				return 0
-			}
-			l.PushString(string(decoded))
-			return 1
-		}},
+// hexEncode pushes the hexadecimal encoding of the string argument.
+// It is shared by `marasi.encoding.hex` and `marasi.utils`.
+func hexEncode(l *lua.State) int {
+	inputString := lua.CheckString(l, 2)
+
+	l.PushString(hex.EncodeToString([]byte(inputString)))
+	return 1
+}
+
+// hexDecode pushes the decoded string of the hexadecimal argument,
+// it raises an error on odd length or invalid input.
+// It is shared by `marasi.encoding.hex` and `marasi.utils`.
+func hexDecode(l *lua.State) int {
+	encodedString := lua.CheckString(l, 2)
+
+	decoded, err := hex.DecodeString(encodedString)
+	if err != nil {
+		lua.Errorf(l, "decoding hex %s: %s", encodedString, err.Error())
+		return 0
 	}
+	l.PushString(string(decoded))
+	return 1
 }
 
 // urlEncodeLibrary returns a list of Lua functions for URL encoding and
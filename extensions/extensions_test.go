@@ -1,10 +1,13 @@
 package extensions
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"net/http"
 	"testing"
 
+	"github.com/andybalholm/brotli"
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/compass"
 	"github.com/tfkr-ae/marasi/domain"
@@ -20,13 +23,35 @@ func (er *erroringReader) Close() error {
 	return nil
 }
 
+// gzipBytes returns s compressed with gzip
+func gzipBytes(s string) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(s))
+	writer.Close()
+	return buf.Bytes()
+}
+
+// brotliBytes returns s compressed with brotli
+func brotliBytes(s string) []byte {
+	var buf bytes.Buffer
+	writer := brotli.NewWriter(&buf)
+	writer.Write([]byte(s))
+	writer.Close()
+	return buf.Bytes()
+}
+
 type mockProxyService struct {
-	GetConfigDirFunc     func() (string, error)
-	GetScopeFunc         func() (*compass.Scope, error)
-	GetClientFunc        func() (*http.Client, error)
-	WriteLogFunc         func(level string, message string, options ...func(log *domain.Log) error) error
-	GetExtensionRepoFunc func() (domain.ExtensionRepository, error)
-	GetTrafficRepoFunc   func() (domain.TrafficRepository, error)
+	GetConfigDirFunc             func() (string, error)
+	GetScopeFunc                 func() (*compass.Scope, error)
+	GetClientFunc                func() (*http.Client, error)
+	WriteLogFunc                 func(level string, message string, options ...func(log *domain.Log) error) error
+	GetExtensionRepoFunc         func() (domain.ExtensionRepository, error)
+	GetTrafficRepoFunc           func() (domain.TrafficRepository, error)
+	GetExtensionEgressPolicyFunc func() (*compass.Scope, error)
+	EmitEventFunc                func(event ExtensionEvent) error
+	SaveArtifactFunc             func(name string, data []byte) error
+	SetDefaultAllowFunc          func(allow bool) error
 }
 
 func (m *mockProxyService) GetConfigDir() (string, error) {
@@ -71,6 +96,39 @@ func (m *mockProxyService) GetTrafficRepo() (domain.TrafficRepository, error) {
 	return nil, nil
 }
 
+func (m *mockProxyService) GetExtensionEgressPolicy() (*compass.Scope, error) {
+	if m.GetExtensionEgressPolicyFunc != nil {
+		return m.GetExtensionEgressPolicyFunc()
+	}
+	return compass.NewScope(true), nil
+}
+
+func (m *mockProxyService) EmitEvent(event ExtensionEvent) error {
+	if m.EmitEventFunc != nil {
+		return m.EmitEventFunc(event)
+	}
+	return nil
+}
+
+func (m *mockProxyService) SaveArtifact(name string, data []byte) error {
+	if m.SaveArtifactFunc != nil {
+		return m.SaveArtifactFunc(name, data)
+	}
+	return nil
+}
+
+func (m *mockProxyService) SetDefaultAllow(allow bool) error {
+	if m.SetDefaultAllowFunc != nil {
+		return m.SetDefaultAllowFunc(allow)
+	}
+	scope, err := m.GetScope()
+	if err != nil {
+		return err
+	}
+	scope.SetDefaultAllow(allow)
+	return nil
+}
+
 type mockExtensionRepo struct {
 	settingsStore map[uuid.UUID]map[string]any
 	forceSetError bool
@@ -90,6 +148,10 @@ func (m *mockExtensionRepo) GetExtensionSettingsByUUID(id uuid.UUID) (map[string
 	return make(map[string]any), nil
 }
 
+func (m *mockExtensionRepo) UpsertExtension(extension *domain.Extension) error { return nil }
+func (m *mockExtensionRepo) DeleteExtension(id uuid.UUID) error                { return nil }
+func (m *mockExtensionRepo) SetExtensionOrder(ids []uuid.UUID) error           { return nil }
+
 func (m *mockExtensionRepo) SetExtensionSettingsByUUID(id uuid.UUID, settings map[string]any) error {
 	if m.forceSetError {
 		return errors.New("forced set error")
@@ -116,6 +178,19 @@ func (m *mockTrafficRepo) InsertResponse(res *domain.ProxyResponse) error {
 func (m *mockTrafficRepo) GetResponse(id uuid.UUID) (*domain.ProxyResponse, error) {
 	return nil, nil
 }
+func (m *mockTrafficRepo) GetRawRequest(id uuid.UUID) ([]byte, error)  { return nil, nil }
+func (m *mockTrafficRepo) GetRawResponse(id uuid.UUID) ([]byte, error) { return nil, nil }
+func (m *mockTrafficRepo) ClearTraffic(preserveLaunchpad bool) error   { return nil }
+func (m *mockTrafficRepo) MarkReviewed(requestID uuid.UUID, reviewed bool) error {
+	return nil
+}
+func (m *mockTrafficRepo) ListTraffic(filter domain.TrafficFilter) ([]*domain.RequestResponseSummary, error) {
+	return nil, nil
+}
+
+func (m *mockTrafficRepo) GetNeighbors(requestID uuid.UUID, filter domain.TrafficFilter) (*uuid.UUID, *uuid.UUID, error) {
+	return nil, nil, nil
+}
 
 func (m *mockTrafficRepo) GetRequestResponseSummary() ([]*domain.RequestResponseSummary, error) {
 	if m.forceError {
@@ -160,6 +235,22 @@ func (m *mockTrafficRepo) UpdateMetadata(metadata map[string]any, ids ...uuid.UU
 	return nil
 }
 
+func (m *mockTrafficRepo) MergeMetadata(requestID uuid.UUID, metadata map[string]any) error {
+	if m.forceError {
+		return errors.New("forced repo error")
+	}
+	if m.metadataStore == nil {
+		m.metadataStore = make(map[uuid.UUID]map[string]any)
+	}
+	if m.metadataStore[requestID] == nil {
+		m.metadataStore[requestID] = make(map[string]any)
+	}
+	for k, v := range metadata {
+		m.metadataStore[requestID][k] = v
+	}
+	return nil
+}
+
 func (m *mockTrafficRepo) GetNote(id uuid.UUID) (string, error) {
 	if m.forceError {
 		return "", errors.New("forced repo error")
@@ -191,6 +282,30 @@ func (m *mockTrafficRepo) SearchByMetadata(path string, value any) ([]*domain.Re
 	return []*domain.RequestResponseSummary{}, nil
 }
 
+func (m *mockTrafficRepo) AddTag(requestID uuid.UUID, tag string) error {
+	if m.forceError {
+		return errors.New("forced repo error")
+	}
+	return nil
+}
+
+func (m *mockTrafficRepo) RemoveTag(requestID uuid.UUID, tag string) error {
+	if m.forceError {
+		return errors.New("forced repo error")
+	}
+	return nil
+}
+
+func (m *mockTrafficRepo) ListByTag(tag string) ([]*domain.RequestResponseSummary, error) {
+	if m.forceError {
+		return nil, errors.New("forced repo error")
+	}
+	if m.summaryData != nil {
+		return m.summaryData, nil
+	}
+	return []*domain.RequestResponseSummary{}, nil
+}
+
 func setupTestExtension(t *testing.T, luaCode string, options ...func(*Runtime) error) (*Runtime, *mockProxyService) {
 	t.Helper()
 
@@ -1,22 +1,22 @@
 package extensions
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
-	"strings"
+	"time"
 
 	"github.com/Shopify/go-lua"
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/core"
+	"github.com/tfkr-ae/marasi/domain"
 )
 
 // registerMarasiLibrary registers the `marasi` global library and its sub-libraries
 // into the Lua state. This is the main entry point for exposing the proxy's
 // functionality to Lua scripts.
-func registerMarasiLibrary(l *lua.State, proxy ProxyService) {
+func registerMarasiLibrary(extension *Runtime, proxy ProxyService) {
+	l := extension.LuaState
 	funcs := []lua.RegistryFunction{
 		// log writes a message to the proxy's log.
 		//
@@ -26,19 +26,71 @@ func registerMarasiLibrary(l *lua.State, proxy ProxyService) {
 		{Name: "log", Function: func(l *lua.State) int {
 			message := lua.CheckString(l, 2)
 			level := lua.OptString(l, 3, "INFO")
+
+			var options []func(*domain.Log) error
 			if extID := GetExtensionID(l); extID != uuid.Nil {
-				err := proxy.WriteLog(level, message, core.LogWithExtensionID(extID))
-				if err != nil {
-					lua.Errorf(l, fmt.Sprintf("writing log : %s", err.Error()))
-					return 0
-				}
-			} else {
-				err := proxy.WriteLog(level, message)
-				if err != nil {
-					lua.Errorf(l, fmt.Sprintf("writing log : %s", err.Error()))
+				options = append(options, core.LogWithExtensionID(extID))
+			}
+			if extension.activeRequestID != nil {
+				options = append(options, core.LogWithReqResID(*extension.activeRequestID))
+			}
+
+			if err := proxy.WriteLog(level, message, options...); err != nil {
+				lua.Errorf(l, fmt.Sprintf("writing log : %s", err.Error()))
+				return 0
+			}
+			return 0
+		}},
+		// emit sends a custom event to the host application, such as a finding the user should be notified about.
+		//
+		// @param name string The name of the event.
+		// @param data table (optional) The JSON serializable payload of the event.
+		{Name: "emit", Function: func(l *lua.State) int {
+			name := lua.CheckString(l, 2)
+			if name == "" {
+				lua.ArgumentError(l, 2, "event name must not be empty")
+				return 0
+			}
+
+			var data any
+			if !l.IsNoneOrNil(3) {
+				lua.CheckType(l, 3, lua.TypeTable)
+				data = GoValue(l, 3)
+				if _, err := json.Marshal(data); err != nil {
+					lua.Errorf(l, fmt.Sprintf("event data is not JSON serializable : %s", err.Error()))
 					return 0
 				}
 			}
+
+			event := ExtensionEvent{
+				ExtensionID: GetExtensionID(l),
+				Name:        name,
+				Data:        data,
+				RequestID:   extension.activeRequestID,
+				Time:        time.Now(),
+			}
+			if err := proxy.EmitEvent(event); err != nil {
+				lua.Errorf(l, fmt.Sprintf("emitting event : %s", err.Error()))
+				return 0
+			}
+			return 0
+		}},
+		// save_artifact passes a named artifact, such as a downloaded file, to the host application which decides where it is stored.
+		//
+		// @param name string The name of the artifact.
+		// @param data string The content of the artifact.
+		{Name: "save_artifact", Function: func(l *lua.State) int {
+			name := lua.CheckString(l, 2)
+			if name == "" {
+				lua.ArgumentError(l, 2, "artifact name must not be empty")
+				return 0
+			}
+			data := lua.CheckString(l, 3)
+
+			if err := proxy.SaveArtifact(name, []byte(data)); err != nil {
+				lua.Errorf(l, fmt.Sprintf("saving artifact : %s", err.Error()))
+				return 0
+			}
 			return 0
 		}},
 		// config returns the path to the proxy's configuration directory.
@@ -53,11 +105,14 @@ func registerMarasiLibrary(l *lua.State, proxy ProxyService) {
 			l.PushString(config)
 			return 1
 		}},
-		// scope returns the proxy's current scope.
+		// scope returns the proxy's scope.
+		// The scope object looks up the proxy scope on every method call, so it follows scopes replaced with SetScope.
+		// Within processRequest and processResponse the same scope is used for the whole call,
+		// even if the proxy scope is replaced while the call is running.
 		//
 		// @return Scope The scope object.
 		{Name: "scope", Function: func(l *lua.State) int {
-			scope, err := proxy.GetScope()
+			scope, err := extension.currentScope(proxy)
 			if err != nil {
 				lua.Errorf(l, fmt.Sprintf("getting scope : %s", err.Error()))
 				return 0
@@ -76,37 +131,15 @@ func registerMarasiLibrary(l *lua.State, proxy ProxyService) {
 
 			if err == nil {
 				builder := NewRequestBuilder(client)
+				if policy, err := proxy.GetExtensionEgressPolicy(); err == nil {
+					builder.egressPolicy = policy
+				}
 
 				if nargs >= 2 {
 					if req, ok := l.ToUserData(2).(*http.Request); ok {
-						builder.method = req.Method
-
-						if req.URL != nil {
-							u := *req.URL
-							builder.url = &u
-						} else {
-							builder.url = &url.URL{}
-						}
-
-						for name, values := range req.Header {
-							builder.headers[name] = values
-							if strings.ToLower(name) == "content-type" {
-								builder.contentType = values[0]
-							}
-						}
-
-						for _, cookie := range req.Cookies() {
-							builder.cookies = append(builder.cookies, cookie)
-						}
-
-						if req.Body != nil {
-							bodyBytes, err := io.ReadAll(req.Body)
-							if err != nil {
-								lua.Errorf(l, fmt.Sprintf("reading request body : %s", err.Error()))
-								return 0
-							}
-							builder.body = string(bodyBytes)
-							req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+						if err := builder.fromRequest(req); err != nil {
+							lua.Errorf(l, fmt.Sprintf("reading request body : %s", err.Error()))
+							return 0
 						}
 					} else {
 						lua.ArgumentError(l, 2, "expected request object")
@@ -121,6 +154,32 @@ func registerMarasiLibrary(l *lua.State, proxy ProxyService) {
 			lua.Errorf(l, fmt.Sprintf("getting marasi client : %s", err.Error()))
 			return 0
 		}},
+		// sleep pauses the extension for the given duration without blocking other calls
+		// into the runtime. The duration is capped to the runtime's maximum sleep.
+		// A call that sleeps while another call is sleeping is queued, the sleepers resume in the reverse order they started sleeping.
+		//
+		// @param ms number The duration to sleep in milliseconds.
+		{Name: "sleep", Function: func(l *lua.State) int {
+			ms := lua.CheckInteger(l, 2)
+			if ms < 0 {
+				lua.ArgumentError(l, 2, "duration must not be negative")
+				return 0
+			}
+
+			maxSleep := extension.MaxSleep
+			if maxSleep <= 0 {
+				maxSleep = DefaultMaxSleep
+			}
+			d := maxSleep
+			if int64(ms) < maxSleep.Milliseconds() {
+				d = time.Duration(ms) * time.Millisecond
+			}
+
+			if err := extension.sleep(d); err != nil {
+				lua.Errorf(l, fmt.Sprintf("sleeping : %s", err.Error()))
+			}
+			return 0
+		}},
 	}
 
 	lua.NewLibrary(l, funcs)
@@ -129,8 +188,9 @@ func registerMarasiLibrary(l *lua.State, proxy ProxyService) {
 	registerSettingsLibrary(l, proxy)
 	registerEncodingLibrary(l)
 	registerCryptoLibrary(l)
-	registerUtilsLibrary(l)
+	registerUtilsLibrary(l, extension)
 	registerStringsLibrary(l)
 	registerRandomLibrary(l)
+	registerPresetsLibrary(l)
 	registerRepoLibrary(l, proxy)
 }
@@ -1,14 +1,22 @@
 package extensions
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Shopify/go-lua"
+	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/compass"
+	"github.com/tfkr-ae/marasi/core"
 	"github.com/tfkr-ae/marasi/domain"
 )
 
@@ -61,6 +69,50 @@ func TestMarasiLog(t *testing.T) {
 		}
 	})
 
+	t.Run("marasi:log should record the request ID during processRequest", func(t *testing.T) {
+		ext, mockProxy := setupTestExtension(t, `
+			function processRequest(req)
+				marasi:log("processing request")
+			end
+		`)
+
+		var capturedLog *domain.Log
+		mockProxy.WriteLogFunc = func(level, msg string, opts ...func(*domain.Log) error) error {
+			log := &domain.Log{Level: level, Message: msg}
+			for _, option := range opts {
+				if err := option(log); err != nil {
+					return err
+				}
+			}
+			capturedLog = log
+			return nil
+		}
+
+		reqID := uuid.MustParse("0193802f-f0e7-73d9-a764-06d21e367809")
+		req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+		req = core.ContextWithRequestID(req, reqID)
+
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("calling processRequest: %v", err)
+		}
+
+		if capturedLog == nil || capturedLog.RequestID == nil {
+			t.Fatalf("wanted:\nrequest ID set\ngot:\n%v", capturedLog)
+		}
+
+		if *capturedLog.RequestID != reqID {
+			t.Errorf("wanted:\n%v\ngot:\n%v", reqID, *capturedLog.RequestID)
+		}
+
+		if err := ext.ExecuteLua(`marasi:log("outside of a handler")`); err != nil {
+			t.Fatalf("executing lua: %v", err)
+		}
+
+		if capturedLog.RequestID != nil {
+			t.Errorf("wanted:\nnil request ID\ngot:\n%v", *capturedLog.RequestID)
+		}
+	})
+
 	t.Run("marasi:log should default to INFO level if not provided", func(t *testing.T) {
 		ext, mockProxy := setupTestExtension(t, "")
 		var capturedLog *domain.Log
@@ -111,6 +163,164 @@ func TestMarasiLog(t *testing.T) {
 	})
 }
 
+func TestMarasiEmit(t *testing.T) {
+	t.Run("marasi:emit should pass the event to the proxy", func(t *testing.T) {
+		ext, mockProxy := setupTestExtension(t, `
+			function processRequest(req)
+				marasi:emit("vulnerability", { title = "Reflected XSS", severity = "high", params = { "q" } })
+			end
+		`)
+
+		var captured *ExtensionEvent
+		mockProxy.EmitEventFunc = func(event ExtensionEvent) error {
+			captured = &event
+			return nil
+		}
+
+		reqID := uuid.MustParse("0193802f-f0e7-73d9-a764-06d21e367809")
+		req, _ := http.NewRequest("GET", "https://marasi.app/?q=1", nil)
+		req = core.ContextWithRequestID(req, reqID)
+
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("calling processRequest: %v", err)
+		}
+
+		if captured == nil {
+			t.Fatalf("wanted:\nevent emitted\ngot:\nnil")
+		}
+
+		if captured.Name != "vulnerability" {
+			t.Errorf("wanted:\n%q\ngot:\n%q", "vulnerability", captured.Name)
+		}
+
+		want := map[string]any{
+			"title":    "Reflected XSS",
+			"severity": "high",
+			"params":   []any{"q"},
+		}
+		if !reflect.DeepEqual(want, captured.Data) {
+			t.Errorf("wanted:\n%v\ngot:\n%v", want, captured.Data)
+		}
+
+		if captured.ExtensionID != ext.Data.ID {
+			t.Errorf("wanted:\n%v\ngot:\n%v", ext.Data.ID, captured.ExtensionID)
+		}
+
+		if captured.RequestID == nil || *captured.RequestID != reqID {
+			t.Errorf("wanted:\n%v\ngot:\n%v", reqID, captured.RequestID)
+		}
+	})
+
+	t.Run("marasi:emit should allow events without data", func(t *testing.T) {
+		ext, mockProxy := setupTestExtension(t, "")
+
+		var captured *ExtensionEvent
+		mockProxy.EmitEventFunc = func(event ExtensionEvent) error {
+			captured = &event
+			return nil
+		}
+
+		if err := ext.ExecuteLua(`marasi:emit("scan_finished")`); err != nil {
+			t.Fatalf("executing lua: %v", err)
+		}
+
+		if captured == nil || captured.Name != "scan_finished" || captured.Data != nil {
+			t.Errorf("wanted:\nscan_finished event without data\ngot:\n%+v", captured)
+		}
+	})
+
+	t.Run("marasi:emit should return an error to lua if the event cannot be emitted", func(t *testing.T) {
+		ext, mockProxy := setupTestExtension(t, "")
+
+		mockProxy.EmitEventFunc = func(event ExtensionEvent) error {
+			return errors.New("no listener")
+		}
+
+		err := ext.ExecuteLua(`
+			local ok, res = pcall(marasi.emit, marasi, "finding", {})
+			if ok then return "expected error" end
+			return res
+		`)
+		if err != nil {
+			t.Fatalf("executing lua: %v", err)
+		}
+
+		result, _ := GoValue(ext.LuaState, -1).(string)
+		if !strings.Contains(result, "emitting event : no listener") {
+			t.Errorf("wanted:\nerror containing 'emitting event : no listener'\ngot:\n%v", result)
+		}
+	})
+}
+
+func TestMarasiSaveArtifact(t *testing.T) {
+	t.Run("marasi:save_artifact should pass the name and the body bytes to the proxy", func(t *testing.T) {
+		ext, mockProxy := setupTestExtension(t, `
+			function processResponse(res)
+				marasi:save_artifact("report.pdf", res:body())
+			end
+		`)
+
+		var gotName string
+		var gotData []byte
+		mockProxy.SaveArtifactFunc = func(name string, data []byte) error {
+			gotName = name
+			gotData = data
+			return nil
+		}
+
+		body := []byte("%PDF-1.7\x00\xff\xfe binary")
+		req, _ := http.NewRequest("GET", "https://marasi.app/report.pdf", nil)
+		res := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/pdf"}},
+			Body:       io.NopCloser(bytes.NewReader(body)),
+			Request:    req,
+		}
+
+		if err := ext.CallResponseHandler(res); err != nil {
+			t.Fatalf("calling processResponse: %v", err)
+		}
+
+		if gotName != "report.pdf" {
+			t.Errorf("wanted:\n%q\ngot:\n%q", "report.pdf", gotName)
+		}
+		if !bytes.Equal(gotData, body) {
+			t.Errorf("wanted:\n%q\ngot:\n%q", body, gotData)
+		}
+	})
+
+	t.Run("marasi:save_artifact should return an error to lua if the artifact cannot be saved", func(t *testing.T) {
+		ext, mockProxy := setupTestExtension(t, "")
+
+		mockProxy.SaveArtifactFunc = func(name string, data []byte) error {
+			return errors.New("no artifact handler defined")
+		}
+
+		err := ext.ExecuteLua(`
+			local ok, res = pcall(marasi.save_artifact, marasi, "dump.bin", "data")
+			if ok then return "expected error" end
+			return res
+		`)
+		if err != nil {
+			t.Fatalf("executing lua: %v", err)
+		}
+
+		result, _ := GoValue(ext.LuaState, -1).(string)
+		if !strings.Contains(result, "saving artifact : no artifact handler defined") {
+			t.Errorf("wanted:\nerror containing 'saving artifact : no artifact handler defined'\ngot:\n%v", result)
+		}
+	})
+
+	t.Run("marasi:save_artifact should reject an empty name", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, "")
+
+		err := ext.ExecuteLua(`marasi:save_artifact("", "data")`)
+		if err == nil || !strings.Contains(err.Error(), "artifact name must not be empty") {
+			t.Errorf("wanted:\nerror containing 'artifact name must not be empty'\ngot:\n%v", err)
+		}
+	})
+}
+
 func TestMarasiConfig(t *testing.T) {
 	t.Run("marasi:config should return config directory path", func(t *testing.T) {
 		ext, mockProxy := setupTestExtension(t, "")
@@ -193,6 +403,7 @@ func TestMarasiBuilder(t *testing.T) {
 		req, _ := http.NewRequest("POST", "https://marasi.app/test", strings.NewReader(bodyContent))
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Add("X-Custom", "Marasi")
+		req.AddCookie(&http.Cookie{Name: "session", Value: "marasi"})
 
 		ext.LuaState.PushUserData(req)
 		lua.SetMetaTableNamed(ext.LuaState, "req")
@@ -229,8 +440,31 @@ func TestMarasiBuilder(t *testing.T) {
 			t.Errorf("\nwanted:\n%v\ngot:\n%v", req.Header, builder.headers)
 		}
 
-		if !reflect.DeepEqual(builder.cookies, req.Cookies()) {
-			t.Errorf("\nwanted:\n%v\ngot:\n%v", req.Cookies(), builder.cookies)
+		// The cookies are carried by the Cookie header
+		if len(builder.cookies) != 0 {
+			t.Errorf("\nwanted:\n0 cookies\ngot:\n%v", builder.cookies)
+		}
+	})
+
+	t.Run("marasi:builder() should use the extension egress policy", func(t *testing.T) {
+		ext, mockProxy := setupTestExtension(t, "")
+		policy := compass.NewScope(false)
+		mockProxy.GetExtensionEgressPolicyFunc = func() (*compass.Scope, error) {
+			return policy, nil
+		}
+
+		err := ext.ExecuteLua(`return marasi:builder()`)
+		if err != nil {
+			t.Fatalf("executing lua: %v", err)
+		}
+
+		builder, ok := GoValue(ext.LuaState, -1).(*RequestBuilder)
+		if !ok {
+			t.Fatalf("\nwanted:\n*RequestBuilder\ngot:\n%T", GoValue(ext.LuaState, -1))
+		}
+
+		if builder.egressPolicy != policy {
+			t.Errorf("\nwanted:\n%v\ngot:\n%v", policy, builder.egressPolicy)
 		}
 	})
 
@@ -336,4 +570,292 @@ func TestMarasiScope(t *testing.T) {
 			t.Errorf("wanted:\ntrue\ngot:\nfalse")
 		}
 	})
+
+	t.Run("scope held since load should follow the replaced proxy scope", func(t *testing.T) {
+		luaCode := `
+			local scope = marasi:scope()
+			local copy = scope:clone()
+
+			function processRequest(req)
+				req:headers():set("x-scope", tostring(scope:matches_string("marasi.app", "host")) .. "," .. tostring(copy:matches_string("marasi.app", "host")))
+			end
+		`
+		ext, mockProxy := setupTestExtension(t, "")
+
+		current := compass.NewScope(true)
+		mockProxy.GetScopeFunc = func() (*compass.Scope, error) {
+			return current, nil
+		}
+		if err := ext.ExecuteLua(luaCode); err != nil {
+			t.Fatalf("executing lua: %v", err)
+		}
+
+		current = compass.NewScope(false)
+
+		req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if got := req.Header.Get("x-scope"); got != "false,true" {
+			t.Errorf("\nwanted:\nfalse,true\ngot:\n%s", got)
+		}
+	})
+
+	t.Run("marasi:scope() should return the same scope for the whole handler call", func(t *testing.T) {
+		luaCode := `
+			function processRequest(req)
+				local before = marasi:scope():matches_string("marasi.app", "host")
+				swap_scope()
+				local after = marasi:scope():matches_string("marasi.app", "host")
+				req:headers():set("x-scope", tostring(before) .. "," .. tostring(after))
+			end
+		`
+		ext, mockProxy := setupTestExtension(t, luaCode)
+
+		current := compass.NewScope(true)
+		mockProxy.GetScopeFunc = func() (*compass.Scope, error) {
+			return current, nil
+		}
+		ext.LuaState.Register("swap_scope", func(l *lua.State) int {
+			current = compass.NewScope(false)
+			return 0
+		})
+
+		req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if got := req.Header.Get("x-scope"); got != "true,true" {
+			t.Errorf("\nwanted:\ntrue,true\ngot:\n%s", got)
+		}
+
+		// the next call sees the replaced scope
+		req, _ = http.NewRequest("GET", "https://marasi.app", nil)
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if got := req.Header.Get("x-scope"); got != "false,false" {
+			t.Errorf("\nwanted:\nfalse,false\ngot:\n%s", got)
+		}
+	})
+
+	t.Run("replaced proxy scopes should not be kept by the runtime", func(t *testing.T) {
+		luaCode := `
+			function processRequest(req)
+				req:headers():set("x-scope", tostring(marasi:scope():matches_string("marasi.app", "host")))
+			end
+		`
+		ext, mockProxy := setupTestExtension(t, luaCode)
+
+		var current *compass.Scope
+		mockProxy.GetScopeFunc = func() (*compass.Scope, error) {
+			return current, nil
+		}
+
+		for i := range 100 {
+			current = compass.NewScope(i%2 == 0)
+			if i == 99 {
+				runtime.GC()
+			}
+
+			req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+			if err := ext.CallRequestHandler(req); err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+			if got, want := req.Header.Get("x-scope"), fmt.Sprint(i%2 == 0); got != want {
+				t.Fatalf("\nwanted:\n%s\ngot:\n%s", want, got)
+			}
+		}
+
+		if got := len(ext.proxyScopes); got > 10 {
+			t.Errorf("\nwanted:\nreplaced scopes to be dropped\ngot:\n%d scopes held", got)
+		}
+	})
+}
+
+func TestMarasiSleep(t *testing.T) {
+	t.Run("marasi:sleep should not serialize concurrent calls", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, `
+			calls = 0
+			function slow()
+				marasi:sleep(500)
+			end
+			function fast()
+				calls = calls + 1
+			end
+		`)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- ext.CallFunction("slow")
+		}()
+
+		// give slow enough time to start sleeping
+		time.Sleep(50 * time.Millisecond)
+
+		start := time.Now()
+		if err := ext.CallFunction("fast"); err != nil {
+			t.Fatalf("calling fast: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+			t.Errorf("wanted:\nfast to finish while slow is sleeping\ngot:\n%s", elapsed)
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("calling slow: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("wanted:\nslow to finish\ngot:\ntimeout")
+		}
+
+		if got := ext.GetGlobal("calls"); got != float64(1) {
+			t.Errorf("wanted:\n1\ngot:\n%v", got)
+		}
+	})
+
+	t.Run("marasi:sleep should be capped to the max sleep", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, "", WithMaxSleep(10*time.Millisecond))
+
+		start := time.Now()
+		if err := ext.ExecuteLua(`marasi:sleep(60000)`); err != nil {
+			t.Fatalf("executing lua: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("wanted:\nsleep capped to 10ms\ngot:\n%s", elapsed)
+		}
+	})
+
+	t.Run("marasi:sleep should queue calls that sleep while another call is sleeping", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, `
+			order = ""
+			function slow()
+				marasi:sleep(300)
+				order = order .. "slow"
+			end
+			function queued()
+				marasi:sleep(10)
+				order = order .. "queued,"
+			end
+		`)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- ext.CallFunction("slow")
+		}()
+
+		// give slow enough time to start sleeping
+		time.Sleep(50 * time.Millisecond)
+		if err := ext.CallFunction("queued"); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("calling slow: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("wanted:\nslow to finish\ngot:\ntimeout")
+		}
+
+		if got := ext.GetGlobal("order"); got != "queued,slow" {
+			t.Errorf("\nwanted:\nqueued,slow\ngot:\n%v", got)
+		}
+	})
+
+	t.Run("marasi:sleep should resume the sleepers in order when the first sleeper is due first", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, `
+			order = ""
+			function first()
+				marasi:sleep(50)
+				order = order .. "first"
+			end
+			function second()
+				marasi:sleep(200)
+				order = order .. "second,"
+			end
+		`)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- ext.CallFunction("first")
+		}()
+
+		// give first enough time to start sleeping
+		time.Sleep(20 * time.Millisecond)
+		if err := ext.CallFunction("second"); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("calling first: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("wanted:\nfirst to finish\ngot:\ntimeout")
+		}
+
+		if got := ext.GetGlobal("order"); got != "second,first" {
+			t.Errorf("\nwanted:\nsecond,first\ngot:\n%v", got)
+		}
+	})
+
+	t.Run("marasi:sleep should resume within the max sleep while other calls keep sleeping", func(t *testing.T) {
+		maxSleep := 200 * time.Millisecond
+		ext, _ := setupTestExtension(t, `
+			function sleeper()
+				marasi:sleep(60000)
+			end
+		`, WithMaxSleep(maxSleep))
+
+		done := make(chan time.Duration, 1)
+		go func() {
+			start := time.Now()
+			ext.CallFunction("sleeper")
+			done <- time.Since(start)
+		}()
+
+		// give sleeper enough time to start sleeping
+		time.Sleep(20 * time.Millisecond)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					ext.CallFunction("sleeper")
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+
+		select {
+		case elapsed := <-done:
+			if elapsed > maxSleep+500*time.Millisecond {
+				t.Errorf("wanted:\nsleeper to resume within %s\ngot:\n%s", maxSleep+500*time.Millisecond, elapsed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("wanted:\nsleeper to resume\ngot:\ntimeout")
+		}
+		close(stop)
+		wg.Wait()
+	})
+
+	t.Run("marasi:sleep should error on negative durations", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, "")
+
+		err := ext.ExecuteLua(`marasi:sleep(-1)`)
+		if err == nil || !strings.Contains(err.Error(), "duration must not be negative") {
+			t.Errorf("wanted:\nnegative duration error\ngot:\n%v", err)
+		}
+	})
 }
@@ -0,0 +1,69 @@
+package extensions
+
+import (
+	"fmt"
+	"maps"
+
+	"github.com/Shopify/go-lua"
+)
+
+// loadedModulesKey is the registry field holding the values returned by the modules loaded with `require`.
+const loadedModulesKey = "marasi_loaded_modules"
+
+// WithModules makes the given Lua modules available to the extension through `require`.
+// The map is keyed by the module name (e.g. "marasi.helpers") and holds the module's Lua source.
+// Only the provided modules can be required, `require` stays disabled when the option is not used.
+func WithModules(modules map[string]string) func(*Runtime) error {
+	return func(extension *Runtime) error {
+		extension.Modules = maps.Clone(modules)
+		registerRequire(extension)
+		return nil
+	}
+}
+
+// registerRequire sets the `require` global to a loader that resolves modules from extension.Modules.
+// Like the standard `require`, a module is executed once and the value it returns is cached,
+// true is cached for modules that do not return a value.
+func registerRequire(extension *Runtime) {
+	l := extension.LuaState
+
+	l.NewTable()
+	l.SetField(lua.RegistryIndex, loadedModulesKey)
+
+	// require loads a module provided by the host.
+	//
+	// @param name string The name of the module.
+	// @return any The value returned by the module.
+	l.Register("require", func(l *lua.State) int {
+		name := lua.CheckString(l, 1)
+
+		l.Field(lua.RegistryIndex, loadedModulesKey)
+		l.Field(-1, name)
+		if !l.IsNil(-1) {
+			return 1
+		}
+		l.Pop(1)
+
+		source, ok := extension.Modules[name]
+		if !ok {
+			lua.Errorf(l, fmt.Sprintf("module %q not found", name))
+			return 0
+		}
+
+		if err := lua.LoadBuffer(l, source, "="+name, "text"); err != nil {
+			msg, _ := l.ToString(-1)
+			lua.Errorf(l, fmt.Sprintf("loading module %q : %s", name, msg))
+			return 0
+		}
+		l.PushString(name)
+		l.Call(1, 1)
+
+		if l.IsNil(-1) {
+			l.Pop(1)
+			l.PushBoolean(true)
+		}
+		l.PushValue(-1)
+		l.SetField(-3, name)
+		return 1
+	})
+}
@@ -0,0 +1,49 @@
+package extensions
+
+import (
+	"github.com/Shopify/go-lua"
+)
+
+// securityHeaders are the response headers that enforce browser security policies.
+// They are exposed as `marasi.presets.security_headers` and removed by `res:remove_security_headers()`.
+var securityHeaders = []string{
+	"Content-Security-Policy",
+	"Content-Security-Policy-Report-Only",
+	"Strict-Transport-Security",
+	"X-Frame-Options",
+	"X-Content-Type-Options",
+	"X-XSS-Protection",
+	"Referrer-Policy",
+	"Permissions-Policy",
+	"Cross-Origin-Opener-Policy",
+	"Cross-Origin-Embedder-Policy",
+	"Cross-Origin-Resource-Policy",
+}
+
+// registerPresetsLibrary registers the `marasi.presets` table, which holds named lists
+// of header names that can be passed to `strip_headers`.
+func registerPresetsLibrary(l *lua.State) {
+	l.Global("marasi")
+
+	if l.IsNil(-1) {
+		l.Pop(1)
+		return
+	}
+
+	l.NewTable()
+	pushStringArray(l, securityHeaders)
+	l.SetField(-2, "security_headers")
+
+	l.SetField(-2, "presets")
+	l.Pop(1)
+}
+
+// pushStringArray pushes the values as a Lua array onto the stack.
+func pushStringArray(l *lua.State, values []string) {
+	l.CreateTable(len(values), 0)
+	for i, value := range values {
+		l.PushInteger(i + 1)
+		l.PushString(value)
+		l.SetTable(-3)
+	}
+}
@@ -1,17 +1,21 @@
 package extensions
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
+	"weak"
 
 	"github.com/Shopify/go-lua"
 	"github.com/Shopify/goluago/util"
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/compass"
+	"github.com/tfkr-ae/marasi/core"
 	"github.com/tfkr-ae/marasi/domain"
 )
 
@@ -31,14 +35,50 @@ type ProxyService interface {
 	GetExtensionRepo() (domain.ExtensionRepository, error)
 	// GetTrafficRepo returns the traffic repository
 	GetTrafficRepo() (domain.TrafficRepository, error)
+	// GetExtensionEgressPolicy returns the policy that restricts the hosts extensions can send requests to.
+	GetExtensionEgressPolicy() (*compass.Scope, error)
+	// EmitEvent passes a custom event emitted by an extension to the host application.
+	EmitEvent(event ExtensionEvent) error
+	// SaveArtifact passes a named artifact saved by an extension to the host application, which decides where it is stored.
+	SaveArtifact(name string, data []byte) error
+	// SetDefaultAllow sets the default behavior of the proxy scope and persists it so it survives a restart.
+	SetDefaultAllow(allow bool) error
 }
 
+// DefaultMaxSleep is the maximum duration of `marasi:sleep` when the runtime does not set MaxSleep.
+const DefaultMaxSleep = 5 * time.Second
+
+// DefaultMaxCallDepth is the maximum depth of nested Lua calls when the runtime does not set MaxCallDepth.
+const DefaultMaxCallDepth = 200
+
+// callDepthCheckInterval is the number of Lua instructions executed between two call depth checks.
+const callDepthCheckInterval = 100
+
+// maxCachedRegexps is the number of compiled patterns a runtime keeps, the cache is emptied when it is full.
+const maxCachedRegexps = 256
+
 // ExtensionLog represents a single log entry generated by a Lua extension.
 type ExtensionLog struct {
 	// Time is the timestamp when the log entry was created.
 	Time time.Time
 	// Text is the content of the log message.
 	Text string
+	// RequestID is the ID of the request being processed when the entry was created, nil outside of a handler call.
+	RequestID *uuid.UUID
+}
+
+// ExtensionEvent is a custom event emitted by a Lua extension with `marasi:emit` for the host application.
+type ExtensionEvent struct {
+	// ExtensionID is the ID of the extension that emitted the event.
+	ExtensionID uuid.UUID
+	// Name is the name of the event chosen by the extension.
+	Name string
+	// Data is the JSON serializable payload of the event, nil when no payload was given.
+	Data any
+	// RequestID is the ID of the request being processed when the event was emitted, nil outside of a handler call.
+	RequestID *uuid.UUID
+	// Time is the timestamp when the event was emitted.
+	Time time.Time
 }
 
 // Runtime represents a self-contained Lua extension environment.
@@ -55,6 +95,212 @@ type Runtime struct {
 	Logs []ExtensionLog
 	// OnLog is a callback function to handle new log entries.
 	OnLog func(ExtensionLog) error `json:"-"`
+	// MaxSleep caps the duration a single `marasi:sleep` waits for, DefaultMaxSleep is used when it is 0.
+	MaxSleep time.Duration
+	// MaxCallDepth caps the depth of nested Lua calls, DefaultMaxCallDepth is used when it is 0.
+	MaxCallDepth int
+	// Modules maps module names to the Lua source returned by `require`, see WithModules.
+	Modules map[string]string
+
+	// proxy is the proxy service the runtime was prepared with.
+	proxy ProxyService
+	// sleepCond signals the sleeping calls waiting for their turn to resume, the calls waiting in lock and Close, it uses Mu as its lock.
+	sleepCond *sync.Cond
+	// sleepers is the number of calls that released Mu in sleep and did not resume yet, it is guarded by Mu.
+	sleepers int
+	// resuming is the number of sleeping calls whose sleep is over and that wait for the calls nested above them, it is guarded by Mu.
+	resuming int
+	// scopeSnapshot holds the scope returned by `marasi:scope` during a processRequest or processResponse call, nil outside of them.
+	scopeSnapshot *scopeSnapshot
+	// proxyScopes holds the proxy scopes returned by `marasi:scope`, they are resolved to the current proxy scope when used.
+	// The scopes are held weakly, so replaced scopes the extension no longer references are dropped.
+	proxyScopes map[weak.Pointer[compass.Scope]]struct{}
+	// activeRequestID is the ID of the request handled by the processRequest or processResponse call in progress, nil outside of them.
+	activeRequestID *uuid.UUID
+	// regexps caches the patterns compiled by compileRegexp, it is guarded by Mu.
+	regexps map[string]*regexp.Regexp
+	// closed is set by Close, it is guarded by Mu.
+	closed bool
+}
+
+// ErrRuntimeClosed is returned when Lua code is executed on a runtime that was closed.
+var ErrRuntimeClosed = errors.New("extension runtime is closed")
+
+// compileRegexp returns the compiled pattern, reusing the result of previous calls with the same pattern.
+// It must be called with Mu held.
+func (extension *Runtime) compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := extension.regexps[pattern]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if extension.regexps == nil || len(extension.regexps) >= maxCachedRegexps {
+		extension.regexps = make(map[string]*regexp.Regexp)
+	}
+	extension.regexps[pattern] = re
+	return re, nil
+}
+
+// scopeSnapshot is the scope seen by a single handler call, it is filled on the first `marasi:scope` call.
+type scopeSnapshot struct {
+	scope *compass.Scope
+}
+
+// beginScopeSnapshot starts a new scope snapshot for a handler call and returns a function that restores the previous one.
+// Restoring keeps the snapshot of a sleeping call intact when another call runs while Mu is released.
+// It must be called with Mu held.
+func (extension *Runtime) beginScopeSnapshot() (restore func()) {
+	previous := extension.scopeSnapshot
+	extension.scopeSnapshot = &scopeSnapshot{}
+	return func() {
+		extension.scopeSnapshot = previous
+	}
+}
+
+// beginActiveRequest sets the request ID found in ctx as the active request of a handler call and returns a function that restores the previous one.
+// It must be called with Mu held.
+func (extension *Runtime) beginActiveRequest(ctx context.Context) (restore func()) {
+	previous := extension.activeRequestID
+	extension.activeRequestID = nil
+	if id, ok := core.RequestIDFromContext(ctx); ok {
+		extension.activeRequestID = &id
+	}
+	return func() {
+		extension.activeRequestID = previous
+	}
+}
+
+// currentScope returns the proxy scope. During a handler call the scope fetched first is returned for the rest of the call,
+// so replacing the proxy scope with SetScope does not change the scope seen by a call in progress.
+func (extension *Runtime) currentScope(proxy ProxyService) (*compass.Scope, error) {
+	snapshot := extension.scopeSnapshot
+	if snapshot != nil && snapshot.scope != nil {
+		return snapshot.scope, nil
+	}
+
+	scope, err := proxy.GetScope()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		snapshot.scope = scope
+	}
+	key := weak.Make(scope)
+	if _, ok := extension.proxyScopes[key]; !ok {
+		if extension.proxyScopes == nil {
+			extension.proxyScopes = make(map[weak.Pointer[compass.Scope]]struct{})
+		}
+		for held := range extension.proxyScopes {
+			if held.Value() == nil {
+				delete(extension.proxyScopes, held)
+			}
+		}
+		extension.proxyScopes[key] = struct{}{}
+	}
+	return scope, nil
+}
+
+// isProxyScope reports whether scope was returned by `marasi:scope`, as opposed to a clone.
+// It must be called with Mu held.
+func (extension *Runtime) isProxyScope(scope *compass.Scope) bool {
+	if extension.proxy == nil {
+		return false
+	}
+	_, ok := extension.proxyScopes[weak.Make(scope)]
+	return ok
+}
+
+// WithMaxSleep sets the maximum duration an extension can pause for with `marasi:sleep`.
+func WithMaxSleep(d time.Duration) func(*Runtime) error {
+	return func(extension *Runtime) error {
+		if d < 0 {
+			return fmt.Errorf("max sleep must not be negative : %s", d)
+		}
+		extension.MaxSleep = d
+		return nil
+	}
+}
+
+// WithMaxCallDepth sets the maximum depth of nested Lua calls before the running handler fails with a stack overflow error.
+func WithMaxCallDepth(depth int) func(*Runtime) error {
+	return func(extension *Runtime) error {
+		if depth < 0 {
+			return fmt.Errorf("max call depth must not be negative : %d", depth)
+		}
+		extension.MaxCallDepth = depth
+		return nil
+	}
+}
+
+// callDepthHook raises a Lua error once the call stack is deeper than MaxCallDepth.
+// Unbounded recursion fails fast as an error returned by the handler call instead of growing the Lua stack until it overflows.
+func (extension *Runtime) callDepthHook(l *lua.State, _ lua.Debug) {
+	maxDepth := extension.MaxCallDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxCallDepth
+	}
+	if _, deeper := lua.Stack(l, maxDepth); deeper {
+		lua.Errorf(l, fmt.Sprintf("stack overflow (call depth exceeds %d)", maxDepth))
+	}
+}
+
+// lock acquires Mu for a new call into the runtime. While a sleeping call is waiting to resume, new calls wait until it did,
+// so that the calls nested above it on the Lua stack can return and the sleeper is not held back by calls that keep coming in.
+func (extension *Runtime) lock() {
+	extension.Mu.Lock()
+	for extension.resuming > 0 {
+		extension.sleepCond.Wait()
+	}
+}
+
+// sleep releases Mu for the duration d so that other calls into the runtime are not blocked.
+// Calls that run while Mu is released are nested above the sleeper on the Lua stack, so a call that sleeps while another
+// call is sleeping is queued above it and the sleepers resume in the reverse order they started sleeping.
+// Once its duration is over a sleeper waits for the calls nested above it to return, new calls wait in lock meanwhile.
+// Once the runtime is closed sleep returns ErrRuntimeClosed, so Close only waits for the calls already sleeping.
+// It must be called with Mu held.
+func (extension *Runtime) sleep(d time.Duration) error {
+	if extension.closed {
+		return ErrRuntimeClosed
+	}
+	if extension.sleepCond == nil {
+		extension.sleepCond = sync.NewCond(&extension.Mu)
+	}
+	extension.sleepers++
+	depth := extension.sleepers
+
+	extension.Mu.Unlock()
+	time.Sleep(d)
+	extension.Mu.Lock()
+
+	extension.resuming++
+	for extension.sleepers != depth {
+		extension.sleepCond.Wait()
+	}
+	extension.resuming--
+	extension.sleepers--
+	extension.sleepCond.Broadcast()
+	return nil
+}
+
+// Close tears down the runtime, the calls sleeping in `marasi:sleep` are allowed to finish before the Lua state is released.
+// Calls made after Close behave as if the extension defined no functions, ExecuteLua returns ErrRuntimeClosed and
+// the callbacks of pending asynchronous requests are dropped.
+func (extension *Runtime) Close() {
+	extension.Mu.Lock()
+	defer extension.Mu.Unlock()
+
+	extension.closed = true
+	for extension.sleepers > 0 {
+		extension.sleepCond.Wait()
+	}
+	extension.LuaState = nil
+	extension.scopeSnapshot = nil
+	extension.proxyScopes = nil
+	extension.regexps = nil
 }
 
 // PrepareState initializes the Lua execution environment for the extension.
@@ -63,6 +309,7 @@ type Runtime struct {
 // It also disables potentially dangerous Lua functions like `dofile` and `loadfile`
 // to sandbox the extension.
 func (extension *Runtime) PrepareState(proxy ProxyService, options []func(*Runtime) error) error {
+	extension.proxy = proxy
 	extension.LuaState = lua.NewState()
 	extension.LuaState.PushString(extension.Data.ID.String())
 	extension.LuaState.SetGlobal("extension_id")
@@ -101,7 +348,7 @@ func (extension *Runtime) PrepareState(proxy ProxyService, options []func(*Runti
 	RegisterRegexType(extension)
 	RegisterScopeType(extension)
 
-	registerMarasiLibrary(extension.LuaState, proxy)
+	registerMarasiLibrary(extension, proxy)
 
 	for _, option := range options {
 		err := option(extension)
@@ -109,7 +356,12 @@ func (extension *Runtime) PrepareState(proxy ProxyService, options []func(*Runti
 			return fmt.Errorf("applying option for extension %s : %w", extension.Data.Name, err)
 		}
 	}
-	if err := lua.DoString(extension.LuaState, extension.Data.LuaContent); err != nil {
+	lua.SetDebugHook(extension.LuaState, extension.callDepthHook, lua.MaskCount, callDepthCheckInterval)
+
+	extension.lock()
+	err := lua.DoString(extension.LuaState, extension.Data.LuaContent)
+	extension.Mu.Unlock()
+	if err != nil {
 		return fmt.Errorf("preparing state for extension %s : %w", extension.Data.Name, err)
 	}
 
@@ -121,9 +373,13 @@ func (extension *Runtime) PrepareState(proxy ProxyService, options []func(*Runti
 
 // GetGlobal returns the value of a global variable from the Lua state.
 func (extension *Runtime) GetGlobal(name string) any {
-	extension.Mu.Lock()
+	extension.lock()
 	defer extension.Mu.Unlock()
 
+	if extension.closed {
+		return nil
+	}
+
 	extension.LuaState.Global(name)
 	defer extension.LuaState.Pop(1)
 
@@ -149,9 +405,13 @@ func (extension *Runtime) GetGlobalString(name string) (string, error) {
 
 // CheckGlobalFunction checks if a global variable of a given name exists and is a function.
 func (extension *Runtime) CheckGlobalFunction(functionName string) bool {
-	extension.Mu.Lock()
+	extension.lock()
 	defer extension.Mu.Unlock()
 
+	if extension.closed {
+		return false
+	}
+
 	extension.LuaState.Global(functionName)
 	defer extension.LuaState.Pop(1)
 
@@ -161,9 +421,13 @@ func (extension *Runtime) CheckGlobalFunction(functionName string) bool {
 // ExecuteLua executes an arbitrary string of Lua code within the extension's sandboxed state.
 // Access is mutex-locked to ensure thread safety.
 func (extension *Runtime) ExecuteLua(code string) error {
-	extension.Mu.Lock()
+	extension.lock()
 	defer extension.Mu.Unlock()
 
+	if extension.closed {
+		return ErrRuntimeClosed
+	}
+
 	err := lua.DoString(extension.LuaState, code)
 	if err != nil {
 		return fmt.Errorf("executing string %s : %w", code, err)
@@ -175,9 +439,13 @@ func (extension *Runtime) ExecuteLua(code string) error {
 // ShouldInterceptRequest calls the `interceptRequest` function in the Lua script
 // to determine if the given HTTP request should be intercepted.
 func (extension *Runtime) ShouldInterceptRequest(req *http.Request) (bool, error) {
-	extension.Mu.Lock()
+	extension.lock()
 	defer extension.Mu.Unlock()
 
+	if extension.closed {
+		return false, nil
+	}
+
 	extension.LuaState.Global("interceptRequest")
 
 	if !extension.LuaState.IsFunction(-1) {
@@ -202,8 +470,13 @@ func (extension *Runtime) ShouldInterceptRequest(req *http.Request) (bool, error
 // ShouldInterceptResponse calls the `interceptResponse` function in the Lua script
 // to determine if the given HTTP response should be intercepted.
 func (extension *Runtime) ShouldInterceptResponse(res *http.Response) (bool, error) {
-	extension.Mu.Lock()
+	extension.lock()
 	defer extension.Mu.Unlock()
+
+	if extension.closed {
+		return false, nil
+	}
+
 	extension.LuaState.Global("interceptResponse")
 
 	if !extension.LuaState.IsFunction(-1) {
@@ -226,9 +499,13 @@ func (extension *Runtime) ShouldInterceptResponse(res *http.Response) (bool, err
 // CallResponseHandler calls the `processResponse` function in the Lua script,
 // passing the HTTP response to be processed by the extension.
 func (extension *Runtime) CallResponseHandler(res *http.Response) error {
-	extension.Mu.Lock()
+	extension.lock()
 	defer extension.Mu.Unlock()
 
+	if extension.closed {
+		return nil
+	}
+
 	extension.LuaState.Global("processResponse")
 
 	if !extension.LuaState.IsFunction(-1) {
@@ -236,6 +513,14 @@ func (extension *Runtime) CallResponseHandler(res *http.Response) error {
 		return nil
 	}
 
+	defer extension.beginScopeSnapshot()()
+
+	ctx := context.Background()
+	if res.Request != nil {
+		ctx = res.Request.Context()
+	}
+	defer extension.beginActiveRequest(ctx)()
+
 	extension.LuaState.PushUserData(res)
 	lua.SetMetaTableNamed(extension.LuaState, "res")
 	err := extension.LuaState.ProtectedCall(1, 0, 0)
@@ -249,9 +534,13 @@ func (extension *Runtime) CallResponseHandler(res *http.Response) error {
 // CallRequestHandler calls the `processRequest` function in the Lua script,
 // passing the HTTP request to be processed by the extension.
 func (extension *Runtime) CallRequestHandler(req *http.Request) error {
-	extension.Mu.Lock()
+	extension.lock()
 	defer extension.Mu.Unlock()
 
+	if extension.closed {
+		return nil
+	}
+
 	extension.LuaState.Global("processRequest")
 
 	if !extension.LuaState.IsFunction(-1) {
@@ -259,6 +548,9 @@ func (extension *Runtime) CallRequestHandler(req *http.Request) error {
 		return nil
 	}
 
+	defer extension.beginScopeSnapshot()()
+	defer extension.beginActiveRequest(req.Context())()
+
 	extension.LuaState.PushUserData(req)
 	lua.SetMetaTableNamed(extension.LuaState, "req")
 
@@ -274,9 +566,13 @@ func (extension *Runtime) CallRequestHandler(req *http.Request) error {
 // It is used for lifecycle events or simple triggers. If the function does not exist,
 // it returns nil. If the function execution fails, it returns a formatted error.
 func (extension *Runtime) CallFunction(name string, args ...any) error {
-	extension.Mu.Lock()
+	extension.lock()
 	defer extension.Mu.Unlock()
 
+	if extension.closed {
+		return nil
+	}
+
 	extension.LuaState.Global(name)
 
 	if !extension.LuaState.IsFunction(-1) {
@@ -327,7 +623,7 @@ func RegisterCustomPrint(extension *Runtime) {
 		}
 
 		msg := strings.Join(parts, "\t")
-		entry := ExtensionLog{Time: time.Now(), Text: msg}
+		entry := ExtensionLog{Time: time.Now(), Text: msg, RequestID: extension.activeRequestID}
 		extension.Logs = append(extension.Logs, entry)
 		if extension.OnLog != nil {
 			extension.OnLog(entry)
@@ -1,15 +1,18 @@
 package extensions
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Shopify/go-lua"
 	"github.com/google/uuid"
+	"github.com/tfkr-ae/marasi/core"
 	"github.com/tfkr-ae/marasi/domain"
 )
 
@@ -244,6 +247,30 @@ func TestRuntime_CallRequestHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("should record the request ID on logs printed by processRequest", func(t *testing.T) {
+		luaCode := `
+			function processRequest(req)
+				print("processRequest executed")
+			end
+		`
+		ext, _ := setupTestExtension(t, luaCode)
+		reqID := uuid.MustParse("0193802f-f0e7-73d9-a764-06d21e367809")
+		req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+		req = core.ContextWithRequestID(req, reqID)
+
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(ext.Logs) != 1 || ext.Logs[0].RequestID == nil {
+			t.Fatalf("\nwanted:\n1 log with a request ID\ngot:\n%+v", ext.Logs)
+		}
+
+		if *ext.Logs[0].RequestID != reqID {
+			t.Errorf("\nwanted:\n%v\ngot:\n%v", reqID, *ext.Logs[0].RequestID)
+		}
+	})
+
 	t.Run("should return error if processRequest fails", func(t *testing.T) {
 		luaCode := `
 			function processRequest(req)
@@ -258,6 +285,80 @@ func TestRuntime_CallRequestHandler(t *testing.T) {
 			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
 		}
 	})
+
+	t.Run("should return a stack overflow error on unbounded recursion", func(t *testing.T) {
+		luaCode := `
+			local function recurse(n)
+				return recurse(n + 1) + 1
+			end
+
+			function processRequest(req)
+				recurse(1)
+			end
+		`
+		ext, _ := setupTestExtension(t, luaCode)
+		req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+
+		err := ext.CallRequestHandler(req)
+		if err == nil || !strings.Contains(err.Error(), "stack overflow") {
+			t.Fatalf("\nwanted:\nstack overflow error\ngot:\n%v", err)
+		}
+
+		if err := ext.ExecuteLua(`function processRequest(req) print("recovered") end`); err != nil {
+			t.Fatalf("updating processRequest : %v", err)
+		}
+
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+	})
+
+	t.Run("should allow recursion within the max call depth", func(t *testing.T) {
+		luaCode := `
+			local function depth(n)
+				if n == 0 then
+					return 0
+				end
+				return depth(n - 1) + 1
+			end
+
+			function processRequest(req)
+				print(depth(150))
+			end
+		`
+		ext, _ := setupTestExtension(t, luaCode)
+		req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(ext.Logs) != 1 || ext.Logs[0].Text != "150" {
+			t.Errorf("\nwanted:\n150\ngot:\n%v", ext.Logs)
+		}
+	})
+
+	t.Run("should use the max call depth set with WithMaxCallDepth", func(t *testing.T) {
+		luaCode := `
+			local function depth(n)
+				if n == 0 then
+					return 0
+				end
+				return depth(n - 1) + 1
+			end
+
+			function processRequest(req)
+				print(depth(150))
+			end
+		`
+		ext, _ := setupTestExtension(t, luaCode, WithMaxCallDepth(50))
+		req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+
+		err := ext.CallRequestHandler(req)
+		if err == nil || !strings.Contains(err.Error(), "call depth exceeds 50") {
+			t.Fatalf("\nwanted:\ncall depth exceeds 50\ngot:\n%v", err)
+		}
+	})
 }
 
 func TestRuntime_CallResponseHandler(t *testing.T) {
@@ -416,6 +517,76 @@ func TestRuntime_MarasiModules(t *testing.T) {
 	}
 }
 
+func TestRuntime_WithModules(t *testing.T) {
+	modules := map[string]string{
+		"marasi.helpers": `
+			local helpers = {}
+			loads = (loads or 0) + 1
+			function helpers.greet(name) return "hello " .. name end
+			return helpers
+		`,
+		"marasi.broken": `return (`,
+	}
+
+	t.Run("required module functions should be callable and the module loaded once", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, "", WithModules(modules))
+
+		err := ext.ExecuteLua(`
+			local helpers = require("marasi.helpers")
+			local again = require("marasi.helpers")
+			if helpers ~= again then return "not cached" end
+			return helpers.greet("marasi"), loads
+		`)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if got := GoValue(ext.LuaState, -2); got != "hello marasi" {
+			t.Errorf("\nwanted:\nhello marasi\ngot:\n%v", got)
+		}
+		if got := GoValue(ext.LuaState, -1); got != float64(1) {
+			t.Errorf("\nwanted:\n1\ngot:\n%v", got)
+		}
+	})
+
+	t.Run("unknown and broken modules should raise an error", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, "", WithModules(modules))
+
+		for name, want := range map[string]string{
+			"marasi.missing": `module "marasi.missing" not found`,
+			"marasi.broken":  `loading module "marasi.broken"`,
+		} {
+			err := ext.ExecuteLua(fmt.Sprintf(`
+				local ok, err = pcall(require, %q)
+				if ok then return "expected error" end
+				return err
+			`, name))
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+
+			got, _ := GoValue(ext.LuaState, -1).(string)
+			if !strings.Contains(got, want) {
+				t.Errorf("\nwanted:\nerror containing %q\ngot:\n%q", want, got)
+			}
+		}
+	})
+
+	t.Run("modules should be copied when the option is applied", func(t *testing.T) {
+		provided := map[string]string{"marasi.helpers": `return 1`}
+		ext, _ := setupTestExtension(t, "", WithModules(provided))
+		provided["marasi.late"] = `return 2`
+
+		err := ext.ExecuteLua(`return pcall(require, "marasi.late")`)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if got := GoValue(ext.LuaState, -2); got != false {
+			t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
+		}
+	})
+}
+
 func TestRuntime_CustomPrint(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -838,6 +1009,113 @@ func TestRuntime_PrepareState_Startup(t *testing.T) {
 	})
 }
 
+func TestRuntime_Close(t *testing.T) {
+	t.Run("calls after Close should not run the Lua state", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, `
+			version = 1
+			function processRequest(request)
+				request:headers():set("X-Ran", "true")
+			end
+		`)
+
+		ext.Close()
+
+		if ext.LuaState != nil {
+			t.Errorf("\nwanted:\nnil lua state\ngot:\n%v", ext.LuaState)
+		}
+		if got := ext.GetGlobal("version"); got != nil {
+			t.Errorf("\nwanted:\nnil\ngot:\n%v", got)
+		}
+		if ext.CheckGlobalFunction("processRequest") {
+			t.Errorf("\nwanted:\nfalse\ngot:\ntrue")
+		}
+
+		req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+		if err := ext.CallRequestHandler(req); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		if got := req.Header.Get("X-Ran"); got != "" {
+			t.Errorf("\nwanted:\nempty\ngot:\n%s", got)
+		}
+
+		if err := ext.ExecuteLua(`version = 2`); !errors.Is(err, ErrRuntimeClosed) {
+			t.Errorf("\nwanted:\n%v\ngot:\n%v", ErrRuntimeClosed, err)
+		}
+	})
+
+	t.Run("Close should wait for sleeping calls to finish", func(t *testing.T) {
+		ext, _ := setupTestExtension(t, `
+			finished = false
+			function slow()
+				marasi:sleep(200)
+				finished = true
+			end
+		`)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- ext.CallFunction("slow")
+		}()
+
+		// give slow enough time to start sleeping
+		time.Sleep(50 * time.Millisecond)
+		ext.Close()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+		default:
+			t.Fatalf("\nwanted:\nslow to finish before Close returned\ngot:\nstill running")
+		}
+	})
+
+	t.Run("Close should return within the max sleep while other calls keep sleeping", func(t *testing.T) {
+		maxSleep := 200 * time.Millisecond
+		ext, _ := setupTestExtension(t, `
+			function sleeper()
+				marasi:sleep(60000)
+			end
+		`, WithMaxSleep(maxSleep))
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					ext.CallFunction("sleeper")
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+		defer wg.Wait()
+		defer close(stop)
+
+		// give the sleepers enough time to start sleeping
+		time.Sleep(50 * time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			ext.Close()
+			close(closed)
+		}()
+
+		select {
+		case <-closed:
+		case <-time.After(maxSleep + 500*time.Millisecond):
+			t.Fatalf("\nwanted:\nClose to return within %s\ngot:\ntimeout", maxSleep+500*time.Millisecond)
+		}
+	})
+}
+
 func TestGoValue(t *testing.T) {
 	t.Run("should convert all supported types correctly", func(t *testing.T) {
 		ext, _ := setupTestExtension(t, "")
@@ -2,15 +2,20 @@ package extensions
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"maps"
 	"mime"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -20,6 +25,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/compass"
 	"github.com/tfkr-ae/marasi/core"
+	"github.com/tfkr-ae/marasi/rawhttp"
 )
 
 var globalCallbackCounter uint64
@@ -63,6 +69,8 @@ type RequestBuilder struct {
 	url *url.URL
 	// body is the request body.
 	body string
+	// bodyChunks is the registry key of the Lua function producing the body in chunks, empty uses body.
+	bodyChunks string
 	// headers are the HTTP headers for the request.
 	headers http.Header
 	// cookies are the cookies to be sent with the request.
@@ -70,6 +78,223 @@ type RequestBuilder struct {
 	// contentType is the value of the "Content-Type" header.
 	contentType string
 	metadata    map[string]any
+	// egressPolicy restricts the hosts the request can be sent to, nil allows all hosts.
+	egressPolicy *compass.Scope
+	// sni is the server name used in the upstream TLS handshake, empty uses the URL host.
+	sni string
+}
+
+// fromRequest populates the builder with the method, URL, headers and body of req.
+// The cookies of req are carried by its Cookie header, the builder cookies are left empty so they are not sent twice.
+// The request body is restored after it is read.
+func (builder *RequestBuilder) fromRequest(req *http.Request) error {
+	builder.method = req.Method
+
+	if req.URL != nil {
+		u := *req.URL
+		builder.url = &u
+	} else {
+		builder.url = &url.URL{}
+	}
+
+	builder.headers = req.Header.Clone()
+	if builder.headers == nil {
+		builder.headers = make(http.Header)
+	}
+	builder.contentType = builder.headers.Get("Content-Type")
+
+	if req.Body != nil {
+		bodyBytes, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		builder.body = string(bodyBytes)
+		req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	}
+	return nil
+}
+
+// clone returns a copy of the builder that can be changed without affecting the original.
+func (builder *RequestBuilder) clone() *RequestBuilder {
+	clone := *builder
+	if builder.url != nil {
+		u := *builder.url
+		clone.url = &u
+	}
+	clone.headers = builder.headers.Clone()
+	if clone.headers == nil {
+		clone.headers = make(http.Header)
+	}
+	clone.cookies = slices.Clone(builder.cookies)
+	clone.metadata = maps.Clone(builder.metadata)
+	if clone.metadata == nil {
+		clone.metadata = make(map[string]any)
+	}
+	return &clone
+}
+
+// sendChunked sends req while writing the chunks produced by the builder's Lua body function to body.
+// The Lua function is only called from the calling goroutine, the request is sent from a separate one.
+func (builder *RequestBuilder) sendChunked(l *lua.State, req *http.Request, body *io.PipeWriter) (*http.Response, error) {
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := builder.client.Do(req)
+		done <- result{resp, err}
+	}()
+
+	body.CloseWithError(builder.writeChunks(l, body))
+	res := <-done
+	return res.resp, res.err
+}
+
+// writeChunks calls the builder's Lua body function until it returns nil and writes each chunk to w.
+func (builder *RequestBuilder) writeChunks(l *lua.State, w io.Writer) error {
+	top := l.Top()
+	defer l.SetTop(top)
+
+	for {
+		l.Field(lua.RegistryIndex, builder.bodyChunks)
+		if err := l.ProtectedCall(0, 1, 0); err != nil {
+			return fmt.Errorf("producing body chunk : %w", err)
+		}
+		if l.IsNil(-1) {
+			return nil
+		}
+		chunk, ok := l.ToString(-1)
+		l.Pop(1)
+		if !ok {
+			return fmt.Errorf("body chunk must be a string")
+		}
+		if _, err := io.WriteString(w, chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// releaseBodyChunks removes the builder's Lua body function from the registry so it can be collected.
+func (builder *RequestBuilder) releaseBodyChunks(l *lua.State) {
+	if builder.bodyChunks == "" {
+		return
+	}
+	l.PushNil()
+	l.SetField(lua.RegistryIndex, builder.bodyChunks)
+	builder.bodyChunks = ""
+}
+
+// asyncSender checks that the builder can be sent asynchronously and returns a function sending a snapshot of it,
+// so the builder can be changed once the function returned. The function can be called without Mu held.
+func (builder *RequestBuilder) asyncSender(extension *Runtime) (func() (*http.Response, error), error) {
+	if builder.method == "" || builder.url == nil || builder.url.String() == "" {
+		return nil, errors.New("method and url must be set before sending the request")
+	}
+
+	if err := builder.checkEgress(); err != nil {
+		return nil, err
+	}
+
+	if builder.bodyChunks != "" {
+		return nil, errors.New("chunked bodies can only be sent with send")
+	}
+
+	client := builder.client
+	reqMethod := builder.method
+	reqUrlStr := builder.url.String()
+	reqBody := builder.body
+	reqHeaders := builder.headers.Clone()
+
+	reqCookies := make([]*http.Cookie, len(builder.cookies))
+	copy(reqCookies, builder.cookies)
+
+	reqMetadata := make(map[string]any)
+	maps.Copy(reqMetadata, builder.metadata)
+
+	extID := extension.Data.ID.String()
+	reqSNI := builder.sni
+	reqPolicy := builder.egressPolicy
+
+	return func() (*http.Response, error) {
+		req, err := http.NewRequest(reqMethod, reqUrlStr, bytes.NewBufferString(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req = withEgressPolicy(req, reqPolicy)
+		req.Header = reqHeaders
+
+		reqMetadata["request_builder"] = true
+		reqMetadata["marasi_extension_id"] = extID
+
+		if jsonBytes, err := json.Marshal(reqMetadata); err == nil {
+			req.Header.Set("x-marasi-metadata", string(jsonBytes))
+		}
+
+		for _, c := range reqCookies {
+			req.AddCookie(c)
+		}
+
+		req.Header.Set("x-extension-id", extID)
+
+		if reqSNI != "" {
+			req.Header.Set("x-marasi-sni", reqSNI)
+		}
+
+		return client.Do(req)
+	}, nil
+}
+
+// pushAsyncResult pushes the arguments of the callback of an asynchronous request, the response and nil or nil and the error message.
+// The body of the response is read so the callback can read it with Mu held.
+func pushAsyncResult(l *lua.State, resp *http.Response, err error) {
+	if err != nil {
+		l.PushNil()
+		l.PushString(err.Error())
+		return
+	}
+
+	bodyBytes, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if readErr != nil {
+		l.PushNil()
+		l.PushString(fmt.Sprintf("reading body: %s", readErr.Error()))
+		return
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	l.PushUserData(resp)
+	lua.SetMetaTableNamed(l, "res")
+	l.PushNil()
+}
+
+// checkEgress returns an error if the builder's URL is not allowed by its egress policy.
+func (builder *RequestBuilder) checkEgress() error {
+	return egressAllowed(builder.egressPolicy, builder.url)
+}
+
+// withEgressPolicy returns req with the egress policy as its redirect policy, so proxy.Client does not follow
+// redirects to hosts the policy blocks.
+func withEgressPolicy(req *http.Request, policy *compass.Scope) *http.Request {
+	if policy == nil {
+		return req
+	}
+	return core.ContextWithRedirectPolicy(req, func(redirect *http.Request) error {
+		return egressAllowed(policy, redirect.URL)
+	})
+}
+
+// egressAllowed returns an error if u is not allowed by the egress policy, a nil policy allows all hosts.
+func egressAllowed(policy *compass.Scope, u *url.URL) error {
+	if policy == nil {
+		return nil
+	}
+
+	target := &http.Request{Host: u.Host, URL: u}
+	if !policy.Matches(target) {
+		return fmt.Errorf("request to %s blocked by the extension egress policy", u.Host)
+	}
+	return nil
 }
 
 // NewRequestBuilder creates and returns a new RequestBuilder instance.
@@ -84,6 +309,22 @@ func NewRequestBuilder(client *http.Client) *RequestBuilder {
 	}
 }
 
+// checkScope returns the scope at index.
+// Scopes returned by `marasi:scope` are resolved to the current proxy scope, so an extension holding on to one sees scopes replaced with SetScope.
+func checkScope(l *lua.State, extension *Runtime, index int) *compass.Scope {
+	scope := lua.CheckUserData(l, index, "scope").(*compass.Scope)
+	if !extension.isProxyScope(scope) {
+		return scope
+	}
+
+	current, err := extension.currentScope(extension.proxy)
+	if err != nil {
+		lua.Errorf(l, "%s", fmt.Sprintf("getting scope : %s", err.Error()))
+		return nil
+	}
+	return current
+}
+
 // RegisterScopeType registers the `compass.Scope` type and its methods with the Lua state.
 // This allows Lua scripts to interact with the proxy's scope, adding, removing, and checking rules.
 func RegisterScopeType(extension *Runtime) {
@@ -91,14 +332,16 @@ func RegisterScopeType(extension *Runtime) {
 		// add_rule adds a new rule to the scope.
 		//
 		// @param rule string The rule to add.
-		// @param matchType string The type of match (e.g., "host", "path").
+		// @param matchType string The type of match ("host", "url" or "cidr").
+		// @param priority int (optional) The priority of the rule, rules with a higher priority are evaluated first.
 		"add_rule": func(l *lua.State) int {
-			scope := lua.CheckUserData(l, 1, "scope").(*compass.Scope)
+			scope := checkScope(l, extension, 1)
 			ruleSring := lua.CheckString(l, 2)
 			matchType := lua.CheckString(l, 3)
+			priority := lua.OptInteger(l, 4, 0)
 			isExclude := strings.HasPrefix(ruleSring, "-")
 
-			err := scope.AddRule(ruleSring, matchType, isExclude)
+			err := scope.AddRuleWithPriority(ruleSring, matchType, isExclude, priority)
 			if err != nil {
 				lua.Errorf(l, fmt.Sprintf("adding rule : %s", err.Error()))
 				return 0
@@ -111,7 +354,7 @@ func RegisterScopeType(extension *Runtime) {
 		// @param rule string The rule to remove.
 		// @param matchType string The type of match.
 		"remove_rule": func(l *lua.State) int {
-			scope := lua.CheckUserData(l, 1, "scope").(*compass.Scope)
+			scope := checkScope(l, extension, 1)
 			ruleSring := lua.CheckString(l, 2)
 			matchType := lua.CheckString(l, 3)
 			isExclude := strings.HasPrefix(ruleSring, "-")
@@ -124,32 +367,82 @@ func RegisterScopeType(extension *Runtime) {
 			return 0
 		},
 		// matches checks if a request or response matches the scope.
+		// The decision for a request is cached in its context and reused for the response
+		// as long as the scope has not changed since.
 		//
 		// @param input Request|Response The request or response to check.
 		// @return boolean True if the input matches the scope.
 		"matches": func(l *lua.State) int {
-			scope := lua.CheckUserData(l, 1, "scope").(*compass.Scope)
+			scope := checkScope(l, extension, 1)
 			input := l.ToUserData(2)
 
-			switch input.(type) {
-			case *http.Request, *http.Response:
+			var result bool
+			switch v := input.(type) {
+			case *http.Request:
+				result = scope.Matches(v)
+				*v = *core.ContextWithScopeDecision(v, core.ScopeDecision{Version: scope.Version(), InScope: result})
+			case *http.Response:
+				if v.Request != nil {
+					if decision, ok := core.ScopeDecisionFromContext(v.Request.Context()); ok && decision.Version == scope.Version() {
+						result = decision.InScope
+						break
+					}
+				}
+				result = scope.Matches(v)
 			default:
 				lua.ArgumentError(l, 2, "expected request / response object")
+				return 0
 			}
 
-			result := scope.Matches(input)
-
 			l.PushBoolean(result)
 			return 1
 		},
+		// matches_detailed checks if a request or response matches the scope like matches, and returns which rule decided it.
+		// It tests each rule separately, so it is slower than matches and is meant for explaining decisions.
+		//
+		// @param input Request|Response The request or response to check.
+		// @return table The decision with in_scope (boolean), side ("include", "exclude" or "default"), rule and target (empty when the default decided).
+		"matches_detailed": func(l *lua.State) int {
+			scope := checkScope(l, extension, 1)
+
+			var result compass.MatchResult
+			switch v := l.ToUserData(2).(type) {
+			case *http.Request:
+				result = scope.MatchesDetailed(v)
+			case *http.Response:
+				result = scope.MatchesDetailed(v)
+			default:
+				lua.ArgumentError(l, 2, "expected request / response object")
+				return 0
+			}
+
+			l.NewTable()
+			l.PushBoolean(result.InScope)
+			l.SetField(-2, "in_scope")
+			l.PushString(string(result.Side))
+			l.SetField(-2, "side")
+			l.PushString(result.Rule)
+			l.SetField(-2, "rule")
+			l.PushString(result.Target)
+			l.SetField(-2, "target")
+			return 1
+		},
 		// set_default_allow sets the default scope policy.
+		// The policy of the proxy scope is set through the proxy so it is persisted, other scopes such as clones are only changed in place.
 		//
 		// @param allow boolean True to allow by default, false to block.
 		"set_default_allow": func(l *lua.State) int {
-			scope := lua.CheckUserData(l, 1, "scope").(*compass.Scope)
 			allow := l.ToBoolean(2)
 
-			scope.DefaultAllow = allow
+			if extension.isProxyScope(lua.CheckUserData(l, 1, "scope").(*compass.Scope)) {
+				if err := extension.proxy.SetDefaultAllow(allow); err != nil {
+					lua.Errorf(l, fmt.Sprintf("setting default allow : %s", err.Error()))
+				}
+				return 0
+			}
+
+			scope := checkScope(l, extension, 1)
+			scope.SetDefaultAllow(allow)
 			return 0
 		},
 		// matches_string checks if a string matches a specific rule type in the scope.
@@ -158,7 +451,7 @@ func RegisterScopeType(extension *Runtime) {
 		// @param matchType string The type of match to perform.
 		// @return boolean True if the string matches.
 		"matches_string": func(l *lua.State) int {
-			scope := lua.CheckUserData(l, 1, "scope").(*compass.Scope)
+			scope := checkScope(l, extension, 1)
 			input := lua.CheckString(l, 2)
 			matchType := lua.CheckString(l, 3)
 			result := scope.MatchesString(input, matchType)
@@ -168,14 +461,62 @@ func RegisterScopeType(extension *Runtime) {
 		},
 		// clear_rules removes all rules from the scope.
 		"clear_rules": func(l *lua.State) int {
-			scope := lua.CheckUserData(l, 1, "scope").(*compass.Scope)
+			scope := checkScope(l, extension, 1)
 			scope.ClearRules()
 			return 0
 		},
+		// remove_rules_of_type removes all inclusion and exclusion rules of a match type.
+		//
+		// @param matchType string The type of the rules to remove ("host", "url" or "cidr").
+		"remove_rules_of_type": func(l *lua.State) int {
+			scope := checkScope(l, extension, 1)
+			matchType := lua.CheckString(l, 2)
+
+			err := scope.RemoveAllOfType(matchType)
+			if err != nil {
+				lua.Errorf(l, fmt.Sprintf("removing rules : %s", err.Error()))
+				return 0
+			}
+			return 0
+		},
+		// rule_stats returns the number of times each rule decided a match, exclude rules first.
+		//
+		// @return table A list of tables with the pattern, match_type, exclude and hits fields.
+		"rule_stats": func(l *lua.State) int {
+			scope := checkScope(l, extension, 1)
+
+			stats := []map[string]any{}
+			for _, stat := range scope.RuleStats() {
+				stats = append(stats, map[string]any{
+					"pattern":    stat.Pattern,
+					"match_type": stat.MatchType,
+					"exclude":    stat.Exclude,
+					"hits":       int(stat.Hits),
+				})
+			}
+
+			util.DeepPush(l, stats)
+			return 1
+		},
+		// reset_stats sets the hit counts of every rule back to zero.
+		"reset_stats": func(l *lua.State) int {
+			scope := checkScope(l, extension, 1)
+			scope.ResetStats()
+			return 0
+		},
+		// clone returns an independent copy of the scope, changes to the copy do not affect the original.
+		//
+		// @return Scope The copied scope.
+		"clone": func(l *lua.State) int {
+			scope := checkScope(l, extension, 1)
+			l.PushUserData(scope.Clone())
+			lua.SetMetaTableNamed(l, "scope")
+			return 1
+		},
 	}
 
 	RegisterType(extension.LuaState, "scope", funcs, func(l *lua.State) int {
-		scope := lua.CheckUserData(l, 1, "scope").(*compass.Scope)
+		scope := checkScope(l, extension, 1)
 
 		policy := "Block"
 		if scope.DefaultAllow {
@@ -188,7 +529,7 @@ func RegisterScopeType(extension *Runtime) {
 			}
 			var parts []string
 			for _, r := range rules {
-				parts = append(parts, fmt.Sprintf("%s (%s)", r.Pattern.String(), r.MatchType))
+				parts = append(parts, fmt.Sprintf("%s (%s)", r.String(), r.MatchType))
 			}
 			slices.Sort(parts)
 
@@ -318,6 +659,34 @@ func RegisterRegexType(extension *Runtime) {
 		return 1
 	}
 
+	// replace_n replaces at most n matches in a string with a replacement string.
+	//
+	// @param input string The string to search in.
+	// @param replacement string The replacement string, $1 style references are expanded like in replace.
+	// @param n number The maximum number of matches to replace, n <= 0 replaces all matches.
+	// @return string The new string.
+	funcs["replace_n"] = func(l *lua.State) int {
+		re := lua.CheckUserData(l, 1, "regexp").(*regexp.Regexp)
+		input := lua.CheckString(l, 2)
+		replacement := lua.CheckString(l, 3)
+		n := lua.CheckInteger(l, 4)
+		if n <= 0 {
+			n = -1
+		}
+
+		var result []byte
+		last := 0
+		for _, match := range re.FindAllStringSubmatchIndex(input, n) {
+			result = append(result, input[last:match[0]]...)
+			result = re.ExpandString(result, replacement, input, match)
+			last = match[1]
+		}
+		result = append(result, input[last:]...)
+
+		l.PushString(string(result))
+		return 1
+	}
+
 	// split splits a string by the regex.
 	//
 	// @param input string The string to split.
@@ -339,6 +708,23 @@ func RegisterRegexType(extension *Runtime) {
 		return 1
 	}
 
+	// groups returns the names of the named capture groups in the order they appear in the pattern.
+	//
+	// @return table A table of the group names, unnamed groups are not included.
+	funcs["groups"] = func(l *lua.State) int {
+		re := lua.CheckUserData(l, 1, "regexp").(*regexp.Regexp)
+
+		names := []string{}
+		for _, name := range re.SubexpNames() {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+
+		util.DeepPush(l, names)
+		return 1
+	}
+
 	// find returns the first match in a string.
 	//
 	// @param input string The string to search in.
@@ -592,6 +978,24 @@ func RegisterCookieType(extension *Runtime) {
 		return 0
 	}
 
+	// is_expired returns true if the cookie's expiration time is set and in the past.
+	//
+	// @return boolean True if the cookie has expired.
+	funcs["is_expired"] = func(l *lua.State) int {
+		cookie := lua.CheckUserData(l, 1, "cookie").(*http.Cookie)
+		l.PushBoolean(!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now()))
+		return 1
+	}
+
+	// is_session returns true if the cookie has neither an expiration time nor a Max-Age.
+	//
+	// @return boolean True if the cookie is a session cookie.
+	funcs["is_session"] = func(l *lua.State) int {
+		cookie := lua.CheckUserData(l, 1, "cookie").(*http.Cookie)
+		l.PushBoolean(cookie.Expires.IsZero() && cookie.MaxAge == 0)
+		return 1
+	}
+
 	// serialize returns the cookie as a string.
 	//
 	// @return string The serialized cookie.
@@ -649,6 +1053,51 @@ func RegisterHeaderType(extension *Runtime) {
 		return 1
 	}
 
+	// get_all_joined returns all values associated with the given key joined by a separator.
+	//
+	// @param key string The header name.
+	// @param sep string The separator placed between the values.
+	// @return string The joined header values, or nil if not found.
+	funcs["get_all_joined"] = func(l *lua.State) int {
+		header := lua.CheckUserData(l, 1, "header").(*http.Header)
+		key := lua.CheckString(l, 2)
+		sep := lua.CheckString(l, 3)
+
+		values := header.Values(key)
+
+		if values == nil {
+			l.PushNil()
+			return 1
+		}
+
+		l.PushString(strings.Join(values, sep))
+		return 1
+	}
+
+	// count returns the number of values associated with the given key, such as duplicated headers.
+	//
+	// @param key string The header name.
+	// @return number The number of values, 0 if not found.
+	funcs["count"] = func(l *lua.State) int {
+		header := lua.CheckUserData(l, 1, "header").(*http.Header)
+		key := lua.CheckString(l, 2)
+
+		l.PushInteger(len(header.Values(key)))
+		return 1
+	}
+
+	// canonical returns the canonical form of a header name, which is the form used by get, set and the other lookups.
+	//
+	// @param key string The header name.
+	// @return string The canonical header name.
+	funcs["canonical"] = func(l *lua.State) int {
+		lua.CheckUserData(l, 1, "header")
+		key := lua.CheckString(l, 2)
+
+		l.PushString(textproto.CanonicalMIMEHeaderKey(key))
+		return 1
+	}
+
 	// to_table returns the headers as a Lua table.
 	//
 	// @return table The headers as a table.
@@ -1001,6 +1450,75 @@ func RegisterRequestType(extension *Runtime) {
 		return 1
 	}
 
+	// raw returns the request as it is sent on the wire, including the request line, headers and body.
+	// The body is restored after dumping so it can still be read.
+	//
+	// @return string The raw request.
+	funcs["raw"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+
+		// Proxied requests carry an absolute-form RequestURI, the copy is dumped with an origin-form request line and a Host header
+		dump := *req
+		dump.RequestURI = ""
+		if dump.ProtoMajor == 0 && dump.ProtoMinor == 0 {
+			dump.ProtoMajor, dump.ProtoMinor = 1, 1
+		}
+
+		raw, _, err := rawhttp.DumpRequest(&dump)
+		req.Body = dump.Body
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("dumping request : %s", err.Error()))
+			return 0
+		}
+
+		l.PushString(string(raw))
+		return 1
+	}
+
+	// proxy_auth returns the username the client authenticated to the proxy with.
+	// The Proxy-Authorization header itself is removed before the request reaches the extensions.
+	//
+	// @return string|nil The username, or nil if proxy authentication is disabled.
+	funcs["proxy_auth"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		if username, ok := core.ProxyAuthUserFromContext(req.Context()); ok {
+			l.PushString(username)
+			return 1
+		}
+		l.PushNil()
+		return 1
+	}
+
+	// decoded_body returns the request's body with its Content-Encoding (gzip, br, deflate or zstd) removed.
+	// The original body is restored so it is forwarded unchanged.
+	//
+	// @return string The decoded request body.
+	funcs["decoded_body"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+
+		if req.Body == nil {
+			l.PushString("")
+			return 1
+		}
+
+		bodyBytes, err := io.ReadAll(req.Body)
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("reading body : %s", err.Error()))
+			return 0
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+		decoded, err := decodeContent(bodyBytes, req.Header.Get("Content-Encoding"))
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("decoding body : %s", err.Error()))
+			return 0
+		}
+
+		l.PushString(string(decoded))
+		return 1
+	}
+
 	// set_body sets the request's body.
 	//
 	// @param body string The new request body.
@@ -1025,49 +1543,158 @@ func RegisterRequestType(extension *Runtime) {
 		return 1
 	}
 
-	// content_type returns the request's Content-Type.
+	// header_count returns the number of distinct header names in the request.
 	//
-	// @return string The Content-Type.
-	funcs["content_type"] = func(l *lua.State) int {
+	// @return number The number of headers.
+	funcs["header_count"] = func(l *lua.State) int {
 		req := lua.CheckUserData(l, 1, "req").(*http.Request)
-		ct := req.Header.Get("Content-Type")
-		if ct == "" {
-			l.PushString("")
-			return 1
-		}
-
-		mediaType, _, err := mime.ParseMediaType(ct)
-		if err != nil {
-			l.PushString(ct)
-		} else {
-			l.PushString(mediaType)
-		}
+		l.PushInteger(len(req.Header))
 		return 1
 	}
 
-	// cookie returns a specific cookie from the request.
+	// header_order returns the header names in the order of the original raw request.
+	// When the original order was not recorded it returns the names sorted, which is the order they are sent in.
 	//
-	// @param name string The name of the cookie.
-	// @return Cookie The cookie object, or nil if not found.
-	funcs["cookie"] = func(l *lua.State) int {
+	// @return table A table of header names.
+	funcs["header_order"] = func(l *lua.State) int {
 		req := lua.CheckUserData(l, 1, "req").(*http.Request)
-		name := lua.CheckString(l, 2)
+		order, ok := core.HeaderOrderFromContext(req.Context())
+		if !ok {
+			order = slices.Sorted(maps.Keys(req.Header))
+		}
 
-		cookie, err := req.Cookie(name)
-		if err != nil {
-			lua.Errorf(l, fmt.Sprintf("getting cookie : %s", err.Error()))
-			return 0
+		l.CreateTable(len(order), 0)
+
+		for i, name := range order {
+			l.PushInteger(i + 1)
+			l.PushString(name)
+			l.SetTable(-3)
 		}
 
-		l.PushUserData(cookie)
-		lua.SetMetaTableNamed(l, "cookie")
 		return 1
 	}
 
-	// set_cookie adds or replaces a cookie in the request.
+	// has_header checks if the request has a header with the given key.
 	//
-	// @param cookie Cookie The cookie to set.
-	funcs["set_cookie"] = func(l *lua.State) int {
+	// @param key string The header name.
+	// @return boolean True if the header exists.
+	funcs["has_header"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		key := lua.CheckString(l, 2)
+
+		l.PushBoolean(req.Header.Get(key) != "")
+		return 1
+	}
+
+	// set_header sets the request header entries associated with key to the single element value.
+	//
+	// @param key string The header name.
+	// @param value string The header value.
+	funcs["set_header"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		key := lua.CheckString(l, 2)
+		value := lua.CheckString(l, 3)
+
+		if key == "" {
+			lua.ArgumentError(l, 2, "header key cannot be empty")
+			return 0
+		}
+
+		req.Header.Set(key, value)
+		return 0
+	}
+
+	// add_header adds the key, value pair to the request headers. It appends to any existing
+	// values associated with key.
+	//
+	// @param key string The header name.
+	// @param value string The header value.
+	funcs["add_header"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		key := lua.CheckString(l, 2)
+		value := lua.CheckString(l, 3)
+
+		if key == "" {
+			lua.ArgumentError(l, 2, "header key cannot be empty")
+			return 0
+		}
+
+		req.Header.Add(key, value)
+		return 0
+	}
+
+	// set_content_type sets the request's Content-Type header from a media type and an optional charset parameter.
+	//
+	// @param mediaType string The media type (e.g., "application/json").
+	// @param charset string (optional) The charset parameter (e.g., "utf-8").
+	funcs["set_content_type"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		contentType, err := formatContentType(lua.CheckString(l, 2), lua.OptString(l, 3, ""))
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("setting content type : %s", err.Error()))
+			return 0
+		}
+
+		req.Header.Set("Content-Type", contentType)
+		return 0
+	}
+
+	// content_type returns the request's Content-Type.
+	//
+	// @return string The Content-Type.
+	funcs["content_type"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		ct := req.Header.Get("Content-Type")
+		if ct == "" {
+			l.PushString("")
+			return 1
+		}
+
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			l.PushString(ct)
+		} else {
+			l.PushString(mediaType)
+		}
+		return 1
+	}
+
+	// is_ajax reports whether the request looks like an XHR or fetch API call rather than a page load.
+	// It is true when the X-Requested-With header is XMLHttpRequest or the Accept header prefers JSON.
+	//
+	// @return boolean True if the request looks like an API call.
+	funcs["is_ajax"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+
+		isAjax := strings.EqualFold(req.Header.Get("X-Requested-With"), "XMLHttpRequest") ||
+			prefersJSON(strings.Join(req.Header.Values("Accept"), ","))
+		l.PushBoolean(isAjax)
+		return 1
+	}
+
+	// cookie returns a specific cookie from the request.
+	//
+	// @param name string The name of the cookie.
+	// @return Cookie The cookie object, or nil if not found.
+	funcs["cookie"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		name := lua.CheckString(l, 2)
+
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("getting cookie : %s", err.Error()))
+			return 0
+		}
+
+		l.PushUserData(cookie)
+		lua.SetMetaTableNamed(l, "cookie")
+		return 1
+	}
+
+	// set_cookie adds or replaces a cookie in the request.
+	//
+	// @param cookie Cookie The cookie to set.
+	funcs["set_cookie"] = func(l *lua.State) int {
 		req := lua.CheckUserData(l, 1, "req").(*http.Request)
 		newCookie := lua.CheckUserData(l, 2, "cookie").(*http.Cookie)
 
@@ -1091,6 +1718,32 @@ func RegisterRequestType(extension *Runtime) {
 		return 0
 	}
 
+	// set_cookie_value updates the value of a cookie in the request, the cookie is added if it does not exist.
+	// Only the name=value pair of the cookie is rewritten, the other cookies are kept as sent even if they do not parse.
+	//
+	// @param name string The name of the cookie.
+	// @param value string The new value of the cookie.
+	funcs["set_cookie_value"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		name := lua.CheckString(l, 2)
+		value := lua.CheckString(l, 3)
+
+		headers := req.Header["Cookie"]
+		for i, header := range headers {
+			if updated, ok := replaceCookiePair(header, name, value, false); ok {
+				headers[i] = updated
+				return 0
+			}
+		}
+
+		if len(headers) > 0 {
+			headers[len(headers)-1] += "; " + name + "=" + value
+		} else {
+			req.Header.Set("Cookie", name+"="+value)
+		}
+		return 0
+	}
+
 	// cookies returns all cookies from the request.
 	//
 	// @return table A table of cookie objects.
@@ -1110,6 +1763,25 @@ func RegisterRequestType(extension *Runtime) {
 		return 1
 	}
 
+	// cookie_names returns the names of all cookies in the request.
+	// It is cheaper than cookies() when only the names are needed.
+	//
+	// @return table A table of cookie names.
+	funcs["cookie_names"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		cookies := req.Cookies()
+
+		l.CreateTable(len(cookies), 0)
+
+		for i, c := range cookies {
+			l.PushInteger(i + 1)
+			l.PushString(c.Name)
+			l.SetTable(-3)
+		}
+
+		return 1
+	}
+
 	// set_cookies replaces all cookies in the request.
 	//
 	// @param cookies table A table of cookie objects.
@@ -1135,6 +1807,34 @@ func RegisterRequestType(extension *Runtime) {
 		return 0
 	}
 
+	// basic_auth returns the username and password from the request's Authorization header.
+	//
+	// @return string The username.
+	// @return string The password.
+	// @return boolean True if the header contained valid basic auth credentials.
+	funcs["basic_auth"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		username, password, ok := req.BasicAuth()
+
+		l.PushString(username)
+		l.PushString(password)
+		l.PushBoolean(ok)
+		return 3
+	}
+
+	// set_basic_auth sets the request's Authorization header to use basic auth.
+	//
+	// @param username string The username.
+	// @param password string The password.
+	funcs["set_basic_auth"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		username := lua.CheckString(l, 2)
+		password := lua.CheckString(l, 3)
+
+		req.SetBasicAuth(username, password)
+		return 0
+	}
+
 	// metadata returns the request's metadata.
 	//
 	// @return table The metadata table.
@@ -1150,6 +1850,72 @@ func RegisterRequestType(extension *Runtime) {
 		return 1
 	}
 
+	// extension_metadata returns the metadata set by another extension on the request.
+	// The returned table is a copy, changes to it are not applied to the request.
+	//
+	// @param name string The name of the extension.
+	// @return table The extension's metadata table, or nil if the extension did not set any.
+	funcs["extension_metadata"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		name := lua.CheckString(l, 2)
+
+		if metadata, ok := core.MetadataFromContext(req.Context()); ok {
+			if extensionMetadata, ok := metadata[name].(map[string]any); ok {
+				util.DeepPush(l, extensionMetadata)
+				return 1
+			}
+		}
+
+		l.PushNil()
+		return 1
+	}
+
+	// extension_ran checks if an extension ran its processRequest or processResponse handler on the request.
+	//
+	// @param name string The name of the extension.
+	// @return boolean True if the extension ran.
+	funcs["extension_ran"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		name := lua.CheckString(l, 2)
+
+		l.PushBoolean(slices.Contains(extensionsRan(req), name))
+		return 1
+	}
+
+	// extensions_ran returns the names of the extensions that ran a handler on the request, in the order they first ran.
+	//
+	// @return table A table of extension names.
+	funcs["extensions_ran"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		pushStringArray(l, extensionsRan(req))
+		return 1
+	}
+
+	// matches_scope checks if the request matches the proxy's live scope.
+	// Unlike marasi:scope():matches(req), the scope is not kept for the rest of the handler call so scope changes are always reflected.
+	//
+	// @return boolean True if the request is in scope.
+	funcs["matches_scope"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+
+		if extension.proxy == nil {
+			lua.Errorf(l, "proxy service not available")
+			return 0
+		}
+
+		scope, err := extension.proxy.GetScope()
+		if err != nil {
+			lua.Errorf(l, "%s", fmt.Sprintf("getting scope : %s", err.Error()))
+			return 0
+		}
+
+		result := scope.Matches(req)
+		*req = *core.ContextWithScopeDecision(req, core.ScopeDecision{Version: scope.Version(), InScope: result})
+
+		l.PushBoolean(result)
+		return 1
+	}
+
 	// set_metadata sets the request's metadata for the current extension.
 	//
 	// @param metadata table The metadata table to set.
@@ -1175,6 +1941,37 @@ func RegisterRequestType(extension *Runtime) {
 		return 0
 	}
 
+	// add_tag tags the request, the tags are stored once the request or its response is written to the database.
+	//
+	// @param tag string The tag to add.
+	funcs["add_tag"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		tag := lua.CheckString(l, 2)
+		if tag == "" {
+			lua.ArgumentError(l, 2, "tag cannot be empty")
+			return 0
+		}
+
+		tags, _ := core.TagsFromContext(req.Context())
+		if !slices.Contains(tags, tag) {
+			// The tags already queued with the request are not changed
+			*req = *core.ContextWithTags(req, append(slices.Clone(tags), tag))
+		}
+		return 0
+	}
+
+	// set_note sets the note of the request, the note is stored once the request or its response is written to the database.
+	// An empty string clears the note.
+	//
+	// @param note string The note text.
+	funcs["set_note"] = func(l *lua.State) int {
+		req := lua.CheckUserData(l, 1, "req").(*http.Request)
+		note := lua.CheckString(l, 2)
+
+		*req = *core.ContextWithNote(req, note)
+		return 0
+	}
+
 	// drop marks the request to be dropped by the proxy.
 	funcs["drop"] = func(l *lua.State) int {
 		req := lua.CheckUserData(l, 1, "req").(*http.Request)
@@ -1200,13 +1997,14 @@ func RegisterRequestType(extension *Runtime) {
 		}
 
 		l.PushString(fmt.Sprintf(
-			"Request { ID: %s, Method: %s, URL: %s, Proto: %s, Remote: %s, Length: %d }",
+			"Request { ID: %s, Method: %s, URL: %s, Proto: %s, Remote: %s, Length: %d, Headers: %d }",
 			id,
 			req.Method,
 			req.URL.String(),
 			req.Proto,
 			req.RemoteAddr,
 			req.ContentLength,
+			len(req.Header),
 		))
 		return 1
 	})
@@ -1277,18 +2075,203 @@ func RegisterResponseType(extension *Runtime) {
 		res.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
 		return 0
 	}
-	// length returns the response's content length.
+	// length returns the response's content length.
+	//
+	// @return number The content length.
+	funcs["length"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		l.PushInteger(int(res.ContentLength))
+		return 1
+	}
+	// upstream_addr returns the remote address of the upstream connection that served the response.
+	//
+	// @return string The address as ip:port, or nil if it was not recorded.
+	funcs["upstream_addr"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+
+		if res.Request != nil {
+			if metadata, ok := core.MetadataFromContext(res.Request.Context()); ok {
+				if addr, ok := metadata["upstream_addr"].(string); ok {
+					l.PushString(addr)
+					return 1
+				}
+			}
+		}
+
+		l.PushNil()
+		return 1
+	}
+	// tls_info returns the negotiated TLS parameters of the upstream connection.
+	//
+	// @return table A table with version, cipher_suite, alpn, resumed and server_name, or nil for plain HTTP.
+	funcs["tls_info"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+
+		if res.TLS == nil {
+			l.PushNil()
+			return 1
+		}
+
+		util.DeepPush(l, core.TLSInfo(res.TLS))
+		return 1
+	}
+	// redirect_chain returns the redirects that were followed before this response, starting with the first one.
+	// Responses to requests from the request builder are read from the client, responses in the proxy from the metadata.
+	//
+	// @return table A list of tables with url, status_code and location, empty if no redirects were followed.
+	funcs["redirect_chain"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+
+		if res.Request != nil {
+			if metadata, ok := core.MetadataFromContext(res.Request.Context()); ok {
+				if chain, ok := metadata["redirect_chain"]; ok {
+					util.DeepPush(l, chain)
+					return 1
+				}
+			}
+			if chain := core.RedirectChain(res.Request); len(chain) > 0 {
+				util.DeepPush(l, chain)
+				return 1
+			}
+		}
+
+		l.NewTable()
+		return 1
+	}
+	// body returns the response's body as a string.
+	//
+	// @return string The response body.
+	funcs["body"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+
+		if res.Body == nil {
+			l.PushString("")
+			return 1
+		}
+
+		bodyBytes, err := io.ReadAll(res.Body)
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("reading body : %s", err.Error()))
+			return 0
+		}
+
+		res.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+		l.PushString(string(bodyBytes))
+		return 1
+	}
+
+	// body_matches reports whether the response's body matches a regular expression.
+	// Compiled patterns are cached by the extension and the body is restored after it is read.
+	//
+	// @param pattern string The regular expression.
+	// @return boolean True if the body matches the pattern.
+	funcs["body_matches"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		pattern := lua.CheckString(l, 2)
+
+		re, err := extension.compileRegexp(pattern)
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("compiling pattern : %s", err.Error()))
+			return 0
+		}
+
+		if res.Body == nil {
+			l.PushBoolean(re.MatchString(""))
+			return 1
+		}
+
+		bodyBytes, err := io.ReadAll(res.Body)
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("reading body : %s", err.Error()))
+			return 0
+		}
+
+		res.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+		l.PushBoolean(re.Match(bodyBytes))
+		return 1
+	}
+
+	// body_length returns the length of the response's body without converting it to a Lua string.
+	// The Content-Length is used when it is known, otherwise the body is read to count the bytes.
+	//
+	// @return number The body length in bytes.
+	funcs["body_length"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+
+		if res.ContentLength >= 0 {
+			l.PushInteger(int(res.ContentLength))
+			return 1
+		}
+
+		if res.Body == nil {
+			l.PushInteger(0)
+			return 1
+		}
+
+		bodyBytes, err := io.ReadAll(res.Body)
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("reading body : %s", err.Error()))
+			return 0
+		}
+
+		res.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+		l.PushInteger(len(bodyBytes))
+		return 1
+	}
+
+	// body_sha256 returns the hex encoded SHA-256 digest of the response's body.
+	// The body is restored after hashing so it can still be read.
+	//
+	// @return string The hex encoded digest.
+	funcs["body_sha256"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+
+		hash := sha256.New()
+		if res.Body != nil {
+			var buf bytes.Buffer
+			if _, err := io.Copy(io.MultiWriter(hash, &buf), res.Body); err != nil {
+				lua.Errorf(l, fmt.Sprintf("reading body : %s", err.Error()))
+				return 0
+			}
+			res.Body = io.NopCloser(&buf)
+		}
+
+		l.PushString(hex.EncodeToString(hash.Sum(nil)))
+		return 1
+	}
+
+	// raw returns the response as it is sent on the wire, including the status line, headers and body.
+	// The body is restored after dumping so it can still be read.
 	//
-	// @return number The content length.
-	funcs["length"] = func(l *lua.State) int {
+	// @return string The raw response.
+	funcs["raw"] = func(l *lua.State) int {
 		res := lua.CheckUserData(l, 1, "res").(*http.Response)
-		l.PushInteger(int(res.ContentLength))
+
+		// Responses built without a protocol version are dumped as HTTP/1.1
+		dump := *res
+		if dump.ProtoMajor == 0 && dump.ProtoMinor == 0 {
+			dump.ProtoMajor, dump.ProtoMinor = 1, 1
+		}
+
+		raw, _, err := rawhttp.DumpResponse(&dump)
+		res.Body = dump.Body
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("dumping response : %s", err.Error()))
+			return 0
+		}
+
+		l.PushString(string(raw))
 		return 1
 	}
-	// body returns the response's body as a string.
+
+	// decoded_body returns the response's body with its Content-Encoding (gzip, br, deflate or zstd) removed.
+	// The original body is restored so it is forwarded unchanged.
 	//
-	// @return string The response body.
-	funcs["body"] = func(l *lua.State) int {
+	// @return string The decoded response body.
+	funcs["decoded_body"] = func(l *lua.State) int {
 		res := lua.CheckUserData(l, 1, "res").(*http.Response)
 
 		if res.Body == nil {
@@ -1304,7 +2287,13 @@ func RegisterResponseType(extension *Runtime) {
 
 		res.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 
-		l.PushString(string(bodyBytes))
+		decoded, err := decodeContent(bodyBytes, res.Header.Get("Content-Encoding"))
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("decoding body : %s", err.Error()))
+			return 0
+		}
+
+		l.PushString(string(decoded))
 		return 1
 	}
 
@@ -1332,6 +2321,94 @@ func RegisterResponseType(extension *Runtime) {
 		return 1
 	}
 
+	// header_count returns the number of distinct header names in the response.
+	//
+	// @return number The number of headers.
+	funcs["header_count"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		l.PushInteger(len(res.Header))
+		return 1
+	}
+
+	// strip_headers removes every header listed in the table from the response.
+	//
+	// @param names table A table of header names, e.g. marasi.presets.security_headers.
+	funcs["strip_headers"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		if l.TypeOf(2) != lua.TypeTable {
+			lua.ArgumentError(l, 2, "expected table")
+			return 0
+		}
+
+		l.PushNil()
+		for l.Next(2) {
+			if name, ok := l.ToString(-1); ok {
+				res.Header.Del(name)
+			}
+			l.Pop(1)
+		}
+		return 0
+	}
+
+	// remove_security_headers removes the headers listed in marasi.presets.security_headers
+	// (CSP, HSTS, X-Frame-Options, ...) from the response.
+	funcs["remove_security_headers"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		for _, name := range securityHeaders {
+			res.Header.Del(name)
+		}
+		return 0
+	}
+
+	// has_header checks if the response has a header with the given key.
+	//
+	// @param key string The header name.
+	// @return boolean True if the header exists.
+	funcs["has_header"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		key := lua.CheckString(l, 2)
+
+		l.PushBoolean(res.Header.Get(key) != "")
+		return 1
+	}
+
+	// set_header sets the response header entries associated with key to the single element value.
+	//
+	// @param key string The header name.
+	// @param value string The header value.
+	funcs["set_header"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		key := lua.CheckString(l, 2)
+		value := lua.CheckString(l, 3)
+
+		if key == "" {
+			lua.ArgumentError(l, 2, "header key cannot be empty")
+			return 0
+		}
+
+		res.Header.Set(key, value)
+		return 0
+	}
+
+	// add_header adds the key, value pair to the response headers. It appends to any existing
+	// values associated with key.
+	//
+	// @param key string The header name.
+	// @param value string The header value.
+	funcs["add_header"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		key := lua.CheckString(l, 2)
+		value := lua.CheckString(l, 3)
+
+		if key == "" {
+			lua.ArgumentError(l, 2, "header key cannot be empty")
+			return 0
+		}
+
+		res.Header.Add(key, value)
+		return 0
+	}
+
 	// content_type returns the response's Content-Type.
 	//
 	// @return string The Content-Type.
@@ -1352,6 +2429,49 @@ func RegisterResponseType(extension *Runtime) {
 		return 1
 	}
 
+	// cache_info returns the caching headers of the response, with the Cache-Control directives parsed.
+	// max_age, etag and expires are nil when they are not set, an invalid max-age is ignored.
+	//
+	// @return table A table with max_age, no_store, no_cache, private, public, etag and expires (the raw Expires header).
+	funcs["cache_info"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		directives := cacheControlDirectives(res.Header.Values("Cache-Control"))
+
+		info := map[string]any{}
+		for _, name := range []string{"no-store", "no-cache", "private", "public"} {
+			_, ok := directives[name]
+			info[strings.ReplaceAll(name, "-", "_")] = ok
+		}
+		if maxAge, ok := parseDeltaSeconds(directives["max-age"]); ok {
+			info["max_age"] = maxAge
+		}
+		if etag := res.Header.Get("ETag"); etag != "" {
+			info["etag"] = etag
+		}
+		if expires := res.Header.Get("Expires"); expires != "" {
+			info["expires"] = expires
+		}
+
+		util.DeepPush(l, info)
+		return 1
+	}
+
+	// set_content_type sets the response's Content-Type header from a media type and an optional charset parameter.
+	//
+	// @param mediaType string The media type (e.g., "application/json").
+	// @param charset string (optional) The charset parameter (e.g., "utf-8").
+	funcs["set_content_type"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		contentType, err := formatContentType(lua.CheckString(l, 2), lua.OptString(l, 3, ""))
+		if err != nil {
+			lua.Errorf(l, fmt.Sprintf("setting content type : %s", err.Error()))
+			return 0
+		}
+
+		res.Header.Set("Content-Type", contentType)
+		return 0
+	}
+
 	// cookie returns a specific cookie from the response.
 	//
 	// @param name string The name of the cookie.
@@ -1396,6 +2516,29 @@ func RegisterResponseType(extension *Runtime) {
 		return 0
 	}
 
+	// set_cookie_value updates the value of a cookie in the response and keeps its attributes,
+	// the cookie is added with the "/" path if it does not exist.
+	// Only the name=value pair of the Set-Cookie header is rewritten, the attributes and the other Set-Cookie headers are kept as sent.
+	//
+	// @param name string The name of the cookie.
+	// @param value string The new value of the cookie.
+	funcs["set_cookie_value"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		name := lua.CheckString(l, 2)
+		value := lua.CheckString(l, 3)
+
+		headers := res.Header["Set-Cookie"]
+		for i, header := range headers {
+			if updated, ok := replaceCookiePair(header, name, value, true); ok {
+				headers[i] = updated
+				return 0
+			}
+		}
+
+		res.Header.Add("Set-Cookie", (&http.Cookie{Name: name, Value: value, Path: "/"}).String())
+		return 0
+	}
+
 	// cookies returns all cookies from the response.
 	//
 	// @return table A table of cookie objects.
@@ -1413,6 +2556,23 @@ func RegisterResponseType(extension *Runtime) {
 		return 1
 	}
 
+	// cookie_names returns the names of all cookies set by the response.
+	// It is cheaper than cookies() when only the names are needed.
+	//
+	// @return table A table of cookie names.
+	funcs["cookie_names"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		cookies := res.Cookies()
+
+		l.CreateTable(len(cookies), 0)
+		for i, c := range cookies {
+			l.PushInteger(i + 1)
+			l.PushString(c.Name)
+			l.SetTable(-3)
+		}
+		return 1
+	}
+
 	// set_cookies replaces all cookies in the response.
 	//
 	// @param cookies table A table of cookie objects.
@@ -1453,6 +2613,33 @@ func RegisterResponseType(extension *Runtime) {
 		l.PushNil()
 		return 1
 	}
+
+	// extension_ran checks if an extension ran its processRequest or processResponse handler on the request of the response.
+	//
+	// @param name string The name of the extension.
+	// @return boolean True if the extension ran.
+	funcs["extension_ran"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+		name := lua.CheckString(l, 2)
+
+		l.PushBoolean(res.Request != nil && slices.Contains(extensionsRan(res.Request), name))
+		return 1
+	}
+
+	// extensions_ran returns the names of the extensions that ran a handler on the request of the response, in the order they first ran.
+	//
+	// @return table A table of extension names.
+	funcs["extensions_ran"] = func(l *lua.State) int {
+		res := lua.CheckUserData(l, 1, "res").(*http.Response)
+
+		var names []string
+		if res.Request != nil {
+			names = extensionsRan(res.Request)
+		}
+		pushStringArray(l, names)
+		return 1
+	}
+
 	// set_metadata sets the response's metadata for the current extension.
 	//
 	// @param metadata table The metadata table to set.
@@ -1614,6 +2801,52 @@ func RegisterRequestBuilderType(extension *Runtime) {
 	funcs["set_body"] = func(l *lua.State) int {
 		builder := lua.CheckUserData(l, 1, "RequestBuilder").(*RequestBuilder)
 		builder.body = lua.CheckString(l, 2)
+		builder.releaseBodyChunks(l)
+		l.PushValue(1)
+		return 1
+	}
+
+	// set_body_chunked streams the request body from a function instead of holding it as a single string.
+	// The function is called repeatedly while the request is sent and returns the next chunk, or nil when the body is complete.
+	// The body is sent with chunked transfer encoding and can only be sent with send, the function is released once it was sent.
+	//
+	// @param producer function A function returning the next chunk of the body, or nil at the end.
+	// @return RequestBuilder The request builder.
+	funcs["set_body_chunked"] = func(l *lua.State) int {
+		builder := lua.CheckUserData(l, 1, "RequestBuilder").(*RequestBuilder)
+		lua.CheckType(l, 2, lua.TypeFunction)
+
+		builder.releaseBodyChunks(l)
+		builder.bodyChunks = fmt.Sprintf("marasi_body_%d", atomic.AddUint64(&globalCallbackCounter, 1))
+		l.PushValue(2)
+		l.SetField(lua.RegistryIndex, builder.bodyChunks)
+
+		builder.body = ""
+		l.PushValue(1)
+		return 1
+	}
+
+	// sni returns the server name used in the TLS handshake.
+	//
+	// @return string|nil The server name, or nil if the URL host is used.
+	funcs["sni"] = func(l *lua.State) int {
+		builder := lua.CheckUserData(l, 1, "RequestBuilder").(*RequestBuilder)
+		if builder.sni == "" {
+			l.PushNil()
+			return 1
+		}
+		l.PushString(builder.sni)
+		return 1
+	}
+
+	// set_sni sets the server name used in the TLS handshake, independently of the Host header.
+	// An empty string resets it to the URL host.
+	//
+	// @param host string The server name to send in the ClientHello.
+	// @return RequestBuilder The request builder.
+	funcs["set_sni"] = func(l *lua.State) int {
+		builder := lua.CheckUserData(l, 1, "RequestBuilder").(*RequestBuilder)
+		builder.sni = lua.CheckString(l, 2)
 		l.PushValue(1)
 		return 1
 	}
@@ -1762,6 +2995,22 @@ func RegisterRequestBuilderType(extension *Runtime) {
 		return 1
 	}
 
+	// from_request populates the request builder from an existing request.
+	//
+	// @param request Request The request to copy the method, URL, headers and body from, the cookies are copied with the Cookie header.
+	// @return RequestBuilder The request builder.
+	funcs["from_request"] = func(l *lua.State) int {
+		builder := lua.CheckUserData(l, 1, "RequestBuilder").(*RequestBuilder)
+		req := lua.CheckUserData(l, 2, "req").(*http.Request)
+
+		if err := builder.fromRequest(req); err != nil {
+			lua.Errorf(l, fmt.Sprintf("reading request body : %s", err.Error()))
+			return 0
+		}
+		l.PushValue(1)
+		return 1
+	}
+
 	// send sends the HTTP request.
 	//
 	// @return Response|nil, string The response object, or nil and an error message.
@@ -1773,14 +3022,24 @@ func RegisterRequestBuilderType(extension *Runtime) {
 			return 0
 		}
 
+		if err := builder.checkEgress(); err != nil {
+			lua.Errorf(l, "%s", err.Error())
+			return 0
+		}
+
 		// Request Body
-		reqBody := bytes.NewBuffer([]byte(builder.body))
+		var reqBody io.Reader = bytes.NewBuffer([]byte(builder.body))
+		var bodyWriter *io.PipeWriter
+		if builder.bodyChunks != "" {
+			reqBody, bodyWriter = io.Pipe()
+		}
 
 		req, err := http.NewRequest(builder.method, builder.url.String(), reqBody)
 		if err != nil {
 			lua.Errorf(l, "creating new request : %s", err.Error())
 			return 0
 		}
+		req = withEgressPolicy(req, builder.egressPolicy)
 
 		// Headers
 		req.Header = builder.headers
@@ -1802,7 +3061,18 @@ func RegisterRequestBuilderType(extension *Runtime) {
 		// x-extension-id
 		req.Header.Set("x-extension-id", extension.Data.ID.String())
 
-		resp, err := builder.client.Do(req)
+		// x-marasi-sni
+		if builder.sni != "" {
+			req.Header.Set("x-marasi-sni", builder.sni)
+		}
+
+		var resp *http.Response
+		if bodyWriter != nil {
+			resp, err = builder.sendChunked(l, req, bodyWriter)
+			builder.releaseBodyChunks(l)
+		} else {
+			resp, err = builder.client.Do(req)
+		}
 		if err != nil {
 			l.PushNil()
 			l.PushString(fmt.Sprintf("sending request: %v", err))
@@ -1830,8 +3100,9 @@ func RegisterRequestBuilderType(extension *Runtime) {
 	funcs["send_async"] = func(l *lua.State) int {
 		builder := lua.CheckUserData(l, 1, "RequestBuilder").(*RequestBuilder)
 
-		if builder.method == "" || builder.url.String() == "" || builder.url == nil {
-			lua.Errorf(l, "method and url must be set before sending the request")
+		send, err := builder.asyncSender(extension)
+		if err != nil {
+			lua.Errorf(l, "%s", err.Error())
 			return 0
 		}
 
@@ -1842,80 +3113,39 @@ func RegisterRequestBuilderType(extension *Runtime) {
 			l.SetField(lua.RegistryIndex, callbackKey)
 		}
 
-		reqMethod := builder.method
-		reqUrlStr := builder.url.String()
-		reqBody := builder.body
-		reqHeaders := builder.headers.Clone()
-
-		reqCookies := make([]*http.Cookie, len(builder.cookies))
-		copy(reqCookies, builder.cookies)
-
-		reqMetadata := make(map[string]any)
-		maps.Copy(reqMetadata, builder.metadata)
-
-		extID := extension.Data.ID.String()
-
 		go func() {
-			reqBodyBuffer := bytes.NewBuffer([]byte(reqBody))
-			var resp *http.Response
-			req, err := http.NewRequest(reqMethod, reqUrlStr, reqBodyBuffer)
-			if err == nil {
-				req.Header = reqHeaders
-
-				reqMetadata["request_builder"] = true
-				reqMetadata["marasi_extension_id"] = extension.Data.ID.String()
-
-				if len(reqMetadata) > 0 {
-					if jsonBytes, err := json.Marshal(reqMetadata); err == nil {
-						req.Header.Set("x-marasi-metadata", string(jsonBytes))
-					}
-				}
-
-				for _, c := range reqCookies {
-					req.AddCookie(c)
-				}
-
-				req.Header.Set("x-extension-id", extID)
-
-				resp, err = builder.client.Do(req)
-
-			}
+			resp, err := send()
 
 			if callbackKey != "" {
-				extension.Mu.Lock()
+				extension.lock()
 				defer extension.Mu.Unlock()
 
+				if extension.closed {
+					if resp != nil {
+						resp.Body.Close()
+					}
+					return
+				}
+
 				top := l.Top()
 				defer l.SetTop(top)
 
 				l.Field(lua.RegistryIndex, callbackKey)
 
 				if l.IsFunction(-1) {
-					if err != nil {
-						l.PushNil()
-						l.PushString(err.Error())
-					} else {
-						bodyBytes, readErr := io.ReadAll(resp.Body)
-						resp.Body.Close()
-
-						if readErr != nil {
-							l.PushNil()
-							l.PushString(fmt.Sprintf("reading body: %s", readErr.Error()))
-						} else {
-							resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-							l.PushUserData(resp)
-							lua.SetMetaTableNamed(l, "res")
-							l.PushNil()
-						}
-					}
+					pushAsyncResult(l, resp, err)
 
 					if callErr := l.ProtectedCall(2, 0, 0); callErr != nil {
 						// TODO: This needs to be properly logged
 					}
+				} else if resp != nil {
+					resp.Body.Close()
 				}
 
 				l.PushNil()
 				l.SetField(lua.RegistryIndex, callbackKey)
+			} else if resp != nil {
+				resp.Body.Close()
 			}
 		}()
 		return 0
@@ -1951,3 +3181,139 @@ func RegisterRequestBuilderType(extension *Runtime) {
 
 	})
 }
+
+// formatContentType builds a Content-Type value from a media type and an optional charset parameter.
+// It returns an error if the media type or the charset is not valid.
+func formatContentType(mediaType string, charset string) (string, error) {
+	params := map[string]string{}
+	if charset != "" {
+		params["charset"] = charset
+	}
+
+	contentType := mime.FormatMediaType(mediaType, params)
+	if contentType == "" {
+		return "", fmt.Errorf("invalid media type %q", mediaType)
+	}
+	return contentType, nil
+}
+
+// prefersJSON reports whether the media type with the highest quality in an Accept header is JSON
+// (application/json or a +json type). Media types with the same quality keep the order of the header.
+func prefersJSON(accept string) bool {
+	preferred := ""
+	bestQuality := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > bestQuality {
+			preferred, bestQuality = mediaType, quality
+		}
+	}
+	return preferred == "application/json" || strings.HasSuffix(preferred, "+json")
+}
+
+// maxDeltaSeconds is the largest delta-seconds value, larger values are capped to it as required by RFC 9111.
+const maxDeltaSeconds = 2147483648
+
+// cacheControlDirectives parses Cache-Control header values into their directives, keyed by the lowercased directive name.
+// Quoted arguments are unquoted and commas inside them do not split directives, the first occurrence of a directive is kept.
+func cacheControlDirectives(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, directive := range splitOutsideQuotes(value, ',') {
+			name, arg, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, ok := directives[name]; name == "" || ok {
+				continue
+			}
+			directives[name] = unquoteArgument(strings.TrimSpace(arg))
+		}
+	}
+	return directives
+}
+
+// splitOutsideQuotes splits s at each sep that is not inside a quoted string
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++ // the escaped character cannot end the quoted string
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquoteArgument removes the quotes and escapes of a quoted directive argument, other arguments are returned as is
+func unquoteArgument(arg string) string {
+	if len(arg) < 2 || arg[0] != '"' || arg[len(arg)-1] != '"' {
+		return arg
+	}
+
+	var unquoted strings.Builder
+	for i := 1; i < len(arg)-1; i++ {
+		if arg[i] == '\\' && i+1 < len(arg)-1 {
+			i++
+		}
+		unquoted.WriteByte(arg[i])
+	}
+	return unquoted.String()
+}
+
+// parseDeltaSeconds parses a delta-seconds directive argument such as the max-age value.
+// Values larger than maxDeltaSeconds are capped, it returns false for empty, negative or non-numeric values.
+func parseDeltaSeconds(arg string) (int64, bool) {
+	if arg == "" || strings.TrimLeft(arg, "0123456789") != "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds > maxDeltaSeconds {
+		return maxDeltaSeconds, true
+	}
+	return seconds, true
+}
+
+// replaceCookiePair rewrites the value of the first name=value pair called name in a Cookie or Set-Cookie header value, the rest
+// of the header is kept byte for byte. With first set only the first pair is considered, the pairs that follow it in a Set-Cookie
+// header are attributes. It returns false if the header has no such pair.
+func replaceCookiePair(header string, name string, value string, first bool) (string, bool) {
+	pairs := strings.Split(header, ";")
+	for i, pair := range pairs {
+		if first && i > 0 {
+			break
+		}
+		key, _, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(key) != name {
+			continue
+		}
+		leading := pair[:len(pair)-len(strings.TrimLeft(pair, " \t"))]
+		pairs[i] = leading + name + "=" + value
+		return strings.Join(pairs, ";"), true
+	}
+	return header, false
+}
+
+// extensionsRan returns the names of the extensions recorded in the `extensions_ran` metadata of the request.
+func extensionsRan(req *http.Request) []string {
+	metadata, ok := core.MetadataFromContext(req.Context())
+	if !ok {
+		return nil
+	}
+	names, _ := metadata["extensions_ran"].([]string)
+	return names
+}
@@ -1,6 +1,9 @@
 package extensions
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -88,6 +91,28 @@ func TestScopeType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "scope:add_rule should set the optional priority",
+			luaCode: `
+				local s = marasi:scope()
+				s:add_rule("-\\.marasi\\.app$", "host")
+				s:add_rule("^api\\.marasi\\.app$", "host", 10)
+				return s:matches_string("api.marasi.app", "host")
+			`,
+			setupScope: func() *compass.Scope { return compass.NewScope(false) },
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				rule, ok := scope.IncludeRules["^api\\.marasi\\.app$|host"]
+				if !ok {
+					t.Fatalf("\nwanted:\ninclude rule\ngot:\n%v", scope.IncludeRules)
+				}
+				if rule.Priority != 10 {
+					t.Errorf("\nwanted:\n10\ngot:\n%d", rule.Priority)
+				}
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
+				}
+			},
+		},
 		{
 			name: "scope:add_rule should raise an error if scope.AddRule errors",
 			luaCode: `
@@ -301,6 +326,73 @@ func TestScopeType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "scope:matches_detailed should return the deciding rule",
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := httptest.NewRequest("GET", "https://api.marasi.app/admin", nil)
+					r.LuaState.PushUserData(req)
+					lua.SetMetaTableNamed(r.LuaState, "req")
+					r.LuaState.SetGlobal("test_req")
+					return nil
+				},
+			},
+			luaCode: `
+				local s = marasi:scope()
+				s:add_rule("marasi\\.app", "host")
+				s:add_rule("-admin", "url")
+				local result = s:matches_detailed(test_req)
+				return tostring(result.in_scope) .. "|" .. result.side .. "|" .. result.rule .. "|" .. result.target
+			`,
+			setupScope: func() *compass.Scope { return compass.NewScope(false) },
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				want := "false|exclude|admin|url|https://api.marasi.app/admin"
+				if got != want {
+					t.Fatalf("\nwanted:\n%s\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name: "scope:matches_detailed should return the default when no rule matches a response",
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := httptest.NewRequest("GET", "https://marasi.app/public", nil)
+					res := &http.Response{Request: req}
+					r.LuaState.PushUserData(res)
+					lua.SetMetaTableNamed(r.LuaState, "res")
+					r.LuaState.SetGlobal("test_res")
+					return nil
+				},
+			},
+			luaCode: `
+				local s = marasi:scope()
+				s:add_rule("admin", "url")
+				local result = s:matches_detailed(test_res)
+				return tostring(result.in_scope) .. "|" .. result.side .. "|" .. result.rule .. "|" .. result.target
+			`,
+			setupScope: func() *compass.Scope { return compass.NewScope(false) },
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				want := "false|default||"
+				if got != want {
+					t.Fatalf("\nwanted:\n%s\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name: "scope:matches_detailed should error on other inputs",
+			luaCode: `
+				local ok, err = pcall(marasi:scope().matches_detailed, marasi:scope(), "marasi.app")
+				if ok then return "expected error" end
+				return err
+			`,
+			setupScope: func() *compass.Scope { return compass.NewScope(false) },
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok || !strings.Contains(errStr, "expected request / response object") {
+					t.Fatalf("\nwanted:\nerror containing 'expected request / response object'\ngot:\n%v", got)
+				}
+			},
+		},
 		{
 			name: "scope:matches should return false on mismatch (url - response) with default allow policy=false",
 			options: []func(*Runtime) error{
@@ -477,6 +569,82 @@ func TestScopeType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "scope:remove_rules_of_type should only remove rules of that type",
+			luaCode: `
+				local s = marasi:scope()
+				s:add_rule("marasi\\.app", "host")
+				s:add_rule("-marasi\\.com", "host")
+				s:add_rule("/api/", "url")
+				s:remove_rules_of_type("host")
+			`,
+			setupScope: func() *compass.Scope { return compass.NewScope(false) },
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				if _, ok := scope.IncludeRules["/api/|url"]; !ok || len(scope.IncludeRules) != 1 {
+					t.Errorf("\nwanted:\nonly the url include rule\ngot:\n%v", scope.IncludeRules)
+				}
+				if len(scope.ExcludeRules) != 0 {
+					t.Errorf("\nwanted:\n0 exclude rules\ngot:\n%d", len(scope.ExcludeRules))
+				}
+			},
+		},
+		{
+			name: "scope:clone should return an independent copy",
+			luaCode: `
+				local s = marasi:scope()
+				s:add_rule("marasi\\.app", "host")
+				local c = s:clone()
+				c:add_rule("-marasi\\.app", "host")
+				c:set_default_allow(true)
+				return c:matches_string("marasi.app", "host")
+			`,
+			setupScope: func() *compass.Scope { return compass.NewScope(false) },
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				if got != false {
+					t.Errorf("\nwanted:\nclone to exclude marasi.app\ngot:\n%v", got)
+				}
+				if len(scope.IncludeRules) != 1 || len(scope.ExcludeRules) != 0 {
+					t.Errorf("\nwanted:\n1 include and 0 exclude rules\ngot:\n%d include and %d exclude rules", len(scope.IncludeRules), len(scope.ExcludeRules))
+				}
+				if scope.DefaultAllow {
+					t.Errorf("\nwanted:\nfalse\ngot:\ntrue")
+				}
+				if !scope.MatchesString("marasi.app", "host") {
+					t.Errorf("\nwanted:\ntrue\ngot:\nfalse")
+				}
+			},
+		},
+		{
+			name: "scope:rule_stats should return the hits of each rule and reset_stats should clear them",
+			luaCode: `
+				local s = marasi:scope()
+				local parts = {}
+				for _, stat in ipairs(s:rule_stats()) do
+					table.insert(parts, stat.pattern .. "|" .. stat.match_type .. "|" .. tostring(stat.exclude) .. "|" .. stat.hits)
+				end
+				s:reset_stats()
+				return table.concat(parts, ",")
+			`,
+			setupScope: func() *compass.Scope {
+				scope := compass.NewScope(false)
+				scope.AddRule("marasi\\.app", "host", false)
+				scope.AddRule("-cdn\\.marasi\\.app", "host", true)
+				scope.Matches(httptest.NewRequest("GET", "https://marasi.app/", nil))
+				scope.Matches(httptest.NewRequest("GET", "https://marasi.app/login", nil))
+				return scope
+			},
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				want := "cdn\\.marasi\\.app|host|true|0,marasi\\.app|host|false|2"
+				if got != want {
+					t.Errorf("\nwanted:\n%s\ngot:\n%v", want, got)
+				}
+				for _, stat := range scope.RuleStats() {
+					if stat.Hits != 0 {
+						t.Errorf("\nwanted:\n0 hits for %s\ngot:\n%d", stat.Pattern, stat.Hits)
+					}
+				}
+			},
+		},
 		{
 			name: "scope:tostring should return formatted string representation",
 			luaCode: `
@@ -498,6 +666,73 @@ func TestScopeType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "scope:matches should reuse the request decision for the response if the scope did not change",
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := httptest.NewRequest("GET", "https://marasi.app/path", nil)
+					res := &http.Response{Request: req}
+					r.LuaState.PushUserData(req)
+					lua.SetMetaTableNamed(r.LuaState, "req")
+					r.LuaState.SetGlobal("test_req")
+					r.LuaState.PushUserData(res)
+					lua.SetMetaTableNamed(r.LuaState, "res")
+					r.LuaState.SetGlobal("test_res")
+					return nil
+				},
+			},
+			luaCode: `
+				local s = marasi:scope()
+				s:add_rule("marasi\\.app", "host")
+				local request_match = s:matches(test_req)
+				test_req:set_host("other.app")
+				return request_match, s:matches(test_res)
+			`,
+			setupScope: func() *compass.Scope { return compass.NewScope(false) },
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				requestMatch := GoValue(ext.LuaState, -2)
+				if requestMatch != true {
+					t.Fatalf("\nwanted:\ntrue (request)\ngot:\n%v", requestMatch)
+				}
+				if got != true {
+					t.Fatalf("\nwanted:\ntrue (cached decision)\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "scope:matches should not reuse the request decision after a rule change",
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := httptest.NewRequest("GET", "https://marasi.app/path", nil)
+					res := &http.Response{Request: req}
+					r.LuaState.PushUserData(req)
+					lua.SetMetaTableNamed(r.LuaState, "req")
+					r.LuaState.SetGlobal("test_req")
+					r.LuaState.PushUserData(res)
+					lua.SetMetaTableNamed(r.LuaState, "res")
+					r.LuaState.SetGlobal("test_res")
+					return nil
+				},
+			},
+			luaCode: `
+				local s = marasi:scope()
+				s:add_rule("marasi\\.app", "host")
+				local request_match = s:matches(test_req)
+				test_req:set_host("other.app")
+				s:add_rule("unrelated\\.app", "host")
+				return request_match, s:matches(test_res)
+			`,
+			setupScope: func() *compass.Scope { return compass.NewScope(false) },
+			validatorFunc: func(t *testing.T, scope *compass.Scope, ext *Runtime, got any) {
+				requestMatch := GoValue(ext.LuaState, -2)
+				if requestMatch != true {
+					t.Fatalf("\nwanted:\ntrue (request)\ngot:\n%v", requestMatch)
+				}
+				if got != false {
+					t.Fatalf("\nwanted:\nfalse (recomputed decision)\ngot:\n%v", got)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -521,6 +756,84 @@ func TestScopeType(t *testing.T) {
 	}
 }
 
+func TestScopeSetDefaultAllow(t *testing.T) {
+	t.Run("set_default_allow on the proxy scope should be set through the proxy", func(t *testing.T) {
+		extension, mockProxy := setupTestExtension(t, "")
+		scope := compass.NewScope(true)
+		mockProxy.GetScopeFunc = func() (*compass.Scope, error) {
+			return scope, nil
+		}
+
+		var persisted []bool
+		mockProxy.SetDefaultAllowFunc = func(allow bool) error {
+			persisted = append(persisted, allow)
+			scope.SetDefaultAllow(allow)
+			return nil
+		}
+
+		err := extension.ExecuteLua(`marasi:scope():set_default_allow(false)`)
+		if err != nil {
+			t.Fatalf("executing lua code : %v", err)
+		}
+
+		if !reflect.DeepEqual(persisted, []bool{false}) {
+			t.Fatalf("\nwanted:\n[false]\ngot:\n%v", persisted)
+		}
+		if scope.DefaultAllow {
+			t.Fatalf("\nwanted:\nDefaultAllow false\ngot:\ntrue")
+		}
+	})
+
+	t.Run("set_default_allow on a clone should not be set through the proxy", func(t *testing.T) {
+		extension, mockProxy := setupTestExtension(t, "")
+		scope := compass.NewScope(true)
+		mockProxy.GetScopeFunc = func() (*compass.Scope, error) {
+			return scope, nil
+		}
+
+		called := false
+		mockProxy.SetDefaultAllowFunc = func(allow bool) error {
+			called = true
+			return nil
+		}
+
+		err := extension.ExecuteLua(`
+			local c = marasi:scope():clone()
+			c:set_default_allow(false)
+			return c:matches_string("marasi.app", "host")
+		`)
+		if err != nil {
+			t.Fatalf("executing lua code : %v", err)
+		}
+
+		if called {
+			t.Fatalf("\nwanted:\nproxy SetDefaultAllow not called\ngot:\ncalled")
+		}
+		if got := GoValue(extension.LuaState, -1); got != false {
+			t.Fatalf("\nwanted:\nfalse\ngot:\n%v", got)
+		}
+		if !scope.DefaultAllow {
+			t.Fatalf("\nwanted:\nDefaultAllow true\ngot:\nfalse")
+		}
+	})
+
+	t.Run("set_default_allow should return an error if the proxy fails to persist it", func(t *testing.T) {
+		extension, mockProxy := setupTestExtension(t, "")
+		scope := compass.NewScope(true)
+		mockProxy.GetScopeFunc = func() (*compass.Scope, error) {
+			return scope, nil
+		}
+		mockProxy.SetDefaultAllowFunc = func(allow bool) error {
+			return errors.New("database is locked")
+		}
+
+		err := extension.ExecuteLua(`marasi:scope():set_default_allow(false)`)
+		if err == nil || !strings.Contains(err.Error(), "database is locked") {
+			t.Fatalf("\nwanted:\nerror containing database is locked\ngot:\n%v", err)
+		}
+	})
+}
+
 func TestRegexType(t *testing.T) {
 	withRegex := func(pattern string) func(*Runtime) error {
 		return func(r *Runtime) error {
@@ -670,6 +983,42 @@ func TestRegexType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "regexp:replace_n with n=1 should replace only the first match",
+			luaCode: `return re:replace_n("a-a-a", "b", 1)`,
+			options: []func(*Runtime) error{
+				withRegex(`a`),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "b-a-a" {
+					t.Errorf("\nwanted:\nb-a-a\ngot:\n%q", got)
+				}
+			},
+		},
+		{
+			name:    "regexp:replace_n with n=0 should replace all matches",
+			luaCode: `return re:replace_n("a-a-a", "b", 0)`,
+			options: []func(*Runtime) error{
+				withRegex(`a`),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "b-b-b" {
+					t.Errorf("\nwanted:\nb-b-b\ngot:\n%q", got)
+				}
+			},
+		},
+		{
+			name:    "regexp:replace_n with n greater than match count should replace all matches",
+			luaCode: `return re:replace_n("marasi 1.0 1.0", "v$1", 10)`,
+			options: []func(*Runtime) error{
+				withRegex(`(1\.0)`),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "marasi v1.0 v1.0" {
+					t.Errorf("\nwanted:\nmarasi v1.0 v1.0\ngot:\n%q", got)
+				}
+			},
+		},
 		{
 			name:    "regexp:pattern should return the regex string",
 			luaCode: `return re:pattern()`,
@@ -682,6 +1031,19 @@ func TestRegexType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "regexp:groups should return only the named groups",
+			luaCode: `return re:groups()`,
+			options: []func(*Runtime) error{
+				withRegex(`(?P<key>\w+)=(\d+)&(?P<value>\w+)`),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := []any{"key", "value"}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
 		{
 			name:    "regexp:find_submatch should return match and capture groups",
 			luaCode: `return re:find_submatch("key=value")`,
@@ -1091,59 +1453,131 @@ func TestCookieType(t *testing.T) {
 			},
 		},
 		{
-			name:    "cookie:serialize should return the cookie string",
-			luaCode: `return c:serialize()`,
+			name:    "cookie:is_expired should return true for a past expiration",
+			luaCode: `return c:is_expired()`,
 			options: []func(*Runtime) error{
-				withCookie(&http.Cookie{Name: "foo", Value: "bar"}),
+				withCookie(&http.Cookie{Name: "a", Expires: time.Now().Add(-time.Hour)}),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "foo=bar" {
-					t.Errorf("\nwanted:\nfoo=bar\ngot:\n%v", got)
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "cookie:tostring should return serialized string",
-			luaCode: `return tostring(c)`,
+			name:    "cookie:is_expired should return false for a future expiration",
+			luaCode: `return c:is_expired()`,
 			options: []func(*Runtime) error{
-				withCookie(&http.Cookie{Name: "session", Value: "123", Path: "/admin", SameSite: http.SameSiteLaxMode, Secure: true, HttpOnly: true}),
+				withCookie(&http.Cookie{Name: "a", Expires: time.Now().Add(time.Hour)}),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				want := "session=123; Path=/admin; HttpOnly; Secure; SameSite=Lax"
-				if got != want {
-					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+				if got != false {
+					t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
 				}
 			},
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			extension, _ := setupTestExtension(t, "", tt.options...)
-
-			err := extension.ExecuteLua(tt.luaCode)
-			if err != nil {
-				t.Fatalf("executing lua code %s : %v", tt.luaCode, err)
-			}
-
-			got := GoValue(extension.LuaState, -1)
-			if tt.validatorFunc != nil {
-				tt.validatorFunc(t, extension, got)
-			}
-		})
-	}
-}
-
-func TestHeaderType(t *testing.T) {
-	withHeader := func(h http.Header) func(*Runtime) error {
-		return func(r *Runtime) error {
-			headerCopy := h.Clone()
-			r.LuaState.PushUserData(&headerCopy)
-			lua.SetMetaTableNamed(r.LuaState, "header")
-			r.LuaState.SetGlobal("h")
-			return nil
-		}
-	}
+		{
+			name:    "cookie:is_expired should return false for a session cookie",
+			luaCode: `return c:is_expired()`,
+			options: []func(*Runtime) error{
+				withCookie(&http.Cookie{Name: "a"}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != false {
+					t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "cookie:is_session should return true without Expires and Max-Age",
+			luaCode: `return c:is_session()`,
+			options: []func(*Runtime) error{
+				withCookie(&http.Cookie{Name: "a"}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "cookie:is_session should return false with Expires",
+			luaCode: `return c:is_session()`,
+			options: []func(*Runtime) error{
+				withCookie(&http.Cookie{Name: "a", Expires: time.Now().Add(time.Hour)}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != false {
+					t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "cookie:is_session should return false with Max-Age",
+			luaCode: `return c:is_session()`,
+			options: []func(*Runtime) error{
+				withCookie(&http.Cookie{Name: "a", MaxAge: 3600}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != false {
+					t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "cookie:serialize should return the cookie string",
+			luaCode: `return c:serialize()`,
+			options: []func(*Runtime) error{
+				withCookie(&http.Cookie{Name: "foo", Value: "bar"}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "foo=bar" {
+					t.Errorf("\nwanted:\nfoo=bar\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "cookie:tostring should return serialized string",
+			luaCode: `return tostring(c)`,
+			options: []func(*Runtime) error{
+				withCookie(&http.Cookie{Name: "session", Value: "123", Path: "/admin", SameSite: http.SameSiteLaxMode, Secure: true, HttpOnly: true}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := "session=123; Path=/admin; HttpOnly; Secure; SameSite=Lax"
+				if got != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extension, _ := setupTestExtension(t, "", tt.options...)
+
+			err := extension.ExecuteLua(tt.luaCode)
+			if err != nil {
+				t.Fatalf("executing lua code %s : %v", tt.luaCode, err)
+			}
+
+			got := GoValue(extension.LuaState, -1)
+			if tt.validatorFunc != nil {
+				tt.validatorFunc(t, extension, got)
+			}
+		})
+	}
+}
+
+func TestHeaderType(t *testing.T) {
+	withHeader := func(h http.Header) func(*Runtime) error {
+		return func(r *Runtime) error {
+			headerCopy := h.Clone()
+			r.LuaState.PushUserData(&headerCopy)
+			lua.SetMetaTableNamed(r.LuaState, "header")
+			r.LuaState.SetGlobal("h")
+			return nil
+		}
+	}
 
 	tests := []struct {
 		name          string
@@ -1163,6 +1597,66 @@ func TestHeaderType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "header:get_all_joined should join all values with the separator",
+			luaCode: `return h:get_all_joined("X-Forwarded-For", ", ")`,
+			options: []func(*Runtime) error{
+				withHeader(http.Header{"X-Forwarded-For": {"10.0.0.1", "10.0.0.2", "10.0.0.3"}}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "10.0.0.1, 10.0.0.2, 10.0.0.3" {
+					t.Errorf("\nwanted:\n10.0.0.1, 10.0.0.2, 10.0.0.3\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "header:count should return the number of values",
+			luaCode: `return h:count("content-length")`,
+			options: []func(*Runtime) error{
+				withHeader(http.Header{"Content-Length": {"5", "10"}}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != float64(2) {
+					t.Errorf("\nwanted:\n2\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "header:count should return 0 if key missing",
+			luaCode: `return h:count("X-Missing")`,
+			options: []func(*Runtime) error{
+				withHeader(http.Header{}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != float64(0) {
+					t.Errorf("\nwanted:\n0\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "header:canonical should canonicalize a lowercased name",
+			luaCode: `return h:canonical("x-forwarded-for")`,
+			options: []func(*Runtime) error{
+				withHeader(http.Header{}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "X-Forwarded-For" {
+					t.Errorf("\nwanted:\nX-Forwarded-For\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "header:get_all_joined should return nil if key missing",
+			luaCode: `return h:get_all_joined("X-Missing", ", ")`,
+			options: []func(*Runtime) error{
+				withHeader(http.Header{}),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != nil {
+					t.Errorf("\nwanted:\nnil\ngot:\n%v", got)
+				}
+			},
+		},
 		{
 			name:    "header:get should return nil if key missing",
 			luaCode: `return h:get("X-Missing")`,
@@ -1583,6 +2077,19 @@ func TestRequestType(t *testing.T) {
 		}
 	}
 
+	// withExtensionsRan records the names in the extensions_ran metadata of the request set by withRequest
+	withExtensionsRan := func(names ...string) func(*Runtime) error {
+		return func(r *Runtime) error {
+			r.LuaState.Global("r")
+			req := r.LuaState.ToUserData(-1).(*http.Request)
+			r.LuaState.Pop(1)
+
+			metadata, _ := core.MetadataFromContext(req.Context())
+			metadata["extensions_ran"] = names
+			return nil
+		}
+	}
+
 	basicReq := func() *http.Request {
 		req := httptest.NewRequest("GET", "https://marasi.app/path?q=1", strings.NewReader("body content"))
 		req.Header.Set("Content-Type", "text/plain")
@@ -1755,429 +2262,1483 @@ func TestRequestType(t *testing.T) {
 			},
 		},
 		{
-			name:    "req:set_body should update body content",
-			luaCode: `r:set_body("new body"); return r:body()`,
+			name:    "req:proxy_auth should return the authenticated username",
+			luaCode: `return r:proxy_auth()`,
 			options: []func(*Runtime) error{
-				withRequest(basicReq()),
+				withRequest(core.ContextWithProxyAuthUser(basicReq(), "tester")),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "new body" {
-					t.Errorf("\nwanted:\nnew body\ngot:\n%v", got)
+				if got != "tester" {
+					t.Errorf("\nwanted:\ntester\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "req:headers should return headers object",
-			luaCode: `return r:headers():get("User-Agent")`,
+			name:    "req:proxy_auth should return nil without proxy authentication",
+			luaCode: `return r:proxy_auth()`,
 			options: []func(*Runtime) error{
 				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "Go-Test" {
-					t.Errorf("\nwanted:\nGo-Test\ngot:\n%v", got)
+				if got != nil {
+					t.Errorf("\nwanted:\nnil\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "req:content_type should return content type",
-			luaCode: `return r:content_type()`,
+			name:    "req:raw should return the request line, headers and body and keep the body readable",
+			luaCode: `return r:raw(), r:body()`,
 			options: []func(*Runtime) error{
 				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "text/plain" {
-					t.Errorf("\nwanted:\ntext/plain\ngot:\n%v", got)
+				raw, _ := GoValue(ext.LuaState, -2).(string)
+				for _, want := range []string{"GET /path?q=1 HTTP/1.1\r\n", "Host: marasi.app\r\n", "Content-Type: text/plain\r\n", "User-Agent: Go-Test\r\n"} {
+					if !strings.Contains(raw, want) {
+						t.Errorf("\nwanted:\nraw containing %q\ngot:\n%q", want, raw)
+					}
+				}
+				if !strings.HasSuffix(raw, "\r\n\r\nbody content") {
+					t.Errorf("\nwanted:\nraw ending with the body\ngot:\n%q", raw)
+				}
+				if got != "body content" {
+					t.Errorf("\nwanted:\nbody content\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "req:cookies should return table of cookies",
-			luaCode: `return r:cookies()`,
+			name: "req:raw should error if reading the body fails",
+			luaCode: `
+				local ok, res = pcall(r.raw, r)
+				if ok then return "expected error" end
+				return res
+			`,
 			options: []func(*Runtime) error{
 				func(r *Runtime) error {
 					req := basicReq()
-					req.AddCookie(&http.Cookie{Name: "c1", Value: "v1"})
+					req.Body = io.NopCloser(&erroringReader{})
 					return withRequest(req)(r)
 				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				// got is []any of *http.Cookie userdata
-				cookies, ok := got.([]any)
+				errStr, ok := got.(string)
 				if !ok {
-					t.Fatalf("\nwanted:\n[]any\ngot:\n%T", got)
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
 				}
-				if len(cookies) != 1 {
-					t.Errorf("\nwanted:\n1 cookie\ngot:\n%d", len(cookies))
+				if !strings.Contains(errStr, "dumping request") {
+					t.Errorf("\nwanted:\nerror containing 'dumping request'\ngot:\n%q", errStr)
 				}
 			},
 		},
 		{
-			name:    "req:cookie should return specific cookie",
-			luaCode: `return r:cookie("c1"):value()`,
+			name:    "req:decoded_body should return the gunzipped body and keep the raw body",
+			luaCode: `return r:decoded_body(), #r:body()`,
 			options: []func(*Runtime) error{
 				func(r *Runtime) error {
-					req := basicReq()
-					req.AddCookie(&http.Cookie{Name: "c1", Value: "v1"})
+					compressed := gzipBytes("request content")
+					req := httptest.NewRequest("POST", "https://marasi.app/upload", bytes.NewReader(compressed))
+					req.Header.Set("Content-Encoding", "gzip")
 					return withRequest(req)(r)
 				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "v1" {
-					t.Errorf("\nwanted:\nv1\ngot:\n%v", got)
+				if decoded := GoValue(ext.LuaState, -2); decoded != "request content" {
+					t.Errorf("\nwanted:\nrequest content\ngot:\n%v", decoded)
+				}
+				want := float64(len(gzipBytes("request content")))
+				if got != want {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
 				}
 			},
 		},
 		{
-			name:    "req:set_cookie should add cookie",
-			luaCode: `r:set_cookie(marasi.utils:cookie("new", "val")); return r:cookie("new"):value()`,
+			name:    "req:decoded_body should return the body as is without Content-Encoding",
+			luaCode: `return r:decoded_body()`,
 			options: []func(*Runtime) error{
 				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "val" {
-					t.Errorf("\nwanted:\nval\ngot:\n%v", got)
+				if got != "body content" {
+					t.Errorf("\nwanted:\nbody content\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name: "req:set_cookies should set cookies from table",
-			luaCode: `
-				local c1 = marasi.utils:cookie("c1", "v1")
-				local c2 = marasi.utils:cookie("c2", "v2")
-				r:set_cookies({c1, c2})
-				return r:cookie("c1"):value(), r:cookie("c2"):value()
-			`,
+			name:    "req:set_body should update body content",
+			luaCode: `r:set_body("new body"); return r:body()`,
 			options: []func(*Runtime) error{
 				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				val2 := got.(string)
-				ext.LuaState.Pop(1)
-				val1 := GoValue(ext.LuaState, -1).(string)
-
-				if val1 != "v1" || val2 != "v2" {
-					t.Errorf("\nwanted:\nv1, v2\ngot:\n%s, %s", val1, val2)
+				if got != "new body" {
+					t.Errorf("\nwanted:\nnew body\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name: "req:set_cookies should error if argument is not a table",
-			luaCode: `
-				local ok, res = pcall(r.set_cookies, r, "not-a-table")
-				if ok then return "expected error" end
-				return res
-			`,
+			name:    "req:headers should return headers object",
+			luaCode: `return r:headers():get("User-Agent")`,
 			options: []func(*Runtime) error{
 				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				errStr, ok := got.(string)
-				if !ok {
-					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
-				}
-				if !strings.Contains(errStr, "expected table") {
-					t.Errorf("\nwanted:\nerror containing 'expected table'\ngot:\n%q", errStr)
+				if got != "Go-Test" {
+					t.Errorf("\nwanted:\nGo-Test\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "req:metadata should return metadata map",
-			luaCode: `return r:metadata()`,
+			name:    "req:is_ajax should be true for XHR requests",
+			luaCode: `return r:is_ajax()`,
 			options: []func(*Runtime) error{
-				withRequest(basicReq()),
+				func(r *Runtime) error {
+					req := basicReq()
+					req.Header.Set("X-Requested-With", "XMLHttpRequest")
+					return withRequest(req)(r)
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				m := asMap(got)
-				if m == nil {
-					t.Fatalf("\nwanted:\nmap\ngot:\n%T", got)
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "req:set_metadata should update metadata for extension",
-			luaCode: `r:set_metadata({flag = true})`,
+			name:    "req:is_ajax should be true if the Accept header prefers JSON",
+			luaCode: `return r:is_ajax()`,
 			options: []func(*Runtime) error{
-				withRequest(basicReq()),
+				func(r *Runtime) error {
+					req := basicReq()
+					req.Header.Set("Accept", "application/json, text/plain, */*")
+					return withRequest(req)(r)
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				ext.LuaState.Global("r")
-				req := ext.LuaState.ToUserData(-1).(*http.Request)
-				ext.LuaState.Pop(1)
-
-				meta, _ := core.MetadataFromContext(req.Context())
-				extMeta, ok := meta[ext.Data.Name].(map[string]any)
-				if !ok {
-					t.Fatalf("\nwanted:\nmetadata for extension %s\ngot:\nmissing", ext.Data.Name)
-				}
-				if val, ok := extMeta["flag"].(bool); !ok || !val {
-					t.Errorf("\nwanted:\nflag=true in metadata\ngot:\n%v", val)
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name: "req:set_metadata should error if table values are mixed/array",
-			luaCode: `
-				local ok, res = pcall(r.set_metadata, r, {1, 2})
-				if ok then return "expected error" end
-				return res
-			`,
+			name:    "req:is_ajax should be false for page navigations",
+			luaCode: `return r:is_ajax()`,
 			options: []func(*Runtime) error{
-				withRequest(basicReq()),
+				func(r *Runtime) error {
+					req := basicReq()
+					req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,application/json;q=0.8,*/*;q=0.7")
+					return withRequest(req)(r)
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				errStr, ok := got.(string)
-				if !ok {
-					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				if got != false {
+					t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
 				}
-				if !strings.Contains(errStr, "metadata must be a key-value table") {
-					t.Errorf("\nwanted:\nerror containing 'metadata must be a key-value table'\ngot:\n%q", errStr)
+			},
+		},
+		{
+			name:    "req:content_type should return content type",
+			luaCode: `return r:content_type()`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "text/plain" {
+					t.Errorf("\nwanted:\ntext/plain\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "req:drop should set drop flag",
-			luaCode: `r:drop()`,
+			name:    "req:set_content_type should set the media type with a charset",
+			luaCode: `r:set_content_type("application/json", "utf-8"); return r:headers():get("Content-Type")`,
 			options: []func(*Runtime) error{
 				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				ext.LuaState.Global("r")
-				req := ext.LuaState.ToUserData(-1).(*http.Request)
-				ext.LuaState.Pop(1)
-
-				if dropped, _ := core.DroppedFlagFromContext(req.Context()); !dropped {
-					t.Errorf("\nwanted:\ndropped=true\ngot:\n%v", dropped)
+				if got != "application/json; charset=utf-8" {
+					t.Errorf("\nwanted:\napplication/json; charset=utf-8\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "req:skip should set skip flag",
-			luaCode: `r:skip()`,
+			name:    "req:set_content_type should set the media type without a charset",
+			luaCode: `r:set_content_type("application/json"); return r:headers():get("Content-Type")`,
 			options: []func(*Runtime) error{
 				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				ext.LuaState.Global("r")
-				req := ext.LuaState.ToUserData(-1).(*http.Request)
-				ext.LuaState.Pop(1)
-
-				if skipped, _ := core.SkipFlagFromContext(req.Context()); !skipped {
-					t.Errorf("\nwanted:\nskipped=true\ngot:\n%v", skipped)
+				if got != "application/json" {
+					t.Errorf("\nwanted:\napplication/json\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "req:tostring should return formatted string",
-			luaCode: `return tostring(r)`,
+			name: "req:set_content_type should error on an invalid media type",
+			luaCode: `
+				local ok, err = pcall(r.set_content_type, r, "not a media type")
+				if ok then return "expected error" end
+				return err
+			`,
 			options: []func(*Runtime) error{
 				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				str, ok := got.(string)
-				if !ok {
-					t.Fatalf("\nwanted:\nstring\ngot:\n%T", got)
+				if errStr, _ := got.(string); !strings.Contains(errStr, "invalid media type") {
+					t.Errorf("\nwanted:\nerror containing 'invalid media type'\ngot:\n%v", got)
 				}
-
-				if !strings.HasPrefix(str, "Request { ID:") {
-					t.Errorf("\nwanted prefix:\nRequest { ID:\ngot:\n%s", str)
+			},
+		},
+		{
+			name:    "req:cookies should return table of cookies",
+			luaCode: `return r:cookies()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := basicReq()
+					req.AddCookie(&http.Cookie{Name: "c1", Value: "v1"})
+					return withRequest(req)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				// got is []any of *http.Cookie userdata
+				cookies, ok := got.([]any)
+				if !ok {
+					t.Fatalf("\nwanted:\n[]any\ngot:\n%T", got)
 				}
-				if !strings.Contains(str, "Method: GET") {
-					t.Errorf("\nwanted:\nMethod: GET\ngot:\n%s", str)
+				if len(cookies) != 1 {
+					t.Errorf("\nwanted:\n1 cookie\ngot:\n%d", len(cookies))
 				}
-				if !strings.Contains(str, "URL: https://marasi.app/path?q=1") {
-					t.Errorf("\nwanted:\nURL: https://marasi.app/path?q=1\ngot:\n%s", str)
+			},
+		},
+		{
+			name:    "req:cookie_names should return the names of all cookies",
+			luaCode: `return r:cookie_names()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := basicReq()
+					req.AddCookie(&http.Cookie{Name: "session", Value: "v1"})
+					req.AddCookie(&http.Cookie{Name: "csrf", Value: "v2"})
+					req.AddCookie(&http.Cookie{Name: "theme", Value: "v3"})
+					return withRequest(req)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := []any{"session", "csrf", "theme"}
+				if !reflect.DeepEqual(want, got) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
 				}
-				if !strings.Contains(str, "Proto: HTTP/1.1") {
-					t.Errorf("\nwanted:\nProto: HTTP/1.1\ngot:\n%s", str)
+			},
+		},
+		{
+			name:    "req:cookie_names should return an empty table without cookies",
+			luaCode: `return #r:cookie_names()`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 0.0 {
+					t.Errorf("\nwanted:\n0\ngot:\n%v", got)
 				}
-				if !strings.Contains(str, "Remote: 192.0.2.1:1234") {
-					t.Errorf("\nwanted:\nRemote: 192.0.2.1:1234\ngot:\n%s", str)
+			},
+		},
+		{
+			name:    "req:cookie should return specific cookie",
+			luaCode: `return r:cookie("c1"):value()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := basicReq()
+					req.AddCookie(&http.Cookie{Name: "c1", Value: "v1"})
+					return withRequest(req)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "v1" {
+					t.Errorf("\nwanted:\nv1\ngot:\n%v", got)
 				}
-				if !strings.Contains(str, "Length: 12") {
-					t.Errorf("\nwanted:\nLength: 12\ngot:\n%s", str)
+			},
+		},
+		{
+			name:    "req:set_cookie should add cookie",
+			luaCode: `r:set_cookie(marasi.utils:cookie("new", "val")); return r:cookie("new"):value()`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "val" {
+					t.Errorf("\nwanted:\nval\ngot:\n%v", got)
 				}
 			},
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			extension, _ := setupTestExtension(t, "", tt.options...)
-
-			err := extension.ExecuteLua(tt.luaCode)
-			if err != nil {
-				t.Fatalf("executing lua code %s : %v", tt.luaCode, err)
-			}
-
-			got := GoValue(extension.LuaState, -1)
-			if tt.validatorFunc != nil {
-				tt.validatorFunc(t, extension, got)
-			}
-		})
-	}
-}
-func TestResponseType(t *testing.T) {
-	withResponse := func(res *http.Response) func(*Runtime) error {
-		return func(r *Runtime) error {
-			id, _ := uuid.NewV7()
-			req := res.Request
-			if req == nil {
-				req = httptest.NewRequest("GET", "https://marasi.app", nil)
-				res.Request = req
-			}
+		{
+			name:    "req:set_cookie_value should update an existing cookie and add a new one",
+			luaCode: `r:set_cookie_value("c1", "updated"); r:set_cookie_value("c3", "v3"); return r:cookie("c1"):value()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := basicReq()
+					req.AddCookie(&http.Cookie{Name: "c1", Value: "v1"})
+					req.AddCookie(&http.Cookie{Name: "c2", Value: "v2"})
+					return withRequest(req)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "updated" {
+					t.Errorf("\nwanted:\nupdated\ngot:\n%v", got)
+				}
 
-			req = core.ContextWithRequestID(req, id)
-			req = core.ContextWithMetadata(req, make(map[string]any))
-			res.Request = req
+				ext.LuaState.Global("r")
+				req := ext.LuaState.ToUserData(-1).(*http.Request)
+				ext.LuaState.Pop(1)
 
-			r.LuaState.PushUserData(res)
-			lua.SetMetaTableNamed(r.LuaState, "res")
-			r.LuaState.SetGlobal("r")
-			return nil
-		}
-	}
+				want := "c1=updated; c2=v2; c3=v3"
+				if req.Header.Get("Cookie") != want {
+					t.Errorf("\nwanted:\n%s\ngot:\n%s", want, req.Header.Get("Cookie"))
+				}
+			},
+		},
+		{
+			name:    "req:set_cookie_value should only rewrite the pair of the cookie",
+			luaCode: `r:set_cookie_value("c1", "updated")`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := basicReq()
+					req.Header.Set("Cookie", `json={"k":"v"}; c1=v1;b=x\y`)
+					req.Header.Add("Cookie", "other=1")
+					return withRequest(req)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				ext.LuaState.Global("r")
+				req := ext.LuaState.ToUserData(-1).(*http.Request)
+				ext.LuaState.Pop(1)
 
-	basicRes := func() *http.Response {
-		req := httptest.NewRequest("GET", "https://marasi.app/path?q=1", nil)
-		res := &http.Response{
-			StatusCode:    200,
-			Status:        "200 OK",
-			Proto:         "HTTP/1.1",
-			ContentLength: 12,
-			Header:        make(http.Header),
-			Body:          io.NopCloser(strings.NewReader("body content")),
-			Request:       req,
-		}
-		res.Header.Set("Content-Type", "text/plain")
-		res.Header.Set("Server", "Marasi-Test")
-		return res
-	}
+				want := []string{`json={"k":"v"}; c1=updated;b=x\y`, "other=1"}
+				if !reflect.DeepEqual(want, req.Header.Values("Cookie")) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, req.Header.Values("Cookie"))
+				}
+			},
+		},
+		{
+			name: "req:set_cookies should set cookies from table",
+			luaCode: `
+				local c1 = marasi.utils:cookie("c1", "v1")
+				local c2 = marasi.utils:cookie("c2", "v2")
+				r:set_cookies({c1, c2})
+				return r:cookie("c1"):value(), r:cookie("c2"):value()
+			`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				val2 := got.(string)
+				ext.LuaState.Pop(1)
+				val1 := GoValue(ext.LuaState, -1).(string)
 
-	tests := []struct {
-		name          string
-		luaCode       string
-		options       []func(*Runtime) error
-		validatorFunc func(t *testing.T, ext *Runtime, got any)
-	}{
+				if val1 != "v1" || val2 != "v2" {
+					t.Errorf("\nwanted:\nv1, v2\ngot:\n%s, %s", val1, val2)
+				}
+			},
+		},
 		{
-			name:    "res:id should return request id",
-			luaCode: `return r:id()`,
+			name: "req:set_cookies should error if argument is not a table",
+			luaCode: `
+				local ok, res = pcall(r.set_cookies, r, "not-a-table")
+				if ok then return "expected error" end
+				return res
+			`,
 			options: []func(*Runtime) error{
-				withResponse(basicRes()),
+				withRequest(basicReq()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				idStr, ok := got.(string)
+				errStr, ok := got.(string)
 				if !ok {
-					t.Fatalf("\nwanted:\nstring\ngot:\n%T", got)
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
 				}
-				if _, err := uuid.Parse(idStr); err != nil {
-					t.Errorf("\nwanted:\nvalid uuid\ngot:\n%s", idStr)
+				if !strings.Contains(errStr, "expected table") {
+					t.Errorf("\nwanted:\nerror containing 'expected table'\ngot:\n%q", errStr)
 				}
 			},
 		},
 		{
-			name:    "res:method should return request method",
-			luaCode: `return r:method()`,
+			name:    "req:metadata should return metadata map",
+			luaCode: `return r:metadata()`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				m := asMap(got)
+				if m == nil {
+					t.Fatalf("\nwanted:\nmap\ngot:\n%T", got)
+				}
+			},
+		},
+		{
+			name:    "req:set_metadata should update metadata for extension",
+			luaCode: `r:set_metadata({flag = true})`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				ext.LuaState.Global("r")
+				req := ext.LuaState.ToUserData(-1).(*http.Request)
+				ext.LuaState.Pop(1)
+
+				meta, _ := core.MetadataFromContext(req.Context())
+				extMeta, ok := meta[ext.Data.Name].(map[string]any)
+				if !ok {
+					t.Fatalf("\nwanted:\nmetadata for extension %s\ngot:\nmissing", ext.Data.Name)
+				}
+				if val, ok := extMeta["flag"].(bool); !ok || !val {
+					t.Errorf("\nwanted:\nflag=true in metadata\ngot:\n%v", val)
+				}
+			},
+		},
+		{
+			name: "req:set_metadata should error if table values are mixed/array",
+			luaCode: `
+				local ok, res = pcall(r.set_metadata, r, {1, 2})
+				if ok then return "expected error" end
+				return res
+			`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "metadata must be a key-value table") {
+					t.Errorf("\nwanted:\nerror containing 'metadata must be a key-value table'\ngot:\n%q", errStr)
+				}
+			},
+		},
+		{
+			name:    "req:extension_ran should only return true for extensions that ran",
+			luaCode: `return tostring(r:extension_ran("workshop")) .. "," .. tostring(r:extension_ran("compass"))`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+				withExtensionsRan("workshop", "classifier"),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "true,false" {
+					t.Errorf("\nwanted:\ntrue,false\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "req:extensions_ran should return the extensions in the order they ran",
+			luaCode: `return r:extensions_ran()`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+				withExtensionsRan("workshop", "classifier"),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := []any{"workshop", "classifier"}
+				if !reflect.DeepEqual(want, got) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name:    "req:extensions_ran should return an empty table when no extension ran",
+			luaCode: `return #r:extensions_ran()`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 0.0 {
+					t.Errorf("\nwanted:\n0\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "req:add_tag should add unique tags to the request context and not to the metadata",
+			luaCode: `r:add_tag("sqli-candidate"); r:add_tag("reviewed"); r:add_tag("sqli-candidate")`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				ext.LuaState.Global("r")
+				req := ext.LuaState.ToUserData(-1).(*http.Request)
+				ext.LuaState.Pop(1)
+
+				tags, _ := core.TagsFromContext(req.Context())
+				want := []string{"sqli-candidate", "reviewed"}
+				if !reflect.DeepEqual(tags, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, tags)
+				}
+
+				meta, _ := core.MetadataFromContext(req.Context())
+				if _, ok := meta["tags"]; ok {
+					t.Errorf("\nwanted:\nno tags in the metadata\ngot:\n%v", meta["tags"])
+				}
+			},
+		},
+		{
+			name: "req:add_tag should error on an empty tag",
+			luaCode: `
+				local ok, res = pcall(r.add_tag, r, "")
+				if ok then return "expected error" end
+				return res
+			`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "tag cannot be empty") {
+					t.Errorf("\nwanted:\nerror containing 'tag cannot be empty'\ngot:\n%q", errStr)
+				}
+			},
+		},
+		{
+			name:    "req:set_note should set the note in the request context and not in the metadata",
+			luaCode: `r:set_note("first"); r:set_note("check the id parameter")`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				ext.LuaState.Global("r")
+				req := ext.LuaState.ToUserData(-1).(*http.Request)
+				ext.LuaState.Pop(1)
+
+				note, _ := core.NoteFromContext(req.Context())
+				if note != "check the id parameter" {
+					t.Errorf("\nwanted:\ncheck the id parameter\ngot:\n%v", note)
+				}
+
+				meta, _ := core.MetadataFromContext(req.Context())
+				if _, ok := meta["note"]; ok {
+					t.Errorf("\nwanted:\nno note in the metadata\ngot:\n%v", meta["note"])
+				}
+			},
+		},
+		{
+			name: "req:set_basic_auth and req:basic_auth should round trip credentials",
+			luaCode: `
+				r:set_basic_auth("marasi", "p@ss:word")
+				local username, password, ok = r:basic_auth()
+				return username .. "|" .. password .. "|" .. tostring(ok)
+			`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := "marasi|p@ss:word|true"
+				if got != want {
+					t.Errorf("\nwanted:\n%s\ngot:\n%v", want, got)
+				}
+
+				ext.LuaState.Global("r")
+				req := ext.LuaState.ToUserData(-1).(*http.Request)
+				ext.LuaState.Pop(1)
+
+				wantHeader := "Basic bWFyYXNpOnBAc3M6d29yZA=="
+				if gotHeader := req.Header.Get("Authorization"); gotHeader != wantHeader {
+					t.Errorf("\nwanted:\n%s\ngot:\n%s", wantHeader, gotHeader)
+				}
+			},
+		},
+		{
+			name: "req:set_header and req:add_header should update the headers",
+			luaCode: `
+				r:set_header("X-Marasi", "one")
+				r:set_header("X-Marasi", "two")
+				r:add_header("X-Marasi", "three")
+				return r:headers():get_all_joined("X-Marasi", ",")
+			`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "two,three" {
+					t.Errorf("\nwanted:\ntwo,three\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "req:set_header and req:add_header should error on empty key",
+			luaCode: `
+				local okSet, errSet = pcall(r.set_header, r, "", "val")
+				local okAdd, errAdd = pcall(r.add_header, r, "", "val")
+				if okSet or okAdd then return "expected error" end
+				return errSet .. "|" .. errAdd
+			`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if strings.Count(errStr, "header key cannot be empty") != 2 {
+					t.Errorf("\nwanted error containing 'header key cannot be empty' twice\ngot:\n%s", errStr)
+				}
+			},
+		},
+		{
+			name:    "req:has_header should return true for a present header and false for a missing one",
+			luaCode: `return r:has_header("content-type"), r:has_header("X-Missing")`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				present := GoValue(ext.LuaState, -2)
+				if present != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", present)
+				}
+				if got != false {
+					t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "req:basic_auth should return empty credentials and false when the header is missing",
+			luaCode: `
+				local username, password, ok = r:basic_auth()
+				return username .. "|" .. password .. "|" .. tostring(ok)
+			`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := "||false"
+				if got != want {
+					t.Errorf("\nwanted:\n%s\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name:    "req:drop should set drop flag",
+			luaCode: `r:drop()`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				ext.LuaState.Global("r")
+				req := ext.LuaState.ToUserData(-1).(*http.Request)
+				ext.LuaState.Pop(1)
+
+				if dropped, _ := core.DroppedFlagFromContext(req.Context()); !dropped {
+					t.Errorf("\nwanted:\ndropped=true\ngot:\n%v", dropped)
+				}
+			},
+		},
+		{
+			name:    "req:skip should set skip flag",
+			luaCode: `r:skip()`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				ext.LuaState.Global("r")
+				req := ext.LuaState.ToUserData(-1).(*http.Request)
+				ext.LuaState.Pop(1)
+
+				if skipped, _ := core.SkipFlagFromContext(req.Context()); !skipped {
+					t.Errorf("\nwanted:\nskipped=true\ngot:\n%v", skipped)
+				}
+			},
+		},
+		{
+			name:    "req:tostring should return formatted string",
+			luaCode: `return tostring(r)`,
+			options: []func(*Runtime) error{
+				withRequest(basicReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				str, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring\ngot:\n%T", got)
+				}
+
+				if !strings.HasPrefix(str, "Request { ID:") {
+					t.Errorf("\nwanted prefix:\nRequest { ID:\ngot:\n%s", str)
+				}
+				if !strings.Contains(str, "Method: GET") {
+					t.Errorf("\nwanted:\nMethod: GET\ngot:\n%s", str)
+				}
+				if !strings.Contains(str, "URL: https://marasi.app/path?q=1") {
+					t.Errorf("\nwanted:\nURL: https://marasi.app/path?q=1\ngot:\n%s", str)
+				}
+				if !strings.Contains(str, "Proto: HTTP/1.1") {
+					t.Errorf("\nwanted:\nProto: HTTP/1.1\ngot:\n%s", str)
+				}
+				if !strings.Contains(str, "Remote: 192.0.2.1:1234") {
+					t.Errorf("\nwanted:\nRemote: 192.0.2.1:1234\ngot:\n%s", str)
+				}
+				if !strings.Contains(str, "Length: 12") {
+					t.Errorf("\nwanted:\nLength: 12\ngot:\n%s", str)
+				}
+				if !strings.Contains(str, "Headers: 2") {
+					t.Errorf("\nwanted:\nHeaders: 2\ngot:\n%s", str)
+				}
+			},
+		},
+		{
+			name:    "req:header_count should return the number of headers",
+			luaCode: `return r:header_count()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := basicReq()
+					req.Header.Add("X-Multi", "a")
+					req.Header.Add("X-Multi", "b")
+					return withRequest(req)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 3.0 {
+					t.Errorf("\nwanted:\n3\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "req:header_order should return the recorded header order",
+			luaCode: `return r:header_order()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := basicReq()
+					req = core.ContextWithHeaderOrder(req, []string{"User-Agent", "Host", "Accept"})
+					return withRequest(req)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := []any{"User-Agent", "Host", "Accept"}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name:    "req:header_order should fall back to the sorted header names",
+			luaCode: `return r:header_order()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					req := basicReq()
+					req.Header = http.Header{"X-B": {"1"}, "Accept": {"*/*"}, "X-A": {"2"}}
+					return withRequest(req)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := []any{"Accept", "X-A", "X-B"}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extension, _ := setupTestExtension(t, "", tt.options...)
+
+			err := extension.ExecuteLua(tt.luaCode)
+			if err != nil {
+				t.Fatalf("executing lua code %s : %v", tt.luaCode, err)
+			}
+
+			got := GoValue(extension.LuaState, -1)
+			if tt.validatorFunc != nil {
+				tt.validatorFunc(t, extension, got)
+			}
+		})
+	}
+}
+func TestRequestExtensionMetadata(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://marasi.app/path?q=1", nil)
+	id, _ := uuid.NewV7()
+	req = core.ContextWithRequestID(req, id)
+	req = core.ContextWithMetadata(req, make(map[string]any))
+
+	withRequest := func(r *Runtime) error {
+		r.LuaState.PushUserData(req)
+		lua.SetMetaTableNamed(r.LuaState, "req")
+		r.LuaState.SetGlobal("r")
+		return nil
+	}
+
+	classifier, _ := setupTestExtension(t, "", withRequest)
+	classifier.Data.Name = "classifier"
+	actor, _ := setupTestExtension(t, "", withRequest)
+	actor.Data.Name = "actor"
+
+	err := classifier.ExecuteLua(`r:set_metadata({interesting = true, reason = "sqli"})`)
+	if err != nil {
+		t.Fatalf("executing classifier lua code : %v", err)
+	}
+
+	t.Run("req:extension_metadata should return the metadata set by another extension", func(t *testing.T) {
+		err := actor.ExecuteLua(`return r:extension_metadata("classifier")`)
+		if err != nil {
+			t.Fatalf("executing actor lua code : %v", err)
+		}
+
+		want := map[string]any{"interesting": true, "reason": "sqli"}
+		got := GoValue(actor.LuaState, -1)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("req:extension_metadata should return nil for an extension without metadata", func(t *testing.T) {
+		err := actor.ExecuteLua(`return r:extension_metadata("missing")`)
+		if err != nil {
+			t.Fatalf("executing actor lua code : %v", err)
+		}
+
+		if got := GoValue(actor.LuaState, -1); got != nil {
+			t.Errorf("\nwanted:\nnil\ngot:\n%v", got)
+		}
+	})
+
+	t.Run("changes to the returned table should not modify the other extension's metadata", func(t *testing.T) {
+		err := actor.ExecuteLua(`local m = r:extension_metadata("classifier"); m.reason = "changed"`)
+		if err != nil {
+			t.Fatalf("executing actor lua code : %v", err)
+		}
+
+		metadata, _ := core.MetadataFromContext(req.Context())
+		classifierMetadata := metadata["classifier"].(map[string]any)
+		if classifierMetadata["reason"] != "sqli" {
+			t.Errorf("\nwanted:\nsqli\ngot:\n%v", classifierMetadata["reason"])
+		}
+	})
+}
+
+func TestRequestMatchesScope(t *testing.T) {
+	newScope := func(t *testing.T, hostPattern string) *compass.Scope {
+		t.Helper()
+		scope := compass.NewScope(false)
+		if err := scope.AddRule(hostPattern, "host", false); err != nil {
+			t.Fatalf("adding scope rule : %v", err)
+		}
+		return scope
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{
+			name: "req:matches_scope should return true for an in scope request",
+			url:  "https://marasi.app/path",
+			want: true,
+		},
+		{
+			name: "req:matches_scope should return false for an out of scope request",
+			url:  "https://example.com/path",
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			extension, mockProxy := setupTestExtension(t, "", func(r *Runtime) error {
+				r.LuaState.PushUserData(req)
+				lua.SetMetaTableNamed(r.LuaState, "req")
+				r.LuaState.SetGlobal("r")
+				return nil
+			})
+
+			scope := newScope(t, `^marasi\.app$`)
+			mockProxy.GetScopeFunc = func() (*compass.Scope, error) {
+				return scope, nil
+			}
+
+			err := extension.ExecuteLua(`return r:matches_scope()`)
+			if err != nil {
+				t.Fatalf("executing lua code : %v", err)
+			}
+
+			if got := GoValue(extension.LuaState, -1); got != tt.want {
+				t.Errorf("\nwanted:\n%v\ngot:\n%v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("req:matches_scope should use the live proxy scope", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "https://marasi.app/path", nil)
+		extension, mockProxy := setupTestExtension(t, "", func(r *Runtime) error {
+			r.LuaState.PushUserData(req)
+			lua.SetMetaTableNamed(r.LuaState, "req")
+			r.LuaState.SetGlobal("r")
+			return nil
+		})
+
+		scope := newScope(t, `^marasi\.app$`)
+		mockProxy.GetScopeFunc = func() (*compass.Scope, error) {
+			return scope, nil
+		}
+
+		err := extension.ExecuteLua(`before = r:matches_scope()`)
+		if err != nil {
+			t.Fatalf("executing lua code : %v", err)
+		}
+
+		scope = newScope(t, `^example\.com$`)
+
+		err = extension.ExecuteLua(`return before, r:matches_scope()`)
+		if err != nil {
+			t.Fatalf("executing lua code : %v", err)
+		}
+
+		before := GoValue(extension.LuaState, -2)
+		after := GoValue(extension.LuaState, -1)
+		if before != true || after != false {
+			t.Errorf("\nwanted:\ntrue, false\ngot:\n%v, %v", before, after)
+		}
+	})
+}
+
+func TestResponseType(t *testing.T) {
+	withResponse := func(res *http.Response) func(*Runtime) error {
+		return func(r *Runtime) error {
+			id, _ := uuid.NewV7()
+			req := res.Request
+			if req == nil {
+				req = httptest.NewRequest("GET", "https://marasi.app", nil)
+				res.Request = req
+			}
+
+			req = core.ContextWithRequestID(req, id)
+			req = core.ContextWithMetadata(req, make(map[string]any))
+			res.Request = req
+
+			r.LuaState.PushUserData(res)
+			lua.SetMetaTableNamed(r.LuaState, "res")
+			r.LuaState.SetGlobal("r")
+			return nil
+		}
+	}
+
+	// withExtensionsRan records the names in the extensions_ran metadata of the response set by withResponse
+	withExtensionsRan := func(names ...string) func(*Runtime) error {
+		return func(r *Runtime) error {
+			r.LuaState.Global("r")
+			res := r.LuaState.ToUserData(-1).(*http.Response)
+			r.LuaState.Pop(1)
+
+			metadata, _ := core.MetadataFromContext(res.Request.Context())
+			metadata["extensions_ran"] = names
+			return nil
+		}
+	}
+
+	basicRes := func() *http.Response {
+		req := httptest.NewRequest("GET", "https://marasi.app/path?q=1", nil)
+		res := &http.Response{
+			StatusCode:    200,
+			Status:        "200 OK",
+			Proto:         "HTTP/1.1",
+			ContentLength: 12,
+			Header:        make(http.Header),
+			Body:          io.NopCloser(strings.NewReader("body content")),
+			Request:       req,
+		}
+		res.Header.Set("Content-Type", "text/plain")
+		res.Header.Set("Server", "Marasi-Test")
+		return res
+	}
+
+	tests := []struct {
+		name          string
+		luaCode       string
+		options       []func(*Runtime) error
+		validatorFunc func(t *testing.T, ext *Runtime, got any)
+	}{
+		{
+			name:    "res:id should return request id",
+			luaCode: `return r:id()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				idStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring\ngot:\n%T", got)
+				}
+				if _, err := uuid.Parse(idStr); err != nil {
+					t.Errorf("\nwanted:\nvalid uuid\ngot:\n%s", idStr)
+				}
+			},
+		},
+		{
+			name:    "res:method should return request method",
+			luaCode: `return r:method()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "GET" {
+					t.Errorf("\nwanted:\nGET\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:url should return url userdata",
+			luaCode: `return r:url():string()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := "https://marasi.app/path?q=1"
+				if got != want {
+					t.Errorf("\nwanted:\n%s\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name:    "res:status should return status string",
+			luaCode: `return r:status()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "200 OK" {
+					t.Errorf("\nwanted:\n200 OK\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:status_code should return status code",
+			luaCode: `return r:status_code()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 200.0 {
+					t.Errorf("\nwanted:\n200\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:set_status_code should update status code and string",
+			luaCode: `r:set_status_code(404); return r:status(), r:status_code()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				code := got.(float64)
+				ext.LuaState.Pop(1)
+				status := GoValue(ext.LuaState, -1).(string)
+
+				if code != 404.0 {
+					t.Errorf("\nwanted:\n404\ngot:\n%v", code)
+				}
+				if status != "404 Not Found" {
+					t.Errorf("\nwanted:\n404 Not Found\ngot:\n%v", status)
+				}
+			},
+		},
+		{
+			name: "res:set_header and res:add_header should update the headers",
+			luaCode: `
+				r:set_header("X-Marasi", "one")
+				r:set_header("X-Marasi", "two")
+				r:add_header("X-Marasi", "three")
+				return r:headers():get_all_joined("X-Marasi", ",")
+			`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "two,three" {
+					t.Errorf("\nwanted:\ntwo,three\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "res:set_header and res:add_header should error on empty key",
+			luaCode: `
+				local okSet, errSet = pcall(r.set_header, r, "", "val")
+				local okAdd, errAdd = pcall(r.add_header, r, "", "val")
+				if okSet or okAdd then return "expected error" end
+				return errSet .. "|" .. errAdd
+			`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if strings.Count(errStr, "header key cannot be empty") != 2 {
+					t.Errorf("\nwanted error containing 'header key cannot be empty' twice\ngot:\n%s", errStr)
+				}
+			},
+		},
+		{
+			name:    "res:has_header should return true for a present header and false for a missing one",
+			luaCode: `return r:has_header("server"), r:has_header("X-Missing")`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				present := GoValue(ext.LuaState, -2)
+				if present != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", present)
+				}
+				if got != false {
+					t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:length should return content length",
+			luaCode: `return r:length()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 12.0 {
+					t.Errorf("\nwanted:\n12\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:tls_info should return the negotiated TLS parameters",
+			luaCode: `return r:tls_info()`,
+			options: []func(*Runtime) error{
+				withResponse(func() *http.Response {
+					res := basicRes()
+					res.TLS = &tls.ConnectionState{
+						Version:            tls.VersionTLS13,
+						CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+						NegotiatedProtocol: "h2",
+						DidResume:          true,
+						ServerName:         "marasi.app",
+					}
+					return res
+				}()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := map[string]any{
+					"version":      "TLS 1.3",
+					"cipher_suite": "TLS_AES_128_GCM_SHA256",
+					"alpn":         "h2",
+					"resumed":      true,
+					"server_name":  "marasi.app",
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name:    "res:tls_info should return nil for plain HTTP",
+			luaCode: `return r:tls_info()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != nil {
+					t.Errorf("\nwanted:\nnil\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:body should return body content",
+			luaCode: `return r:body()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "body content" {
+					t.Errorf("\nwanted:\nbody content\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "res:body should error if reading fails",
+			luaCode: `
+				local ok, res = pcall(r.body, r)
+				if ok then return "expected error" end
+				return res
+			`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Body = io.NopCloser(&erroringReader{})
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "reading body : forced error") {
+					t.Errorf("\nwanted:\nerror containing 'reading body : forced error'\ngot:\n%q", errStr)
+				}
+			},
+		},
+		{
+			name:    "res:body_matches should return true and keep the body if the pattern matches",
+			luaCode: `return r:body_matches("^body\\s+\\w+$"), r:body()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				matched := GoValue(ext.LuaState, -2)
+				if matched != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", matched)
+				}
+				if got != "body content" {
+					t.Errorf("\nwanted:\nbody content\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:body_matches should return false if the pattern does not match",
+			luaCode: `return r:body_matches("secret")`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != false {
+					t.Errorf("\nwanted:\nfalse\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "res:body_matches should error on an invalid pattern",
+			luaCode: `
+				local ok, res = pcall(r.body_matches, r, "([a-z")
+				if ok then return "expected error" end
+				return res
+			`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "compiling pattern") {
+					t.Errorf("\nwanted:\nerror containing 'compiling pattern'\ngot:\n%q", errStr)
+				}
+			},
+		},
+		{
+			name:    "res:body_matches should cache the compiled pattern",
+			luaCode: `return r:body_matches("content"), r:body_matches("content")`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
+				}
+				if len(ext.regexps) != 1 {
+					t.Errorf("\nwanted:\n1 cached pattern\ngot:\n%d", len(ext.regexps))
+				}
+			},
+		},
+		{
+			name:    "res:body_length should return the content length",
+			luaCode: `return r:body_length()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 12.0 {
+					t.Errorf("\nwanted:\n12\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:body_length should count the body if the content length is unknown",
+			luaCode: `return r:body_length(), r:body()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.ContentLength = -1
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				length := GoValue(ext.LuaState, -2)
+				if length != 12.0 {
+					t.Errorf("\nwanted:\n12\ngot:\n%v", length)
+				}
+				if got != "body content" {
+					t.Errorf("\nwanted:\nbody content\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:body_sha256 should return the body digest and keep the body readable",
+			luaCode: `return r:body_sha256(), r:body()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := "ca2c6fd05a432e2011d4838d4cb007db3d88e2b220c85c7542183eb5de4fa0e8"
+				digest := GoValue(ext.LuaState, -2)
+				if digest != want {
+					t.Errorf("\nwanted:\n%s\ngot:\n%v", want, digest)
+				}
+				if got != "body content" {
+					t.Errorf("\nwanted:\nbody content\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "res:body_sha256 should error if reading fails",
+			luaCode: `
+				local ok, res = pcall(r.body_sha256, r)
+				if ok then return "expected error" end
+				return res
+			`,
 			options: []func(*Runtime) error{
-				withResponse(basicRes()),
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Body = io.NopCloser(&erroringReader{})
+					return withResponse(res)(r)
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "GET" {
-					t.Errorf("\nwanted:\nGET\ngot:\n%v", got)
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "reading body : forced error") {
+					t.Errorf("\nwanted:\nerror containing 'reading body : forced error'\ngot:\n%q", errStr)
 				}
 			},
 		},
 		{
-			name:    "res:url should return url userdata",
-			luaCode: `return r:url():string()`,
+			name:    "res:raw should return the status line, headers and body and keep the body readable",
+			luaCode: `return r:raw(), r:body()`,
 			options: []func(*Runtime) error{
 				withResponse(basicRes()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				want := "https://marasi.app/path?q=1"
-				if got != want {
-					t.Errorf("\nwanted:\n%s\ngot:\n%v", want, got)
+				raw, _ := GoValue(ext.LuaState, -2).(string)
+				for _, want := range []string{"HTTP/1.1 200 OK\r\n", "Content-Type: text/plain\r\n", "Server: Marasi-Test\r\n"} {
+					if !strings.Contains(raw, want) {
+						t.Errorf("\nwanted:\nraw containing %q\ngot:\n%q", want, raw)
+					}
+				}
+				if !strings.HasSuffix(raw, "\r\n\r\nbody content") {
+					t.Errorf("\nwanted:\nraw ending with the body\ngot:\n%q", raw)
+				}
+				if got != "body content" {
+					t.Errorf("\nwanted:\nbody content\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "res:status should return status string",
-			luaCode: `return r:status()`,
+			name: "res:raw should error if reading the body fails",
+			luaCode: `
+				local ok, res = pcall(r.raw, r)
+				if ok then return "expected error" end
+				return res
+			`,
 			options: []func(*Runtime) error{
-				withResponse(basicRes()),
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Body = io.NopCloser(&erroringReader{})
+					return withResponse(res)(r)
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "200 OK" {
-					t.Errorf("\nwanted:\n200 OK\ngot:\n%v", got)
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "dumping response") {
+					t.Errorf("\nwanted:\nerror containing 'dumping response'\ngot:\n%q", errStr)
 				}
 			},
 		},
 		{
-			name:    "res:status_code should return status code",
-			luaCode: `return r:status_code()`,
+			name:    "res:upstream_addr should return the recorded upstream address",
+			luaCode: `return r:upstream_addr()`,
 			options: []func(*Runtime) error{
-				withResponse(basicRes()),
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Request = core.ContextWithMetadata(res.Request, map[string]any{"upstream_addr": "203.0.113.10:443"})
+					r.LuaState.PushUserData(res)
+					lua.SetMetaTableNamed(r.LuaState, "res")
+					r.LuaState.SetGlobal("r")
+					return nil
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != 200.0 {
-					t.Errorf("\nwanted:\n200\ngot:\n%v", got)
+				if got != "203.0.113.10:443" {
+					t.Errorf("\nwanted:\n203.0.113.10:443\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "res:set_status_code should update status code and string",
-			luaCode: `r:set_status_code(404); return r:status(), r:status_code()`,
+			name:    "res:upstream_addr should return nil when not recorded",
+			luaCode: `return r:upstream_addr()`,
 			options: []func(*Runtime) error{
 				withResponse(basicRes()),
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				code := got.(float64)
-				ext.LuaState.Pop(1)
-				status := GoValue(ext.LuaState, -1).(string)
-
-				if code != 404.0 {
-					t.Errorf("\nwanted:\n404\ngot:\n%v", code)
-				}
-				if status != "404 Not Found" {
-					t.Errorf("\nwanted:\n404 Not Found\ngot:\n%v", status)
+				if got != nil {
+					t.Errorf("\nwanted:\nnil\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "res:length should return content length",
-			luaCode: `return r:length()`,
+			name:    "res:decoded_body should return the gunzipped body",
+			luaCode: `return r:decoded_body()`,
 			options: []func(*Runtime) error{
-				withResponse(basicRes()),
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Body = io.NopCloser(bytes.NewReader(gzipBytes("gzip content")))
+					res.ContentLength = -1
+					res.Header.Set("Content-Encoding", "gzip")
+					return withResponse(res)(r)
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != 12.0 {
-					t.Errorf("\nwanted:\n12\ngot:\n%v", got)
+				if got != "gzip content" {
+					t.Errorf("\nwanted:\ngzip content\ngot:\n%v", got)
 				}
 			},
 		},
 		{
-			name:    "res:body should return body content",
-			luaCode: `return r:body()`,
+			name:    "res:decoded_body should return the brotli decoded body and restore the raw body",
+			luaCode: `local decoded = r:decoded_body(); return decoded, r:body()`,
 			options: []func(*Runtime) error{
-				withResponse(basicRes()),
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Body = io.NopCloser(bytes.NewReader(brotliBytes("brotli content")))
+					res.ContentLength = -1
+					res.Header.Set("Content-Encoding", "br")
+					return withResponse(res)(r)
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "body content" {
-					t.Errorf("\nwanted:\nbody content\ngot:\n%v", got)
+				if decoded := GoValue(ext.LuaState, -2); decoded != "brotli content" {
+					t.Errorf("\nwanted:\nbrotli content\ngot:\n%v", decoded)
+				}
+				if want := string(brotliBytes("brotli content")); got != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
 				}
 			},
 		},
 		{
-			name: "res:body should error if reading fails",
+			name: "res:decoded_body should error on an unsupported encoding",
 			luaCode: `
-				local ok, res = pcall(r.body, r)
+				local ok, res = pcall(r.decoded_body, r)
 				if ok then return "expected error" end
 				return res
 			`,
 			options: []func(*Runtime) error{
 				func(r *Runtime) error {
 					res := basicRes()
-					res.Body = io.NopCloser(&erroringReader{})
+					res.Header.Set("Content-Encoding", "compress")
 					return withResponse(res)(r)
 				},
 			},
@@ -2186,8 +3747,8 @@ func TestResponseType(t *testing.T) {
 				if !ok {
 					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
 				}
-				if !strings.Contains(errStr, "reading body : forced error") {
-					t.Errorf("\nwanted:\nerror containing 'reading body : forced error'\ngot:\n%q", errStr)
+				if !strings.Contains(errStr, `unsupported content encoding "compress"`) {
+					t.Errorf("\nwanted:\nerror containing 'unsupported content encoding'\ngot:\n%q", errStr)
 				}
 			},
 		},
@@ -2227,6 +3788,46 @@ func TestResponseType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "res:set_content_type should set the media type with a charset",
+			luaCode: `r:set_content_type("application/json", "utf-8"); return r:headers():get("Content-Type")`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "application/json; charset=utf-8" {
+					t.Errorf("\nwanted:\napplication/json; charset=utf-8\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:set_content_type should set the media type without a charset",
+			luaCode: `r:set_content_type("application/json"); return r:headers():get("Content-Type")`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "application/json" {
+					t.Errorf("\nwanted:\napplication/json\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "res:set_content_type should error on an invalid media type",
+			luaCode: `
+				local ok, err = pcall(r.set_content_type, r, "not a media type")
+				if ok then return "expected error" end
+				return err
+			`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if errStr, _ := got.(string); !strings.Contains(errStr, "invalid media type") {
+					t.Errorf("\nwanted:\nerror containing 'invalid media type'\ngot:\n%v", got)
+				}
+			},
+		},
 		{
 			name:    "res:cookies should return table of cookies",
 			luaCode: `return r:cookies()`,
@@ -2247,6 +3848,160 @@ func TestResponseType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "res:cache_info should report a no-store response",
+			luaCode: `return r:cache_info()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Header.Set("Cache-Control", "No-Store, no-cache=\"Set-Cookie, X-Token\"")
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := map[string]any{"no_store": true, "no_cache": true, "private": false, "public": false}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name:    "res:cache_info should report a public response with max-age, etag and expires",
+			luaCode: `return r:cache_info()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Header.Set("Cache-Control", "max-age=300, public")
+					res.Header.Set("ETag", `"33a64df5"`)
+					res.Header.Set("Expires", "Wed, 21 Oct 2026 07:28:00 GMT")
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := map[string]any{
+					"max_age":  float64(300),
+					"no_store": false,
+					"no_cache": false,
+					"private":  false,
+					"public":   true,
+					"etag":     `"33a64df5"`,
+					"expires":  "Wed, 21 Oct 2026 07:28:00 GMT",
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name:    "res:cache_info should ignore an invalid max-age",
+			luaCode: `return r:cache_info().max_age`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Header.Set("Cache-Control", "max-age=-1")
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != nil {
+					t.Errorf("\nwanted:\nnil\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:header_count should return the number of headers",
+			luaCode: `return r:header_count()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 2.0 {
+					t.Errorf("\nwanted:\n2\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "res:strip_headers should remove the preset headers and preserve the others",
+			luaCode: `
+				r:strip_headers(marasi.presets.security_headers)
+				return {
+					csp = r:has_header("Content-Security-Policy"),
+					hsts = r:has_header("Strict-Transport-Security"),
+					xfo = r:has_header("X-Frame-Options"),
+					content_type = r:has_header("Content-Type"),
+					custom = r:has_header("X-Custom"),
+				}
+			`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Header.Set("Content-Security-Policy", "default-src 'self'")
+					res.Header.Set("Strict-Transport-Security", "max-age=31536000")
+					res.Header.Set("X-Frame-Options", "DENY")
+					res.Header.Set("X-Custom", "keep")
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := map[string]any{"csp": false, "hsts": false, "xfo": false, "content_type": true, "custom": true}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name: "res:remove_security_headers should only remove the security headers",
+			luaCode: `
+				r:remove_security_headers()
+				return r:header_count()
+			`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Header.Set("Content-Security-Policy", "default-src 'self'")
+					res.Header.Set("X-Content-Type-Options", "nosniff")
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 2.0 {
+					t.Errorf("\nwanted:\n2\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "res:strip_headers should error when the argument is not a table",
+			luaCode: `
+				local ok, err = pcall(r.strip_headers, r, "Content-Type")
+				return err
+			`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if str, ok := got.(string); !ok || !strings.Contains(str, "expected table") {
+					t.Errorf("\nwanted:\nexpected table error\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:cookie_names should return the names of all cookies",
+			luaCode: `return r:cookie_names()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Header.Add("Set-Cookie", (&http.Cookie{Name: "session", Value: "v1"}).String())
+					res.Header.Add("Set-Cookie", (&http.Cookie{Name: "csrf", Value: "v2"}).String())
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := []any{"session", "csrf"}
+				if !reflect.DeepEqual(want, got) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
 		{
 			name:    "res:cookie should return specific cookie",
 			luaCode: `return r:cookie("c1"):value()`,
@@ -2258,20 +4013,94 @@ func TestResponseType(t *testing.T) {
 				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "v1" {
-					t.Errorf("\nwanted:\nv1\ngot:\n%v", got)
+				if got != "v1" {
+					t.Errorf("\nwanted:\nv1\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:extension_ran should only return true for extensions that ran",
+			luaCode: `return tostring(r:extension_ran("workshop")) .. "," .. tostring(r:extension_ran("compass"))`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+				withExtensionsRan("workshop"),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "true,false" {
+					t.Errorf("\nwanted:\ntrue,false\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:extensions_ran should return the extensions in the order they ran",
+			luaCode: `return r:extensions_ran()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+				withExtensionsRan("classifier", "workshop"),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := []any{"classifier", "workshop"}
+				if !reflect.DeepEqual(want, got) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name:    "res:set_cookie should add Set-Cookie header",
+			luaCode: `r:set_cookie(marasi.utils:cookie("new", "val")); return r:cookie("new"):value()`,
+			options: []func(*Runtime) error{
+				withResponse(basicRes()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "val" {
+					t.Errorf("\nwanted:\nval\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "res:set_cookie_value should update an existing cookie and add a new one",
+			luaCode: `r:set_cookie_value("session", "updated"); r:set_cookie_value("csrf", "v2"); return r:cookie("session"):value()`,
+			options: []func(*Runtime) error{
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Header.Add("Set-Cookie", (&http.Cookie{Name: "session", Value: "v1", Path: "/app", HttpOnly: true}).String())
+					return withResponse(res)(r)
+				},
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "updated" {
+					t.Errorf("\nwanted:\nupdated\ngot:\n%v", got)
+				}
+
+				ext.LuaState.Global("r")
+				res := ext.LuaState.ToUserData(-1).(*http.Response)
+				ext.LuaState.Pop(1)
+
+				want := []string{"session=updated; Path=/app; HttpOnly", "csrf=v2; Path=/"}
+				if !reflect.DeepEqual(want, res.Header.Values("Set-Cookie")) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, res.Header.Values("Set-Cookie"))
 				}
 			},
 		},
 		{
-			name:    "res:set_cookie should add Set-Cookie header",
-			luaCode: `r:set_cookie(marasi.utils:cookie("new", "val")); return r:cookie("new"):value()`,
+			name:    "res:set_cookie_value should keep the attributes and the other Set-Cookie headers as sent",
+			luaCode: `r:set_cookie_value("id", "2")`,
 			options: []func(*Runtime) error{
-				withResponse(basicRes()),
+				func(r *Runtime) error {
+					res := basicRes()
+					res.Header.Add("Set-Cookie", `json={"k":"v"}; Path=/`)
+					res.Header.Add("Set-Cookie", "id=1; Path=/; Priority=High; Partitioned")
+					return withResponse(res)(r)
+				},
 			},
 			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
-				if got != "val" {
-					t.Errorf("\nwanted:\nval\ngot:\n%v", got)
+				ext.LuaState.Global("r")
+				res := ext.LuaState.ToUserData(-1).(*http.Response)
+				ext.LuaState.Pop(1)
+
+				want := []string{`json={"k":"v"}; Path=/`, "id=2; Path=/; Priority=High; Partitioned"}
+				if !reflect.DeepEqual(want, res.Header.Values("Set-Cookie")) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, res.Header.Values("Set-Cookie"))
 				}
 			},
 		},
@@ -2507,9 +4336,20 @@ func TestResponseType(t *testing.T) {
 
 func TestRequestBuilderType(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hop1":
+			http.Redirect(w, r, "/hop2", http.StatusFound)
+			return
+		case "/hop2":
+			http.Redirect(w, r, "/final", http.StatusMovedPermanently)
+			return
+		}
 		body, _ := io.ReadAll(r.Body)
 		w.Header().Set("X-Echo-Body", string(body))
 		w.Header().Set("X-Echo-Method", r.Method)
+		w.Header().Set("X-Echo-SNI", r.Header.Get("x-marasi-sni"))
+		w.Header().Set("X-Echo-Length", fmt.Sprint(len(body)))
+		w.Header().Set("X-Echo-Cookie", strings.Join(r.Header.Values("Cookie"), ", "))
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("server response"))
 	}))
@@ -2525,6 +4365,41 @@ func TestRequestBuilderType(t *testing.T) {
 		}
 	}
 
+	// withPolicyBuilder sets a builder with an egress policy that has a single host rule,
+	// an include rule is used as an allowlist and an exclude rule as a denylist
+	withPolicyBuilder := func(client *http.Client, hostPattern string, exclude bool) func(*Runtime) error {
+		return func(r *Runtime) error {
+			policy := compass.NewScope(exclude)
+			if err := policy.AddRule(hostPattern, "host", exclude); err != nil {
+				return err
+			}
+
+			builder := NewRequestBuilder(client)
+			builder.egressPolicy = policy
+			r.LuaState.PushUserData(builder)
+			lua.SetMetaTableNamed(r.LuaState, "RequestBuilder")
+			r.LuaState.SetGlobal("b")
+			return nil
+		}
+	}
+
+	withRequest := func(req *http.Request) func(*Runtime) error {
+		return func(r *Runtime) error {
+			r.LuaState.PushUserData(req)
+			lua.SetMetaTableNamed(r.LuaState, "req")
+			r.LuaState.SetGlobal("r")
+			return nil
+		}
+	}
+
+	postReq := func() *http.Request {
+		req := httptest.NewRequest("POST", server.URL+"/submit?q=1", strings.NewReader("request payload"))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("X-Custom", "marasi")
+		req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		return req
+	}
+
 	asyncResultCh := make(chan string, 1)
 	tests := []struct {
 		name          string
@@ -2576,6 +4451,83 @@ func TestRequestBuilderType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "b:sni should return nil by default",
+			luaCode: `return b:sni()`,
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != nil {
+					t.Errorf("\nwanted:\nnil\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name:    "b:set_sni should update sni and support chaining",
+			luaCode: `return b:set_sni("front.marasi.app"):sni()`,
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "front.marasi.app" {
+					t.Errorf("\nwanted:\nfront.marasi.app\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "b:send should pass the sni to the proxy",
+			luaCode: fmt.Sprintf(`
+				local res = b:set_method("GET"):set_url("%s"):set_sni("front.marasi.app"):send()
+				return res:headers():get("X-Echo-SNI")
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "front.marasi.app" {
+					t.Errorf("\nwanted:\nfront.marasi.app\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "res:redirect_chain should return the redirects followed by the builder",
+			luaCode: fmt.Sprintf(`
+				local res = b:set_method("GET"):set_url("%s/hop1"):send()
+				local targets = {}
+				for _, hop in ipairs(res:redirect_chain()) do
+					table.insert(targets, hop.status_code .. " " .. hop.url .. " -> " .. hop.location)
+				end
+				return targets
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := []any{
+					fmt.Sprintf("302 %s/hop1 -> /hop2", server.URL),
+					fmt.Sprintf("301 %s/hop2 -> /final", server.URL),
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("\nwanted:\n%v\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name: "res:redirect_chain should return an empty table without redirects",
+			luaCode: fmt.Sprintf(`
+				local res = b:set_method("GET"):set_url("%s"):send()
+				return #res:redirect_chain()
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != 0.0 {
+					t.Errorf("\nwanted:\n0\ngot:\n%v", got)
+				}
+			},
+		},
 		{
 			name:    "b:url should return url userdata",
 			luaCode: `b:set_url("https://marasi.app"); return b:url():string()`,
@@ -2752,6 +4704,112 @@ func TestRequestBuilderType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "b:set_body_chunked should stream a large body",
+			luaCode: fmt.Sprintf(`
+				-- string.rep is not available in the sandbox, the 64KiB chunk is built by doubling
+				local chunk = "a"
+				for i = 1, 16 do
+					chunk = chunk .. chunk
+				end
+				local sent = 0
+				b:set_method("POST")
+				b:set_url("%s")
+				b:set_body_chunked(function()
+					if sent == 64 then return nil end
+					sent = sent + 1
+					return chunk
+				end)
+				local res, err = b:send()
+				if err then error(err) end
+				return res:headers():get("X-Echo-Length")
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := fmt.Sprint(64 * 64 * 1024)
+				if got != want {
+					t.Errorf("\nwanted:\n%s\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name: "b:set_body_chunked should return the error raised by the body function",
+			luaCode: fmt.Sprintf(`
+				b:set_method("POST")
+				b:set_url("%s")
+				b:set_body_chunked(function() error("no more data") end)
+				local res, err = b:send()
+				return err
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if err, ok := got.(string); !ok || !strings.Contains(err, "no more data") {
+					t.Errorf("\nwanted:\nerror containing no more data\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "b:set_body_chunked should release the body function once the request is sent",
+			luaCode: fmt.Sprintf(`
+				b:set_method("POST")
+				b:set_url("%s")
+				b:set_body_chunked(function() return "replaced" end)
+				local sent = false
+				b:set_body_chunked(function()
+					if sent then return nil end
+					sent = true
+					return "chunk"
+				end)
+				local res, err = b:send()
+				if err then error(err) end
+				return b:body()
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "" {
+					t.Errorf("\nwanted:\nempty body\ngot:\n%v", got)
+				}
+
+				ext.lock()
+				defer ext.Mu.Unlock()
+				l := ext.LuaState
+				var held []string
+				l.PushNil()
+				for l.Next(lua.RegistryIndex) {
+					if key, ok := l.ToValue(-2).(string); ok && strings.HasPrefix(key, "marasi_body_") {
+						held = append(held, key)
+					}
+					l.Pop(1)
+				}
+				if len(held) != 0 {
+					t.Errorf("\nwanted:\nno body functions in the registry\ngot:\n%v", held)
+				}
+			},
+		},
+		{
+			name: "b:send_async should error with a chunked body",
+			luaCode: fmt.Sprintf(`
+				b:set_method("POST")
+				b:set_url("%s")
+				b:set_body_chunked(function() return nil end)
+				local ok, err = pcall(b.send_async, b)
+				return err
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if err, ok := got.(string); !ok || !strings.Contains(err, "chunked bodies can only be sent with send") {
+					t.Errorf("\nwanted:\nchunked bodies can only be sent with send\ngot:\n%v", got)
+				}
+			},
+		},
 		{
 			name: "b:send_async should execute multiple requests asynchronously without race conditions",
 			luaCode: fmt.Sprintf(`
@@ -2812,6 +4870,135 @@ func TestRequestBuilderType(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "b:send should send the request if the host is allowed by the egress policy",
+			luaCode: fmt.Sprintf(`
+				b:set_method("GET")
+				b:set_url("%s")
+				local res, err = b:send()
+				if err then error(err) end
+				return res:body()
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withPolicyBuilder(server.Client(), `^127\.0\.0\.1(:\d+)?$`, false),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "server response" {
+					t.Errorf("\nwanted:\nserver response\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "b:send should error if the host is not allowed by the egress policy",
+			luaCode: fmt.Sprintf(`
+				b:set_method("GET")
+				b:set_url("%s")
+				local ok, res = pcall(b.send, b)
+				if ok then return "expected error" end
+				return res
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withPolicyBuilder(server.Client(), `^marasi\.app$`, false),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "blocked by the extension egress policy") {
+					t.Errorf("\nwanted:\nerror containing 'blocked by the extension egress policy'\ngot:\n%s", errStr)
+				}
+			},
+		},
+		{
+			name: "b:send_async should error if the host is denied by the egress policy",
+			luaCode: fmt.Sprintf(`
+				b:set_method("GET")
+				b:set_url("%s")
+				local ok, res = pcall(b.send_async, b, function(res, err) end)
+				if ok then return "expected error" end
+				return res
+			`, server.URL),
+			options: []func(*Runtime) error{
+				withPolicyBuilder(server.Client(), `^127\.0\.0\.1(:\d+)?$`, true),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "blocked by the extension egress policy") {
+					t.Errorf("\nwanted:\nerror containing 'blocked by the extension egress policy'\ngot:\n%s", errStr)
+				}
+			},
+		},
+		{
+			name: "b:from_request should copy the method, url, headers and body and keep the cookies in the Cookie header",
+			luaCode: `
+				b:from_request(r)
+				return b:method() .. " " .. b:url():string() .. " " .. b:headers():get("X-Custom") .. " " .. b:headers():get("Cookie") .. " " .. #b:cookies() .. " " .. b:body()
+			`,
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+				withRequest(postReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				want := fmt.Sprintf("POST %s/submit?q=1 marasi session=abc 0 request payload", server.URL)
+				if got != want {
+					t.Errorf("\nwanted:\n%s\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name: "b:from_request should send the copied request and leave the original body readable",
+			luaCode: `
+				local res, err = b:from_request(r):send()
+				if err then error(err) end
+				return res:headers():get("X-Echo-Method") .. " " .. res:headers():get("X-Echo-Body") .. " " .. r:body()
+			`,
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+				withRequest(postReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "POST request payload request payload" {
+					t.Errorf("\nwanted:\nPOST request payload request payload\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "b:from_request should send the cookies of the request once",
+			luaCode: `
+				local res, err = b:from_request(r):send()
+				if err then error(err) end
+				return res:headers():get("X-Echo-Cookie")
+			`,
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+				withRequest(postReq()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if got != "session=abc" {
+					t.Errorf("\nwanted:\nsession=abc\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "b:from_request should error if the argument is not a request",
+			luaCode: `
+				local ok, res = pcall(b.from_request, b, "not a request")
+				if ok then return "expected error" end
+				return res
+			`,
+			options: []func(*Runtime) error{
+				withBuilder(server.Client()),
+			},
+			validatorFunc: func(t *testing.T, ext *Runtime, got any) {
+				if _, ok := got.(string); !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+			},
+		},
 		{
 			name: "b:send should error if method or url are missing",
 			luaCode: `
@@ -2862,7 +5049,10 @@ func TestRequestBuilderType(t *testing.T) {
 				t.Fatalf("executing lua code %s : %v", tt.luaCode, err)
 			}
 
+			// send_async callbacks can already be running, the result is read under the runtime lock
+			extension.lock()
 			got := GoValue(extension.LuaState, -1)
+			extension.Mu.Unlock()
 			if tt.validatorFunc != nil {
 				tt.validatorFunc(t, extension, got)
 			}
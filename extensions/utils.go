@@ -1,15 +1,18 @@
 package extensions
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/go-lua"
 	"github.com/google/uuid"
 )
 
-func registerUtilsLibrary(l *lua.State) {
+func registerUtilsLibrary(l *lua.State, extension *Runtime) {
 	l.Global("marasi")
 
 	if l.IsNil(-1) {
@@ -17,7 +20,7 @@ func registerUtilsLibrary(l *lua.State) {
 		return
 	}
 
-	lua.NewLibrary(l, utilsLibrary())
+	lua.NewLibrary(l, utilsLibrary(extension))
 
 	l.SetField(-2, "utils")
 	l.Pop(1)
@@ -26,7 +29,7 @@ func registerUtilsLibrary(l *lua.State) {
 // utilsLibrary returns a list of Lua functions that provide utility
 // functionalities. These functions are available under the `marasi.utils`
 // table in Lua scripts.
-func utilsLibrary() []lua.RegistryFunction {
+func utilsLibrary(extension *Runtime) []lua.RegistryFunction {
 	return []lua.RegistryFunction{
 		// uuid generates a new UUIDv7 and returns it as a string.
 		//
@@ -83,18 +86,191 @@ func utilsLibrary() []lua.RegistryFunction {
 		//
 		// @param url string The URL string.
 		// @return URL The new URL object.
-		{Name: "url", Function: func(l *lua.State) int {
-			inputString := lua.CheckString(l, 2)
-			parsed, err := url.Parse(inputString)
+		{Name: "url", Function: parseURL},
+		// parse_url parses a string into a URL object, it is the same as url.
+		//
+		// @param url string The URL string.
+		// @return URL The new URL object.
+		{Name: "parse_url", Function: parseURL},
+		// fuzz sends a copy of the builder for each value with the query parameter set to that value.
+		// The requests are sent asynchronously one after the other, fuzz returns once they are queued and the callback
+		// is called after each one like the callback of send_async.
+		//
+		// @param builder RequestBuilder The request to send, it is not modified.
+		// @param param string The name of the query parameter.
+		// @param values table The values of the query parameter.
+		// @param callback function Called with the response (or nil), the error message (or nil) and the value.
+		{Name: "fuzz", Function: func(l *lua.State) int {
+			builder := lua.CheckUserData(l, 2, "RequestBuilder").(*RequestBuilder)
+			param := lua.CheckString(l, 3)
+			lua.CheckType(l, 4, lua.TypeTable)
+			lua.CheckType(l, 5, lua.TypeFunction)
+
+			count := lua.LengthEx(l, 4)
+			values := make([]string, 0, count)
+			senders := make([]func() (*http.Response, error), 0, count)
+			for i := 1; i <= count; i++ {
+				l.RawGetInt(4, i)
+				value, ok := l.ToString(-1)
+				l.Pop(1)
+				if !ok {
+					lua.ArgumentError(l, 4, fmt.Sprintf("value at index %d is not a string", i))
+					return 0
+				}
 
+				clone := builder.clone()
+				if clone.url != nil {
+					query := clone.url.Query()
+					query.Set(param, value)
+					clone.url.RawQuery = query.Encode()
+				}
+
+				send, err := clone.asyncSender(extension)
+				if err != nil {
+					lua.Errorf(l, "%s", err.Error())
+					return 0
+				}
+				values = append(values, value)
+				senders = append(senders, send)
+			}
+
+			callbackKey := fmt.Sprintf("marasi_cb_%d", atomic.AddUint64(&globalCallbackCounter, 1))
+			l.PushValue(5)
+			l.SetField(lua.RegistryIndex, callbackKey)
+
+			go func() {
+				defer func() {
+					extension.lock()
+					defer extension.Mu.Unlock()
+					if !extension.closed {
+						l.PushNil()
+						l.SetField(lua.RegistryIndex, callbackKey)
+					}
+				}()
+
+				for i, send := range senders {
+					resp, err := send()
+					if !fuzzCallback(extension, l, callbackKey, resp, err, values[i]) {
+						return
+					}
+				}
+			}()
+			return 0
+		}},
+		// regex compiles a pattern into a regexp object.
+		//
+		// @param pattern string The regular expression pattern.
+		// @param anchored boolean (optional) True to anchor the pattern to the whole string with ^...$.
+		// @return Regexp The compiled regexp object.
+		{Name: "regex", Function: func(l *lua.State) int {
+			pattern := lua.CheckString(l, 2)
+			if l.ToBoolean(3) {
+				pattern = "^(?:" + pattern + ")$"
+			}
+
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				lua.Errorf(l, "compiling regex: %s", err.Error())
+				return 0
+			}
+
+			l.PushUserData(re)
+			lua.SetMetaTableNamed(l, "regexp")
+			return 1
+		}},
+		// url_encode percent-encodes a string so it can be placed in a URL query.
+		//
+		// @param input string The string to encode.
+		// @return string The query escaped string.
+		{Name: "url_encode", Function: func(l *lua.State) int {
+			inputString := lua.CheckString(l, 2)
+			l.PushString(url.QueryEscape(inputString))
+			return 1
+		}},
+		// url_decode decodes a percent-encoded query string.
+		//
+		// @param input string The query escaped string.
+		// @return string The decoded string.
+		{Name: "url_decode", Function: func(l *lua.State) int {
+			inputString := lua.CheckString(l, 2)
+			decoded, err := url.QueryUnescape(inputString)
 			if err != nil {
-				lua.Errorf(l, "parsing URL: %s", err.Error())
+				lua.Errorf(l, "decoding URL: %s", err.Error())
 				return 0
 			}
 
-			l.PushUserData(parsed)
-			lua.SetMetaTableNamed(l, "url")
+			l.PushString(decoded)
 			return 1
 		}},
+		// hex_encode encodes a string using hexadecimal.
+		//
+		// @param input string The string to encode.
+		// @return string The hexadecimal encoded string.
+		{Name: "hex_encode", Function: hexEncode},
+		// hex_decode decodes a hexadecimal encoded string, it errors on odd length or invalid input.
+		//
+		// @param input string The hexadecimal encoded string.
+		// @return string The decoded string.
+		{Name: "hex_decode", Function: hexDecode},
+		// md5 calculates the MD5 hash of a given string.
+		//
+		// @param input string The string to hash.
+		// @return string The MD5 hash encoded as a hexadecimal string.
+		{Name: "md5", Function: md5Hex},
+		// sha1 calculates the SHA1 hash of a given string.
+		//
+		// @param input string The string to hash.
+		// @return string The SHA1 hash encoded as a hexadecimal string.
+		{Name: "sha1", Function: sha1Hex},
+		// sha256 calculates the SHA256 hash of a given string.
+		//
+		// @param input string The string to hash.
+		// @return string The SHA256 hash encoded as a hexadecimal string.
+		{Name: "sha256", Function: sha256Hex},
+	}
+}
+
+// parseURL parses the string argument into a url userdata that supports all the url methods.
+// It raises a Lua error if the string is empty or can't be parsed.
+func parseURL(l *lua.State) int {
+	inputString := lua.CheckString(l, 2)
+	if inputString == "" {
+		lua.Errorf(l, "parsing URL: empty URL")
+		return 0
+	}
+
+	parsed, err := url.Parse(inputString)
+	if err != nil {
+		lua.Errorf(l, "parsing URL: %s", err.Error())
+		return 0
+	}
+
+	l.PushUserData(parsed)
+	lua.SetMetaTableNamed(l, "url")
+	return 1
+}
+
+// fuzzCallback calls the fuzz callback stored in the registry at callbackKey with the response or the error and the value.
+// It returns false once the runtime is closed, so the remaining requests are not sent.
+func fuzzCallback(extension *Runtime, l *lua.State, callbackKey string, resp *http.Response, err error, value string) bool {
+	extension.lock()
+	defer extension.Mu.Unlock()
+
+	if extension.closed {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return false
+	}
+
+	top := l.Top()
+	defer l.SetTop(top)
+
+	l.Field(lua.RegistryIndex, callbackKey)
+	pushAsyncResult(l, resp, err)
+	l.PushString(value)
+	if callErr := l.ProtectedCall(3, 0, 0); callErr != nil {
+		// TODO: This needs to be properly logged
 	}
+	return true
 }
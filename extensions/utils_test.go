@@ -2,12 +2,14 @@ package extensions
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Shopify/go-lua"
 	"github.com/google/uuid"
 )
 
@@ -120,6 +122,229 @@ func TestUtilsLibrary(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "utils:parse_url should return url userdata usable with the url methods",
+			luaCode: `
+				local u = marasi.utils:parse_url("https://marasi.app:8443/path?query=1")
+				u:set_path("/other")
+				return u:host() .. " " .. u:string()
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				want := "marasi.app:8443 https://marasi.app:8443/other?query=1"
+				if got != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%v", want, got)
+				}
+			},
+		},
+		{
+			name: "utils:parse_url should return an error when parsing an invalid URL",
+			luaCode: `
+				local ok, res = pcall(marasi.utils.parse_url, marasi.utils, "http://[::1")
+				if ok then
+					return "expected nil value"
+				end
+				return res
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "parsing URL") {
+					t.Errorf("wanted error containing 'parsing URL', got: %q", errStr)
+				}
+			},
+		},
+		{
+			name: "utils:parse_url should return an error for an empty string",
+			luaCode: `
+				local ok, res = pcall(marasi.utils.parse_url, marasi.utils, "")
+				if ok then
+					return "expected nil value"
+				end
+				return res
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "empty URL") {
+					t.Errorf("wanted error containing 'empty URL', got: %q", errStr)
+				}
+			},
+		},
+		{
+			name:    "utils:regex should compile an unanchored pattern",
+			luaCode: `return marasi.utils:regex("mar[a-z]+"):match("api.marasi.app")`,
+			validatorFunc: func(t *testing.T, got any) {
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "utils:regex should anchor the pattern to the whole string",
+			luaCode: `
+				local re = marasi.utils:regex("marasi|proxy", true)
+				return tostring(re:match("marasi")) .. " " .. tostring(re:match("proxy")) .. " " .. tostring(re:match("api.marasi.app"))
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				if got != "true true false" {
+					t.Errorf("\nwanted:\ntrue true false\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "utils:regex should return an error on invalid patterns",
+			luaCode: `
+				local ok, res = pcall(marasi.utils.regex, marasi.utils, "(unclosed", true)
+				if ok then
+					return "expected nil value"
+				end
+				return res
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "compiling regex") {
+					t.Errorf("wanted error containing 'compiling regex', got: %q", errStr)
+				}
+			},
+		},
+		{
+			name:    "utils:url_encode should escape reserved characters",
+			luaCode: `return marasi.utils:url_encode("a b&c=d/e?f#g%")`,
+			validatorFunc: func(t *testing.T, got any) {
+				want := "a+b%26c%3Dd%2Fe%3Ff%23g%25"
+				if got != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+				}
+			},
+		},
+		{
+			name: "utils:url_decode should round trip reserved characters",
+			luaCode: `
+				local input = "a b&c=d/e?f#g%+"
+				return marasi.utils:url_decode(marasi.utils:url_encode(input)) == input
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "utils:url_decode should return an error on malformed escapes",
+			luaCode: `
+				local ok, res = pcall(marasi.utils.url_decode, marasi.utils, "%zz")
+				if ok then
+					return "expected nil value"
+				end
+				return res
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "invalid URL escape") {
+					t.Errorf("wanted error containing 'invalid URL escape', got: %q", errStr)
+				}
+			},
+		},
+		{
+			name:    "utils:hex_encode should encode to lowercase hexadecimal",
+			luaCode: `return marasi.utils:hex_encode("marasi\x00\xff")`,
+			validatorFunc: func(t *testing.T, got any) {
+				want := "6d617261736900ff"
+				if got != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+				}
+			},
+		},
+		{
+			name: "utils:hex_decode should round trip binary data",
+			luaCode: `
+				local input = "token\x00\x01\x7f\x80\xff"
+				return marasi.utils:hex_decode(marasi.utils:hex_encode(input)) == input
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				if got != true {
+					t.Errorf("\nwanted:\ntrue\ngot:\n%v", got)
+				}
+			},
+		},
+		{
+			name: "utils:hex_decode should return an error on odd length input",
+			luaCode: `
+				local ok, res = pcall(marasi.utils.hex_decode, marasi.utils, "abc")
+				if ok then
+					return "expected nil value"
+				end
+				return res
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "odd length hex string") {
+					t.Errorf("wanted error containing 'odd length hex string', got: %q", errStr)
+				}
+			},
+		},
+		{
+			name: "utils:hex_decode should return an error on invalid characters",
+			luaCode: `
+				local ok, res = pcall(marasi.utils.hex_decode, marasi.utils, "zz")
+				if ok then
+					return "expected nil value"
+				end
+				return res
+			`,
+			validatorFunc: func(t *testing.T, got any) {
+				errStr, ok := got.(string)
+				if !ok {
+					t.Fatalf("\nwanted:\nstring error\ngot:\n%T", got)
+				}
+				if !strings.Contains(errStr, "invalid byte") {
+					t.Errorf("wanted error containing 'invalid byte', got: %q", errStr)
+				}
+			},
+		},
+		{
+			name:    "utils:md5 should return the hex encoded digest",
+			luaCode: `return marasi.utils:md5("marasi")`,
+			validatorFunc: func(t *testing.T, got any) {
+				want := "ed29d12b9dba98e790689ee8d8e99064"
+				if got != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+				}
+			},
+		},
+		{
+			name:    "utils:sha1 should return the hex encoded digest",
+			luaCode: `return marasi.utils:sha1("marasi")`,
+			validatorFunc: func(t *testing.T, got any) {
+				want := "4f4af7d274a8e31d082d026b4ed4def51509dcc4"
+				if got != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+				}
+			},
+		},
+		{
+			name:    "utils:sha256 should return the hex encoded digest",
+			luaCode: `return marasi.utils:sha256("marasi")`,
+			validatorFunc: func(t *testing.T, got any) {
+				want := "35c7134d79db008dee1ad4438c69196aaeda57d591d2507c80db8eaf01386a51"
+				if got != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -139,3 +364,139 @@ func TestUtilsLibrary(t *testing.T) {
 		})
 	}
 }
+
+func TestUtilsFuzz(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Echo-Param", r.URL.Query().Get("q"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	withBuilder := func(r *Runtime) error {
+		builder := NewRequestBuilder(server.Client())
+		builder.method = http.MethodGet
+		u, err := url.Parse(server.URL + "/search?page=1")
+		if err != nil {
+			return err
+		}
+		builder.url = u
+		r.LuaState.PushUserData(builder)
+		lua.SetMetaTableNamed(r.LuaState, "RequestBuilder")
+		r.LuaState.SetGlobal("b")
+		return nil
+	}
+
+	withResults := func(results chan string) func(*Runtime) error {
+		return func(r *Runtime) error {
+			r.LuaState.Register("test_done", func(l *lua.State) int {
+				results <- lua.CheckString(l, 1)
+				return 0
+			})
+			return nil
+		}
+	}
+
+	t.Run("utils:fuzz should send the builder once per value in order", func(t *testing.T) {
+		results := make(chan string, 3)
+		extension, _ := setupTestExtension(t, "", withBuilder, withResults(results))
+
+		err := extension.ExecuteLua(`
+			marasi.utils:fuzz(b, "q", {"one", "two", "three"}, function(res, err, value)
+				if err ~= nil then
+					test_done("error: " .. err)
+					return
+				end
+				test_done(value .. "=" .. res:headers():get("X-Echo-Param"))
+			end)
+		`)
+		if err != nil {
+			t.Fatalf("executing lua code : %v", err)
+		}
+
+		for _, want := range []string{"one=one", "two=two", "three=three"} {
+			select {
+			case got := <-results:
+				if got != want {
+					t.Fatalf("\nwanted:\n%s\ngot:\n%s", want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("\nwanted:\n%s\ngot:\ntimeout", want)
+			}
+		}
+	})
+
+	t.Run("utils:fuzz should return before the responses and not hold the runtime", func(t *testing.T) {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer slow.Close()
+		defer close(release)
+
+		results := make(chan string, 2)
+		extension, _ := setupTestExtension(t, "", withResults(results), func(r *Runtime) error {
+			builder := NewRequestBuilder(slow.Client())
+			builder.method = http.MethodGet
+			u, err := url.Parse(slow.URL)
+			if err != nil {
+				return err
+			}
+			builder.url = u
+			r.LuaState.PushUserData(builder)
+			lua.SetMetaTableNamed(r.LuaState, "RequestBuilder")
+			r.LuaState.SetGlobal("b")
+			return nil
+		})
+
+		done := make(chan error, 1)
+		go func() {
+			done <- extension.ExecuteLua(`marasi.utils:fuzz(b, "q", {"one", "two"}, function(res, err, value) test_done(value) end)`)
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("executing lua code : %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("\nwanted:\nfuzz to return before the responses\ngot:\ntimeout")
+		}
+
+		if err := extension.ExecuteLua(`version = 2`); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		select {
+		case got := <-results:
+			t.Fatalf("\nwanted:\nno callback before the response\ngot:\n%s", got)
+		default:
+		}
+	})
+
+	t.Run("utils:fuzz should not modify the builder", func(t *testing.T) {
+		extension, _ := setupTestExtension(t, "", withBuilder)
+
+		err := extension.ExecuteLua(`
+			marasi.utils:fuzz(b, "q", {"one"}, function(res, err, value) end)
+			return b:url():string()
+		`)
+		if err != nil {
+			t.Fatalf("executing lua code : %v", err)
+		}
+
+		got := GoValue(extension.LuaState, -1)
+		want := server.URL + "/search?page=1"
+		if got != want {
+			t.Fatalf("\nwanted:\n%s\ngot:\n%v", want, got)
+		}
+	})
+
+	t.Run("utils:fuzz should error if a value is not a string", func(t *testing.T) {
+		extension, _ := setupTestExtension(t, "", withBuilder)
+
+		err := extension.ExecuteLua(`marasi.utils:fuzz(b, "q", {{}}, function() end)`)
+		if err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+	})
+}
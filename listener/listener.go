@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -15,49 +16,252 @@ import (
 type connWrapper struct {
 	net.Conn
 	io.Reader
+	// conns is the set the connection is tracked in by its listener, nil when it is not tracked
+	conns *connSet
+	// wire records the bytes read from a plain HTTP connection, nil when they are not recorded
+	wire *wireRecorder
 }
 
-// connWrapper.Read method will read from the io.Reader instead of the net.Conn
+// connWrapper.Read method will read from the io.Reader instead of the net.Conn, the bytes are recorded when wire is set
 func (cw *connWrapper) Read(b []byte) (int, error) {
-	return cw.Reader.Read(b)
+	n, err := cw.Reader.Read(b)
+	if cw.wire != nil && n > 0 {
+		cw.wire.record(b[:n])
+	}
+	return n, err
+}
+
+// connWrapper.Close method stops tracking the connection before closing the net.Conn
+func (cw *connWrapper) Close() error {
+	if cw.conns != nil {
+		cw.conns.remove(cw)
+	}
+	return cw.Conn.Close()
+}
+
+// ConnCloser is implemented by the listeners that keep track of the connections they returned
+type ConnCloser interface {
+	// CloseConnections closes the open connections returned by Accept, connections accepted afterwards are closed right away
+	CloseConnections() error
+}
+
+// HeaderRecorder is implemented by the listeners that record the bytes of the plain HTTP connections they returned,
+// the raw request line and headers are lost once net/http parsed a request
+type HeaderRecorder interface {
+	// RawHeader returns the raw request line and headers of the first request recorded on the connection from remoteAddr
+	// that starts with requestLine, the recorded bytes up to the end of the headers are forgotten
+	RawHeader(remoteAddr string, requestLine string) ([]byte, bool)
+}
+
+// connSet tracks the open connections of a listener so they can be closed together
+type connSet struct {
+	mu     sync.Mutex
+	conns  map[*connWrapper]struct{}
+	byAddr map[string]*connWrapper
+	closed bool
+}
+
+// add tracks the connection, it returns false and closes the connection if the set was already closed
+func (set *connSet) add(conn *connWrapper) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.closed {
+		conn.Conn.Close()
+		return false
+	}
+	if set.conns == nil {
+		set.conns = make(map[*connWrapper]struct{})
+		set.byAddr = make(map[string]*connWrapper)
+	}
+	set.conns[conn] = struct{}{}
+	if addr := conn.RemoteAddr(); addr != nil {
+		set.byAddr[addr.String()] = conn
+	}
+	return true
+}
+
+// remove stops tracking the connection
+func (set *connSet) remove(conn *connWrapper) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	delete(set.conns, conn)
+	if addr := conn.RemoteAddr(); addr != nil && set.byAddr[addr.String()] == conn {
+		delete(set.byAddr, addr.String())
+	}
+}
+
+// rawHeader returns the raw header block recorded on the tracked connection from remoteAddr, see HeaderRecorder
+func (set *connSet) rawHeader(remoteAddr string, requestLine string) ([]byte, bool) {
+	set.mu.Lock()
+	conn := set.byAddr[remoteAddr]
+	set.mu.Unlock()
+	if conn == nil || conn.wire == nil {
+		return nil, false
+	}
+	return conn.wire.take(requestLine)
+}
+
+// closeAll closes every tracked connection and closes the set
+func (set *connSet) closeAll() error {
+	set.mu.Lock()
+	set.closed = true
+	conns := set.conns
+	set.conns = nil
+	set.byAddr = nil
+	set.mu.Unlock()
+
+	var errs []error
+	for conn := range conns {
+		if err := conn.Conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
+// httpMethods are the request methods recognized at the start of a plain HTTP connection, PRI is the HTTP/2 connection preface
+var httpMethods = []string{"GET", "POST", "PUT", "HEAD", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE", "PRI"}
+
+// DefaultDetectTimeout is the time a connection has to send its first bytes before the protocol detection gives up
+const DefaultDetectTimeout = 10 * time.Second
+
 // ProtocolMuxListener wraps net.Listener and inspects the incoming connection to determine the protocol
+// The protocol of each connection is detected in its own goroutine, so a slow or silent client does not hold back the others
+// The open connections, including the relayed ones, are tracked and can be closed with CloseConnections
+// The bytes of the plain HTTP connections are recorded for RawHeader, the TLS connections are decrypted after the listener and are not recorded
 type ProtocolMuxListener struct {
 	net.Listener
 	TLSConfig *tls.Config
+	// OriginalDestination returns the "host:port" a connection was addressed to, used when the listener receives redirected traffic.
+	// When it is set, connections that start with neither an HTTP request line nor a TLS record are relayed to the
+	// original destination untouched instead of being returned by Accept. Connections that send less than the bytes needed
+	// for the detection before DetectTimeout, such as the clients of server speaks first protocols, are relayed as well.
+	// When it is nil every connection is returned.
+	OriginalDestination func(conn net.Conn) (string, error)
+	// DetectTimeout is the time a connection has to send its first bytes, DefaultDetectTimeout is used when it is 0
+	DetectTimeout time.Duration
+
+	startOnce sync.Once
+	results   chan acceptResult
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	conns     connSet
+	// err is the error of the underlying listener that stopped the accept loop, it is set before done is closed
+	err error
 }
 
+// NewProtocolMuxListener creates a ProtocolMuxListener for listener, the zero value of a ProtocolMuxListener is not usable
 func NewProtocolMuxListener(listener net.Listener, tlsConfig *tls.Config) *ProtocolMuxListener {
 	return &ProtocolMuxListener{
 		Listener:  listener,
 		TLSConfig: tlsConfig,
+		results:   make(chan acceptResult),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
 	}
 }
 
+// Accept returns the next connection for the proxy, connections relayed to their original destination are not returned
 func (l *ProtocolMuxListener) Accept() (net.Conn, error) {
-	rawConnection, err := l.Listener.Accept()
-	if err != nil {
-		return nil, fmt.Errorf("accepting connection: %w", err)
+	l.startOnce.Do(func() {
+		go l.acceptLoop()
+	})
+	select {
+	case result := <-l.results:
+		return result.conn, result.err
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close closes the underlying listener, the connections whose protocol is still being detected are closed once it is known
+func (l *ProtocolMuxListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closing)
+	})
+	return l.Listener.Close()
+}
+
+// CloseConnections closes the open connections accepted by the listener
+func (l *ProtocolMuxListener) CloseConnections() error {
+	return l.conns.closeAll()
+}
+
+// acceptLoop accepts the connections of the underlying listener and starts the protocol detection of each one until the listener is closed
+func (l *ProtocolMuxListener) acceptLoop() {
+	defer close(l.done)
+	for {
+		rawConnection, err := l.Listener.Accept()
+		if err != nil {
+			err = fmt.Errorf("accepting connection: %w", err)
+			if errors.Is(err, net.ErrClosed) {
+				l.err = err
+				return
+			}
+			select {
+			case l.results <- acceptResult{err: err}:
+				continue
+			case <-l.closing:
+				l.err = fmt.Errorf("accepting connection: %w", net.ErrClosed)
+				return
+			}
+		}
+		go l.detect(rawConnection)
 	}
+}
+
+// detect detects the protocol of the connection and hands it to Accept, relayed connections are not handed over
+func (l *ProtocolMuxListener) detect(rawConnection net.Conn) {
+	conn, err := l.accept(rawConnection)
+	if conn == nil && err == nil {
+		return
+	}
+	select {
+	case l.results <- acceptResult{conn: conn, err: err}:
+	case <-l.closing:
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
 
+// accept detects the protocol of a single connection, it returns a nil connection and error when the connection was relayed
+// or accepted after CloseConnections
+func (l *ProtocolMuxListener) accept(rawConnection net.Conn) (net.Conn, error) {
 	bufferedReader := bufio.NewReader(rawConnection)
+	conn := &connWrapper{
+		Conn:   rawConnection,
+		Reader: bufferedReader,
+		conns:  &l.conns,
+	}
+	if !l.conns.add(conn) {
+		return nil, nil
+	}
 
-	err = rawConnection.SetReadDeadline(time.Now().Add(10 * time.Second))
+	timeout := l.DetectTimeout
+	if timeout == 0 {
+		timeout = DefaultDetectTimeout
+	}
+	err := rawConnection.SetReadDeadline(time.Now().Add(timeout))
 	if err != nil {
-		rawConnection.Close()
+		conn.Close()
 		return nil, fmt.Errorf("setting read deadline for peak: %w", err)
 	}
 
 	peekedBytes, err := bufferedReader.Peek(5)
 
 	if err := rawConnection.SetReadDeadline(time.Time{}); err != nil {
-		rawConnection.Close()
+		conn.Close()
 		return nil, fmt.Errorf("clearing read deadline after peek: %w", err)
 	}
 	if err != nil {
 		if err != bufio.ErrBufferFull {
-			rawConnection.Close()
+			// The client is waiting for the server to speak first or sent less than the detection needs
+			if l.OriginalDestination != nil {
+				return nil, l.relayToOriginalDestination(conn)
+			}
+			conn.Close()
 			return nil, fmt.Errorf("peaking initial bytes: %w", err)
 		}
 	}
@@ -65,10 +269,7 @@ func (l *ProtocolMuxListener) Accept() (net.Conn, error) {
 	isTLS := len(peekedBytes) >= 2 && peekedBytes[0] == 0x16 && peekedBytes[1] == 0x03
 
 	if isTLS {
-		tlsConn := tls.Server(&connWrapper{
-			Conn:   rawConnection,
-			Reader: bufferedReader,
-		}, l.TLSConfig)
+		tlsConn := tls.Server(conn, l.TLSConfig)
 
 		err := rawConnection.SetReadDeadline(time.Now().Add(10 * time.Second))
 		if err != nil {
@@ -89,10 +290,68 @@ func (l *ProtocolMuxListener) Accept() (net.Conn, error) {
 		}
 		return tlsConn, nil
 	}
-	return &connWrapper{
-		Conn:   rawConnection,
-		Reader: bufferedReader,
-	}, nil
+
+	if l.OriginalDestination != nil && !looksLikeHTTP(peekedBytes) {
+		return nil, l.relayToOriginalDestination(conn)
+	}
+	conn.wire = &wireRecorder{}
+	return conn, nil
+}
+
+// RawHeader returns the raw request line and headers of a request read from one of the plain HTTP connections, see HeaderRecorder
+func (l *ProtocolMuxListener) RawHeader(remoteAddr string, requestLine string) ([]byte, bool) {
+	return l.conns.rawHeader(remoteAddr, requestLine)
+}
+
+// relayToOriginalDestination relays the connection to its original destination in a new goroutine
+func (l *ProtocolMuxListener) relayToOriginalDestination(conn *connWrapper) error {
+	destination, err := l.OriginalDestination(conn.Conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("getting original destination of non-HTTP connection: %w", err)
+	}
+	go relay(conn, destination)
+	return nil
+}
+
+// looksLikeHTTP reports whether the first bytes of a connection can be the start of an HTTP request line
+func looksLikeHTTP(peeked []byte) bool {
+	for _, method := range httpMethods {
+		prefix := method + " "
+		n := min(len(peeked), len(prefix))
+		if n > 0 && string(peeked[:n]) == prefix[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+// relay dials the destination and copies the bytes of conn, including the peeked ones, to it and back until both sides are done
+func relay(conn *connWrapper, destination string) {
+	defer conn.Close()
+
+	upstream, err := net.DialTimeout("tcp", destination, 10*time.Second)
+	if err != nil {
+		// TODO this will need a clean mechanism to log to the DB for applications to consume
+		log.Printf("Relaying non-HTTP connection to %s: %v", destination, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst net.Conn, src io.Reader) {
+		io.Copy(dst, src)
+		if closer, ok := dst.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(upstream, conn)
+	go copyHalf(conn.Conn, upstream)
+	<-done
+	<-done
 }
 
 // MarasiListener wraps net.Listener to be resilient, recoverable errors are handled gracefully
@@ -105,6 +364,22 @@ func NewMarasiListener(listenerToWrap net.Listener) *MarasiListener {
 	return &MarasiListener{Listener: listenerToWrap}
 }
 
+// CloseConnections closes the open connections of the wrapped listener if it implements ConnCloser
+func (l *MarasiListener) CloseConnections() error {
+	if closer, ok := l.Listener.(ConnCloser); ok {
+		return closer.CloseConnections()
+	}
+	return nil
+}
+
+// RawHeader returns the raw header block recorded by the wrapped listener if it implements HeaderRecorder
+func (l *MarasiListener) RawHeader(remoteAddr string, requestLine string) ([]byte, bool) {
+	if recorder, ok := l.Listener.(HeaderRecorder); ok {
+		return recorder.RawHeader(remoteAddr, requestLine)
+	}
+	return nil, false
+}
+
 // MarasiListnener Accept will gracefully handle recoverable errors and continue without crashing the server
 func (l *MarasiListener) Accept() (net.Conn, error) {
 	for {
@@ -123,3 +398,144 @@ func (l *MarasiListener) Accept() (net.Conn, error) {
 		return conn, nil
 	}
 }
+
+// acceptResult is a connection or error returned by one of the listeners of a MultiListener
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// MultiListener accepts connections from multiple listeners so the proxy can be served on multiple addresses
+// Closing the MultiListener closes every listener
+type MultiListener struct {
+	listeners []net.Listener
+	results   chan acceptResult
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMultiListener starts accepting connections on each of the listeners, at least one listener is required
+func NewMultiListener(listeners ...net.Listener) *MultiListener {
+	l := &MultiListener{
+		listeners: listeners,
+		results:   make(chan acceptResult),
+		closing:   make(chan struct{}),
+	}
+	for _, listener := range listeners {
+		go l.acceptLoop(listener)
+	}
+	return l
+}
+
+// acceptLoop forwards the accepted connections of a single listener until it is closed
+func (l *MultiListener) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case l.results <- acceptResult{conn: conn, err: err}:
+		case <-l.closing:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// Accept returns the next connection accepted by any of the listeners
+func (l *MultiListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.results:
+		return result.conn, result.err
+	case <-l.closing:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes all the listeners, pending and later calls to Accept return net.ErrClosed
+func (l *MultiListener) Close() error {
+	var errs []error
+	l.closeOnce.Do(func() {
+		close(l.closing)
+		for _, listener := range l.listeners {
+			if err := listener.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener
+func (l *MultiListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// CloseConnections closes the open connections of every listener that implements ConnCloser
+func (l *MultiListener) CloseConnections() error {
+	var errs []error
+	for _, listener := range l.listeners {
+		if closer, ok := listener.(ConnCloser); ok {
+			if err := closer.CloseConnections(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RawHeader returns the raw header block recorded by the first listener that implements HeaderRecorder and knows the connection
+func (l *MultiListener) RawHeader(remoteAddr string, requestLine string) ([]byte, bool) {
+	for _, listener := range l.listeners {
+		if recorder, ok := listener.(HeaderRecorder); ok {
+			if raw, ok := recorder.RawHeader(remoteAddr, requestLine); ok {
+				return raw, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// TrackingListener wraps a net.Listener and keeps track of the connections it returned so they can be closed with CloseConnections
+// The connections are wrapped and their bytes are recorded for RawHeader, listeners returning a *tls.Conn should implement ConnCloser
+// themselves (see ProtocolMuxListener)
+type TrackingListener struct {
+	net.Listener
+	conns connSet
+}
+
+func NewTrackingListener(listenerToWrap net.Listener) *TrackingListener {
+	return &TrackingListener{Listener: listenerToWrap}
+}
+
+// Accept returns the next connection of the wrapped listener, it is tracked until it is closed
+func (l *TrackingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tracked := &connWrapper{
+			Conn:   conn,
+			Reader: conn,
+			conns:  &l.conns,
+			wire:   &wireRecorder{},
+		}
+		if l.conns.add(tracked) {
+			return tracked, nil
+		}
+	}
+}
+
+// CloseConnections closes the open connections accepted by the listener
+func (l *TrackingListener) CloseConnections() error {
+	return l.conns.closeAll()
+}
+
+// RawHeader returns the raw request line and headers of a request read from one of the connections, see HeaderRecorder
+func (l *TrackingListener) RawHeader(remoteAddr string, requestLine string) ([]byte, bool) {
+	return l.conns.rawHeader(remoteAddr, requestLine)
+}
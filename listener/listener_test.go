@@ -15,6 +15,8 @@ import (
 	"io"
 	"math/big"
 	"net"
+	"net/http"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -371,3 +373,439 @@ func TestMarasiListener_FatalError(t *testing.T) {
 		t.Errorf("expected 1 but got %d", acceptedCount)
 	}
 }
+
+func TestMultiListener(t *testing.T) {
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	second, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	multiListener := NewMultiListener(first, second)
+	defer multiListener.Close()
+
+	if multiListener.Addr().String() != first.Addr().String() {
+		t.Errorf("expected %s got %s", first.Addr(), multiListener.Addr())
+	}
+
+	for _, addr := range []net.Addr{first.Addr(), second.Addr()} {
+		client, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatalf("dialing %s: %v", addr, err)
+		}
+
+		conn, err := multiListener.Accept()
+		if err != nil {
+			t.Fatalf("accepting connection on %s: %v", addr, err)
+		}
+		if conn.LocalAddr().String() != addr.String() {
+			t.Errorf("expected connection on %s got %s", addr, conn.LocalAddr())
+		}
+		conn.Close()
+		client.Close()
+	}
+
+	if err := multiListener.Close(); err != nil {
+		t.Fatalf("closing listener: %v", err)
+	}
+
+	if _, err := multiListener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected error to be net.ErrClosed, but got: %v", err)
+	}
+
+	if _, err := net.Dial("tcp", second.Addr().String()); err == nil {
+		t.Errorf("expected the underlying listeners to be closed")
+	}
+}
+
+func TestProtocolMuxListener_NonHTTPPassthrough(t *testing.T) {
+	testServerTLSConfig, _ := generateTestTLSConfig(t)
+
+	// Upstream echoes everything it receives until the client closes its side
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create upstream listener : %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener : %v", err)
+	}
+	defer baseListener.Close()
+
+	muxListener := NewProtocolMuxListener(baseListener, testServerTLSConfig)
+	muxListener.OriginalDestination = func(conn net.Conn) (string, error) {
+		return upstream.Addr().String(), nil
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := muxListener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	t.Run("non-HTTP bytes should be relayed verbatim", func(t *testing.T) {
+		clientConn, err := net.Dial("tcp", baseListener.Addr().String())
+		if err != nil {
+			t.Fatalf("client failed to dial: %v", err)
+		}
+		defer clientConn.Close()
+
+		want := append([]byte("SSH-2.0-OpenSSH_9.6\r\n"), 0x00, 0x01, 0xff, 0xfe)
+		if _, err := clientConn.Write(want); err != nil {
+			t.Fatalf("client write failed : %v", err)
+		}
+		clientConn.(*net.TCPConn).CloseWrite()
+
+		got, err := io.ReadAll(clientConn)
+		if err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+		}
+	})
+
+	t.Run("HTTP connections should be returned by Accept", func(t *testing.T) {
+		clientConn, err := net.Dial("tcp", baseListener.Addr().String())
+		if err != nil {
+			t.Fatalf("client failed to dial: %v", err)
+		}
+		defer clientConn.Close()
+
+		want := []byte("GET / HTTP/1.1\r\nHost: marasi.app\r\n\r\n")
+		if _, err := clientConn.Write(want); err != nil {
+			t.Fatalf("client write failed : %v", err)
+		}
+
+		select {
+		case conn, ok := <-accepted:
+			if !ok {
+				t.Fatal("\nwanted:\nconnection\ngot:\naccept error")
+			}
+			defer conn.Close()
+
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("server read failed: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("\nwanted:\nconnection\ngot:\ntimeout")
+		}
+	})
+}
+
+func TestProtocolMuxListener_SlowClients(t *testing.T) {
+	testServerTLSConfig, _ := generateTestTLSConfig(t)
+
+	// Upstream speaks first, then echoes everything it receives until the client closes its side
+	greeting := []byte("220 marasi.app ESMTP\r\n")
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create upstream listener : %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(greeting)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener : %v", err)
+	}
+	defer baseListener.Close()
+
+	muxListener := NewProtocolMuxListener(baseListener, testServerTLSConfig)
+	muxListener.DetectTimeout = 200 * time.Millisecond
+	muxListener.OriginalDestination = func(conn net.Conn) (string, error) {
+		return upstream.Addr().String(), nil
+	}
+
+	t.Run("a silent client should not block other connections", func(t *testing.T) {
+		silentConn, err := net.Dial("tcp", baseListener.Addr().String())
+		if err != nil {
+			t.Fatalf("client failed to dial: %v", err)
+		}
+		defer silentConn.Close()
+
+		clientConn, err := net.Dial("tcp", baseListener.Addr().String())
+		if err != nil {
+			t.Fatalf("client failed to dial: %v", err)
+		}
+		defer clientConn.Close()
+		if _, err := clientConn.Write([]byte("GET / HTTP/1.1\r\nHost: marasi.app\r\n\r\n")); err != nil {
+			t.Fatalf("client write failed : %v", err)
+		}
+
+		start := time.Now()
+		conn, err := muxListener.Accept()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		defer conn.Close()
+		if elapsed := time.Since(start); elapsed >= muxListener.DetectTimeout {
+			t.Errorf("\nwanted:\nAccept to return before the silent client timed out\ngot:\n%s", elapsed)
+		}
+	})
+
+	t.Run("a client waiting for the server to speak first should be relayed", func(t *testing.T) {
+		clientConn, err := net.Dial("tcp", baseListener.Addr().String())
+		if err != nil {
+			t.Fatalf("client failed to dial: %v", err)
+		}
+		defer clientConn.Close()
+		clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		got := make([]byte, len(greeting))
+		if _, err := io.ReadFull(clientConn, got); err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+		if !bytes.Equal(got, greeting) {
+			t.Errorf("\nwanted:\n%q\ngot:\n%q", greeting, got)
+		}
+	})
+
+	t.Run("a client sending less than the detection needs should be relayed", func(t *testing.T) {
+		clientConn, err := net.Dial("tcp", baseListener.Addr().String())
+		if err != nil {
+			t.Fatalf("client failed to dial: %v", err)
+		}
+		defer clientConn.Close()
+		clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		want := []byte{0x01, 0x02}
+		if _, err := clientConn.Write(want); err != nil {
+			t.Fatalf("client write failed : %v", err)
+		}
+		clientConn.(*net.TCPConn).CloseWrite()
+
+		got, err := io.ReadAll(clientConn)
+		if err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+		if want := append(slices.Clone(greeting), want...); !bytes.Equal(got, want) {
+			t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+		}
+	})
+
+	t.Run("Accept should return net.ErrClosed once the listener is closed", func(t *testing.T) {
+		muxListener.Close()
+		if _, err := muxListener.Accept(); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("\nwanted:\n%v\ngot:\n%v", net.ErrClosed, err)
+		}
+	})
+}
+
+func TestCloseConnections(t *testing.T) {
+	testServerTLSConfig, _ := generateTestTLSConfig(t)
+
+	type connCloserListener interface {
+		net.Listener
+		ConnCloser
+	}
+	listeners := map[string]func(net.Listener) connCloserListener{
+		"ProtocolMuxListener": func(base net.Listener) connCloserListener {
+			return NewProtocolMuxListener(base, testServerTLSConfig)
+		},
+		"TrackingListener": func(base net.Listener) connCloserListener {
+			return NewTrackingListener(base)
+		},
+	}
+
+	for name, newListener := range listeners {
+		t.Run(name+" should close the open connections", func(t *testing.T) {
+			baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to create listener : %v", err)
+			}
+			defer baseListener.Close()
+			trackingListener := newListener(baseListener)
+
+			clientConn, err := net.Dial("tcp", baseListener.Addr().String())
+			if err != nil {
+				t.Fatalf("client failed to dial: %v", err)
+			}
+			defer clientConn.Close()
+			if _, err := clientConn.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+				t.Fatalf("client write failed : %v", err)
+			}
+
+			conn, err := trackingListener.Accept()
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+			defer conn.Close()
+
+			if err := trackingListener.CloseConnections(); err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+
+			if err := waitClosed(clientConn); err != nil {
+				t.Errorf("\nwanted:\nconnection closed\ngot:\n%v", err)
+			}
+
+			// Connections accepted after CloseConnections are closed right away
+			lateConn, err := net.Dial("tcp", baseListener.Addr().String())
+			if err != nil {
+				t.Fatalf("client failed to dial: %v", err)
+			}
+			defer lateConn.Close()
+			lateConn.Write([]byte("GET / HTTP/1.1\r\n"))
+			go trackingListener.Accept()
+
+			if err := waitClosed(lateConn); err != nil {
+				t.Errorf("\nwanted:\nconnection closed\ngot:\n%v", err)
+			}
+		})
+	}
+}
+
+func TestRawHeader(t *testing.T) {
+	testServerTLSConfig, _ := generateTestTLSConfig(t)
+
+	type recordingListener interface {
+		net.Listener
+		HeaderRecorder
+	}
+	listeners := map[string]func(net.Listener) recordingListener{
+		"ProtocolMuxListener": func(base net.Listener) recordingListener {
+			return NewProtocolMuxListener(base, testServerTLSConfig)
+		},
+		"TrackingListener": func(base net.Listener) recordingListener {
+			return NewTrackingListener(base)
+		},
+	}
+
+	smuggled := "POST http://marasi.app/ HTTP/1.1\r\nHost: marasi.app\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	duplicate := "POST http://marasi.app/ HTTP/1.1\r\nHost: marasi.app\r\nContent-Length: 4\r\nContent-Length: 4\r\n\r\nbody"
+
+	for name, newListener := range listeners {
+		t.Run(name+" should return the raw headers of each request read from the connection", func(t *testing.T) {
+			baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to create listener : %v", err)
+			}
+			defer baseListener.Close()
+			recorder := newListener(baseListener)
+
+			clientConn, err := net.Dial("tcp", baseListener.Addr().String())
+			if err != nil {
+				t.Fatalf("client failed to dial: %v", err)
+			}
+			defer clientConn.Close()
+			if _, err := clientConn.Write([]byte(smuggled + duplicate)); err != nil {
+				t.Fatalf("client write failed : %v", err)
+			}
+
+			conn, err := recorder.Accept()
+			if err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+			for _, raw := range []string{smuggled, duplicate} {
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+				}
+				io.Copy(io.Discard, req.Body)
+
+				requestLine := req.Method + " " + req.RequestURI + " " + req.Proto
+				got, ok := recorder.RawHeader(conn.RemoteAddr().String(), requestLine)
+				if !ok {
+					t.Fatalf("\nwanted:\nraw header of %q\ngot:\nnone", requestLine)
+				}
+				want, _, _ := strings.Cut(raw, "\r\n\r\n")
+				want += "\r\n\r\n"
+				if string(got) != want {
+					t.Errorf("\nwanted:\n%q\ngot:\n%q", want, got)
+				}
+			}
+
+			if _, ok := recorder.RawHeader(conn.RemoteAddr().String(), "POST http://marasi.app/ HTTP/1.1"); ok {
+				t.Errorf("\nwanted:\nno raw header once every request was taken\ngot:\nraw header")
+			}
+		})
+	}
+
+	t.Run("ProtocolMuxListener should not record TLS connections", func(t *testing.T) {
+		testServerTLSConfig, testClientTLSConfig := generateTestTLSConfig(t)
+		baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to create listener : %v", err)
+		}
+		defer baseListener.Close()
+		muxListener := NewProtocolMuxListener(baseListener, testServerTLSConfig)
+
+		go func() {
+			clientConn, err := tls.Dial("tcp", baseListener.Addr().String(), testClientTLSConfig)
+			if err != nil {
+				return
+			}
+			defer clientConn.Close()
+			clientConn.Write([]byte(duplicate))
+			io.Copy(io.Discard, clientConn)
+		}()
+
+		conn, err := muxListener.Accept()
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		requestLine := req.Method + " " + req.RequestURI + " " + req.Proto
+		if _, ok := muxListener.RawHeader(conn.RemoteAddr().String(), requestLine); ok {
+			t.Errorf("\nwanted:\nno raw header\ngot:\nraw header")
+		}
+	})
+}
+
+// waitClosed reads from conn until the server closed it, it returns an error if the connection is still open after 5 seconds
+func waitClosed(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return err
+	}
+	return nil
+}
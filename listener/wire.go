@@ -0,0 +1,74 @@
+package listener
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxWireBuffer is the number of bytes a connection keeps for the header lookups, older bytes such as the rest of a large body are dropped
+const maxWireBuffer = 64 * 1024
+
+// wireRecorder keeps the last bytes read from a connection, so the raw header block of a request can be looked up after net/http
+// parsed it. net/http drops the Content-Length of chunked requests, merges duplicate headers and loses the header order
+type wireRecorder struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// record appends the bytes read from the connection, only the last maxWireBuffer bytes are kept
+func (w *wireRecorder) record(b []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, b...)
+	if over := len(w.buf) - maxWireBuffer; over > 0 {
+		copy(w.buf, w.buf[over:])
+		w.buf = w.buf[:maxWireBuffer]
+	}
+}
+
+// take returns the request line and headers, including the empty line ending them, of the first request that starts with requestLine.
+// The bytes up to the end of the headers are forgotten, so the next lookup starts after this request
+func (w *wireRecorder) take(requestLine string) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	line := []byte(requestLine)
+	for offset := 0; offset < len(w.buf); {
+		i := bytes.Index(w.buf[offset:], line)
+		if i < 0 {
+			return nil, false
+		}
+		start := offset + i
+		offset = start + 1
+
+		rest := w.buf[start+len(line):]
+		atLineStart := start == 0 || w.buf[start-1] == '\n'
+		if !atLineStart || !(bytes.HasPrefix(rest, []byte("\r\n")) || bytes.HasPrefix(rest, []byte("\n"))) {
+			continue
+		}
+
+		end := headerEnd(w.buf[start:])
+		if end < 0 {
+			return nil, false
+		}
+		header := bytes.Clone(w.buf[start : start+end])
+		w.buf = append(w.buf[:0], w.buf[start+end:]...)
+		return header, true
+	}
+	return nil, false
+}
+
+// headerEnd returns the length of the header block at the start of b up to and including the empty line ending it, or -1 if it is incomplete
+func headerEnd(b []byte) int {
+	for pos := 0; ; {
+		i := bytes.IndexByte(b[pos:], '\n')
+		if i < 0 {
+			return -1
+		}
+		line := b[pos : pos+i]
+		pos += i + 1
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return pos
+		}
+	}
+}
@@ -3,6 +3,8 @@ package marasi
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,12 +13,16 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/andybalholm/brotli"
 	"github.com/google/martian"
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/core"
+	"github.com/tfkr-ae/marasi/domain"
+	"github.com/tfkr-ae/marasi/listener"
 	"github.com/tfkr-ae/marasi/rawhttp"
 )
 
@@ -58,6 +64,9 @@ var (
 
 	// ErrReadBody is returned when there is an error with reading the response body
 	ErrReadBody = errors.New("failed to read the body")
+
+	// ErrHandlerPanic is returned when the OnRequest / OnResponse handler panics
+	ErrHandlerPanic = errors.New("handler panicked")
 )
 
 // RequestModifierFunc is a signature for HTTP request modifiers, it takes in the request and *Proxy
@@ -145,7 +154,7 @@ func getHostPort(req *http.Request) string {
 	return net.JoinHostPort(host, port)
 }
 
-// PreventLoopModifier skips processing a request if it is made to marasi's active listener address and port, preventing an infinite loop
+// PreventLoopModifier skips processing a request if it is made to any of marasi's listener addresses, preventing an infinite loop
 // It will normalize localhost & 127.0.0.1 when checking the host and port
 func PreventLoopModifier(proxy *Proxy, req *http.Request) error {
 	host, port, err := net.SplitHostPort(req.Host)
@@ -165,26 +174,162 @@ func PreventLoopModifier(proxy *Proxy, req *http.Request) error {
 		host = "127.0.0.1"
 	}
 
-	listenerAddr := proxy.Addr
-	if listenerAddr == "localhost" {
-		listenerAddr = "127.0.0.1"
-	}
+	listenAddrs := append([]string{net.JoinHostPort(proxy.Addr, proxy.Port)}, proxy.ListenAddrs...)
+	for _, listenAddr := range listenAddrs {
+		listenerHost, listenerPort, err := net.SplitHostPort(listenAddr)
+		if err != nil {
+			continue
+		}
+		if listenerHost == "localhost" {
+			listenerHost = "127.0.0.1"
+		}
 
-	if host == listenerAddr && port == proxy.Port {
-		martian.NewContext(req).SkipRoundTrip()
-		return ErrSkipPipeline
+		if host == listenerHost && port == listenerPort {
+			martian.NewContext(req).SkipRoundTrip()
+			return proxy.skipped(req, "prevent_loop", "request to the proxy listener")
+		}
 	}
 	return nil
 }
 
-// SkipConnectRequestModifier will skip processing for CONNECT requests
+// SkipConnectRequestModifier will skip processing for CONNECT requests, the proxy's OnConnect handler
+// is called with the tunnel's target host before skipping
 func SkipConnectRequestModifier(proxy *Proxy, req *http.Request) error {
 	if req.Method == http.MethodConnect {
-		return ErrSkipPipeline
+		if proxy.OnConnect != nil {
+			proxy.OnConnect(req.Host, req)
+		}
+		return proxy.skipped(req, "skip_connect", "CONNECT request")
 	}
 	return nil
 }
 
+// proxyAuthSessionKey is the martian session key for the username of an authenticated CONNECT tunnel,
+// requests sent through the tunnel do not carry the Proxy-Authorization header
+const proxyAuthSessionKey = "marasi_proxy_auth_user"
+
+// ProxyAuthRequestModifier removes the hop-by-hop Proxy-Authorization and Proxy-Connection headers so they are not sent upstream.
+// When `proxy.ProxyCredentials` is set, the basic authentication credentials of the header are checked first. Requests with
+// missing or wrong credentials receive a 407 response and are dropped, authenticated requests have the username added to the context.
+// The authentication of a CONNECT request is stored in the martian session and applies to the requests sent through the tunnel
+func ProxyAuthRequestModifier(proxy *Proxy, req *http.Request) error {
+	authorization := req.Header.Get("Proxy-Authorization")
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+
+	if proxy.ProxyCredentials == nil {
+		return nil
+	}
+
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return ErrSessionContext
+	}
+	session := ctx.Session()
+
+	if username, ok := session.Get(proxyAuthSessionKey); ok {
+		*req = *core.ContextWithProxyAuthUser(req, username.(string))
+		return nil
+	}
+
+	if username, ok := checkProxyAuthorization(proxy.ProxyCredentials, authorization); ok {
+		if req.Method == http.MethodConnect {
+			session.Set(proxyAuthSessionKey, username)
+		}
+		*req = *core.ContextWithProxyAuthUser(req, username)
+		return nil
+	}
+
+	conn, brw, err := session.Hijack()
+	if err != nil {
+		return fmt.Errorf("hijacking session : %w", err)
+	}
+	defer conn.Close()
+
+	res := &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     http.Header{},
+		Close:      true,
+	}
+	res.Header.Set("Proxy-Authenticate", `Basic realm="marasi"`)
+	if err := res.Write(brw); err != nil {
+		return fmt.Errorf("writing proxy authentication response : %w", err)
+	}
+	if err := brw.Flush(); err != nil {
+		return fmt.Errorf("writing proxy authentication response : %w", err)
+	}
+	return proxy.dropped(req, "proxy_auth", "missing or invalid proxy credentials")
+}
+
+// checkProxyAuthorization compares the basic authentication credentials of a Proxy-Authorization header value with the
+// expected credentials, it returns the username and true if they match
+func checkProxyAuthorization(credentials *ProxyCredentials, authorization string) (string, bool) {
+	scheme, encoded, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(credentials.Username))
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(credentials.Password))
+	return username, usernameMatch&passwordMatch == 1
+}
+
+// takeRawHeader moves the raw request line and headers recorded by the listener of the proxy, and the header order they were sent in,
+// into the context. They are recorded for the plain HTTP/1 requests read by a listener.HeaderRecorder, martian decrypts the requests of
+// CONNECT tunnels after the listener.
+func (proxy *Proxy) takeRawHeader(req *http.Request) {
+	recorder, ok := proxy.listener.(listener.HeaderRecorder)
+	if !ok {
+		return
+	}
+	requestLine := fmt.Sprintf("%s %s %s", req.Method, req.RequestURI, req.Proto)
+	if raw, ok := recorder.RawHeader(req.RemoteAddr, requestLine); ok {
+		*req = *core.ContextWithRawHeader(req, raw)
+		*req = *core.ContextWithHeaderOrder(req, rawhttp.HeaderOrder(raw))
+	}
+}
+
+// takeInternalHeaders moves the x-marasi-header-order, x-marasi-sni and x-marasi-redirect-chain headers set by launchpad,
+// the request builder and proxy.Client into the request context and removes them. It runs in the base pipeline before any
+// modifier can skip the request, so the headers never reach the upstream, `SetupRequestModifier` records the values in the metadata.
+// x-marasi-header-order replaces the header order of the wire only when the request carries the x-marasi-internal token of proxy.Client,
+// the order sent by any other client is ignored.
+func takeInternalHeaders(proxy *Proxy, req *http.Request) {
+	internal := proxy.internalToken != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("x-marasi-internal")), []byte(proxy.internalToken)) == 1
+	req.Header.Del("x-marasi-internal")
+
+	if headerOrder := req.Header.Get("x-marasi-header-order"); headerOrder != "" && internal {
+		*req = *core.ContextWithHeaderOrder(req, strings.Split(headerOrder, ","))
+	}
+	req.Header.Del("x-marasi-header-order")
+
+	if sni := req.Header.Get("x-marasi-sni"); sni != "" {
+		*req = *core.ContextWithSNI(req, sni)
+	}
+	req.Header.Del("x-marasi-sni")
+
+	if chainString := req.Header.Get("x-marasi-redirect-chain"); chainString != "" {
+		var chain []any
+		if err := json.Unmarshal([]byte(chainString), &chain); err == nil {
+			*req = *core.ContextWithRedirectChain(req, chain)
+		}
+	}
+	req.Header.Del("x-marasi-redirect-chain")
+}
+
 // SetupRequestModifier initializes the request context. It will generate and set the request ID,
 // set the request time, initial and set the metadata map, and stores the Martian session. If the request is coming
 // from launchpad, it will set the launchapd ID in the context
@@ -206,6 +351,24 @@ func SetupRequestModifier(proxy *Proxy, req *http.Request) error {
 		req.Header.Del("x-launchpad-id")
 	}
 
+	// The internal headers are normally taken by the base pipeline already
+	takeInternalHeaders(proxy, req)
+
+	// The header order of the wire or, for requests coming from launchpad, of the raw request
+	if order, ok := core.HeaderOrderFromContext(req.Context()); ok {
+		metadata["header_order"] = order
+	}
+
+	// Requests from the request builder can override the server name used in the upstream TLS handshake
+	if sni, ok := core.SNIFromContext(req.Context()); ok {
+		metadata["sni"] = sni
+	}
+
+	// Requests sent by proxy.Client after following a redirect carry the redirects that led to them
+	if chain, ok := core.RedirectChainFromContext(req.Context()); ok {
+		metadata["redirect_chain"] = chain
+	}
+
 	if metadataString := req.Header.Get("x-marasi-metadata"); metadataString != "" {
 		var headerMetadata map[string]any
 
@@ -215,6 +378,14 @@ func SetupRequestModifier(proxy *Proxy, req *http.Request) error {
 		req.Header.Del("x-marasi-metadata")
 	}
 
+	// Ambiguous framing is flagged for the extensions and the UI, the request is left untouched
+	if raw, ok := core.RawHeaderFromContext(req.Context()); ok {
+		if reason, ok := smugglingSuspect(raw); ok {
+			metadata["smuggling_suspect"] = true
+			metadata["smuggling_reason"] = reason
+		}
+	}
+
 	*req = *core.ContextWithRequestID(req, uuid)
 	*req = *core.ContextWithMetadata(req, metadata)
 
@@ -224,6 +395,35 @@ func SetupRequestModifier(proxy *Proxy, req *http.Request) error {
 	return nil
 }
 
+// smugglingSuspect reports whether the raw headers of a request have an ambiguous body length that front-end and back-end servers
+// may disagree on, which is used for request smuggling: both Content-Length and Transfer-Encoding, or more than one Content-Length value.
+// The raw headers are needed as net/http drops the Content-Length of chunked requests and merges duplicate Content-Length values.
+// It returns the reason when the request is suspect.
+func smugglingSuspect(raw []byte) (string, bool) {
+	contentLengths, transferEncodings := 0, 0
+	lines := strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n")
+	for _, line := range lines[1:] {
+		name, _, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+		case "Content-Length":
+			contentLengths++
+		case "Transfer-Encoding":
+			transferEncodings++
+		}
+	}
+
+	switch {
+	case contentLengths > 0 && transferEncodings > 0:
+		return "content-length and transfer-encoding", true
+	case contentLengths > 1:
+		return "duplicate content-length", true
+	}
+	return "", false
+}
+
 // OverrideWaypointsModifier checks if a Waypoint (host override) is defined for this host:port.
 // If a waypoint exists it will write the "original_host" and "override_host" to the metadata.
 // These values are used later in the `DialContext` function. If the metadata is not found
@@ -231,7 +431,7 @@ func SetupRequestModifier(proxy *Proxy, req *http.Request) error {
 // TODO should allow TLS -> Non TLS override
 func OverrideWaypointsModifier(proxy *Proxy, req *http.Request) error {
 	if metadata, ok := core.MetadataFromContext(req.Context()); ok {
-		if override, ok := proxy.Waypoints[getHostPort(req)]; ok {
+		if override, ok := proxy.waypoint(getHostPort(req)); ok {
 			metadata["original_host"] = getHostPort(req)
 			metadata["override_host"] = override
 			*req = *core.ContextWithMetadata(req, metadata)
@@ -255,32 +455,49 @@ func CompassRequestModifier(proxy *Proxy, req *http.Request) error {
 			// Continue as a err in Lua should not bring down the proxy
 		}
 		if skip, ok := core.SkipFlagFromContext(req.Context()); ok && skip {
-			return ErrSkipPipeline
+			return proxy.skipped(req, "compass_request", proxy.compassReason("skipped", req))
 		}
 
 		if dropped, ok := core.DroppedFlagFromContext(req.Context()); ok && dropped {
 			martian.NewContext(req).SkipRoundTrip()
-			return ErrDropped
+			return proxy.dropped(req, "compass_request", proxy.compassReason("dropped", req))
 		}
 		return nil
 	}
 	return ErrExtensionNotFound
 }
 
+// compassReason returns the reason passed to OnSkip and OnDrop for a request or response skipped or dropped by compass.
+// When the proxy scope puts it out of scope, the reason explains which rule or default decided it.
+func (proxy *Proxy) compassReason(action string, input any) string {
+	reason := action + " by compass"
+	if scope, err := proxy.GetScope(); err == nil {
+		if result := scope.MatchesDetailed(input); !result.InScope {
+			reason = fmt.Sprintf("%s, %s", reason, result)
+		}
+	}
+	return reason
+}
+
 // ExtensionsRequestModifier will run the `processRequest` function (if it is defined) for all the loaded extensions (except compass and checkpoint).
 // Initially the modifier will check if the request originated from an extension by reading the "x-extension-id" header. This extension ID
 // will be set in the context so that the response modifier will be able to read it.
+// The names of the extensions that define `processRequest` are recorded in the `extensions_ran` metadata before their handler runs.
 // After processRequest, it will check if the request is passed through (nil), skipped (`ErrSkipPipeline`), or dropped (`ErrDropped`).
 func ExtensionsRequestModifier(proxy *Proxy, req *http.Request) error {
 	extensionID := req.Header.Get("x-extension-id")
 	*req = *core.ContextWithExtensionID(req, extensionID)
+	origin := proxy.originExtension(extensionID)
 
 	// header is removed after processing
 	req.Header.Del("x-extension-id")
 
-	for _, ext := range proxy.Extensions {
+	for _, ext := range proxy.loadedExtensions() {
 		if ext.Data.Name != "checkpoint" && ext.Data.Name != "compass" {
-			if extensionID != ext.Data.ID.String() {
+			if ext != origin {
+				if ext.CheckGlobalFunction("processRequest") {
+					recordExtensionRan(req, ext.Data.Name)
+				}
 				err := ext.CallRequestHandler(req)
 				if err != nil {
 					proxy.WriteLog("ERROR", fmt.Sprintf("Running processRequest : %s", err.Error()), core.LogWithExtensionID(ext.Data.ID))
@@ -288,12 +505,12 @@ func ExtensionsRequestModifier(proxy *Proxy, req *http.Request) error {
 				}
 
 				if skip, ok := core.SkipFlagFromContext(req.Context()); ok && skip {
-					return ErrSkipPipeline
+					return proxy.skipped(req, "extensions_request", fmt.Sprintf("skipped by extension %s", ext.Data.Name))
 				}
 
 				if dropped, ok := core.DroppedFlagFromContext(req.Context()); ok && dropped {
 					martian.NewContext(req).SkipRoundTrip()
-					return ErrDropped
+					return proxy.dropped(req, "extensions_request", fmt.Sprintf("dropped by extension %s", ext.Data.Name))
 				}
 
 			}
@@ -307,8 +524,15 @@ func ExtensionsRequestModifier(proxy *Proxy, req *http.Request) error {
 // rebuilt with the same context and metadata from the modified raw request. The metadata will be updated to include "intercepted", "original-request", and "dropped" based
 // on the user action. If the modifier receives `ShouldInterceptResponse` the flag is added to the context so that the
 // response is intercepted regardless of the `processResponse` or `proxy.InterceptFlag`
+// When `proxy.InterceptMethods` is not empty, requests with other methods are never intercepted
 func CheckpointRequestModifier(proxy *Proxy, req *http.Request) error {
 	if checkpointExt, ok := proxy.GetExtension("checkpoint"); ok {
+		if len(proxy.InterceptMethods) > 0 && !slices.ContainsFunc(proxy.InterceptMethods, func(method string) bool {
+			return strings.EqualFold(method, req.Method)
+		}) {
+			return nil
+		}
+
 		shouldIntercept, err := checkpointExt.ShouldInterceptRequest(req)
 		if err != nil {
 			if reqID, ok := core.RequestIDFromContext(req.Context()); ok {
@@ -336,7 +560,7 @@ func CheckpointRequestModifier(proxy *Proxy, req *http.Request) error {
 			if proxy.OnIntercept == nil {
 				proxy.WriteLog("ERROR", "Request intercepted but OnIntercept is not defined. Dropping request")
 				martian.NewContext(req).SkipRoundTrip()
-				return ErrDropped
+				return proxy.dropped(req, "checkpoint_request", "OnIntercept is not defined")
 			}
 
 			proxy.OnIntercept(&interceptedRequest)
@@ -356,7 +580,7 @@ func CheckpointRequestModifier(proxy *Proxy, req *http.Request) error {
 
 			if !userAction.Resume {
 				martian.NewContext(req).SkipRoundTrip()
-				return ErrDropped
+				return proxy.dropped(req, "checkpoint_request", "dropped by the user")
 			}
 
 			if userAction.ShouldInterceptResponse {
@@ -381,28 +605,96 @@ func CheckpointRequestModifier(proxy *Proxy, req *http.Request) error {
 // It will create a `ProxyRequest` struct and queue it for database insertion.
 // If the request came from launchpad, it will create a `LaunchpadRequest` struct and queue it for database insertion as well.
 // If the `proxy.OnRequest` handler is defined, it will be called with the `ProxyRequest` otherwise the modifier will return `ErrRequestHandlerUndefined`
+// A panic in the handler is logged and returned as `ErrHandlerPanic`, the request is still written to the DB
 func WriteRequestModifier(proxy *Proxy, req *http.Request) error {
 	if reqID, ok := core.RequestIDFromContext(req.Context()); ok {
 		proxyRequest, err := NewProxyRequest(req, reqID)
 		if err != nil {
 			return fmt.Errorf("%w : %w", ErrProxyRequest, err)
 		}
-		proxy.DBWriteChannel <- proxyRequest
+		proxy.queueDBWrite(proxyRequest)
 		if proxy.OnRequest == nil {
 			return ErrRequestHandlerUndefined
 		} else {
-			proxy.OnRequest(*proxyRequest)
+			if err := recoverHandler(func() { proxy.OnRequest(*proxyRequest) }); err != nil {
+				proxy.handlerPanicked(req, "OnRequest", reqID, err)
+				return err
+			}
 			return nil
 		}
 	}
 	return ErrRequestIDNotFound
 }
 
+// dropped calls proxy.OnDrop with the ID of the request dropped at stage and returns `ErrDropped`.
+// The ID is uuid.Nil when the request is dropped before SetupRequestModifier assigned it.
+func (proxy *Proxy) dropped(req *http.Request, stage string, reason string) error {
+	if proxy.OnDrop != nil {
+		reqID, _ := core.RequestIDFromContext(req.Context())
+		proxy.OnDrop(reqID, stage, reason)
+	}
+	return ErrDropped
+}
+
+// skipped calls proxy.OnSkip with the ID of the request skipped at stage and returns `ErrSkipPipeline`.
+// The ID is uuid.Nil when the request is skipped before SetupRequestModifier assigned it.
+func (proxy *Proxy) skipped(req *http.Request, stage string, reason string) error {
+	if proxy.OnSkip != nil {
+		reqID, _ := core.RequestIDFromContext(req.Context())
+		proxy.OnSkip(reqID, stage, reason)
+	}
+	return ErrSkipPipeline
+}
+
+// recordExtensionRan adds the extension name to the `extensions_ran` metadata of the request, each name is recorded once.
+func recordExtensionRan(req *http.Request, name string) {
+	metadata, ok := core.MetadataFromContext(req.Context())
+	if !ok {
+		return
+	}
+	ran, _ := metadata["extensions_ran"].([]string)
+	if !slices.Contains(ran, name) {
+		metadata["extensions_ran"] = append(ran, name)
+	}
+	*req = *core.ContextWithMetadata(req, metadata)
+}
+
+// recoverHandler runs a user supplied handler and returns `ErrHandlerPanic` if it panics.
+// This prevents a panicking `OnRequest` / `OnResponse` handler from taking down the request goroutine
+func recoverHandler(handler func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w : %v", ErrHandlerPanic, r)
+		}
+	}()
+	handler()
+	return nil
+}
+
+// handlerPanicked reports a panic recovered from the handler through the proxy logs, so it reaches `proxy.OnLog` like any other error.
+// The log is associated with the request ID and, if the request was sent by an extension, with the extension ID.
+func (proxy *Proxy) handlerPanicked(req *http.Request, handler string, reqID uuid.UUID, err error) {
+	options := []func(*domain.Log) error{
+		core.LogWithReqResID(reqID),
+		core.LogWithContext(map[string]any{"handler": handler}),
+	}
+	if extensionID, ok := core.ExtensionIDFromContext(req.Context()); ok {
+		if id, err := uuid.Parse(extensionID); err == nil {
+			options = append(options, core.LogWithExtensionID(id))
+		}
+	}
+	proxy.WriteLog("ERROR", fmt.Sprintf("Running %s : %s", handler, err.Error()), options...)
+}
+
 // ResponseFilterModifier will perform an initial filtering round on responses.
 // It will skip processing for responses to CONNECT requests, responses where the skip flag was set, or SkipRoundTrip is true.
 // It will also add the response time to the context
 func ResponseFilterModifier(proxy *Proxy, res *http.Response) error {
-	if res.Request.Method == http.MethodConnect || martian.NewContext(res.Request).SkippingRoundTrip() {
+	if res.Request.Method == http.MethodConnect {
+		return ErrSkipPipeline
+	}
+	// The martian context is missing for responses that are not served by martian (e.g. during Shutdown)
+	if ctx := martian.NewContext(res.Request); ctx != nil && ctx.SkippingRoundTrip() {
 		return ErrSkipPipeline
 	}
 	if skip, ok := core.SkipFlagFromContext(res.Request.Context()); ok && skip {
@@ -412,10 +704,36 @@ func ResponseFilterModifier(proxy *Proxy, res *http.Response) error {
 	return nil
 }
 
+// TLSInfoResponseModifier records the negotiated upstream TLS parameters (version, cipher suite, ALPN and session resumption)
+// in the metadata under the "tls" key. Responses received over plain HTTP are left untouched.
+func TLSInfoResponseModifier(proxy *Proxy, res *http.Response) error {
+	if res.TLS == nil {
+		return nil
+	}
+	if metadata, ok := core.MetadataFromContext(res.Request.Context()); ok {
+		metadata["tls"] = core.TLSInfo(res.TLS)
+		res.Request = core.ContextWithMetadata(res.Request, metadata)
+		return nil
+	}
+	return ErrMetadataNotFound
+}
+
 // BufferStreamingBodyModifier reads the entire streaming response body into memory
 // and replaces the `res.Body` with a new `io.NopCloser` on the full body. It will
 // remove the `Transfer-Encoding` and update the `Content-Length` to reflect the new body.
+// Event streams that never end (see `isEventStream`) are not buffered, they are marked with `streamed` in the metadata
+// and continue through the pipeline with the original body. Checkpoint and the DB write only record their headers,
+// extensions reading the body of a streamed response block until the stream ends.
+// When `proxy.PreserveChunkedEncoding` is set, chunked responses are marked with `chunked` in the metadata for `RechunkResponseModifier`.
 func BufferStreamingBodyModifier(proxy *Proxy, res *http.Response) error {
+	if isEventStream(res) {
+		if metadata, ok := core.MetadataFromContext(res.Request.Context()); ok {
+			metadata["streamed"] = true
+			res.Request = core.ContextWithMetadata(res.Request, metadata)
+		}
+		return nil
+	}
+
 	defer res.Body.Close()
 
 	responseBody, err := io.ReadAll(res.Body)
@@ -423,6 +741,13 @@ func BufferStreamingBodyModifier(proxy *Proxy, res *http.Response) error {
 		return fmt.Errorf("%w : %w", ErrReadBody, err)
 	}
 
+	if proxy.PreserveChunkedEncoding && slices.Contains(res.TransferEncoding, "chunked") && res.Request != nil {
+		if metadata, ok := core.MetadataFromContext(res.Request.Context()); ok {
+			metadata["chunked"] = true
+			res.Request = core.ContextWithMetadata(res.Request, metadata)
+		}
+	}
+
 	res.Body = io.NopCloser(bytes.NewReader(responseBody))
 	res.ContentLength = int64(len(responseBody))
 	res.Header.Set("Content-Length", fmt.Sprintf("%d", len(responseBody)))
@@ -430,6 +755,51 @@ func BufferStreamingBodyModifier(proxy *Proxy, res *http.Response) error {
 	return nil
 }
 
+// RechunkResponseModifier restores the chunked transfer encoding on responses that were buffered by `BufferStreamingBodyModifier`
+// when `proxy.PreserveChunkedEncoding` is set. The `Content-Length` is removed so the response is re-emitted chunked to the client.
+func RechunkResponseModifier(proxy *Proxy, res *http.Response) error {
+	if !proxy.PreserveChunkedEncoding || res.Request == nil {
+		return nil
+	}
+	metadata, ok := core.MetadataFromContext(res.Request.Context())
+	if !ok {
+		return nil
+	}
+	if chunked, _ := metadata["chunked"].(bool); !chunked {
+		return nil
+	}
+	res.TransferEncoding = []string{"chunked"}
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	return nil
+}
+
+// isStreamed checks if the response was marked as `streamed` by `BufferStreamingBodyModifier`.
+func isStreamed(res *http.Response) bool {
+	if res.Request == nil {
+		return false
+	}
+	metadata, ok := core.MetadataFromContext(res.Request.Context())
+	if !ok {
+		return false
+	}
+	streamed, _ := metadata["streamed"].(bool)
+	return streamed
+}
+
+// isEventStream checks if the response is a stream that should not be buffered.
+// This covers Server-Sent Events (text/event-stream) and responses that disable proxy buffering with `X-Accel-Buffering: no`.
+func isEventStream(res *http.Response) bool {
+	if res.Body == nil || res.Body == http.NoBody {
+		return false
+	}
+	if strings.EqualFold(res.Header.Get("X-Accel-Buffering"), "no") {
+		return true
+	}
+	mediaType, err := parseContentType(res.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
 // CompressedResponseModifier decompresses the response bodies and replaces the `res.Body`
 // with the decompressed data. It will remove the "Content-Encoding" header and update the "Content-Length" to the new length.
 // Currently the modifier handles gzip and br compressed bodies.
@@ -476,6 +846,29 @@ func CompressedResponseModifier(proxy *Proxy, res *http.Response) error {
 	return nil
 }
 
+// DecompressBeforeExtensionsModifier runs `CompressedResponseModifier` when `proxy.DecompressBeforeExtensions` is set,
+// guaranteeing that the extensions see the decompressed body.
+func DecompressBeforeExtensionsModifier(proxy *Proxy, res *http.Response) error {
+	if !proxy.DecompressBeforeExtensions {
+		return nil
+	}
+	return CompressedResponseModifier(proxy, res)
+}
+
+// DecompressAfterExtensionsModifier runs `CompressedResponseModifier` when `proxy.DecompressBeforeExtensions` is not set,
+// so the extensions see the compressed body while checkpoint and the database still get the decompressed one.
+// If the body can no longer be decompressed, `ErrCompressedBodyModified` is returned as an extension replaced the body
+// without removing the Content-Encoding header.
+func DecompressAfterExtensionsModifier(proxy *Proxy, res *http.Response) error {
+	if proxy.DecompressBeforeExtensions {
+		return nil
+	}
+	if err := CompressedResponseModifier(proxy, res); err != nil {
+		return fmt.Errorf("%w : %w", ErrCompressedBodyModified, err)
+	}
+	return nil
+}
+
 // CompassResponseModifier will run the `processResponse` function in the compass extension to determine if the response is in scope.
 // After `processResponse`, it will check if the response is passed through (nil), skipped (`ErrSkipPipeline`), or dropped (`ErrDropped`).
 // If the compass extension is not found the modifier will return `ErrExtensionNotFound` as "compass" is considered a core extension.
@@ -487,11 +880,11 @@ func CompassResponseModifier(proxy *Proxy, res *http.Response) error {
 			// Continue as a err in Lua should not bring down the proxy
 		}
 		if skip, ok := core.SkipFlagFromContext(res.Request.Context()); ok && skip {
-			return ErrSkipPipeline
+			return proxy.skipped(res.Request, "compass_response", proxy.compassReason("skipped", res))
 		}
 
 		if dropped, ok := core.DroppedFlagFromContext(res.Request.Context()); ok && dropped {
-			return ErrDropped
+			return proxy.dropped(res.Request, "compass_response", proxy.compassReason("dropped", res))
 		}
 		return nil
 	}
@@ -500,11 +893,18 @@ func CompassResponseModifier(proxy *Proxy, res *http.Response) error {
 
 // ExtensionsResponseModifier will run the `processResponse` function (if it is defined) for all the loaded extensions (except compass and checkpoint).
 // The modifier will check if the extension ID in request context matches the current extension and skip execution if it does.
+// Like ExtensionsRequestModifier, the names of the extensions that define `processResponse` are added to the `extensions_ran` metadata.
 // After `processResponse`, it will check if the request is passed through (nil), skipped (`ErrSkipPipeline`), or dropped (`ErrDropped`).
 func ExtensionsResponseModifier(proxy *Proxy, res *http.Response) error {
-	for _, ext := range proxy.Extensions {
+	extensionID, _ := core.ExtensionIDFromContext(res.Request.Context())
+	origin := proxy.originExtension(extensionID)
+
+	for _, ext := range proxy.loadedExtensions() {
 		if ext.Data.Name != "checkpoint" && ext.Data.Name != "compass" {
-			if extensionID, ok := core.ExtensionIDFromContext(res.Request.Context()); !ok || extensionID != ext.Data.ID.String() {
+			if ext != origin {
+				if ext.CheckGlobalFunction("processResponse") {
+					recordExtensionRan(res.Request, ext.Data.Name)
+				}
 				err := ext.CallResponseHandler(res)
 				if err != nil {
 					proxy.WriteLog("ERROR", fmt.Sprintf("Running processResponse : %s", err.Error()), core.LogWithExtensionID(ext.Data.ID))
@@ -512,11 +912,11 @@ func ExtensionsResponseModifier(proxy *Proxy, res *http.Response) error {
 				}
 
 				if skip, ok := core.SkipFlagFromContext(res.Request.Context()); ok && skip {
-					return ErrSkipPipeline
+					return proxy.skipped(res.Request, "extensions_response", fmt.Sprintf("skipped by extension %s", ext.Data.Name))
 				}
 
 				if dropped, ok := core.DroppedFlagFromContext(res.Request.Context()); ok && dropped {
-					return ErrDropped
+					return proxy.dropped(res.Request, "extensions_response", fmt.Sprintf("dropped by extension %s", ext.Data.Name))
 				}
 
 			}
@@ -543,7 +943,9 @@ func CheckpointResponseModifier(proxy *Proxy, res *http.Response) error {
 		}
 
 		if interceptFlag, ok := core.InterceptFlagFromContext(res.Request.Context()); (ok && interceptFlag) || shouldIntercept || proxy.InterceptFlag {
-			original, err := httputil.DumpResponse(res, true)
+			// Only the headers of a streamed response can be edited, the stream is kept as the body
+			streamed := isStreamed(res)
+			original, err := httputil.DumpResponse(res, !streamed)
 			if err != nil {
 				return fmt.Errorf("getting raw response for intercept : %w", err)
 			}
@@ -557,7 +959,7 @@ func CheckpointResponseModifier(proxy *Proxy, res *http.Response) error {
 
 			if proxy.OnIntercept == nil {
 				proxy.WriteLog("ERROR", "Response intercepted but OnIntercept is not defined. Dropping response")
-				return ErrDropped
+				return proxy.dropped(res.Request, "checkpoint_response", "OnIntercept is not defined")
 			}
 
 			proxy.OnIntercept(&interceptedResponse)
@@ -576,13 +978,18 @@ func CheckpointResponseModifier(proxy *Proxy, res *http.Response) error {
 			}
 
 			if !userAction.Resume {
-				return ErrDropped
+				return proxy.dropped(res.Request, "checkpoint_response", "dropped by the user")
 			}
 
 			rebuiltRes, err := rawhttp.RebuildResponse([]byte(interceptedResponse.Raw), res.Request)
 			if err != nil {
 				return fmt.Errorf("%w : %w", ErrRebuildResponse, err)
 			}
+			if streamed {
+				rebuiltRes.Body = res.Body
+				rebuiltRes.ContentLength = res.ContentLength
+				rebuiltRes.TransferEncoding = res.TransferEncoding
+			}
 
 			*res = *rebuiltRes
 
@@ -595,17 +1002,25 @@ func CheckpointResponseModifier(proxy *Proxy, res *http.Response) error {
 
 // WriteResponseModifier is the final modifier in the default response pipeline.
 // It will create a `ProxyResponse` struct and queue it for database insertion.
+// Bodies with a content type outside of `proxy.PersistBodyContentTypes` are replaced with a placeholder, the in-flight response is not changed.
 // If the `proxy.OnResponse` handler is defined, it will be called with the `ProxyResponse` otherwise the modifier will return `ErrResponseHandlerUndefined`
+// A panic in the handler is logged and returned as `ErrHandlerPanic`, the response is still written to the DB
 func WriteResponseModifier(proxy *Proxy, res *http.Response) error {
 	proxyResponse, err := NewProxyResponse(res)
 	if err != nil {
 		return fmt.Errorf("%w : %w", ErrProxyResponse, err)
 	}
-	proxy.DBWriteChannel <- proxyResponse
+	if !proxy.persistBody(proxyResponse.ContentType) {
+		skipResponseBody(proxyResponse)
+	}
+	proxy.queueDBWrite(proxyResponse)
 	if proxy.OnResponse == nil {
 		return ErrResponseHandlerUndefined
 	} else {
-		proxy.OnResponse(*proxyResponse)
+		if err := recoverHandler(func() { proxy.OnResponse(*proxyResponse) }); err != nil {
+			proxy.handlerPanicked(res.Request, "OnResponse", proxyResponse.ID, err)
+			return err
+		}
 		return nil
 	}
 }
@@ -1,14 +1,20 @@
 package marasi
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
@@ -16,6 +22,7 @@ import (
 
 	"github.com/andybalholm/brotli"
 	"github.com/google/martian"
+	"github.com/google/martian/mitm"
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/compass"
 	"github.com/tfkr-ae/marasi/core"
@@ -410,6 +417,61 @@ func TestPreventLoopModifier(t *testing.T) {
 			t.Fatalf("wanted: True\ngot: %t", ctx.SkippingRoundTrip())
 		}
 	})
+
+	t.Run("requests to any of the bound addresses should fail", func(t *testing.T) {
+		proxy := newTestProxy(t)
+		proxy.Client = &http.Client{}
+
+		l, err := proxy.GetListeners("127.0.0.1:0", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		defer l.Close()
+
+		if len(proxy.ListenAddrs) != 2 {
+			t.Fatalf("wanted: 2 listen addresses\ngot: %v", proxy.ListenAddrs)
+		}
+
+		for _, listenAddr := range proxy.ListenAddrs {
+			_, port, _ := net.SplitHostPort(listenAddr)
+			for _, host := range []string{"127.0.0.1", "localhost"} {
+				req := httptest.NewRequest(http.MethodGet, "http://"+net.JoinHostPort(host, port)+"/path", nil)
+				ctx, remove, err := martian.TestContext(req, nil, nil)
+				if err != nil {
+					t.Fatalf("applying martian context : %v", err)
+				}
+				err = PreventLoopModifier(proxy, req)
+				remove()
+				if !errors.Is(err, ErrSkipPipeline) {
+					t.Fatalf("wanted: %q\ngot: %v", ErrSkipPipeline, err)
+				}
+				if !ctx.SkippingRoundTrip() {
+					t.Fatalf("wanted: True\ngot: %t", ctx.SkippingRoundTrip())
+				}
+			}
+		}
+	})
+
+	t.Run("request to an unbound port with multiple listen addresses should work", func(t *testing.T) {
+		proxy := &Proxy{
+			Addr:        "127.0.0.1",
+			Port:        "8080",
+			ListenAddrs: []string{"127.0.0.1:8080", "192.168.1.10:9090"},
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://192.168.1.10:8080/path", nil)
+		ctx, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+		err = PreventLoopModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if ctx.SkippingRoundTrip() {
+			t.Fatalf("wanted: False\ngot: %t", ctx.SkippingRoundTrip())
+		}
+	})
 }
 
 func TestSkipConnectModifier(t *testing.T) {
@@ -435,6 +497,46 @@ func TestSkipConnectModifier(t *testing.T) {
 			t.Fatalf("wanted: nil\ngot: %q", err)
 		}
 	})
+
+	t.Run("CONNECT request should call the OnConnect handler with the target host", func(t *testing.T) {
+		var gotHost string
+		var gotReq *http.Request
+		proxy := &Proxy{
+			OnConnect: func(host string, req *http.Request) {
+				gotHost = host
+				gotReq = req
+			},
+		}
+		req := httptest.NewRequest(http.MethodConnect, "marasi.app:443", nil)
+
+		err := SkipConnectRequestModifier(proxy, req)
+		if !errors.Is(err, ErrSkipPipeline) {
+			t.Fatalf("wanted: %q\ngot: %v", ErrSkipPipeline, err)
+		}
+		if gotHost != "marasi.app:443" {
+			t.Fatalf("wanted: %q\ngot: %q", "marasi.app:443", gotHost)
+		}
+		if gotReq != req {
+			t.Fatalf("wanted: %p\ngot: %p", req, gotReq)
+		}
+	})
+
+	t.Run("non CONNECT request should not call the OnConnect handler", func(t *testing.T) {
+		called := false
+		proxy := &Proxy{
+			OnConnect: func(host string, req *http.Request) {
+				called = true
+			},
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+
+		if err := SkipConnectRequestModifier(proxy, req); err != nil {
+			t.Fatalf("wanted: nil\ngot: %q", err)
+		}
+		if called {
+			t.Fatalf("wanted: OnConnect not called\ngot: called")
+		}
+	})
 }
 
 func TestCompassRequestModifier(t *testing.T) {
@@ -509,6 +611,28 @@ func TestCompassRequestModifier(t *testing.T) {
 		}
 	})
 
+	t.Run("request should be matched against the scope replaced with SetScope", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["compass"])
+		proxy.SetScope(compass.NewScope(false))
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		err = CompassRequestModifier(proxy, req)
+
+		if !errors.Is(err, ErrSkipPipeline) {
+			t.Fatalf("wanted: %q\ngot: %v", ErrSkipPipeline, err)
+		}
+
+		if skip, ok := core.SkipFlagFromContext(req.Context()); !ok || !skip {
+			t.Errorf("expected skipflag to be set in context and to be equal to true")
+		}
+	})
+
 	t.Run("request that matches blocked rule should be dropped when :drop() method is used", func(t *testing.T) {
 		proxy := newTestProxy(t, testExtensions["compass"])
 		updateExtension(t, proxy, "compass", `
@@ -544,6 +668,39 @@ func TestCompassRequestModifier(t *testing.T) {
 		}
 	})
 
+	t.Run("request skipped by compass should call OnSkip with the compass stage", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["compass"])
+		var gotStage, gotReason string
+		skips := 0
+		proxy.OnSkip = func(reqID uuid.UUID, stage string, reason string) {
+			skips++
+			gotStage, gotReason = stage, reason
+		}
+		proxy.OnDrop = func(reqID uuid.UUID, stage string, reason string) {
+			t.Errorf("expected OnDrop to not be called, got %s : %s", stage, reason)
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://www.blocked.com/examplePage", nil)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		err = CompassRequestModifier(proxy, req)
+		if !errors.Is(err, ErrSkipPipeline) {
+			t.Fatalf("wanted: %q\ngot: %v", ErrSkipPipeline, err)
+		}
+
+		if skips != 1 {
+			t.Fatalf("wanted: 1 OnSkip call\ngot: %d", skips)
+		}
+		wantReason := `skipped by compass, in scope: false (exclude rule "blocked\\.com|host" matched "www.blocked.com")`
+		if gotStage != "compass_request" || gotReason != wantReason {
+			t.Errorf("wanted: compass_request : %s\ngot: %s : %s", wantReason, gotStage, gotReason)
+		}
+	})
+
 	t.Run("CompassRequestModifier should return an error if the proxy has no compass extension configured", func(t *testing.T) {
 		proxy := newTestProxy(t)
 		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
@@ -560,6 +717,134 @@ func TestCompassRequestModifier(t *testing.T) {
 	})
 }
 
+func TestProxyAuthRequestModifier(t *testing.T) {
+	credentials := &ProxyCredentials{Username: "tester", Password: "secret"}
+	basicAuth := func(username string, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	t.Run("proxy headers should be removed without configured credentials", func(t *testing.T) {
+		proxy := &Proxy{}
+		req := httptest.NewRequest(http.MethodGet, "http://marasi.app", nil)
+		req.Header.Set("Proxy-Authorization", basicAuth("tester", "secret"))
+		req.Header.Set("Proxy-Connection", "keep-alive")
+
+		if err := ProxyAuthRequestModifier(proxy, req); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		for _, header := range []string{"Proxy-Authorization", "Proxy-Connection"} {
+			if got := req.Header.Get(header); got != "" {
+				t.Errorf("wanted: %s to be removed\ngot: %q", header, got)
+			}
+		}
+		if _, ok := core.ProxyAuthUserFromContext(req.Context()); ok {
+			t.Errorf("wanted: no proxy auth user in context")
+		}
+	})
+
+	t.Run("request with matching credentials should be authenticated and have the header removed", func(t *testing.T) {
+		proxy := &Proxy{ProxyCredentials: credentials}
+		req := httptest.NewRequest(http.MethodGet, "http://marasi.app", nil)
+		req.Header.Set("Proxy-Authorization", basicAuth("tester", "secret"))
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context: %v", err)
+		}
+		defer remove()
+
+		if err := ProxyAuthRequestModifier(proxy, req); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if got := req.Header.Get("Proxy-Authorization"); got != "" {
+			t.Errorf("wanted: Proxy-Authorization to be removed\ngot: %q", got)
+		}
+		if got, _ := core.ProxyAuthUserFromContext(req.Context()); got != "tester" {
+			t.Errorf("wanted: %q\ngot: %q", "tester", got)
+		}
+	})
+
+	t.Run("request with wrong credentials should receive a 407 and be dropped", func(t *testing.T) {
+		proxy := &Proxy{ProxyCredentials: credentials}
+		req := httptest.NewRequest(http.MethodGet, "http://marasi.app", nil)
+		req.Header.Set("Proxy-Authorization", basicAuth("tester", "wrong"))
+
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		brw := bufio.NewReadWriter(bufio.NewReader(serverConn), bufio.NewWriter(serverConn))
+
+		_, remove, err := martian.TestContext(req, serverConn, brw)
+		if err != nil {
+			t.Fatalf("applying martian context: %v", err)
+		}
+		defer remove()
+
+		resCh := make(chan *http.Response, 1)
+		go func() {
+			res, err := http.ReadResponse(bufio.NewReader(clientConn), req)
+			if err != nil {
+				resCh <- nil
+				return
+			}
+			resCh <- res
+		}()
+
+		err = ProxyAuthRequestModifier(proxy, req)
+		if !errors.Is(err, ErrDropped) {
+			t.Fatalf("wanted: %q\ngot: %v", ErrDropped, err)
+		}
+
+		res := <-resCh
+		if res == nil {
+			t.Fatalf("wanted: 407 response\ngot: nil")
+		}
+		if res.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("wanted: %d\ngot: %d", http.StatusProxyAuthRequired, res.StatusCode)
+		}
+		if got := res.Header.Get("Proxy-Authenticate"); !strings.HasPrefix(got, "Basic") {
+			t.Fatalf("wanted: Basic challenge\ngot: %q", got)
+		}
+	})
+
+	t.Run("authenticated CONNECT request should authenticate the requests of the tunnel", func(t *testing.T) {
+		proxy := &Proxy{ProxyCredentials: credentials}
+		req := httptest.NewRequest(http.MethodConnect, "https://marasi.app:443", nil)
+		req.Header.Set("Proxy-Authorization", basicAuth("tester", "secret"))
+
+		ctx, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context: %v", err)
+		}
+		defer remove()
+
+		if err := ProxyAuthRequestModifier(proxy, req); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		username, ok := ctx.Session().Get(proxyAuthSessionKey)
+		if !ok || username != "tester" {
+			t.Fatalf("wanted: %q in session\ngot: %v", "tester", username)
+		}
+
+		tunnelReq := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		tunnelCtx, removeTunnel, err := martian.TestContext(tunnelReq, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context: %v", err)
+		}
+		defer removeTunnel()
+		tunnelCtx.Session().Set(proxyAuthSessionKey, username)
+
+		if err := ProxyAuthRequestModifier(proxy, tunnelReq); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if got, _ := core.ProxyAuthUserFromContext(tunnelReq.Context()); got != "tester" {
+			t.Errorf("wanted: %q\ngot: %q", "tester", got)
+		}
+	})
+}
+
 func TestSetupRequestModifier(t *testing.T) {
 	t.Run("request should have all the context keys and data", func(t *testing.T) {
 		proxy := &Proxy{}
@@ -670,6 +955,215 @@ func TestSetupRequestModifier(t *testing.T) {
 			t.Errorf("expected x-marasi-metadata header to be removed")
 		}
 	})
+
+	t.Run("redirects followed by the proxy client should be stored as the redirect_chain metadata", func(t *testing.T) {
+		proxy := &Proxy{}
+		var chainHeader string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/hop1":
+				http.Redirect(w, r, "/hop2", http.StatusFound)
+			case "/hop2":
+				http.Redirect(w, r, "/final", http.StatusMovedPermanently)
+			default:
+				chainHeader = r.Header.Get("x-marasi-redirect-chain")
+			}
+		}))
+		defer server.Close()
+
+		client := &http.Client{CheckRedirect: recordRedirect}
+		res, err := client.Get(server.URL + "/hop1")
+		if err != nil {
+			t.Fatalf("sending request : %v", err)
+		}
+		res.Body.Close()
+
+		req := httptest.NewRequest(http.MethodGet, server.URL+"/final", nil)
+		req.Header.Set("x-marasi-redirect-chain", chainHeader)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context: %v", err)
+		}
+		defer remove()
+
+		err = SetupRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		metadata, ok := core.MetadataFromContext(req.Context())
+		if !ok {
+			t.Fatalf("expected metadata to be set in context")
+		}
+
+		want := []any{
+			map[string]any{"url": server.URL + "/hop1", "status_code": 302.0, "location": "/hop2"},
+			map[string]any{"url": server.URL + "/hop2", "status_code": 301.0, "location": "/final"},
+		}
+		if !reflect.DeepEqual(want, metadata["redirect_chain"]) {
+			t.Errorf("wanted:\n%v\ngot:\n%v", want, metadata["redirect_chain"])
+		}
+
+		if req.Header.Get("x-marasi-redirect-chain") != "" {
+			t.Errorf("expected x-marasi-redirect-chain header to be removed")
+		}
+	})
+
+	t.Run("requests with an ambiguous body length should be flagged as smuggling suspects", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			raw        string
+			wantReason string
+		}{
+			{
+				name:       "content-length and transfer-encoding",
+				raw:        "POST / HTTP/1.1\r\nHost: marasi.app\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n",
+				wantReason: "content-length and transfer-encoding",
+			},
+			{
+				name:       "duplicate content-length",
+				raw:        "POST / HTTP/1.1\r\nHost: marasi.app\r\nContent-Length: 4\r\ncontent-length: 4\r\n\r\n",
+				wantReason: "duplicate content-length",
+			},
+			{
+				name: "normal request",
+				raw:  "POST / HTTP/1.1\r\nHost: marasi.app\r\nContent-Length: 4\r\n\r\n",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				proxy := &Proxy{}
+				req := httptest.NewRequest(http.MethodPost, "https://marasi.app", strings.NewReader("body"))
+				req.Header.Set("Content-Length", "4")
+				header := req.Header.Clone()
+				req = core.ContextWithRawHeader(req, []byte(tt.raw))
+
+				_, remove, err := martian.TestContext(req, nil, nil)
+				if err != nil {
+					t.Fatalf("applying martian context: %v", err)
+				}
+				defer remove()
+
+				err = SetupRequestModifier(proxy, req)
+				if err != nil {
+					t.Fatalf("wanted: nil\ngot: %v", err)
+				}
+
+				metadata, ok := core.MetadataFromContext(req.Context())
+				if !ok {
+					t.Fatalf("expected metadata to be set in context")
+				}
+
+				suspect, _ := metadata["smuggling_suspect"].(bool)
+				if suspect != (tt.wantReason != "") {
+					t.Errorf("wanted: %t\ngot: %t", tt.wantReason != "", suspect)
+				}
+				if reason, _ := metadata["smuggling_reason"].(string); reason != tt.wantReason {
+					t.Errorf("wanted: %q\ngot: %q", tt.wantReason, reason)
+				}
+				if !reflect.DeepEqual(req.Header, header) {
+					t.Errorf("wanted: the headers to be left untouched\ngot: %v", req.Header)
+				}
+			})
+		}
+	})
+
+	t.Run("requests sent through the proxy with an ambiguous body length should be flagged as smuggling suspects", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer upstream.Close()
+		upstreamURL, err := url.Parse(upstream.URL)
+		if err != nil {
+			t.Fatalf("parsing upstream url : %v", err)
+		}
+
+		requests := make(chan domain.ProxyRequest, 3)
+		proxy, err := New(
+			WithExtensions([]*domain.Extension{testExtensions["compass"], testExtensions["checkpoint"]}),
+			WithTrafficRepository(newTestTrafficRepo()),
+			WithRequestHandler(func(req domain.ProxyRequest) error {
+				requests <- req
+				return nil
+			}),
+			WithResponseHandler(func(res domain.ProxyResponse) error { return nil }),
+			WithBasePipeline(),
+			WithDefaultModifierPipeline(),
+		)
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("creating listener : %v", err)
+		}
+		go proxy.Serve(l)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			proxy.Shutdown(ctx)
+		}()
+
+		target := "http://" + upstreamURL.Host + "/"
+		tests := []struct {
+			name       string
+			raw        string
+			wantReason string
+		}{
+			{
+				name:       "content-length and transfer-encoding",
+				raw:        "POST " + target + " HTTP/1.1\r\nHost: " + upstreamURL.Host + "\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+				wantReason: "content-length and transfer-encoding",
+			},
+			{
+				name:       "duplicate content-length",
+				raw:        "POST " + target + " HTTP/1.1\r\nHost: " + upstreamURL.Host + "\r\nContent-Length: 4\r\nContent-Length: 4\r\n\r\nbody",
+				wantReason: "duplicate content-length",
+			},
+			{
+				name: "normal request",
+				raw:  "POST " + target + " HTTP/1.1\r\nHost: " + upstreamURL.Host + "\r\nContent-Length: 4\r\n\r\nbody",
+			},
+		}
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dialing proxy : %v", err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		for _, tt := range tests {
+			if _, err := conn.Write([]byte(tt.raw)); err != nil {
+				t.Fatalf("writing %s : %v", tt.name, err)
+			}
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("reading response of %s : %v", tt.name, err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+
+			var req domain.ProxyRequest
+			select {
+			case req = <-requests:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s was not written", tt.name)
+			}
+
+			suspect, _ := req.Metadata["smuggling_suspect"].(bool)
+			if suspect != (tt.wantReason != "") {
+				t.Errorf("%s\nwanted: %t\ngot: %t", tt.name, tt.wantReason != "", suspect)
+			}
+			if reason, _ := req.Metadata["smuggling_reason"].(string); reason != tt.wantReason {
+				t.Errorf("%s\nwanted: %q\ngot: %q", tt.name, tt.wantReason, reason)
+			}
+		}
+	})
 }
 
 func TestOverrideWaypointsModifier(t *testing.T) {
@@ -784,6 +1278,77 @@ func TestOverrideWaypointsModifier(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("CONNECT to host in waypoint map should get a MITM certificate for the original host", func(t *testing.T) {
+		ca, priv, err := mitm.NewAuthority("Marasi", "Marasi Authority", time.Hour)
+		if err != nil {
+			t.Fatalf("creating mitm authority: %v", err)
+		}
+		mitmConfig, err := mitm.NewConfig(ca, priv)
+		if err != nil {
+			t.Fatalf("creating mitm config: %v", err)
+		}
+
+		proxy, err := New(WithBasePipeline(), WithDefaultModifierPipeline())
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		proxy.martianProxy.SetMITM(mitmConfig)
+		if err := proxy.SetWaypoint("marasi.app:443", "127.0.0.1:8443"); err != nil {
+			t.Fatalf("setting waypoint : %v", err)
+		}
+		// The handler follows the waypoint, the certificate should still be minted for the CONNECT host
+		proxy.OnConnect = func(host string, req *http.Request) {
+			if override, ok := proxy.waypoint(host); ok {
+				req.Host = override
+			}
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("creating listener : %v", err)
+		}
+		go proxy.Serve(listener)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			proxy.Shutdown(ctx)
+		}()
+
+		// martian falls back to the CONNECT host when the client does not send SNI
+		for _, serverName := range []string{"marasi.app", ""} {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatalf("connecting to proxy : %v", err)
+			}
+			defer conn.Close()
+
+			fmt.Fprint(conn, "CONNECT marasi.app:443 HTTP/1.1\r\nHost: marasi.app:443\r\n\r\n")
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("reading CONNECT response : %v", err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("wanted: %d\ngot: %d", http.StatusOK, res.StatusCode)
+			}
+
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+			if err := tlsConn.Handshake(); err != nil {
+				t.Fatalf("performing tls handshake with SNI %q : %v", serverName, err)
+			}
+			leaf := tlsConn.ConnectionState().PeerCertificates[0]
+
+			if leaf.Subject.CommonName != "marasi.app" {
+				t.Errorf("wanted CN: %q\ngot: %q", "marasi.app", leaf.Subject.CommonName)
+			}
+			if err := leaf.VerifyHostname("marasi.app"); err != nil {
+				t.Errorf("wanted: leaf valid for %q\ngot: %v", "marasi.app", err)
+			}
+			if err := leaf.VerifyHostname("127.0.0.1"); err == nil {
+				t.Errorf("wanted: leaf invalid for override %q\ngot: nil", "127.0.0.1")
+			}
+		}
+	})
 }
 
 func TestExtensionsRequestModifier(t *testing.T) {
@@ -810,13 +1375,31 @@ func TestExtensionsRequestModifier(t *testing.T) {
 		}
 	})
 
-	t.Run("if first extension skips the remaining should not run", func(t *testing.T) {
+	t.Run("only extensions that define processRequest should be recorded in extensions_ran", func(t *testing.T) {
 		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
-		updateExtension(t, proxy, "workshop", `
-			function processRequest(request)
-				request:headers():set("x-workshop-ran", "true")
-				request:skip()
-			end
+		updateExtension(t, proxy, "testExtension", `processRequest = nil`)
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		req = core.ContextWithMetadata(req, make(map[string]any))
+
+		err := ExtensionsRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		metadata, _ := core.MetadataFromContext(req.Context())
+		want := []string{"workshop"}
+		if !reflect.DeepEqual(metadata["extensions_ran"], want) {
+			t.Fatalf("wanted: %v\ngot: %v", want, metadata["extensions_ran"])
+		}
+	})
+
+	t.Run("if first extension skips the remaining should not run", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
+		updateExtension(t, proxy, "workshop", `
+			function processRequest(request)
+				request:headers():set("x-workshop-ran", "true")
+				request:skip()
+			end
 		`)
 		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
 
@@ -838,6 +1421,46 @@ func TestExtensionsRequestModifier(t *testing.T) {
 		}
 	})
 
+	t.Run("request dropped by an extension should call OnDrop with the extensions stage and request ID", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["compass"])
+		updateExtension(t, proxy, "workshop", `
+			function processRequest(request)
+				request:drop()
+			end
+		`)
+		var gotID uuid.UUID
+		var gotStage, gotReason string
+		drops := 0
+		proxy.OnDrop = func(reqID uuid.UUID, stage string, reason string) {
+			drops++
+			gotID, gotStage, gotReason = reqID, stage, reason
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		wantID := uuid.Must(uuid.NewV7())
+		req = core.ContextWithRequestID(req, wantID)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		err = ExtensionsRequestModifier(proxy, req)
+		if !errors.Is(err, ErrDropped) {
+			t.Fatalf("wanted: %q\ngot: %v", ErrDropped, err)
+		}
+
+		if drops != 1 {
+			t.Fatalf("wanted: 1 OnDrop call\ngot: %d", drops)
+		}
+		if gotID != wantID {
+			t.Errorf("wanted: %s\ngot: %s", wantID, gotID)
+		}
+		if gotStage != "extensions_request" || gotReason != "dropped by extension workshop" {
+			t.Errorf("wanted: extensions_request : dropped by extension workshop\ngot: %s : %s", gotStage, gotReason)
+		}
+	})
+
 	t.Run("if first extension drops the remaining should not run", func(t *testing.T) {
 		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
 		updateExtension(t, proxy, "workshop", `
@@ -880,6 +1503,42 @@ func TestExtensionsRequestModifier(t *testing.T) {
 		}
 	})
 
+	t.Run("unbounded recursion in an extension should be logged and the remaining extensions should run", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
+		updateExtension(t, proxy, "workshop", `
+			local function recurse(n)
+				return recurse(n + 1) + 1
+			end
+
+			function processRequest(request)
+				recurse(1)
+			end
+		`)
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+
+		err := ExtensionsRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if req.Header.Get("x-testExtension-ran") != "true" {
+			t.Errorf("expected x-testExtension-ran header to be set to true but got %q", req.Header.Get("x-testExtension-ran"))
+		}
+
+		if len(proxy.DBWriteChannel) != 1 {
+			t.Fatalf("wanted: 1\ngot: %d", len(proxy.DBWriteChannel))
+		}
+
+		logItem, ok := (<-proxy.DBWriteChannel).(*domain.Log)
+		if !ok {
+			t.Fatalf("wanted: *domain.Log")
+		}
+
+		if logItem.Level != "ERROR" || !strings.Contains(logItem.Message, "stack overflow") {
+			t.Errorf("wanted: ERROR log containing %q\ngot: %s %q", "stack overflow", logItem.Level, logItem.Message)
+		}
+	})
+
 	t.Run("if request x-extension-id matches extensionID it should skip execution", func(t *testing.T) {
 		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
 		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
@@ -910,6 +1569,68 @@ func TestExtensionsRequestModifier(t *testing.T) {
 		}
 	})
 
+	t.Run("x-extension-id should be matched by the parsed extension ID", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+
+		defer remove()
+
+		workshopID := testExtensions["workshop"].ID
+		if ext, ok := proxy.GetExtensionByID(workshopID); !ok || ext.Data.Name != "workshop" {
+			t.Fatalf("wanted: workshop extension\ngot: %v, %t", ext, ok)
+		}
+
+		// the upper case form of the ID does not match the string representation but refers to the same extension
+		req.Header.Set("x-extension-id", strings.ToUpper(workshopID.String()))
+		err = ExtensionsRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if req.Header.Get("x-workshop-ran") == "true" {
+			t.Errorf("expected x-workshop-ran header to not be set but got %q", req.Header.Get("x-workshop-ran"))
+		}
+
+		if req.Header.Get("x-testExtension-ran") != "true" {
+			t.Errorf("expected x-testExtension-ran header to be set to true but got %q", req.Header.Get("x-testExtension-ran"))
+		}
+	})
+
+	t.Run("unknown x-extension-id should not skip any extension", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+
+		defer remove()
+
+		if _, ok := proxy.GetExtensionByID(uuid.Nil); ok {
+			t.Fatalf("wanted: false\ngot: true")
+		}
+
+		req.Header.Set("x-extension-id", uuid.Nil.String())
+		err = ExtensionsRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if req.Header.Get("x-workshop-ran") != "true" {
+			t.Errorf("expected x-workshop-ran header to be set to true but got %q", req.Header.Get("x-workshop-ran"))
+		}
+
+		if req.Header.Get("x-testExtension-ran") != "true" {
+			t.Errorf("expected x-testExtension-ran header to be set to true but got %q", req.Header.Get("x-testExtension-ran"))
+		}
+	})
+
 	t.Run("extensions without processRequest defined should not be executed on requests", func(t *testing.T) {
 		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
 		updateExtension(t, proxy, "workshop", "processRequest = nil")
@@ -1412,6 +2133,44 @@ func TestCheckpointRequestModifier(t *testing.T) {
 
 	})
 
+	t.Run("resumed HTTP/1.0 request should close the connection", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["checkpoint"])
+		modifiedRequest := "GET / HTTP/1.0\r\nHost: marasi.app\r\n\r\n"
+		proxy.InterceptFlag = true
+		proxy.OnIntercept = func(intercepted *Intercepted) error {
+			intercepted.Raw = modifiedRequest
+			go func() {
+				intercepted.Channel <- InterceptionTuple{Resume: true}
+			}()
+			return nil
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		err = SetupRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("running SetupRequestModifier : %v", err)
+		}
+
+		err = CheckpointRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if req.ProtoMajor != 1 || req.ProtoMinor != 0 {
+			t.Fatalf("wanted: HTTP/1.0\ngot: %s", req.Proto)
+		}
+
+		if !req.Close {
+			t.Fatalf("wanted: true\ngot: %t", req.Close)
+		}
+	})
+
 	t.Run("modifier should return an error if the modified request is invalid / malformed", func(t *testing.T) {
 		proxy := newTestProxy(t, testExtensions["checkpoint"])
 		modifiedRequest := "POST /HTTP/1.1\r\nHost: marasi.app\r\nContent-Length: 12\r\nContent-Type: text/plain\r\n\r\nhello marasi"
@@ -1448,6 +2207,50 @@ func TestCheckpointRequestModifier(t *testing.T) {
 			t.Fatalf("wanted: 1\ngot: %d", len(proxy.InterceptedQueue))
 		}
 	})
+
+	t.Run("should only intercept requests with a method in InterceptMethods", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["checkpoint"])
+		proxy.InterceptFlag = true
+		proxy.InterceptMethods = []string{"POST"}
+		proxy.OnIntercept = func(intercepted *Intercepted) error {
+			go func() {
+				intercepted.Channel <- InterceptionTuple{Resume: true}
+			}()
+			return nil
+		}
+
+		for _, tt := range []struct {
+			method          string
+			wantIntercepted bool
+		}{
+			{method: http.MethodGet, wantIntercepted: false},
+			{method: http.MethodPost, wantIntercepted: true},
+		} {
+			req := httptest.NewRequest(tt.method, "https://marasi.app", nil)
+			_, remove, err := martian.TestContext(req, nil, nil)
+			if err != nil {
+				t.Fatalf("applying martian context : %v", err)
+			}
+			defer remove()
+
+			if err := SetupRequestModifier(proxy, req); err != nil {
+				t.Fatalf("running SetupRequestModifier : %v", err)
+			}
+
+			if err := CheckpointRequestModifier(proxy, req); err != nil {
+				t.Fatalf("%s wanted: nil\ngot: %v", tt.method, err)
+			}
+
+			metadata, _ := core.MetadataFromContext(req.Context())
+			if intercepted := metadata["intercepted"] == true; intercepted != tt.wantIntercepted {
+				t.Fatalf("%s wanted intercepted: %t\ngot: %t", tt.method, tt.wantIntercepted, intercepted)
+			}
+		}
+
+		if len(proxy.InterceptedQueue) != 1 {
+			t.Fatalf("wanted: 1\ngot: %d", len(proxy.InterceptedQueue))
+		}
+	})
 }
 
 func TestWriteRequestModifier(t *testing.T) {
@@ -1492,6 +2295,81 @@ func TestWriteRequestModifier(t *testing.T) {
 
 	})
 
+	t.Run("a panicking OnRequest should be recovered and the request still written to the DB", func(t *testing.T) {
+		proxy := newTestProxy(t)
+		proxy.OnRequest = func(req domain.ProxyRequest) error {
+			panic("onrequest exploded")
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		err = SetupRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("running SetupRequestModifier : %v", err)
+		}
+
+		err = WriteRequestModifier(proxy, req)
+		if !errors.Is(err, ErrHandlerPanic) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", ErrHandlerPanic, err)
+		}
+
+		if !strings.Contains(err.Error(), "onrequest exploded") {
+			t.Errorf("\nwanted:\nerror containing the panic value\ngot:\n%v", err)
+		}
+
+		if len(proxy.DBWriteChannel) != 2 {
+			t.Fatalf("\nwanted:\n2\ngot:\n%d", len(proxy.DBWriteChannel))
+		}
+
+		if _, ok := (<-proxy.DBWriteChannel).(*domain.ProxyRequest); !ok {
+			t.Fatalf("\nwanted:\n*domain.ProxyRequest written to the DB")
+		}
+
+		logItem, ok := (<-proxy.DBWriteChannel).(*domain.Log)
+		if !ok {
+			t.Fatalf("\nwanted:\n*domain.Log written to the DB")
+		}
+
+		if logItem.Level != "ERROR" || !strings.Contains(logItem.Message, "onrequest exploded") {
+			t.Errorf("\nwanted:\nERROR log containing the panic value\ngot:\n%s %s", logItem.Level, logItem.Message)
+		}
+	})
+
+	t.Run("the request protocol version should be stored with the request", func(t *testing.T) {
+		proxy := newTestProxy(t)
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		err = SetupRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("running SetupRequestModifier : %v", err)
+		}
+
+		err = WriteRequestModifier(proxy, req)
+		if !errors.Is(err, ErrRequestHandlerUndefined) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", ErrRequestHandlerUndefined, err)
+		}
+
+		proxyRequest, ok := (<-proxy.DBWriteChannel).(*domain.ProxyRequest)
+		if !ok {
+			t.Fatalf("\nwanted:\n*domain.ProxyRequest written to the DB")
+		}
+		if proxyRequest.Proto != "HTTP/2.0" {
+			t.Fatalf("\nwanted:\nHTTP/2.0\ngot:\n%s", proxyRequest.Proto)
+		}
+	})
+
 	t.Run("requests without a timestamp should return an error", func(t *testing.T) {
 		wantID, err := uuid.NewV7()
 		if err != nil {
@@ -1528,6 +2406,7 @@ func TestWriteRequestModifier(t *testing.T) {
 			Method:      "GET",
 			Host:        "marasi.app",
 			Path:        "/blog",
+			Proto:       "HTTP/1.1",
 			Metadata:    make(map[string]any),
 			RequestedAt: wantTime,
 		}
@@ -1542,6 +2421,7 @@ func TestWriteRequestModifier(t *testing.T) {
 			t.Fatalf("dumping http request (rawhttp) : %v", err)
 		}
 		want.Raw = raw
+		want.RawLength = int64(len(raw))
 
 		*req = *core.ContextWithRequestID(req, wantID)
 		*req = *core.ContextWithRequestTime(req, wantTime)
@@ -1622,6 +2502,7 @@ func TestWriteRequestModifier(t *testing.T) {
 			Method:      "GET",
 			Host:        "marasi.app",
 			Path:        "/blog",
+			Proto:       "HTTP/1.1",
 			Metadata:    make(map[string]any),
 			RequestedAt: wantTime,
 		}
@@ -1637,6 +2518,7 @@ func TestWriteRequestModifier(t *testing.T) {
 			t.Fatalf("dumping http request (rawhttp) : %v", err)
 		}
 		want.Raw = raw
+		want.RawLength = int64(len(raw))
 
 		*req = *core.ContextWithRequestID(req, wantID)
 		*req = *core.ContextWithRequestTime(req, wantTime)
@@ -1683,6 +2565,17 @@ func TestResponseFilterModifier(t *testing.T) {
 		}
 	})
 
+	t.Run("responses without a martian context should not panic", func(t *testing.T) {
+		proxy := &Proxy{}
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		res := &http.Response{Request: req}
+
+		err := ResponseFilterModifier(proxy, res)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+	})
+
 	t.Run("responses to requests that were marked as skipped should be skipped by marasi", func(t *testing.T) {
 		proxy := &Proxy{}
 		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
@@ -1750,6 +2643,162 @@ func TestResponseFilterModifier(t *testing.T) {
 	})
 }
 
+func TestTLSInfoResponseModifier(t *testing.T) {
+	t.Run("response through the marasi transport should record the utls connection state in metadata", func(t *testing.T) {
+		proxy := &Proxy{}
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.EnableHTTP2 = true
+		// Like most h2 servers, h2 is preferred and http/1.1 is offered as well
+		server.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+		server.StartTLS()
+		defer server.Close()
+
+		transport := newMarasiTransport(testCert(t), 0, nil)
+		if mrt, ok := transport.(*marasiRoundTripper); ok {
+			if ht, ok := mrt.base.(*http.Transport); ok {
+				ht.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			}
+		}
+
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		req.RequestURI = ""
+		req = core.ContextWithMetadata(req, make(map[string]any))
+
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("sending request : %v", err)
+		}
+		defer res.Body.Close()
+
+		err = TLSInfoResponseModifier(proxy, res)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		metadata, ok := core.MetadataFromContext(res.Request.Context())
+		if !ok {
+			t.Fatalf("wanted: metadata\ngot: nil")
+		}
+		tlsInfo, ok := metadata["tls"].(map[string]any)
+		if !ok {
+			t.Fatalf("wanted: map[string]any\ngot: %T", metadata["tls"])
+		}
+		// The marasi transport only offers http/1.1 even when the server supports h2
+		if tlsInfo["alpn"] != "http/1.1" {
+			t.Fatalf("wanted: http/1.1\ngot: %v", tlsInfo["alpn"])
+		}
+		if tlsInfo["version"] != "TLS 1.3" {
+			t.Fatalf("wanted: TLS 1.3\ngot: %v", tlsInfo["version"])
+		}
+		if tlsInfo["cipher_suite"] == "" {
+			t.Fatalf("wanted: cipher suite\ngot: empty string")
+		}
+	})
+
+	t.Run("response negotiated over h2 should record the h2 ALPN", func(t *testing.T) {
+		proxy := &Proxy{}
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		req.RequestURI = ""
+		req = core.ContextWithMetadata(req, make(map[string]any))
+
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("sending request : %v", err)
+		}
+		defer res.Body.Close()
+
+		err = TLSInfoResponseModifier(proxy, res)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		metadata, _ := core.MetadataFromContext(res.Request.Context())
+		tlsInfo, ok := metadata["tls"].(map[string]any)
+		if !ok {
+			t.Fatalf("wanted: map[string]any\ngot: %T", metadata["tls"])
+		}
+		if tlsInfo["alpn"] != "h2" {
+			t.Fatalf("wanted: h2\ngot: %v", tlsInfo["alpn"])
+		}
+		if tlsInfo["resumed"] != false {
+			t.Fatalf("wanted: false\ngot: %v", tlsInfo["resumed"])
+		}
+	})
+
+	t.Run("response over a resumed session should record the resumption", func(t *testing.T) {
+		proxy := &Proxy{}
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		// Every request dials a new connection, so the second handshake resumes the session of the first
+		transport.DisableKeepAlives = true
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		client := &http.Client{Transport: transport}
+
+		var res *http.Response
+		for range 2 {
+			req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+			req.RequestURI = ""
+			req = core.ContextWithMetadata(req, make(map[string]any))
+
+			var err error
+			res, err = client.Do(req)
+			if err != nil {
+				t.Fatalf("sending request : %v", err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		err := TLSInfoResponseModifier(proxy, res)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		metadata, _ := core.MetadataFromContext(res.Request.Context())
+		tlsInfo, ok := metadata["tls"].(map[string]any)
+		if !ok {
+			t.Fatalf("wanted: map[string]any\ngot: %T", metadata["tls"])
+		}
+		if tlsInfo["resumed"] != true {
+			t.Fatalf("wanted: true\ngot: %v", tlsInfo["resumed"])
+		}
+		if tlsInfo["alpn"] != "http/1.1" {
+			t.Fatalf("wanted: http/1.1\ngot: %v", tlsInfo["alpn"])
+		}
+	})
+
+	t.Run("plain HTTP response should not record TLS info", func(t *testing.T) {
+		proxy := &Proxy{}
+		req := httptest.NewRequest(http.MethodGet, "http://marasi.app", nil)
+		req = core.ContextWithMetadata(req, make(map[string]any))
+		res := &http.Response{Request: req}
+
+		err := TLSInfoResponseModifier(proxy, res)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		metadata, _ := core.MetadataFromContext(res.Request.Context())
+		if _, ok := metadata["tls"]; ok {
+			t.Fatalf("wanted: no tls key\ngot: %v", metadata["tls"])
+		}
+	})
+}
+
 func TestBufferedStreamingResponseModifier(t *testing.T) {
 	proxy := &Proxy{}
 	t.Run("chunked response modifier should return an error if it fails to read the body", func(t *testing.T) {
@@ -1782,32 +2831,262 @@ func TestBufferedStreamingResponseModifier(t *testing.T) {
 			testWriter.Write([]byte("treamed marasi"))
 		}()
 
-		err := BufferStreamingBodyModifier(proxy, res)
+		err := BufferStreamingBodyModifier(proxy, res)
+
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		got, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if string(got) != want {
+			t.Fatalf("wanted: %q\ngot: %q", want, string(got))
+		}
+
+		if res.ContentLength != int64(len(want)) {
+			t.Fatalf("wanted: %d\ngot: %d", len(want), len(got))
+		}
+
+		if res.Header.Get("Content-Length") != fmt.Sprintf("%d", len(want)) {
+			t.Fatalf("wanted: %d\ngot: %s", len(want), res.Header.Get("Content-Length"))
+		}
+
+		if res.TransferEncoding != nil {
+			t.Fatalf("wanted: nil\ngot: %v", res.TransferEncoding)
+		}
+	})
+
+	streamTests := []struct {
+		name   string
+		header string
+		value  string
+	}{
+		{
+			name:   "server-sent events should not be buffered and should be marked as streamed",
+			header: "Content-Type",
+			value:  "text/event-stream; charset=utf-8",
+		},
+		{
+			name:   "responses disabling proxy buffering should not be buffered and should be marked as streamed",
+			header: "X-Accel-Buffering",
+			value:  "no",
+		},
+	}
+
+	for _, tt := range streamTests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t)
+
+			id, err := uuid.NewV7()
+			if err != nil {
+				t.Fatalf("generating uuid : %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "https://marasi.app/events", nil)
+			*req = *core.ContextWithRequestID(req, id)
+			*req = *core.ContextWithMetadata(req, make(map[string]any))
+			*req = *core.ContextWithResponseTime(req, time.Now())
+
+			// The writer is never closed, buffering the body would block forever
+			testReader, testWriter := io.Pipe()
+			defer testWriter.Close()
+
+			res := &http.Response{
+				Status:           "200 OK",
+				StatusCode:       http.StatusOK,
+				Header:           make(http.Header),
+				TransferEncoding: []string{"chunked"},
+				ContentLength:    -1,
+				Body:             testReader,
+				Request:          req,
+			}
+			res.Header.Set(tt.header, tt.value)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- BufferStreamingBodyModifier(proxy, res)
+			}()
+
+			select {
+			case err := <-errCh:
+				if err != nil {
+					t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("wanted: stream to not be buffered\ngot: modifier blocked reading the body")
+			}
+
+			if res.Body != testReader {
+				t.Fatalf("wanted: original stream body\ngot: %T", res.Body)
+			}
+
+			if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+				t.Fatalf("wanted: [chunked]\ngot: %v", res.TransferEncoding)
+			}
+
+			metadata, _ := core.MetadataFromContext(res.Request.Context())
+			if streamed, _ := metadata["streamed"].(bool); !streamed {
+				t.Fatalf("wanted: streamed=true\ngot: %v", metadata["streamed"])
+			}
+
+			// The rest of the pipeline still runs, the DB write only records the headers of the stream
+			if len(proxy.DBWriteChannel) != 0 {
+				t.Fatalf("wanted: 0\ngot: %d", len(proxy.DBWriteChannel))
+			}
+
+			go func() {
+				errCh <- WriteResponseModifier(proxy, res)
+			}()
+
+			select {
+			case err := <-errCh:
+				if !errors.Is(err, ErrResponseHandlerUndefined) {
+					t.Fatalf("\nwanted:\n%v\ngot:\n%v", ErrResponseHandlerUndefined, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("wanted: stream to not be read\ngot: WriteResponseModifier blocked reading the body")
+			}
+
+			proxyResponse, ok := (<-proxy.DBWriteChannel).(*domain.ProxyResponse)
+			if !ok {
+				t.Fatalf("wanted: *domain.ProxyResponse written to the DB")
+			}
+
+			if !strings.Contains(string(proxyResponse.Raw), tt.header+": "+tt.value) {
+				t.Fatalf("wanted: headers to be recorded\ngot: %s", proxyResponse.Raw)
+			}
+		})
+	}
+
+	t.Run("chunked responses that are not event streams should not be marked as streamed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app/data", nil)
+		*req = *core.ContextWithMetadata(req, make(map[string]any))
+
+		res := &http.Response{
+			Header:           make(http.Header),
+			TransferEncoding: []string{"chunked"},
+			Body:             io.NopCloser(strings.NewReader("chunked marasi")),
+			Request:          req,
+		}
+		res.Header.Set("Content-Type", "application/json")
+
+		err := BufferStreamingBodyModifier(proxy, res)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if res.TransferEncoding != nil {
+			t.Fatalf("wanted: nil\ngot: %v", res.TransferEncoding)
+		}
+
+		metadata, _ := core.MetadataFromContext(res.Request.Context())
+		if _, ok := metadata["streamed"]; ok {
+			t.Fatalf("wanted: no streamed key\ngot: %v", metadata["streamed"])
+		}
+	})
+}
+
+func TestRechunkResponseModifier(t *testing.T) {
+	const body = "chunked marasi"
+
+	// newResponse returns a chunked response with metadata in its request context
+	newResponse := func() *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app/data", nil)
+		*req = *core.ContextWithMetadata(req, make(map[string]any))
+
+		return &http.Response{
+			Status:           "200 OK",
+			StatusCode:       http.StatusOK,
+			ProtoMajor:       1,
+			ProtoMinor:       1,
+			Header:           make(http.Header),
+			TransferEncoding: []string{"chunked"},
+			ContentLength:    -1,
+			Body:             io.NopCloser(strings.NewReader(body)),
+			Request:          req,
+		}
+	}
+
+	t.Run("buffered chunked response should be re-emitted chunked when the flag is set", func(t *testing.T) {
+		proxy := &Proxy{PreserveChunkedEncoding: true}
+		res := newResponse()
+
+		for _, modifier := range []ResponseModifierFunc{BufferStreamingBodyModifier, RechunkResponseModifier} {
+			if err := modifier(proxy, res); err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
+		}
+
+		if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+			t.Fatalf("wanted: [chunked]\ngot: %v", res.TransferEncoding)
+		}
+
+		if res.Header.Get("Content-Length") != "" {
+			t.Fatalf("wanted: no Content-Length\ngot: %s", res.Header.Get("Content-Length"))
+		}
 
-		if err != nil {
-			t.Fatalf("wanted: nil\ngot: %v", err)
+		var egress bytes.Buffer
+		if err := res.Write(&egress); err != nil {
+			t.Fatalf("writing response : %v", err)
 		}
 
-		got, err := io.ReadAll(res.Body)
+		if !strings.Contains(egress.String(), "Transfer-Encoding: chunked") {
+			t.Fatalf("wanted: Transfer-Encoding: chunked\ngot: %s", egress.String())
+		}
+
+		egressRes, err := http.ReadResponse(bufio.NewReader(&egress), nil)
 		if err != nil {
-			t.Fatalf("wanted: nil\ngot: %v", err)
+			t.Fatalf("reading egress response : %v", err)
 		}
+		got, err := io.ReadAll(egressRes.Body)
+		if err != nil {
+			t.Fatalf("reading egress body : %v", err)
+		}
+		if string(got) != body {
+			t.Fatalf("wanted: %q\ngot: %q", body, string(got))
+		}
+	})
 
-		if string(got) != want {
-			t.Fatalf("wanted: %q\ngot: %q", want, string(got))
+	t.Run("buffered chunked response should keep the Content-Length when the flag is not set", func(t *testing.T) {
+		proxy := &Proxy{}
+		res := newResponse()
+
+		for _, modifier := range []ResponseModifierFunc{BufferStreamingBodyModifier, RechunkResponseModifier} {
+			if err := modifier(proxy, res); err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
 		}
 
-		if res.ContentLength != int64(len(want)) {
-			t.Fatalf("wanted: %d\ngot: %d", len(want), len(got))
+		if res.TransferEncoding != nil {
+			t.Fatalf("wanted: nil\ngot: %v", res.TransferEncoding)
 		}
 
-		if res.Header.Get("Content-Length") != fmt.Sprintf("%d", len(want)) {
-			t.Fatalf("wanted: %d\ngot: %s", len(want), res.Header.Get("Content-Length"))
+		if res.Header.Get("Content-Length") != fmt.Sprintf("%d", len(body)) {
+			t.Fatalf("wanted: %d\ngot: %s", len(body), res.Header.Get("Content-Length"))
+		}
+	})
+
+	t.Run("responses that were not chunked should not be re-emitted chunked", func(t *testing.T) {
+		proxy := &Proxy{PreserveChunkedEncoding: true}
+		res := newResponse()
+		res.TransferEncoding = nil
+		res.ContentLength = int64(len(body))
+
+		for _, modifier := range []ResponseModifierFunc{BufferStreamingBodyModifier, RechunkResponseModifier} {
+			if err := modifier(proxy, res); err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
 		}
 
 		if res.TransferEncoding != nil {
 			t.Fatalf("wanted: nil\ngot: %v", res.TransferEncoding)
 		}
+
+		if res.ContentLength != int64(len(body)) {
+			t.Fatalf("wanted: %d\ngot: %d", len(body), res.ContentLength)
+		}
 	})
 }
 
@@ -2025,6 +3304,118 @@ func TestCompressedResponseModifier(t *testing.T) {
 	})
 }
 
+func TestDecompressBeforeExtensions(t *testing.T) {
+	const plaintext = "gzipped marasi content"
+
+	// runPipeline runs the decompression modifiers around the extensions like the default pipeline
+	runPipeline := func(proxy *Proxy, res *http.Response) error {
+		for _, modifier := range []ResponseModifierFunc{DecompressBeforeExtensionsModifier, ExtensionsResponseModifier, DecompressAfterExtensionsModifier} {
+			if err := modifier(proxy, res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	newResponse := func(t *testing.T) (*http.Response, func()) {
+		t.Helper()
+		body, length := testGzipBody(t, plaintext)
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		*req = *core.ContextWithExtensionID(req, "")
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+
+		res := &http.Response{
+			Header:        make(http.Header),
+			Body:          body,
+			ContentLength: int64(length),
+			Request:       req,
+		}
+		res.Header.Set("Content-Encoding", "gzip")
+		return res, remove
+	}
+
+	t.Run("New should decompress before the extensions by default", func(t *testing.T) {
+		proxy, err := New()
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		if !proxy.DecompressBeforeExtensions {
+			t.Fatalf("wanted: true\ngot: false")
+		}
+	})
+
+	t.Run("extensions should see the plaintext body when the flag is set", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"])
+		proxy.DecompressBeforeExtensions = true
+		updateExtension(t, proxy, "workshop", `
+			function processResponse(response)
+				response:headers():set("x-seen-body", response:body())
+			end
+		`)
+		res, remove := newResponse(t)
+		defer remove()
+
+		if err := runPipeline(proxy, res); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if got := res.Header.Get("x-seen-body"); got != plaintext {
+			t.Fatalf("wanted: %q\ngot: %q", plaintext, got)
+		}
+		if res.Header.Get("Content-Encoding") != "" {
+			t.Fatalf("wanted: ''\ngot: %v", res.Header.Get("Content-Encoding"))
+		}
+	})
+
+	t.Run("extensions should see the compressed body and the body should be decompressed afterwards when the flag is not set", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"])
+		proxy.DecompressBeforeExtensions = false
+		updateExtension(t, proxy, "workshop", `
+			function processResponse(response)
+				response:headers():set("x-seen-encoding", response:headers():get("Content-Encoding"))
+			end
+		`)
+		res, remove := newResponse(t)
+		defer remove()
+
+		if err := runPipeline(proxy, res); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if got := res.Header.Get("x-seen-encoding"); got != "gzip" {
+			t.Fatalf("wanted: gzip\ngot: %q", got)
+		}
+		got, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("reading response body : %v", err)
+		}
+		if string(got) != plaintext {
+			t.Fatalf("wanted: %q\ngot: %q", plaintext, got)
+		}
+	})
+
+	t.Run("modifying a still compressed body should return ErrCompressedBodyModified", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"])
+		proxy.DecompressBeforeExtensions = false
+		updateExtension(t, proxy, "workshop", `
+			function processResponse(response)
+				response:set_body("replaced")
+			end
+		`)
+		res, remove := newResponse(t)
+		defer remove()
+
+		err := runPipeline(proxy, res)
+		if !errors.Is(err, ErrCompressedBodyModified) {
+			t.Fatalf("wanted: %v\ngot: %v", ErrCompressedBodyModified, err)
+		}
+	})
+}
+
 func TestCompassResponseModifier(t *testing.T) {
 	t.Run("should return ErrExtensionNotFound if no compass extension was loaded", func(t *testing.T) {
 		proxy := newTestProxy(t)
@@ -2193,6 +3584,39 @@ func TestExtensionsResponseModifier(t *testing.T) {
 			t.Errorf("expected x-testExtension-ran-response header to be set to true but got %q", req.Header.Get("x-testExtension-ran-response"))
 		}
 	})
+	t.Run("only extensions that define processResponse should be added to extensions_ran once", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["checkpoint"])
+		updateExtension(t, proxy, "workshop", `processResponse = nil`)
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		*req = *core.ContextWithExtensionID(req, "")
+		*req = *core.ContextWithMetadata(req, map[string]any{"extensions_ran": []string{"testExtension"}})
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		res := &http.Response{
+			Header:  make(http.Header),
+			Request: req,
+		}
+
+		err = ExtensionsResponseModifier(proxy, res)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if res.Header.Get("x-testExtension-ran-response") != "true" {
+			t.Fatalf("expected x-testExtension-ran-response header to be set to true but got %q", res.Header.Get("x-testExtension-ran-response"))
+		}
+
+		metadata, _ := core.MetadataFromContext(res.Request.Context())
+		want := []string{"testExtension"}
+		if !reflect.DeepEqual(metadata["extensions_ran"], want) {
+			t.Fatalf("wanted: %v\ngot: %v", want, metadata["extensions_ran"])
+		}
+	})
 	t.Run("extensions should run in the order they are defined", func(t *testing.T) {
 		proxy := newTestProxy(t, testExtensions["workshop"], testExtensions["testExtension"], testExtensions["compass"])
 		updateExtension(t, proxy, "testExtension", `
@@ -2561,6 +3985,76 @@ func TestCheckpointResponseModifier(t *testing.T) {
 		}
 	})
 
+	t.Run("should intercept the headers of a streamed response and keep the stream as the body", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["checkpoint"])
+		proxy.InterceptFlag = true
+		proxy.OnIntercept = func(intercepted *Intercepted) error {
+			go func() {
+				intercepted.Raw = strings.Replace(intercepted.Raw, "X-Test: 1", "X-Test: 2", 1)
+				intercepted.Channel <- InterceptionTuple{Resume: true}
+			}()
+			return nil
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app/events", nil)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		err = SetupRequestModifier(proxy, req)
+		if err != nil {
+			t.Fatalf("setting up request: %v", err)
+		}
+
+		// The writer is never closed, dumping the body would block forever
+		testReader, testWriter := io.Pipe()
+		defer testWriter.Close()
+
+		res := &http.Response{
+			Status:           "200 OK",
+			StatusCode:       http.StatusOK,
+			ProtoMajor:       1,
+			ProtoMinor:       1,
+			Header:           make(http.Header),
+			TransferEncoding: []string{"chunked"},
+			ContentLength:    -1,
+			Body:             testReader,
+			Request:          req,
+		}
+		res.Header.Set("Content-Type", "text/event-stream")
+		res.Header.Set("X-Test", "1")
+
+		if err := BufferStreamingBodyModifier(proxy, res); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- CheckpointResponseModifier(proxy, res)
+		}()
+
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("wanted: stream to not be read\ngot: modifier blocked reading the body")
+		}
+
+		if got := res.Header.Get("X-Test"); got != "2" {
+			t.Fatalf("wanted: 2\ngot: %s", got)
+		}
+		if res.Body != testReader {
+			t.Fatalf("wanted: original stream body\ngot: %T", res.Body)
+		}
+		if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+			t.Fatalf("wanted: [chunked]\ngot: %v", res.TransferEncoding)
+		}
+	})
+
 	t.Run("should intercept response if global intercept flag is set", func(t *testing.T) {
 		proxy := newTestProxy(t, testExtensions["checkpoint"])
 		proxy.InterceptFlag = true
@@ -2862,6 +4356,68 @@ func TestWriteResponseModifier(t *testing.T) {
 
 	})
 
+	t.Run("tags and notes set by processResponse should be written with the response", func(t *testing.T) {
+		proxy := newTestProxy(t, testExtensions["workshop"])
+		updateExtension(t, proxy, "workshop", `
+			function processRequest(request)
+				request:add_tag("reviewed")
+				request:set_note("check the id parameter")
+			end
+			function processResponse(response)
+				response:request():add_tag("sqli-candidate")
+				response:request():set_note("reflected in the response")
+			end
+		`)
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("applying martian context : %v", err)
+		}
+		defer remove()
+
+		if err := SetupRequestModifier(proxy, req); err != nil {
+			t.Fatalf("running SetupRequestModifier : %v", err)
+		}
+		if err := ExtensionsRequestModifier(proxy, req); err != nil {
+			t.Fatalf("running ExtensionsRequestModifier : %v", err)
+		}
+		proxyRequest, err := NewProxyRequest(req, uuid.Nil)
+		if err != nil {
+			t.Fatalf("creating proxy request : %v", err)
+		}
+
+		res := &http.Response{
+			Header:  make(http.Header),
+			Request: req,
+			Body:    http.NoBody,
+		}
+		if err := ExtensionsResponseModifier(proxy, res); err != nil {
+			t.Fatalf("running ExtensionsResponseModifier : %v", err)
+		}
+		res.Request = core.ContextWithResponseTime(res.Request, time.Now())
+
+		proxyResponse, err := NewProxyResponse(res)
+		if err != nil {
+			t.Fatalf("creating proxy response : %v", err)
+		}
+
+		if want := []string{"reviewed"}; !reflect.DeepEqual(proxyRequest.Tags, want) {
+			t.Errorf("wanted: %v\ngot: %v", want, proxyRequest.Tags)
+		}
+		if want := []string{"reviewed", "sqli-candidate"}; !reflect.DeepEqual(proxyResponse.Tags, want) {
+			t.Errorf("wanted: %v\ngot: %v", want, proxyResponse.Tags)
+		}
+		if _, ok := proxyResponse.Metadata["tags"]; ok {
+			t.Errorf("wanted: no tags in the metadata\ngot: %v", proxyResponse.Metadata["tags"])
+		}
+		if proxyRequest.Note == nil || *proxyRequest.Note != "check the id parameter" {
+			t.Errorf("wanted: check the id parameter\ngot: %v", proxyRequest.Note)
+		}
+		if proxyResponse.Note == nil || *proxyResponse.Note != "reflected in the response" {
+			t.Errorf("wanted: reflected in the response\ngot: %v", proxyResponse.Note)
+		}
+	})
+
 	t.Run("proxy response should be written to DBWriteChannel", func(t *testing.T) {
 		wantID, err := uuid.NewV7()
 		if err != nil {
@@ -2899,6 +4455,7 @@ func TestWriteResponseModifier(t *testing.T) {
 			t.Fatalf("dumping http response (rawhttp) : %v", err)
 		}
 		want.Raw = raw
+		want.RawLength = int64(len(raw))
 
 		*req = *core.ContextWithRequestID(req, wantID)
 		*req = *core.ContextWithRequestTime(req, wantTime)
@@ -2960,6 +4517,7 @@ func TestWriteResponseModifier(t *testing.T) {
 			t.Fatalf("dumping http response (rawhttp) : %v", err)
 		}
 		want.Raw = raw
+		want.RawLength = int64(len(raw))
 
 		*req = *core.ContextWithRequestID(req, wantID)
 		*req = *core.ContextWithRequestTime(req, wantTime)
@@ -2989,4 +4547,147 @@ func TestWriteResponseModifier(t *testing.T) {
 			t.Fatalf("expected onResponse to be called")
 		}
 	})
+
+	t.Run("a panicking OnResponse should be recovered and the response still written to the DB", func(t *testing.T) {
+		proxy := newTestProxy(t)
+		proxy.OnResponse = func(res domain.ProxyResponse) error {
+			panic("onresponse exploded")
+		}
+
+		id, err := uuid.NewV7()
+		if err != nil {
+			t.Fatalf("generating uuid : %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		extensionID := uuid.New()
+		*req = *core.ContextWithRequestID(req, id)
+		*req = *core.ContextWithMetadata(req, make(map[string]any))
+		*req = *core.ContextWithResponseTime(req, time.Now())
+		*req = *core.ContextWithExtensionID(req, extensionID.String())
+
+		res := &http.Response{
+			Header:     make(http.Header),
+			Request:    req,
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Body:       http.NoBody,
+		}
+
+		err = WriteResponseModifier(proxy, res)
+		if !errors.Is(err, ErrHandlerPanic) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", ErrHandlerPanic, err)
+		}
+
+		if len(proxy.DBWriteChannel) != 2 {
+			t.Fatalf("\nwanted:\n2\ngot:\n%d", len(proxy.DBWriteChannel))
+		}
+
+		if _, ok := (<-proxy.DBWriteChannel).(*domain.ProxyResponse); !ok {
+			t.Fatalf("\nwanted:\n*domain.ProxyResponse written to the DB")
+		}
+
+		logItem, ok := (<-proxy.DBWriteChannel).(*domain.Log)
+		if !ok {
+			t.Fatalf("\nwanted:\n*domain.Log written to the DB")
+		}
+
+		if logItem.RequestID == nil || *logItem.RequestID != id {
+			t.Errorf("\nwanted:\n%s\ngot:\n%v", id, logItem.RequestID)
+		}
+
+		if logItem.ExtensionID == nil || *logItem.ExtensionID != extensionID {
+			t.Errorf("\nwanted:\n%s\ngot:\n%v", extensionID, logItem.ExtensionID)
+		}
+
+		if logItem.Level != "ERROR" || logItem.Context["handler"] != "OnResponse" {
+			t.Errorf("\nwanted:\nERROR log for the OnResponse handler\ngot:\n%s %v", logItem.Level, logItem.Context)
+		}
+	})
+
+	persistTests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantSkipped bool
+	}{
+		{
+			name:        "response body with an allowed content type should be persisted",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"marasi":true}`,
+			wantSkipped: false,
+		},
+		{
+			name:        "response body with a content type matching a wildcard should be persisted",
+			contentType: "text/html",
+			body:        "<html></html>",
+			wantSkipped: false,
+		},
+		{
+			name:        "response body with a disallowed content type should be skipped",
+			contentType: "image/png",
+			body:        "\x89PNG\r\n\x1a\n",
+			wantSkipped: true,
+		},
+	}
+
+	for _, tt := range persistTests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t)
+			proxy.PersistBodyContentTypes = []string{"text/*", "application/json"}
+			proxy.OnResponse = func(res domain.ProxyResponse) error {
+				return nil
+			}
+
+			id, err := uuid.NewV7()
+			if err != nil {
+				t.Fatalf("generating uuid : %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "https://marasi.app/asset", nil)
+			*req = *core.ContextWithRequestID(req, id)
+			*req = *core.ContextWithMetadata(req, make(map[string]any))
+			*req = *core.ContextWithResponseTime(req, time.Now())
+
+			res := &http.Response{
+				Header:        make(http.Header),
+				Request:       req,
+				StatusCode:    http.StatusOK,
+				Status:        "200 OK",
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+				ContentLength: int64(len(tt.body)),
+			}
+			res.Header.Set("Content-Type", tt.contentType)
+
+			err = WriteResponseModifier(proxy, res)
+			if err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
+
+			got := (<-proxy.DBWriteChannel).(*domain.ProxyResponse)
+
+			skipped, _ := got.Metadata["body_skipped"].(bool)
+			if skipped != tt.wantSkipped {
+				t.Fatalf("\nwanted:\nbody_skipped %t\ngot:\n%t", tt.wantSkipped, skipped)
+			}
+
+			if storedBody := strings.Contains(string(got.Raw), tt.body); storedBody == tt.wantSkipped {
+				t.Errorf("\nwanted:\nbody stored %t\ngot:\n%s", !tt.wantSkipped, got.Raw)
+			}
+
+			if got.RawLength != int64(len(got.Raw)) {
+				t.Errorf("\nwanted:\n%d\ngot:\n%d", len(got.Raw), got.RawLength)
+			}
+
+			if !strings.Contains(string(got.Raw), "Content-Type: "+tt.contentType) {
+				t.Errorf("\nwanted:\nheaders to be stored\ngot:\n%s", got.Raw)
+			}
+
+			inFlight, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("reading response body : %v", err)
+			}
+			if string(inFlight) != tt.body {
+				t.Errorf("\nwanted:\n%q\ngot:\n%q", tt.body, inFlight)
+			}
+		})
+	}
 }
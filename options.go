@@ -1,6 +1,7 @@
 package marasi
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -8,12 +9,15 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"runtime"
+	"slices"
 	"time"
 
+	"github.com/google/martian"
 	"github.com/google/martian/mitm"
 	"github.com/spf13/viper"
 	"github.com/tfkr-ae/marasi/chrome"
@@ -33,6 +37,10 @@ type RepositoryProvider interface {
 	domain.ConfigRepository
 	domain.LogRepository
 	domain.ReportingRepository
+	domain.CertificateRepository
+	domain.ProfileRepository
+	domain.HealthRepository
+	domain.BatchRepository
 	io.Closer
 }
 
@@ -124,10 +132,6 @@ func WithConfigDir(appConfigDir string) func(*Proxy) error {
 // It prepares the extension's Lua state and adds it to the proxy's extension list.
 func WithExtension(extension *domain.Extension, options ...func(*extensions.Runtime) error) func(*Proxy) error {
 	return func(proxy *Proxy) error {
-		// Check if the map is nil and create if it is
-		if proxy.Extensions == nil {
-			proxy.Extensions = make([]*extensions.Runtime, 0)
-		}
 		// Check if the extension doesn't exist
 		if _, ok := proxy.GetExtension(extension.Name); !ok {
 			ext := &extensions.Runtime{Data: extension}
@@ -135,7 +139,9 @@ func WithExtension(extension *domain.Extension, options ...func(*extensions.Runt
 			if err != nil {
 				return fmt.Errorf("preparing extension %s : %w", extension.Name, err)
 			}
-			proxy.Extensions = append(proxy.Extensions, ext)
+			proxy.extensionsMu.Lock()
+			proxy.Extensions = append(slices.Clip(proxy.Extensions), ext)
+			proxy.extensionsMu.Unlock()
 		}
 
 		return nil
@@ -146,14 +152,18 @@ func WithExtension(extension *domain.Extension, options ...func(*extensions.Runt
 // It iterates through the provided extensions and prepares each one.
 func WithExtensions(exts []*domain.Extension, options ...func(*extensions.Runtime) error) func(*Proxy) error {
 	return func(proxy *Proxy) error {
+		proxy.extensionsMu.Lock()
 		proxy.Extensions = make([]*extensions.Runtime, 0)
+		proxy.extensionsMu.Unlock()
 		for _, extension := range exts {
 			if _, ok := proxy.GetExtension(extension.Name); !ok {
 				ext := &extensions.Runtime{Data: extension}
 				// Extension does not exist
 				// if it is enabled add it, if not keep it disabled
 				ext.PrepareState(proxy, options)
-				proxy.Extensions = append(proxy.Extensions, ext)
+				proxy.extensionsMu.Lock()
+				proxy.Extensions = append(slices.Clip(proxy.Extensions), ext)
+				proxy.extensionsMu.Unlock()
 			}
 		}
 
@@ -205,6 +215,128 @@ func WithLogHandler(handler func(log domain.Log) error) func(*Proxy) error {
 	}
 }
 
+// WithConnectHandler takes a handler function that will be executed on each CONNECT request
+func WithConnectHandler(handler func(host string, req *http.Request)) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		if proxy.OnConnect != nil {
+			return errors.New("proxy already has a connect handler defined")
+		}
+		proxy.OnConnect = handler
+		return nil
+	}
+}
+
+// WithExtensionEventHandler takes a handler function that will be executed on each event emitted by an extension
+func WithExtensionEventHandler(handler func(event extensions.ExtensionEvent)) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		if proxy.OnExtensionEvent != nil {
+			return errors.New("proxy already has an extension event handler defined")
+		}
+		proxy.OnExtensionEvent = handler
+		return nil
+	}
+}
+
+// WithDropHandler takes a handler function that will be executed where a request or response is dropped
+func WithDropHandler(handler PipelineStopHandler) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		if proxy.OnDrop != nil {
+			return errors.New("proxy already has a drop handler defined")
+		}
+		proxy.OnDrop = handler
+		return nil
+	}
+}
+
+// WithSkipHandler takes a handler function that will be executed where a request or response skips the rest of the pipeline
+func WithSkipHandler(handler PipelineStopHandler) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		if proxy.OnSkip != nil {
+			return errors.New("proxy already has a skip handler defined")
+		}
+		proxy.OnSkip = handler
+		return nil
+	}
+}
+
+// WithArtifactHandler takes a handler function that will be executed on each artifact saved by an extension.
+// The handler decides where the artifact is stored and should not trust the name chosen by the extension as a path.
+func WithArtifactHandler(handler func(name string, data []byte) error) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		if proxy.OnArtifact != nil {
+			return errors.New("proxy already has an artifact handler defined")
+		}
+		proxy.OnArtifact = handler
+		return nil
+	}
+}
+
+// WithProxyCredentials requires clients to authenticate to the proxy with the given basic authentication credentials.
+// Requests without a matching Proxy-Authorization header receive a 407 response.
+func WithProxyCredentials(username string, password string) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		if username == "" {
+			return errors.New("proxy username cannot be empty")
+		}
+		proxy.ProxyCredentials = &ProxyCredentials{Username: username, Password: password}
+		return nil
+	}
+}
+
+// WithInterceptMethods restricts request interception to the given methods (e.g. POST, PUT, DELETE).
+// Requests with other methods pass through even if the global intercept flag is set.
+func WithInterceptMethods(methods ...string) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.InterceptMethods = methods
+		return nil
+	}
+}
+
+// WithDefaultAllow sets the default behavior of the proxy scope for items not matching any rule.
+// A behavior persisted through SetDefaultAllow takes precedence over it when the proxy is created.
+func WithDefaultAllow(allow bool) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		scope, err := proxy.GetScope()
+		if err != nil {
+			return err
+		}
+		scope.SetDefaultAllow(allow)
+		return nil
+	}
+}
+
+// WithPreserveChunkedEncoding sets whether buffered chunked responses are re-emitted chunked to the client.
+// When disabled, they are sent with the `Content-Length` of the buffered body.
+func WithPreserveChunkedEncoding(enabled bool) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.PreserveChunkedEncoding = enabled
+		return nil
+	}
+}
+
+// WithDecompressBeforeExtensions sets whether response bodies are decompressed before the extensions run.
+// When disabled, extensions see the compressed bytes and the body is decompressed after they ran.
+func WithDecompressBeforeExtensions(enabled bool) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.DecompressBeforeExtensions = enabled
+		return nil
+	}
+}
+
+// setMITM configures martian to MITM TLS connections with leaf certificates issued by ca.
+// The certificates of both the CONNECT requests and the direct TLS connections are looked up through cachedCertificate.
+func (proxy *Proxy) setMITM(ca *x509.Certificate, priv any) error {
+	tlsc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		return fmt.Errorf("creating new mitm config : %w", err)
+	}
+	proxy.martianProxy.SetMITM(tlsc)
+	proxy.martianMITM = tlsc
+	proxy.mitmConfig = tlsc.TLS()
+	proxy.mitmConfig.GetCertificate = proxy.cachedCertificate(proxy.mitmConfig.GetCertificate, ca)
+	return nil
+}
+
 // WithTLS will configure the proxy CA based on the proxy.ConfigDir
 // It will also configure the http.Client that is used for the launchpad requests
 // TODO - Check if the certificate expired
@@ -241,12 +373,9 @@ func WithTLS() func(*Proxy) error {
 		if err != nil {
 			return fmt.Errorf("setting spki hash %s : %w", proxy.SPKIHash, err)
 		}
-		tlsc, err := mitm.NewConfig(x509c, priv)
-		if err != nil {
-			return fmt.Errorf("creating new mitm config : %w", err)
+		if err := proxy.setMITM(x509c, priv); err != nil {
+			return err
 		}
-		proxy.martianProxy.SetMITM(tlsc)
-		proxy.mitmConfig = tlsc.TLS()
 
 		// Add system certificates + marasi cert
 		systemPool, err := x509.SystemCertPool()
@@ -274,11 +403,66 @@ func WithDefaultRepositories(repo RepositoryProvider) func(*Proxy) error {
 			WithLaunchpadRepository(repo),
 			WithWaypointRepository(repo),
 			WithReportingRepository(repo),
+			WithProfileRepository(repo),
+			WithHealthRepository(repo),
+			WithBatchRepository(repo),
 			WithDBCloser(repo),
 		)
 	}
 }
 
+// WithCertCache sets the cache used for the generated MITM leaf certificates.
+// The proxy uses a MemoryCertCache by default, use NewRepositoryCertCache to persist the certificates and their private keys.
+func WithCertCache(cache CertCache) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.CertCache = cache
+		return nil
+	}
+}
+
+// WithPersistBodyContentTypes sets the response content types whose bodies are persisted to the database.
+// Entries can be exact media types (application/json) or wildcard subtypes (text/*).
+func WithPersistBodyContentTypes(contentTypes ...string) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.PersistBodyContentTypes = contentTypes
+		return nil
+	}
+}
+
+// WithMaxConnsPerHost limits the number of simultaneous upstream connections per host.
+// The limit is applied to the proxy's upstream transport, so it covers the requests sent with Launch and marasi:builder() as well.
+func WithMaxConnsPerHost(maxConns int) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		if maxConns < 0 {
+			return fmt.Errorf("max connections per host must not be negative : %d", maxConns)
+		}
+		proxy.MaxConnsPerHost = maxConns
+		return nil
+	}
+}
+
+// WithOriginalDestination sets the function returning the original destination of connections redirected to the proxy,
+// such as when Marasi is used as a transparent proxy. Connections that are neither HTTP nor TLS are relayed to it untouched.
+func WithOriginalDestination(resolver func(conn net.Conn) (string, error)) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.OriginalDestination = resolver
+		return nil
+	}
+}
+
+// WithPinnedCerts sets the SHA-256 certificate fingerprints (hex, optionally ':' separated) that upstream hosts must present.
+func WithPinnedCerts(pins map[string]string) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		for host, fingerprint := range pins {
+			if len(normalizeFingerprint(fingerprint)) != sha256.Size*2 {
+				return fmt.Errorf("invalid SHA-256 fingerprint for %s : %q", host, fingerprint)
+			}
+		}
+		proxy.PinnedCerts = pins
+		return nil
+	}
+}
+
 // WithDBCloser injects the database closer.
 func WithDBCloser(closer io.Closer) func(*Proxy) error {
 	return func(proxy *Proxy) error {
@@ -355,17 +539,78 @@ func WithReportingRepository(repo domain.ReportingRepository) func(*Proxy) error
 	}
 }
 
+// WithProfileRepository injects the profile repository implementation.
+func WithProfileRepository(repo domain.ProfileRepository) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.ProfileRepo = repo
+		return nil
+	}
+}
+
+// WithHealthRepository injects the health repository implementation.
+func WithHealthRepository(repo domain.HealthRepository) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.HealthRepo = repo
+		return nil
+	}
+}
+
+// WithBatchRepository injects the repository used to write the DBWriteChannel items in transactions.
+func WithBatchRepository(repo domain.BatchRepository) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		proxy.BatchRepo = repo
+		return nil
+	}
+}
+
+// WithDBWriteBatching sets the maximum number of items written in a single transaction and
+// the maximum time to wait for more items after the first one of a batch.
+func WithDBWriteBatching(size int, delay time.Duration) func(*Proxy) error {
+	return func(proxy *Proxy) error {
+		if size < 0 {
+			return fmt.Errorf("batch size must not be negative, got %d", size)
+		}
+		if delay < 0 {
+			return fmt.Errorf("batch delay must not be negative, got %s", delay)
+		}
+		proxy.DBWriteBatchSize = size
+		proxy.DBWriteBatchDelay = delay
+		return nil
+	}
+}
+
 // WithBasePipeline will setup the base modifier pipeline for marasi
 // It will define the main Request & Response modifiers that will execute the
 // attached modifiers and hande `ErrDropped` and `ErrSkipPipeline`.
 // If a response is dropped the `martian.Session` is read from the context and hijacked to
-// close the `conn`
+// close the `conn`. The x-marasi-sni, x-marasi-header-order and x-marasi-redirect-chain headers are moved into the context
+// before the modifiers run so skipped requests do not send them upstream, the raw headers recorded by the listener are moved into the
+// context as well (see takeRawHeader). The base pipeline also tracks the number of active requests used by `Shutdown`,
+// requests whose session was hijacked by a request modifier stop counting as active since no response follows.
+// The host of a CONNECT request is restored once the modifiers ran, martian mints the MITM certificate for it when the client
+// sends no SNI, so the client receives a certificate for the host it asked for even when a modifier or `OnConnect` changed it.
+// The certificate of the CONNECT host is then looked up through the certificate cache of the proxy, see primeCertificate
 func WithBasePipeline() func(*Proxy) error {
 	return func(proxy *Proxy) error {
 		proxy.martianProxy.SetRequestModifier(
 			martianReqModifierFunc(func(req *http.Request) error {
+				if req.Method == http.MethodConnect {
+					host := req.Host
+					defer func() {
+						req.Host = host
+						proxy.primeCertificate(host)
+					}()
+				}
+				proxy.activeRequests.Add(1)
+				proxy.takeRawHeader(req)
+				takeInternalHeaders(proxy, req)
 				err := proxy.Modifiers.ModifyRequest(req)
-				if err == nil || errors.Is(err, ErrDropped) || errors.Is(err, ErrSkipPipeline) {
+				// A hijacked request never reaches the response modifier
+				if ctx := martian.NewContext(req); ctx != nil && ctx.Session().Hijacked() {
+					proxy.activeRequests.Add(-1)
+				}
+				// Handler panics are already reported through the proxy logs
+				if err == nil || errors.Is(err, ErrDropped) || errors.Is(err, ErrSkipPipeline) || errors.Is(err, ErrHandlerPanic) {
 					return nil
 				}
 				// TODO this should be handled through logging
@@ -375,8 +620,10 @@ func WithBasePipeline() func(*Proxy) error {
 		)
 		proxy.martianProxy.SetResponseModifier(
 			martianResModifierFunc(func(res *http.Response) error {
+				defer proxy.activeRequests.Add(-1)
 				err := proxy.Modifiers.ModifyResponse(res)
-				if err == nil || errors.Is(err, ErrSkipPipeline) {
+				// Handler panics are already reported through the proxy logs
+				if err == nil || errors.Is(err, ErrSkipPipeline) || errors.Is(err, ErrHandlerPanic) {
 					return nil
 				}
 				if errors.Is(err, ErrDropped) {
@@ -407,11 +654,13 @@ func WithBasePipeline() func(*Proxy) error {
 // WithDefaultModifierPipeline will apply the default modifier pipelines for Requests & Responses.
 // The processing order is:
 // (Request): Compass -> Waypoint -> Extensions -> Checkpoint -> Database Write
-// (Response): Buffer Streaming -> Decompress -> Compass -> Extensions -> Checkpoint -> Database Write
+// (Response): Buffer Streaming -> Decompress -> Compass -> Extensions -> Checkpoint -> Rechunk -> Database Write
+// When `proxy.DecompressBeforeExtensions` is false, responses are decompressed after the extensions instead.
 func WithDefaultModifierPipeline() func(*Proxy) error {
 	return func(proxy *Proxy) error {
 		// Request Modifiers
 		proxy.AddRequestModifier(PreventLoopModifier)
+		proxy.AddRequestModifier(ProxyAuthRequestModifier)
 		proxy.AddRequestModifier(SkipConnectRequestModifier)
 		proxy.AddRequestModifier(CompassRequestModifier)
 		proxy.AddRequestModifier(SetupRequestModifier)
@@ -422,11 +671,14 @@ func WithDefaultModifierPipeline() func(*Proxy) error {
 
 		// Response Modifiers
 		proxy.AddResponseModifier(ResponseFilterModifier)
+		proxy.AddResponseModifier(TLSInfoResponseModifier)
 		proxy.AddResponseModifier(BufferStreamingBodyModifier)
-		proxy.AddResponseModifier(CompressedResponseModifier)
+		proxy.AddResponseModifier(DecompressBeforeExtensionsModifier)
 		proxy.AddResponseModifier(CompassResponseModifier)
 		proxy.AddResponseModifier(ExtensionsResponseModifier)
+		proxy.AddResponseModifier(DecompressAfterExtensionsModifier)
 		proxy.AddResponseModifier(CheckpointResponseModifier)
+		proxy.AddResponseModifier(RechunkResponseModifier)
 		proxy.AddResponseModifier(WriteResponseModifier)
 		return nil
 	}
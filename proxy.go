@@ -15,23 +15,31 @@ package marasi
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"maps"
 	"mime"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/martian"
 	"github.com/google/martian/fifo"
+	"github.com/google/martian/mitm"
 	"github.com/google/uuid"
 	"github.com/tfkr-ae/marasi/chrome"
 	"github.com/tfkr-ae/marasi/compass"
@@ -47,12 +55,29 @@ var (
 	ErrConfigDirNotSet = errors.New("config dir not set")
 	// ErrScopeNotFound is returned when the scope is not found in the proxy.
 	ErrScopeNotFound = errors.New("scope field is not found")
+	// ErrEgressPolicyNotFound is returned when the extension egress policy is not found in the proxy.
+	ErrEgressPolicyNotFound = errors.New("extension egress policy field is not found")
 	// ErrClientNotFound is returned when the HTTP client is not found in the proxy.
 	ErrClientNotFound = errors.New("http client field not found")
 	// ErrExtensionRepoNotFound is returned when the extension repository is not found.
 	ErrExtensionRepoNotFound = errors.New("extension repo not found")
 	// ErrReportingRepoNotFound is returned when the reporting repository is not found.
 	ErrReportingRepoNotFound = errors.New("reporting repo not found")
+	// ErrTrafficRepoNotFound is returned when the traffic repository is not found.
+	ErrTrafficRepoNotFound = errors.New("traffic repo not found")
+	// ErrProfileRepoNotFound is returned when the profile repository is not found.
+	ErrProfileRepoNotFound = errors.New("profile repo not found")
+	// ErrLaunchpadRepoNotFound is returned when the launchpad repository is not found.
+	ErrLaunchpadRepoNotFound = errors.New("launchpad repo not found")
+	// ErrHealthRepoNotFound is returned when the health repository is not found.
+	ErrHealthRepoNotFound = errors.New("health repo not found")
+	// ErrExtensionNotLoaded is returned when an operation targets an extension that is not loaded in the proxy.
+	ErrExtensionNotLoaded = errors.New("extension is not loaded")
+	// ErrCompressedBodyModified is returned when a compressed response body cannot be decompressed after the extensions ran,
+	// which happens when an extension replaces the body without removing the Content-Encoding header.
+	ErrCompressedBodyModified = errors.New("compressed response body was modified by an extension")
+	// ErrArtifactHandlerUndefined is returned when an extension saves an artifact and no artifact handler is set.
+	ErrArtifactHandlerUndefined = errors.New("no artifact handler defined")
 )
 
 const (
@@ -60,31 +85,70 @@ const (
 	keyFile  = "marasi_key.pem"  // Private Key File Name
 )
 
+// DefaultAllowConfigKey is the configuration key the default behavior of the proxy scope is persisted under.
+const DefaultAllowConfigKey = "scope_default_allow"
+
+const (
+	DefaultDBWriteBatchSize  = 100                   // Maximum number of items written in a single transaction when Proxy.DBWriteBatchSize is not set
+	DefaultDBWriteBatchDelay = 10 * time.Millisecond // Maximum time to wait for more items of a batch when Proxy.DBWriteBatchDelay is not set
+)
+
+// PipelineStopHandler is called when a request or response stops the modifier pipeline, see Proxy.OnDrop and Proxy.OnSkip.
+// stage is the modifier that stopped the pipeline (e.g. "compass_request", "extensions_response", "checkpoint_request") and reason describes why.
+// reqID is uuid.Nil for requests stopped before an ID was assigned, such as the requests skipped by compass.
+type PipelineStopHandler func(reqID uuid.UUID, stage string, reason string)
+
+// ProxyCredentials are the basic authentication credentials clients must send to use the proxy
+type ProxyCredentials struct {
+	Username string // Username expected in the Proxy-Authorization header
+	Password string // Password expected in the Proxy-Authorization header
+}
+
 // Proxy is the main struct that orchestrates all proxy functionality including request/response processing,
 // extension management, database operations, and TLS handling. It serves as the central coordinator
 // for the Marasi proxy server.
 type Proxy struct {
-	martianProxy          *martian.Proxy                       // The underlying martian.Proxy
-	ConfigDir             string                               // The configuration directory (defaults to the marasi folder under the user configuration directory)
-	Config                *Config                              // The marasi proxy configuration (separate from the GUI config)
-	Modifiers             *fifo.Group                          // Modifier group pipeline
-	DBWriteChannel        chan any                             // DB Write Channel
-	InterceptedQueue      []*Intercepted                       // Queue of intercepted requests / responses
-	OnRequest             func(req domain.ProxyRequest) error  // Function to be ran on each request - used by the GUI application to handle the new requests
-	OnResponse            func(res domain.ProxyResponse) error // Function to be ran on each response - used by the GUI application to handle the new responses
-	OnIntercept           func(intercepted *Intercepted) error // Function to be ran on each intercept - used by the GUI application to handle the new intercepted items
-	OnLog                 func(log domain.Log) error           // Function to be ran on each log event - used by the GUI application to handle new log entries
-	Addr                  string                               // IP Address of the proxy
-	Port                  string                               // Port of the proxy
-	Client                *http.Client                         // HTTP Client that is used by the repeater functionality (autoconfigured to use the proxy)
-	Extensions            []*extensions.Runtime                // Slice of loaded extensions
-	SPKIHash              string                               // SPKI Hash of the current certificate
-	Cert                  *x509.Certificate                    // The proxy's TLS certificate.
-	mitmConfig            *tls.Config                          // Martian Proxy MITM config
-	MarasiClientTLSConfig *tls.Config                          // TLSConfig for the proxy.Client
-	Scope                 *compass.Scope                       // Proxy scope configuration through Compass
-	Waypoints             map[string]string                    // Map of host:port overrides
-	InterceptFlag         bool                                 // Global intercept flag
+	martianProxy               *martian.Proxy                       // The underlying martian.Proxy
+	ConfigDir                  string                               // The configuration directory (defaults to the marasi folder under the user configuration directory)
+	Config                     *Config                              // The marasi proxy configuration (separate from the GUI config)
+	Modifiers                  *fifo.Group                          // Modifier group pipeline
+	DBWriteChannel             chan any                             // DB Write Channel
+	InterceptedQueue           []*Intercepted                       // Queue of intercepted requests / responses
+	OnRequest                  func(req domain.ProxyRequest) error  // Function to be ran on each request - used by the GUI application to handle the new requests
+	OnResponse                 func(res domain.ProxyResponse) error // Function to be ran on each response - used by the GUI application to handle the new responses
+	OnIntercept                func(intercepted *Intercepted) error // Function to be ran on each intercept - used by the GUI application to handle the new intercepted items
+	OnLog                      func(log domain.Log) error           // Function to be ran on each log event - used by the GUI application to handle new log entries
+	OnConnect                  func(host string, req *http.Request) // Function to be ran on each CONNECT request before it is skipped - used by the GUI application to show the established tunnels
+	OnExtensionEvent           func(extensions.ExtensionEvent)      // Function to be ran on each event emitted by an extension with marasi:emit - used by the GUI application to notify the user
+	OnArtifact                 func(name string, data []byte) error // Function to be ran on each artifact saved by an extension with marasi:save_artifact - used by the GUI application to decide where the artifact is stored
+	OnDrop                     PipelineStopHandler                  // Function to be ran where a request or response is dropped (`ErrDropped`) - used to count and inspect the dropped exchanges
+	OnSkip                     PipelineStopHandler                  // Function to be ran where a request or response skips the rest of the pipeline (`ErrSkipPipeline`) - used to count and inspect the skipped exchanges
+	Addr                       string                               // IP Address of the proxy
+	Port                       string                               // Port of the proxy
+	ListenAddrs                []string                             // host:port of every address the proxy is bound to, Addr and Port hold the first one
+	Client                     *http.Client                         // HTTP Client that is used by the repeater functionality (autoconfigured to use the proxy)
+	Extensions                 []*extensions.Runtime                // Slice of loaded extensions, it is replaced instead of changed in place while the proxy is running
+	SPKIHash                   string                               // SPKI Hash of the current certificate
+	Cert                       *x509.Certificate                    // The proxy's TLS certificate.
+	mitmConfig                 *tls.Config                          // Martian Proxy MITM config
+	martianMITM                *mitm.Config                         // MITM config martian uses for CONNECT requests, see primeCertificate
+	CertCache                  CertCache                            // Cache of the generated MITM leaf certificates
+	MarasiClientTLSConfig      *tls.Config                          // TLSConfig for the proxy.Client
+	Scope                      *compass.Scope                       // Proxy scope configuration through Compass, read and replaced with GetScope and SetScope once the proxy is serving
+	Waypoints                  map[string]string                    // Map of host:port overrides, use SetWaypoint and RemoveWaypoint to change it while the proxy is running
+	ExtensionEgressPolicy      *compass.Scope                       // Hosts extensions can send requests to with marasi:builder(), allows all hosts by default
+	PersistBodyContentTypes    []string                             // Response content types (e.g. text/*, application/json) whose bodies are persisted, all bodies are persisted when empty
+	MaxConnsPerHost            int                                  // Maximum number of upstream connections per host, 0 means no limit
+	StrictLaunchpadVars        bool                                 // Launch returns an error for {{name}} placeholders without a launchpad variable instead of leaving them intact
+	PinnedCerts                map[string]string                    // Map of hostname to the expected SHA-256 fingerprint (hex) of its leaf certificate, applied when Serve is called
+	DecompressBeforeExtensions bool                                 // Decompress response bodies before the extensions run so they see plaintext (default), otherwise after they ran
+	PreserveChunkedEncoding    bool                                 // Re-emit chunked responses chunked after they were buffered instead of with a Content-Length
+	ProxyCredentials           *ProxyCredentials                    // Credentials clients must send in the Proxy-Authorization header, nil disables proxy authentication
+	OriginalDestination        func(conn net.Conn) (string, error)  // Returns the original "host:port" of redirected connections, non-HTTP connections are relayed to it untouched when set
+	InterceptFlag              bool                                 // Global intercept flag
+	InterceptMethods           []string                             // Request methods that can be intercepted, all methods can be intercepted when empty
+	DBWriteBatchSize           int                                  // Maximum number of DBWriteChannel items written in a single transaction, DefaultDBWriteBatchSize when 0
+	DBWriteBatchDelay          time.Duration                        // Maximum time to wait for more items after the first one of a batch, DefaultDBWriteBatchDelay when 0
 
 	TrafficRepo   domain.TrafficRepository   // Repository for traffic data.
 	LaunchpadRepo domain.LaunchpadRepository // Repository for launchpad data.
@@ -94,8 +158,22 @@ type Proxy struct {
 	LogRepo       domain.LogRepository       // Repository for log data.
 	ExtensionRepo domain.ExtensionRepository // Repository for extension data.
 	ReportingRepo domain.ReportingRepository // Repository for reporting data.
+	ProfileRepo   domain.ProfileRepository   // Repository for exporting and importing profiles.
+	HealthRepo    domain.HealthRepository    // Repository for checking the database health.
+	BatchRepo     domain.BatchRepository     // Repository for writing the DBWriteChannel items in transactions, items are written one by one when nil.
 	DBCloser      io.Closer                  // Closer for the database connection.
 	Logger        *slog.Logger               // Logger for Marasi
+
+	scopeMu        sync.RWMutex  // Guards Scope
+	listener       net.Listener  // Listener the proxy is serving on
+	internalToken  string        // Sent by Launch in the x-marasi-internal header, the x-marasi-header-order of requests without it is ignored
+	activeRequests atomic.Int64  // Number of requests currently going through the modifier pipeline
+	dbWriterStop   chan struct{} // Closed by Shutdown to make WriteToDB return once DBWriteChannel is drained
+	dbWriterDone   chan struct{} // Closed when WriteToDB returns
+	closeOnce      sync.Once     // Ensures the martian proxy is only closed once
+	waypointsMu    sync.RWMutex  // Guards Waypoints
+	extensionsMu   sync.RWMutex  // Guards Extensions
+	reloadMu       sync.Mutex    // Serializes ReloadExtension
 }
 
 // GetConfigDir returns the configuration directory path.
@@ -110,12 +188,102 @@ func (proxy *Proxy) GetConfigDir() (string, error) {
 // GetScope returns the current scope configuration.
 // It returns an error if the scope is not set.
 func (proxy *Proxy) GetScope() (*compass.Scope, error) {
+	proxy.scopeMu.RLock()
+	defer proxy.scopeMu.RUnlock()
 	if proxy.Scope == nil {
 		return nil, ErrScopeNotFound
 	}
 	return proxy.Scope, nil
 }
 
+// SetScope atomically replaces the proxy scope.
+// Requests that are already being matched keep using the previous scope, new requests use the replacement.
+// The default behavior of the scope is persisted like SetDefaultAllow so it is restored the next time the proxy is created.
+func (proxy *Proxy) SetScope(scope *compass.Scope) error {
+	proxy.scopeMu.Lock()
+	proxy.Scope = scope
+	proxy.scopeMu.Unlock()
+
+	return proxy.persistDefaultAllow(scope.DefaultAllow)
+}
+
+// SetDefaultAllow sets the default behavior of the proxy scope for items not matching any rule.
+// The behavior is persisted through the ConfigRepo when it is set, so it is restored the next time the proxy is created.
+func (proxy *Proxy) SetDefaultAllow(allow bool) error {
+	scope, err := proxy.GetScope()
+	if err != nil {
+		return err
+	}
+	scope.SetDefaultAllow(allow)
+
+	return proxy.persistDefaultAllow(allow)
+}
+
+// persistDefaultAllow stores the default behavior of the proxy scope through the ConfigRepo when it is set.
+func (proxy *Proxy) persistDefaultAllow(allow bool) error {
+	if proxy.ConfigRepo == nil {
+		return nil
+	}
+	if err := proxy.ConfigRepo.Set(DefaultAllowConfigKey, strconv.FormatBool(allow)); err != nil {
+		return fmt.Errorf("persisting default allow : %w", err)
+	}
+	return nil
+}
+
+// loadDefaultAllow applies the default behavior persisted by SetDefaultAllow to the proxy scope.
+// The scope is left untouched when the ConfigRepo is not set or nothing was persisted.
+func (proxy *Proxy) loadDefaultAllow() error {
+	if proxy.ConfigRepo == nil {
+		return nil
+	}
+	value, err := proxy.ConfigRepo.Get(DefaultAllowConfigKey)
+	if errors.Is(err, domain.ErrConfigKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting config key %s : %w", DefaultAllowConfigKey, err)
+	}
+	allow, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("parsing config key %s : %w", DefaultAllowConfigKey, err)
+	}
+
+	scope, err := proxy.GetScope()
+	if err != nil {
+		return err
+	}
+	scope.SetDefaultAllow(allow)
+	return nil
+}
+
+// GetExtensionEgressPolicy returns the policy that restricts the hosts extensions can send requests to.
+// Requests built by extensions bypass the proxy scope, setting DefaultAllow to false and adding include rules for the
+// expected hosts (or exclude rules for blocked hosts) limits where an extension can send data.
+// It returns an error if the policy is not set.
+func (proxy *Proxy) GetExtensionEgressPolicy() (*compass.Scope, error) {
+	if proxy.ExtensionEgressPolicy == nil {
+		return nil, ErrEgressPolicyNotFound
+	}
+	return proxy.ExtensionEgressPolicy, nil
+}
+
+// EmitEvent passes an event emitted by an extension to proxy.OnExtensionEvent, the event is dropped if no handler is set.
+func (proxy *Proxy) EmitEvent(event extensions.ExtensionEvent) error {
+	if proxy.OnExtensionEvent != nil {
+		proxy.OnExtensionEvent(event)
+	}
+	return nil
+}
+
+// SaveArtifact passes an artifact saved by an extension to proxy.OnArtifact.
+// It returns ErrArtifactHandlerUndefined if no handler is set, as the artifact would otherwise be lost.
+func (proxy *Proxy) SaveArtifact(name string, data []byte) error {
+	if proxy.OnArtifact == nil {
+		return ErrArtifactHandlerUndefined
+	}
+	return proxy.OnArtifact(name, data)
+}
+
 // GetClient returns the proxy's HTTP client.
 // It returns an error if the client is not set.
 func (proxy *Proxy) GetClient() (*http.Client, error) {
@@ -143,6 +311,23 @@ func (proxy *Proxy) GetTrafficRepo() (domain.TrafficRepository, error) {
 	return proxy.TrafficRepo, nil
 }
 
+// ClearTrafficOptions configures which traffic is kept by ClearTraffic.
+type ClearTrafficOptions struct {
+	PreserveLaunchpad bool // Keep the requests that are linked to a launchpad
+}
+
+// ClearTraffic deletes the captured traffic of the current session from the traffic repository.
+// Requests that are still going through the pipeline are written after the clear and are kept.
+func (proxy *Proxy) ClearTraffic(opts ClearTrafficOptions) error {
+	if proxy.TrafficRepo == nil {
+		return ErrTrafficRepoNotFound
+	}
+	if err := proxy.TrafficRepo.ClearTraffic(opts.PreserveLaunchpad); err != nil {
+		return fmt.Errorf("clearing traffic : %w", err)
+	}
+	return nil
+}
+
 // GetReportingRepo returns the reporting repository.
 // It returns an error if the repository is not set.
 func (proxy *Proxy) GetReportingRepo() (domain.ReportingRepository, error) {
@@ -164,30 +349,41 @@ func (proxy *Proxy) GetReportingRepo() (domain.ReportingRepository, error) {
 //   - error: Configuration error if any option fails
 func New(options ...func(*Proxy) error) (*Proxy, error) {
 	proxy := &Proxy{
-		martianProxy:   martian.NewProxy(),
-		Modifiers:      fifo.NewGroup(),
-		DBWriteChannel: make(chan any, 10),
-		Extensions:     make([]*extensions.Runtime, 0),
-		Client:         &http.Client{},
-		Scope:          compass.NewScope(true),
-		Waypoints:      make(map[string]string),
-		InterceptFlag:  false,
-		Logger:         slog.Default(),
+		martianProxy:               martian.NewProxy(),
+		Modifiers:                  fifo.NewGroup(),
+		DBWriteChannel:             make(chan any, 10),
+		dbWriterStop:               make(chan struct{}),
+		Extensions:                 make([]*extensions.Runtime, 0),
+		Client:                     &http.Client{CheckRedirect: recordRedirect},
+		Scope:                      compass.NewScope(true),
+		Waypoints:                  make(map[string]string),
+		ExtensionEgressPolicy:      compass.NewScope(true),
+		CertCache:                  NewMemoryCertCache(),
+		InterceptFlag:              false,
+		DecompressBeforeExtensions: true,
+		Logger:                     slog.Default(),
+		internalToken:              uuid.NewString(),
 	}
 	err := proxy.WithOptions(options...)
 	if err != nil {
 		return nil, err
 	}
+	if err := proxy.loadDefaultAllow(); err != nil {
+		return nil, fmt.Errorf("loading default allow : %w", err)
+	}
 	return proxy, nil
 }
 
-// AddRequestModifier accepts RequestModifierFunc and wraps it in a reqAdapter
+// AddRequestModifier accepts RequestModifierFunc and wraps it in a reqAdapter.
+// Modifiers run in the order they are added, so Go embedders can extend the pipeline by adding their own
+// modifiers after `WithDefaultModifierPipeline`. Returning `ErrSkipPipeline` or `ErrDropped` stops the pipeline.
 func (proxy *Proxy) AddRequestModifier(modifier RequestModifierFunc) {
 	adapter := &reqAdapter{proxy: proxy, modifier: modifier}
 	proxy.Modifiers.AddRequestModifier(adapter)
 }
 
-// AddResponseModifier accepts ResponseModifierFunc and wraps it in a resAdapter
+// AddResponseModifier accepts ResponseModifierFunc and wraps it in a resAdapter.
+// Like AddRequestModifier, modifiers run in the order they are added and `ErrSkipPipeline` or `ErrDropped` stops the pipeline.
 func (proxy *Proxy) AddResponseModifier(modifier ResponseModifierFunc) {
 	adapter := &resAdapter{proxy: proxy, modifier: modifier}
 	proxy.Modifiers.AddResponseModifier(adapter)
@@ -209,15 +405,65 @@ func (proxy *Proxy) SyncWaypoints() error {
 		waypointsMap[waypoint.Hostname] = waypoint.Override
 	}
 
+	proxy.waypointsMu.Lock()
 	proxy.Waypoints = waypointsMap
+	proxy.waypointsMu.Unlock()
+	return nil
+
+}
+
+// SetWaypoint redirects requests for the source host:port to the target host:port.
+// The waypoint is persisted through the waypoint repository when it is set.
+func (proxy *Proxy) SetWaypoint(source string, target string) error {
+	if proxy.WaypointRepo != nil {
+		if err := proxy.WaypointRepo.CreateOrUpdateWaypoint(source, target); err != nil {
+			return fmt.Errorf("setting waypoint for %s : %w", source, err)
+		}
+	}
+
+	proxy.waypointsMu.Lock()
+	defer proxy.waypointsMu.Unlock()
+	if proxy.Waypoints == nil {
+		proxy.Waypoints = make(map[string]string)
+	}
+	proxy.Waypoints[source] = target
+	return nil
+}
+
+// RemoveWaypoint stops redirecting requests for the source host:port.
+// The waypoint is removed from the waypoint repository when it is set.
+func (proxy *Proxy) RemoveWaypoint(source string) error {
+	if proxy.WaypointRepo != nil {
+		if err := proxy.WaypointRepo.DeleteWaypoint(source); err != nil {
+			return fmt.Errorf("removing waypoint for %s : %w", source, err)
+		}
+	}
+
+	proxy.waypointsMu.Lock()
+	defer proxy.waypointsMu.Unlock()
+	delete(proxy.Waypoints, source)
 	return nil
+}
 
+// waypoint returns the override for the host:port if a waypoint is set for it.
+func (proxy *Proxy) waypoint(hostPort string) (string, bool) {
+	proxy.waypointsMu.RLock()
+	defer proxy.waypointsMu.RUnlock()
+	override, ok := proxy.Waypoints[hostPort]
+	return override, ok
+}
+
+// loadedExtensions returns the current slice of loaded extensions, it is safe to iterate while ReloadExtension runs
+func (proxy *Proxy) loadedExtensions() []*extensions.Runtime {
+	proxy.extensionsMu.RLock()
+	defer proxy.extensionsMu.RUnlock()
+	return proxy.Extensions
 }
 
 // GetExtension retrieves a loaded extension by its name.
 // It returns the extension and true if found, otherwise nil and false.
 func (proxy *Proxy) GetExtension(name string) (*extensions.Runtime, bool) {
-	for _, ext := range proxy.Extensions {
+	for _, ext := range proxy.loadedExtensions() {
 		if ext.Data.Name == name {
 			return ext, true
 		}
@@ -225,6 +471,79 @@ func (proxy *Proxy) GetExtension(name string) (*extensions.Runtime, bool) {
 	return nil, false
 }
 
+// GetExtensionByID retrieves a loaded extension by its ID.
+// It returns the extension and true if found, otherwise nil and false.
+func (proxy *Proxy) GetExtensionByID(id uuid.UUID) (*extensions.Runtime, bool) {
+	for _, ext := range proxy.loadedExtensions() {
+		if ext.Data.ID == id {
+			return ext, true
+		}
+	}
+	return nil, false
+}
+
+// originExtension returns the loaded extension that sent a request, identified by the value of its "x-extension-id" header.
+// It returns nil if the value is empty, not a valid ID, or does not belong to a loaded extension.
+func (proxy *Proxy) originExtension(extensionID string) *extensions.Runtime {
+	id, err := uuid.Parse(extensionID)
+	if err != nil {
+		return nil
+	}
+	ext, _ := proxy.GetExtensionByID(id)
+	return ext
+}
+
+// ReloadExtension replaces a loaded extension with a fresh runtime running the latest Lua code from the extension repository.
+// The reloaded extension keeps its position in the extension list, as well as the log handler, max sleep and modules of the old runtime.
+// If the new code fails to load, the error is returned and the old runtime stays active.
+// Otherwise the old runtime is closed once it was swapped out, calls that already hold it finish first (see extensions.Runtime.Close).
+func (proxy *Proxy) ReloadExtension(name string) error {
+	repo, err := proxy.GetExtensionRepo()
+	if err != nil {
+		return err
+	}
+
+	proxy.reloadMu.Lock()
+	defer proxy.reloadMu.Unlock()
+
+	old, ok := proxy.GetExtension(name)
+	if !ok {
+		return fmt.Errorf("reloading %s : %w", name, ErrExtensionNotLoaded)
+	}
+
+	data, err := repo.GetExtensionByName(name)
+	if err != nil {
+		return fmt.Errorf("getting extension %s : %w", name, err)
+	}
+
+	ext := &extensions.Runtime{
+		Data:         data,
+		OnLog:        old.OnLog,
+		MaxSleep:     old.MaxSleep,
+		MaxCallDepth: old.MaxCallDepth,
+	}
+	var options []func(*extensions.Runtime) error
+	if old.Modules != nil {
+		options = append(options, extensions.WithModules(old.Modules))
+	}
+
+	if err := ext.PrepareState(proxy, options); err != nil {
+		return fmt.Errorf("reloading %s : %w", name, err)
+	}
+
+	// The slice is replaced so the modifiers iterating over the previous one are not affected
+	proxy.extensionsMu.Lock()
+	loaded := slices.Clone(proxy.Extensions)
+	if idx := slices.Index(loaded, old); idx != -1 {
+		loaded[idx] = ext
+	}
+	proxy.Extensions = loaded
+	proxy.extensionsMu.Unlock()
+
+	old.Close()
+	return nil
+}
+
 // InterceptionTuple contains the user's decision when an intercepted item is resumed,
 // indicating whether to continue and whether to intercept the corresponding response.
 type InterceptionTuple struct {
@@ -286,12 +605,28 @@ func NewProxyRequest(req *http.Request, requestId uuid.UUID) (*domain.ProxyReque
 			Method:      req.Method,
 			Host:        req.Host,
 			Path:        path,
+			Proto:       req.Proto,
 			Metadata:    metadata,
 			RequestedAt: requestTime,
 		}
+		if tags, ok := core.TagsFromContext(req.Context()); ok {
+			proxyRequest.Tags = tags
+		}
+		if note, ok := core.NoteFromContext(req.Context()); ok {
+			proxyRequest.Note = &note
+		}
 
 		// TODO Check prettified error
-		rawReq, prettified, err := rawhttp.DumpRequest(req)
+		var (
+			rawReq     []byte
+			prettified string
+			err        error
+		)
+		if order, ok := core.HeaderOrderFromContext(req.Context()); ok {
+			rawReq, prettified, err = rawhttp.DumpRequestOrdered(req, order)
+		} else {
+			rawReq, prettified, err = rawhttp.DumpRequest(req)
+		}
 
 		req.Host = currentHost
 		req.URL.Host = currentURLHost
@@ -301,9 +636,12 @@ func NewProxyRequest(req *http.Request, requestId uuid.UUID) (*domain.ProxyReque
 		}
 
 		proxyRequest.Raw = domain.RawField(rawReq)
+		proxyRequest.RawLength = int64(len(rawReq))
 		if prettified != "" {
 			proxyRequest.Metadata["prettified-request"] = prettified
 		}
+		// The request is written by WriteToDB while the response modifiers keep writing to the metadata in the context
+		proxyRequest.Metadata = maps.Clone(metadata)
 		return proxyRequest, nil
 	}
 	return nil, fmt.Errorf("metadata not set")
@@ -336,7 +674,20 @@ func NewProxyResponse(res *http.Response) (*domain.ProxyResponse, error) {
 		return nil, fmt.Errorf("timestamp not found for this context")
 	}
 
-	rawRes, prettified, err := rawhttp.DumpResponse(res)
+	metadata, ok := core.MetadataFromContext(res.Request.Context())
+	if !ok {
+		metadata = make(map[string]any)
+	}
+
+	var rawRes []byte
+	var prettified string
+	var err error
+	if streamed, _ := metadata["streamed"].(bool); streamed {
+		// The body of a streamed response is never read, only the headers are recorded
+		rawRes, err = httputil.DumpResponse(res, false)
+	} else {
+		rawRes, prettified, err = rawhttp.DumpResponse(res)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("dumping response %s: %w", requestId, err)
 	}
@@ -357,11 +708,6 @@ func NewProxyResponse(res *http.Response) (*domain.ProxyResponse, error) {
 		}
 	}
 
-	metadata, ok := core.MetadataFromContext(res.Request.Context())
-	if !ok {
-		metadata = make(map[string]any)
-	}
-
 	proxyResponse := &domain.ProxyResponse{
 		ID:          requestId,
 		Status:      res.Status,
@@ -369,53 +715,284 @@ func NewProxyResponse(res *http.Response) (*domain.ProxyResponse, error) {
 		ContentType: contentType,
 		Length:      res.Header.Get("Content-Length"),
 		Raw:         domain.RawField(rawRes),
+		RawLength:   int64(len(rawRes)),
 		Metadata:    metadata,
 		RespondedAt: responseTime,
 	}
 
+	if upstreamAddr, ok := metadata["upstream_addr"].(string); ok {
+		proxyResponse.UpstreamAddr = upstreamAddr
+	}
+
+	if tags, ok := core.TagsFromContext(res.Request.Context()); ok {
+		proxyResponse.Tags = tags
+	}
+	if note, ok := core.NoteFromContext(res.Request.Context()); ok {
+		proxyResponse.Note = &note
+	}
+
 	if prettified != "" {
 		proxyResponse.Metadata["prettified-response"] = prettified
 	}
 	return proxyResponse, nil
 }
 
+// persistBody reports whether a response body with the given media type should be persisted.
+// Entries in PersistBodyContentTypes match exactly or by type with a wildcard subtype (e.g. text/*).
+// All bodies are persisted when PersistBodyContentTypes is empty.
+func (proxy *Proxy) persistBody(contentType string) bool {
+	if len(proxy.PersistBodyContentTypes) == 0 {
+		return true
+	}
+
+	for _, allowed := range proxy.PersistBodyContentTypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "*/*" || allowed == contentType {
+			return true
+		}
+		if mainType, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(contentType, mainType+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// skipResponseBody replaces the body in the raw response with a placeholder and sets the body_skipped metadata flag.
+// The headers of the raw response are kept as is.
+func skipResponseBody(proxyResponse *domain.ProxyResponse) {
+	headers, _, found := bytes.Cut(proxyResponse.Raw, []byte("\r\n\r\n"))
+	if !found {
+		return
+	}
+
+	placeholder := fmt.Sprintf("[%s body not persisted]", proxyResponse.ContentType)
+	raw := make([]byte, 0, len(headers)+4+len(placeholder))
+	raw = append(raw, headers...)
+	raw = append(raw, "\r\n\r\n"...)
+	raw = append(raw, placeholder...)
+
+	proxyResponse.Raw = domain.RawField(raw)
+	proxyResponse.RawLength = int64(len(raw))
+	delete(proxyResponse.Metadata, "prettified-response")
+	proxyResponse.Metadata["body_skipped"] = true
+}
+
 // WriteToDB reads from the DBWriteChannel and writes items to their respective repositories.
 // It handles ProxyRequest, ProxyResponse, LaunchpadRequest, and Log items.
+// When BatchRepo is set, the items that arrive within DBWriteBatchDelay of the first one are written in a single transaction,
+// up to DBWriteBatchSize items. Items are written in the order they were sent, so a response is written after its request.
+// It returns when DBWriteChannel is closed, or once the channel is empty after Shutdown stopped the writer.
 func (proxy *Proxy) WriteToDB() {
-	for proxyItem := range proxy.DBWriteChannel {
-		switch castItem := proxyItem.(type) {
-		case *domain.ProxyRequest:
-			err := proxy.TrafficRepo.InsertRequest(castItem)
-			if err != nil {
+	size := proxy.DBWriteBatchSize
+	if size <= 0 {
+		size = DefaultDBWriteBatchSize
+	}
+	delay := proxy.DBWriteBatchDelay
+	if delay <= 0 {
+		delay = DefaultDBWriteBatchDelay
+	}
+
+	for {
+		select {
+		case proxyItem, ok := <-proxy.DBWriteChannel:
+			if !ok {
+				return
+			}
+			proxy.writeFrom(proxyItem, size, delay)
+		case <-proxy.dbWriterStop:
+			// Write the items queued before Shutdown and return once the channel is empty
+			for {
+				select {
+				case proxyItem, ok := <-proxy.DBWriteChannel:
+					if !ok {
+						return
+					}
+					proxy.writeFrom(proxyItem, size, delay)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeFrom writes proxyItem together with the items collected for its batch.
+func (proxy *Proxy) writeFrom(proxyItem any, size int, delay time.Duration) {
+	batch := []any{proxyItem}
+	if proxy.BatchRepo != nil {
+		batch = proxy.collectBatch(batch, size, delay)
+	}
+	proxy.writeBatch(batch)
+}
+
+// queueDBWrite sends item to the DBWriteChannel. Items queued after Shutdown stopped the database writer are logged
+// and dropped, so late writers (logs, extensions) neither block on the channel nor panic on a closed one.
+func (proxy *Proxy) queueDBWrite(item any) {
+	select {
+	case <-proxy.dbWriterStop:
+		log.Printf("dropping %T queued after shutdown", item)
+		return
+	default:
+	}
+
+	select {
+	case proxy.DBWriteChannel <- item:
+	case <-proxy.dbWriterStop:
+		log.Printf("dropping %T queued after shutdown", item)
+	}
+}
+
+// collectBatch adds the items received from the DBWriteChannel to batch until it holds size items,
+// delay has passed or the channel is closed.
+func (proxy *Proxy) collectBatch(batch []any, size int, delay time.Duration) []any {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for len(batch) < size {
+		select {
+		case proxyItem, ok := <-proxy.DBWriteChannel:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, proxyItem)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// writeBatch writes the items in a single transaction through BatchRepo, or one by one through the repositories
+// when there is a single item, BatchRepo is not set or the transaction fails. An item that cannot be written fails the
+// transaction, so it is rolled back and the batch is written one by one. OnLog is called once the items are written.
+func (proxy *Proxy) writeBatch(batch []any) {
+	written := false
+	if proxy.BatchRepo != nil && len(batch) > 1 {
+		err := proxy.BatchRepo.Batch(func(writer domain.BatchWriter) error {
+			for _, proxyItem := range batch {
+				// A failed item rolls back the transaction so the batch is written one by one
+				if err := writeItem(writer, proxyItem); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("writing batch of %d items, writing them one by one: %v", len(batch), err)
+		}
+		written = err == nil
+	}
+
+	if !written {
+		writer := &repositoryWriter{proxy: proxy}
+		for _, proxyItem := range batch {
+			if err := writeItem(writer, proxyItem); err != nil {
 				log.Println(err)
-				continue
 			}
+		}
+	}
 
-			if val, ok := castItem.Metadata["launchpad_id"]; ok {
-				if launchpadID, ok := val.(uuid.UUID); ok {
-					err := proxy.LaunchpadRepo.LinkRequestToLaunchpad(castItem.ID, launchpadID)
-					if err != nil {
-						log.Printf("linking request to launchpad: %v", err)
-					}
+	for _, proxyItem := range batch {
+		if logItem, ok := proxyItem.(*domain.Log); ok && proxy.OnLog != nil {
+			proxy.OnLog(*logItem)
+		}
+	}
+}
+
+// writeItem writes a single item from the DBWriteChannel with writer.
+// The launchpad link, tags and note of a request are still written when one of them fails, the errors are returned together.
+// The tags and note of a response are written with it, so the ones set by extensions while handling the response are stored as well.
+func writeItem(writer domain.BatchWriter, proxyItem any) error {
+	switch castItem := proxyItem.(type) {
+	case *domain.ProxyRequest:
+		err := writer.InsertRequest(castItem)
+		if err != nil {
+			return err
+		}
+
+		var errs []error
+		if val, ok := castItem.Metadata["launchpad_id"]; ok {
+			if launchpadID, ok := val.(uuid.UUID); ok {
+				err := writer.LinkRequestToLaunchpad(castItem.ID, launchpadID)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("linking request to launchpad: %w", err))
 				}
 			}
-		case *domain.ProxyResponse:
-			err := proxy.TrafficRepo.InsertResponse(castItem)
+		}
+
+		for _, tag := range castItem.Tags {
+			err := writer.AddTag(castItem.ID, tag)
 			if err != nil {
-				log.Println(err)
+				errs = append(errs, fmt.Errorf("tagging request: %w", err))
+			}
+		}
+
+		if castItem.Note != nil {
+			err := writer.UpdateNote(castItem.ID, *castItem.Note)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("adding note to request: %w", err))
 			}
-		case *domain.Log:
-			err := proxy.LogRepo.InsertLog(castItem)
+		}
+		return errors.Join(errs...)
+	case *domain.ProxyResponse:
+		err := writer.InsertResponse(castItem)
+		if err != nil {
+			return err
+		}
+
+		// Tags and notes set while handling the response are only known now, adding the tags of the request again is a no-op
+		var errs []error
+		for _, tag := range castItem.Tags {
+			err := writer.AddTag(castItem.ID, tag)
 			if err != nil {
-				log.Print(err)
+				errs = append(errs, fmt.Errorf("tagging request: %w", err))
 			}
-			proxy.OnLog(*castItem)
-		default:
-			log.Print(castItem)
 		}
+
+		if castItem.Note != nil {
+			err := writer.UpdateNote(castItem.ID, *castItem.Note)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("adding note to request: %w", err))
+			}
+		}
+		return errors.Join(errs...)
+	case *domain.Log:
+		return writer.InsertLog(castItem)
+	default:
+		log.Print(castItem)
+		return nil
 	}
 }
 
+// repositoryWriter implements domain.BatchWriter with the proxy repositories, each write is committed on its own.
+type repositoryWriter struct {
+	proxy *Proxy
+}
+
+func (writer *repositoryWriter) InsertRequest(req *domain.ProxyRequest) error {
+	return writer.proxy.TrafficRepo.InsertRequest(req)
+}
+
+func (writer *repositoryWriter) InsertResponse(res *domain.ProxyResponse) error {
+	return writer.proxy.TrafficRepo.InsertResponse(res)
+}
+
+func (writer *repositoryWriter) LinkRequestToLaunchpad(requestID uuid.UUID, launchpadID uuid.UUID) error {
+	return writer.proxy.LaunchpadRepo.LinkRequestToLaunchpad(requestID, launchpadID)
+}
+
+func (writer *repositoryWriter) AddTag(requestID uuid.UUID, tag string) error {
+	return writer.proxy.TrafficRepo.AddTag(requestID, tag)
+}
+
+func (writer *repositoryWriter) UpdateNote(requestID uuid.UUID, note string) error {
+	return writer.proxy.TrafficRepo.UpdateNote(requestID, note)
+}
+
+func (writer *repositoryWriter) InsertLog(logItem *domain.Log) error {
+	return writer.proxy.LogRepo.InsertLog(logItem)
+}
+
 // WriteLog creates a new log entry and sends it to the DBWriteChannel.
 // It accepts a level, a message, and optional functions to modify the log entry.
 func (proxy *Proxy) WriteLog(level string, message string, options ...func(log *domain.Log) error) error {
@@ -444,14 +1021,61 @@ func (proxy *Proxy) WriteLog(level string, message string, options ...func(log *
 			return fmt.Errorf("applying log option : %w", err)
 		}
 	}
-	proxy.DBWriteChannel <- &log
+	proxy.queueDBWrite(&log)
 	return nil
 }
 
+// GetListener binds the proxy to address:port and configures proxy.Client to use it.
 func (proxy *Proxy) GetListener(address string, port string) (net.Listener, error) {
-	rawListener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", address, port))
+	proxy.ListenAddrs = nil
+	marasiListener, err := proxy.bindListener(address, port)
 	if err != nil {
-		return rawListener, fmt.Errorf("setting up listener on address:port %s:%s", address, port)
+		return nil, err
+	}
+	proxy.configureClient()
+	return marasiListener, nil
+}
+
+// GetListeners binds the proxy to each of the host:port addresses and returns a single listener accepting
+// connections from all of them. The first address is used for proxy.Client and the Chrome launcher.
+func (proxy *Proxy) GetListeners(addresses ...string) (net.Listener, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no listen addresses provided")
+	}
+
+	proxy.ListenAddrs = nil
+	listeners := make([]net.Listener, 0, len(addresses))
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, address := range addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			closeListeners()
+			return nil, fmt.Errorf("parsing listen address %s : %w", address, err)
+		}
+		marasiListener, err := proxy.bindListener(host, port)
+		if err != nil {
+			closeListeners()
+			return nil, fmt.Errorf("binding %s : %w", address, err)
+		}
+		listeners = append(listeners, marasiListener)
+	}
+
+	host, port, _ := net.SplitHostPort(proxy.ListenAddrs[0])
+	proxy.Addr, proxy.Port = host, port
+	proxy.configureClient()
+	return listener.NewMultiListener(listeners...), nil
+}
+
+// bindListener listens on address:port and records the bound address in proxy.ListenAddrs and proxy.Addr / proxy.Port.
+// Listeners bound to an unspecified address are recorded as 127.0.0.1.
+func (proxy *Proxy) bindListener(address string, port string) (net.Listener, error) {
+	rawListener, err := net.Listen("tcp", net.JoinHostPort(address, port))
+	if err != nil {
+		return nil, fmt.Errorf("setting up listener on address:port %s:%s : %w", address, port, err)
 	}
 	addr := rawListener.Addr().(*net.TCPAddr)
 
@@ -461,40 +1085,206 @@ func (proxy *Proxy) GetListener(address string, port string) (net.Listener, erro
 		proxy.Addr = addr.IP.String()
 	}
 	proxy.Port = fmt.Sprintf("%d", addr.Port)
+	proxy.ListenAddrs = append(proxy.ListenAddrs, net.JoinHostPort(proxy.Addr, proxy.Port))
 
 	muxListener := listener.NewProtocolMuxListener(rawListener, proxy.mitmConfig)
+	muxListener.OriginalDestination = proxy.OriginalDestination
 	marasiListener := listener.NewMarasiListener(muxListener)
 
 	proxy.WriteLog("INFO", fmt.Sprintf("Marasi Service Started on %s", rawListener.Addr().String()))
+	return marasiListener, nil
+}
+
+// DBHealth checks that the database is reachable and writable and reports the state of the connection.
+func (proxy *Proxy) DBHealth(ctx context.Context) (domain.DBHealth, error) {
+	if proxy.HealthRepo == nil {
+		return domain.DBHealth{}, ErrHealthRepoNotFound
+	}
+
+	health, err := proxy.HealthRepo.HealthCheck(ctx)
+	if err != nil {
+		return health, fmt.Errorf("checking database health : %w", err)
+	}
+	return health, nil
+}
+
+// ExportProfile writes the scope, waypoints, extensions and configuration keys to w as a versioned JSON profile.
+// The profile can be applied to another installation with ImportProfile.
+func (proxy *Proxy) ExportProfile(w io.Writer) error {
+	if proxy.ProfileRepo == nil {
+		return ErrProfileRepoNotFound
+	}
+
+	profile, err := proxy.ProfileRepo.ExportProfile()
+	if err != nil {
+		return fmt.Errorf("exporting profile : %w", err)
+	}
+
+	if scope, err := proxy.GetScope(); err == nil {
+		profile.Scope = scopeToProfile(scope)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(profile); err != nil {
+		return fmt.Errorf("encoding profile : %w", err)
+	}
+	return nil
+}
+
+// ImportProfile reads a profile written by ExportProfile from r and applies it.
+// The repository changes are applied in a single transaction and the scope is only replaced once they succeed.
+// The loaded extensions keep running their previous code until they are reloaded with ReloadExtension.
+func (proxy *Proxy) ImportProfile(r io.Reader) error {
+	if proxy.ProfileRepo == nil {
+		return ErrProfileRepoNotFound
+	}
+
+	var profile domain.Profile
+	if err := json.NewDecoder(r).Decode(&profile); err != nil {
+		return fmt.Errorf("decoding profile : %w", err)
+	}
+
+	var scope *compass.Scope
+	if profile.Scope != nil {
+		var err error
+		scope, err = scopeFromProfile(profile.Scope)
+		if err != nil {
+			return fmt.Errorf("importing scope : %w", err)
+		}
+	}
+
+	if err := proxy.ProfileRepo.ImportProfile(&profile); err != nil {
+		return fmt.Errorf("importing profile : %w", err)
+	}
 
+	if scope != nil {
+		if err := proxy.SetScope(scope); err != nil {
+			return fmt.Errorf("setting scope : %w", err)
+		}
+	}
+
+	if proxy.WaypointRepo != nil {
+		if err := proxy.SyncWaypoints(); err != nil {
+			return fmt.Errorf("syncing waypoints : %w", err)
+		}
+	}
+	return nil
+}
+
+// scopeToProfile converts the scope to its profile representation, the rules are sorted so the output is stable.
+func scopeToProfile(scope *compass.Scope) *domain.ProfileScope {
+	profileScope := &domain.ProfileScope{
+		DefaultAllow: scope.DefaultAllow,
+		Rules:        []domain.ProfileScopeRule{},
+	}
+	for _, exclude := range []bool{false, true} {
+		rules := scope.IncludeRules
+		if exclude {
+			rules = scope.ExcludeRules
+		}
+		for _, key := range slices.Sorted(maps.Keys(rules)) {
+			rule := rules[key]
+			profileScope.Rules = append(profileScope.Rules, domain.ProfileScopeRule{
+				Pattern:   rule.String(),
+				MatchType: rule.MatchType,
+				Exclude:   exclude,
+				Priority:  rule.Priority,
+			})
+		}
+	}
+	return profileScope
+}
+
+// scopeFromProfile creates a scope from its profile representation.
+func scopeFromProfile(profileScope *domain.ProfileScope) (*compass.Scope, error) {
+	scope := compass.NewScope(profileScope.DefaultAllow)
+	for _, rule := range profileScope.Rules {
+		if err := scope.AddRuleWithPriority(rule.Pattern, rule.MatchType, rule.Exclude, rule.Priority); err != nil {
+			return nil, fmt.Errorf("adding rule %s : %w", rule.Pattern, err)
+		}
+	}
+	return scope, nil
+}
+
+// recordRedirect is the redirect policy of proxy.Client, it follows up to 10 redirects like the default policy.
+// Redirects rejected by the redirect policy in the request context, such as the extension egress policy of the request builder, are not followed.
+// The redirects followed so far are sent in the x-marasi-redirect-chain header so they are stored in the metadata of the final request.
+func recordRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if policy, ok := core.RedirectPolicyFromContext(req.Context()); ok {
+		if err := policy(req); err != nil {
+			return err
+		}
+	}
+
+	if chain := core.RedirectChain(req); len(chain) > 0 {
+		if chainJSON, err := json.Marshal(chain); err == nil {
+			req.Header.Set("x-marasi-redirect-chain", string(chainJSON))
+		}
+	}
+	return nil
+}
+
+// configureClient points proxy.Client at proxy.Addr and proxy.Port
+func (proxy *Proxy) configureClient() {
 	hostPort := net.JoinHostPort(proxy.Addr, proxy.Port)
 	parsedURL, err := url.Parse(fmt.Sprintf("http://%s", hostPort))
 	if err != nil {
 		log.Fatal(fmt.Errorf("error parsing proxy URL: %w", err))
 	}
 
-	log.Printf("Proxy Client Configured: %s", parsedURL.String())
+	// Internal traffic (launchpad, request builder, fuzzing) authenticates like any other client
+	if proxy.ProxyCredentials != nil {
+		parsedURL.User = url.UserPassword(proxy.ProxyCredentials.Username, proxy.ProxyCredentials.Password)
+	}
+
+	log.Printf("Proxy Client Configured: %s", parsedURL.Redacted())
 
+	// MaxConnsPerHost is not set here, proxy.Client connects to the proxy itself so the limit would be shared by every target host.
+	// The limit is applied to the upstream connections by the proxy's round tripper instead.
 	transport := &http.Transport{
 		Proxy:           http.ProxyURL(parsedURL),
 		TLSClientConfig: proxy.MarasiClientTLSConfig,
 	}
 	proxy.Client.Transport = transport
-	return marasiListener, nil
 }
 
 // Serve starts the proxy and begins accepting connections on the provided listener.
 // It also starts the database writer goroutine.
-func (proxy *Proxy) Serve(listener net.Listener) error {
-	go proxy.WriteToDB()
-	roundTripper := newMarasiTransport(proxy.Cert)
+// Listeners that do not implement listener.ConnCloser are wrapped in a listener.TrackingListener, so the open connections can be closed by Close and Shutdown.
+func (proxy *Proxy) Serve(l net.Listener) error {
+	if _, ok := l.(listener.ConnCloser); !ok {
+		l = listener.NewTrackingListener(l)
+	}
+	proxy.listener = l
+	proxy.dbWriterDone = make(chan struct{})
+	go func() {
+		defer close(proxy.dbWriterDone)
+		proxy.WriteToDB()
+	}()
+	roundTripper := newMarasiTransport(proxy.Cert, proxy.MaxConnsPerHost, proxy.PinnedCerts)
 	proxy.martianProxy.SetRoundTripper(roundTripper)
-	return proxy.martianProxy.Serve(listener)
+	return proxy.martianProxy.Serve(l)
+}
+
+// closeMartian closes the martian proxy. martian waits for every open connection to close, including idle keep-alive
+// connections and tunnels, so the connections of the listener are closed first.
+func (proxy *Proxy) closeMartian() {
+	if closer, ok := proxy.listener.(listener.ConnCloser); ok {
+		if err := closer.CloseConnections(); err != nil {
+			log.Printf("closing connections : %v", err)
+		}
+	}
+	proxy.closeOnce.Do(proxy.martianProxy.Close)
 }
 
 // Close shuts down the proxy and closes the database connection.
 func (proxy *Proxy) Close() {
-	proxy.martianProxy.Close()
+	proxy.closeMartian()
 	if proxy.DBCloser != nil {
 		log.Println("Closing database connection...")
 		proxy.DBCloser.Close()
@@ -502,10 +1292,88 @@ func (proxy *Proxy) Close() {
 
 }
 
+// Shutdown gracefully stops the proxy. It stops accepting new connections and waits for the in-flight
+// requests to finish the modifier pipeline before closing the martian proxy and the open connections, such as idle keep-alive
+// connections and tunnels. Once there are no active requests,
+// the database writer is stopped after writing every queued item, so everything is persisted before the database
+// connection is closed. DBWriteChannel is never closed, items queued after the writer stopped are dropped.
+//
+// If ctx is done before the proxy is drained, Shutdown returns the context error and the database writer keeps running.
+// The proxy must not be used after Shutdown returns successfully.
+func (proxy *Proxy) Shutdown(ctx context.Context) error {
+	if proxy.listener != nil {
+		err := proxy.listener.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return fmt.Errorf("closing listener : %w", err)
+		}
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for proxy.activeRequests.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %d active requests : %w", proxy.activeRequests.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		proxy.closeMartian()
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		return fmt.Errorf("closing connections : %w", ctx.Err())
+	}
+
+	if proxy.dbWriterDone != nil {
+		select {
+		case <-proxy.dbWriterStop:
+		default:
+			close(proxy.dbWriterStop)
+		}
+		select {
+		case <-proxy.dbWriterDone:
+		case <-ctx.Done():
+			return fmt.Errorf("draining db write channel : %w", ctx.Err())
+		}
+	}
+
+	if proxy.DBCloser != nil {
+		err := proxy.DBCloser.Close()
+		if err != nil {
+			return fmt.Errorf("closing database connection : %w", err)
+		}
+	}
+	return nil
+}
+
 // Launch sends a raw HTTP request through the proxy client.
 // It is used for the launchpad functionality to replay and test requests.
+// The {{name}} placeholders in the raw request are replaced with the launchpad's variables before it is sent.
 func (proxy *Proxy) Launch(raw string, launchpadId string, useHttps bool) error {
-	updated, err := rawhttp.RecalculateContentLength([]byte(raw))
+	return proxy.launch(raw, launchpadId, useHttps, true)
+}
+
+// launch sends the raw request like Launch, the request is only linked to the launchpad when link is set
+func (proxy *Proxy) launch(raw string, launchpadId string, useHttps bool, link bool) error {
+	substituted := []byte(raw)
+	if launchpadID, err := uuid.Parse(launchpadId); err == nil && proxy.LaunchpadRepo != nil {
+		variables, err := proxy.LaunchpadRepo.GetLaunchpadVariables(launchpadID)
+		if err != nil {
+			return fmt.Errorf("getting launchpad variables : %w", err)
+		}
+		substituted, err = rawhttp.SubstituteVariables(substituted, variables, proxy.StrictLaunchpadVars)
+		if err != nil {
+			return fmt.Errorf("substituting launchpad variables : %w", err)
+		}
+	}
+
+	updated, err := rawhttp.RecalculateContentLength(substituted)
 	if err != nil {
 		return fmt.Errorf("recalculating content length : %w", err)
 	}
@@ -527,16 +1395,67 @@ func (proxy *Proxy) Launch(raw string, launchpadId string, useHttps bool) error
 	}
 
 	req.RequestURI, req.URL.Scheme, req.URL.Host = "", scheme, host
-	req.Header.Add("x-launchpad-id", launchpadId)
+	if link {
+		req.Header.Add("x-launchpad-id", launchpadId)
+	}
+	// http.Header loses the order of the raw request, it is passed to the pipeline to be restored in the persisted raw
+	req.Header.Set("x-marasi-header-order", strings.Join(rawhttp.HeaderOrder(updated), ","))
+	req.Header.Set("x-marasi-internal", proxy.internalToken)
 
 	if _, ok := req.Header["User-Agent"]; !ok {
 		req.Header.Set("User-Agent", "")
 	}
 
-	_, err = proxy.Client.Do(req)
+	res, err := proxy.Client.Do(req)
 	if err != nil {
 		return fmt.Errorf("client doing request : %w", err)
 	}
+	// The response is stored by the proxy pipeline, the body is drained so the connection can be reused
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return nil
+}
+
+// ReplayOptions configures how ReplaySequence sends the requests of a launchpad.
+type ReplayOptions struct {
+	PreserveTiming bool // Wait between requests for the time that passed between them when they were captured
+}
+
+// ReplaySequence sends the requests of a launchpad again through Launch, one after the other in the launchpad order.
+// The replayed requests use the launchpad variables but are not linked to the launchpad, so replaying does not grow the sequence.
+// With opts.PreserveTiming, it waits before each request for the time between the RequestedAt of the request and the previous one,
+// requests that were captured before the previous one are sent right away.
+// It stops at the first request that cannot be sent and returns the context error when ctx is cancelled.
+func (proxy *Proxy) ReplaySequence(ctx context.Context, launchpadID uuid.UUID, opts ReplayOptions) error {
+	if proxy.LaunchpadRepo == nil {
+		return ErrLaunchpadRepoNotFound
+	}
+
+	requests, err := proxy.LaunchpadRepo.GetLaunchpadRequests(launchpadID)
+	if err != nil {
+		return fmt.Errorf("getting launchpad requests : %w", err)
+	}
+
+	for i, req := range requests {
+		if opts.PreserveTiming && i > 0 {
+			if delay := req.RequestedAt.Sub(requests[i-1].RequestedAt); delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := proxy.launch(string(req.Raw), launchpadID.String(), req.Scheme == "https", false); err != nil {
+			return fmt.Errorf("replaying request %s : %w", req.ID, err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,1875 @@
+package marasi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/martian"
+	"github.com/google/martian/fifo"
+	"github.com/google/uuid"
+	"github.com/tfkr-ae/marasi/compass"
+	"github.com/tfkr-ae/marasi/core"
+	"github.com/tfkr-ae/marasi/domain"
+	"github.com/tfkr-ae/marasi/extensions"
+	"github.com/tfkr-ae/marasi/rawhttp"
+)
+
+// testTrafficRepo is an in-memory domain.TrafficRepository that only records inserted requests and responses
+type testTrafficRepo struct {
+	domain.TrafficRepository
+
+	mu        sync.Mutex
+	requests  map[uuid.UUID]*domain.ProxyRequest
+	responses map[uuid.UUID]*domain.ProxyResponse
+}
+
+func newTestTrafficRepo() *testTrafficRepo {
+	return &testTrafficRepo{
+		requests:  make(map[uuid.UUID]*domain.ProxyRequest),
+		responses: make(map[uuid.UUID]*domain.ProxyResponse),
+	}
+}
+
+func (repo *testTrafficRepo) InsertRequest(req *domain.ProxyRequest) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.requests[req.ID] = req
+	return nil
+}
+
+func (repo *testTrafficRepo) InsertResponse(res *domain.ProxyResponse) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.responses[res.ID] = res
+	return nil
+}
+
+func (repo *testTrafficRepo) ClearTraffic(preserveLaunchpad bool) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	clear(repo.requests)
+	clear(repo.responses)
+	return nil
+}
+
+// testLaunchpadRepo is an in-memory domain.LaunchpadRepository that only returns the launchpad variables and requests
+type testLaunchpadRepo struct {
+	domain.LaunchpadRepository
+
+	mu        sync.Mutex
+	variables map[uuid.UUID]map[string]string
+	requests  map[uuid.UUID][]*domain.ProxyRequest
+}
+
+func (repo *testLaunchpadRepo) GetLaunchpadRequests(id uuid.UUID) ([]*domain.ProxyRequest, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	requests, ok := repo.requests[id]
+	if !ok {
+		return nil, errors.New("launchpad not found")
+	}
+	return slices.Clone(requests), nil
+}
+
+func (repo *testLaunchpadRepo) LinkRequestToLaunchpad(requestID uuid.UUID, launchpadID uuid.UUID) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.requests[launchpadID] = append(repo.requests[launchpadID], &domain.ProxyRequest{ID: requestID})
+	return nil
+}
+
+func (repo *testLaunchpadRepo) GetLaunchpadVariables(launchpadID uuid.UUID) (map[string]string, error) {
+	variables, ok := repo.variables[launchpadID]
+	if !ok {
+		return nil, errors.New("launchpad not found")
+	}
+	return variables, nil
+}
+
+// testExtensionRepo is an in-memory domain.ExtensionRepository that only returns extensions by name
+type testExtensionRepo struct {
+	domain.ExtensionRepository
+
+	extensions map[string]*domain.Extension
+}
+
+func (repo *testExtensionRepo) GetExtensionByName(name string) (*domain.Extension, error) {
+	ext, ok := repo.extensions[name]
+	if !ok {
+		return nil, errors.New("extension not found")
+	}
+	return ext, nil
+}
+
+// testWaypointRepo is an in-memory domain.WaypointRepository
+type testWaypointRepo struct {
+	domain.WaypointRepository
+
+	mu        sync.Mutex
+	waypoints map[string]string
+}
+
+func (repo *testWaypointRepo) CreateOrUpdateWaypoint(hostname string, override string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.waypoints[hostname] = override
+	return nil
+}
+
+func (repo *testWaypointRepo) DeleteWaypoint(hostname string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if _, ok := repo.waypoints[hostname]; !ok {
+		return errors.New("hostname has no waypoint configured")
+	}
+	delete(repo.waypoints, hostname)
+	return nil
+}
+
+// testProfileRepo is an in-memory domain.ProfileRepository that keeps the last imported profile
+type testProfileRepo struct {
+	profile *domain.Profile
+}
+
+func (repo *testProfileRepo) ExportProfile() (*domain.Profile, error) {
+	profile := *repo.profile
+	return &profile, nil
+}
+
+func (repo *testProfileRepo) ImportProfile(profile *domain.Profile) error {
+	if profile.Version != domain.ProfileVersion {
+		return errors.New("unsupported profile version")
+	}
+	repo.profile = profile
+	return nil
+}
+
+// testHealthRepo is a domain.HealthRepository that returns a fixed health and error
+type testHealthRepo struct {
+	health domain.DBHealth
+	err    error
+}
+
+func (repo *testHealthRepo) Ping(ctx context.Context) error {
+	return repo.err
+}
+
+func (repo *testHealthRepo) HealthCheck(ctx context.Context) (domain.DBHealth, error) {
+	return repo.health, repo.err
+}
+
+// testLogRepo is an in-memory domain.LogRepository that only records inserted logs
+type testLogRepo struct {
+	domain.LogRepository
+
+	mu   sync.Mutex
+	logs []*domain.Log
+}
+
+func (repo *testLogRepo) InsertLog(log *domain.Log) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.logs = append(repo.logs, log)
+	return nil
+}
+
+// testConfigRepo is an in-memory domain.ConfigRepository that only stores the configuration keys
+type testConfigRepo struct {
+	domain.ConfigRepository
+
+	mu     sync.Mutex
+	config map[string]string
+}
+
+func (repo *testConfigRepo) Get(key string) (string, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	value, ok := repo.config[key]
+	if !ok {
+		return "", domain.ErrConfigKeyNotFound
+	}
+	return value, nil
+}
+
+func (repo *testConfigRepo) Set(key string, value string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.config[key] = value
+	return nil
+}
+
+func (repo *testConfigRepo) Keys() ([]string, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return slices.Sorted(maps.Keys(repo.config)), nil
+}
+
+// testBatchRepo is an in-memory domain.BatchRepository that counts the committed batches and records the writes in order
+type testBatchRepo struct {
+	mu      sync.Mutex
+	commits int
+	writes  []any
+	tags    map[uuid.UUID][]string
+	notes   map[uuid.UUID]string
+	err     error
+	itemErr error // Returned by the writer for every response
+}
+
+func (repo *testBatchRepo) Batch(fn func(writer domain.BatchWriter) error) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if repo.err != nil {
+		return repo.err
+	}
+
+	writer := &testBatchWriter{err: repo.itemErr, tags: make(map[uuid.UUID][]string), notes: make(map[uuid.UUID]string)}
+	if err := fn(writer); err != nil {
+		return err
+	}
+	repo.commits++
+	repo.writes = append(repo.writes, writer.writes...)
+	if repo.tags == nil {
+		repo.tags = make(map[uuid.UUID][]string)
+	}
+	for id, tags := range writer.tags {
+		repo.tags[id] = append(repo.tags[id], tags...)
+	}
+	if repo.notes == nil {
+		repo.notes = make(map[uuid.UUID]string)
+	}
+	maps.Copy(repo.notes, writer.notes)
+	return nil
+}
+
+type testBatchWriter struct {
+	writes []any
+	tags   map[uuid.UUID][]string
+	notes  map[uuid.UUID]string
+	err    error
+}
+
+func (writer *testBatchWriter) InsertRequest(req *domain.ProxyRequest) error {
+	writer.writes = append(writer.writes, req)
+	return nil
+}
+
+func (writer *testBatchWriter) InsertResponse(res *domain.ProxyResponse) error {
+	if writer.err != nil {
+		return writer.err
+	}
+	writer.writes = append(writer.writes, res)
+	return nil
+}
+
+func (writer *testBatchWriter) LinkRequestToLaunchpad(requestID uuid.UUID, launchpadID uuid.UUID) error {
+	return nil
+}
+
+func (writer *testBatchWriter) AddTag(requestID uuid.UUID, tag string) error {
+	// Adding a tag that already exists is a no-op like in the repository
+	if !slices.Contains(writer.tags[requestID], tag) {
+		writer.tags[requestID] = append(writer.tags[requestID], tag)
+	}
+	return nil
+}
+
+func (writer *testBatchWriter) UpdateNote(requestID uuid.UUID, note string) error {
+	writer.notes[requestID] = note
+	return nil
+}
+
+func (writer *testBatchWriter) InsertLog(log *domain.Log) error {
+	writer.writes = append(writer.writes, log)
+	return nil
+}
+
+func TestProxyShutdown(t *testing.T) {
+	t.Run("request in flight at shutdown should be persisted before Shutdown returns", func(t *testing.T) {
+		handlerStarted := make(chan struct{})
+		releaseHandler := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(handlerStarted)
+			<-releaseHandler
+			w.Write([]byte("Hello Marasi"))
+		}))
+		defer upstream.Close()
+
+		trafficRepo := newTestTrafficRepo()
+		proxy, err := New(
+			WithExtensions([]*domain.Extension{testExtensions["compass"], testExtensions["checkpoint"]}),
+			WithTrafficRepository(trafficRepo),
+			WithRequestHandler(func(req domain.ProxyRequest) error { return nil }),
+			WithResponseHandler(func(res domain.ProxyResponse) error { return nil }),
+			WithBasePipeline(),
+			WithDefaultModifierPipeline(),
+		)
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("creating listener : %v", err)
+		}
+		go proxy.Serve(listener)
+
+		proxyURL, err := url.Parse("http://" + listener.Addr().String())
+		if err != nil {
+			t.Fatalf("parsing proxy url : %v", err)
+		}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		requestDone := make(chan error, 1)
+		go func() {
+			res, err := client.Get(upstream.URL)
+			if err == nil {
+				res.Body.Close()
+			}
+			requestDone <- err
+		}()
+
+		select {
+		case <-handlerStarted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request did not reach the upstream server")
+		}
+
+		shutdownDone := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdownDone <- proxy.Shutdown(ctx)
+		}()
+
+		select {
+		case err := <-shutdownDone:
+			t.Fatalf("wanted: Shutdown to wait for the in-flight request\ngot: returned %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(releaseHandler)
+
+		if err := <-shutdownDone; err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		trafficRepo.mu.Lock()
+		defer trafficRepo.mu.Unlock()
+		if len(trafficRepo.requests) != 1 {
+			t.Fatalf("wanted: 1 request persisted\ngot: %d", len(trafficRepo.requests))
+		}
+		if len(trafficRepo.responses) != 1 {
+			t.Fatalf("wanted: 1 response persisted\ngot: %d", len(trafficRepo.responses))
+		}
+
+		if err := <-requestDone; err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+	})
+
+	t.Run("writes queued after Shutdown should neither panic nor block", func(t *testing.T) {
+		proxy, err := New(WithTrafficRepository(newTestTrafficRepo()))
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+
+		// Start the database writer like Serve does
+		proxy.dbWriterDone = make(chan struct{})
+		go func() {
+			defer close(proxy.dbWriterDone)
+			proxy.WriteToDB()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := proxy.Shutdown(ctx); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			for range cap(proxy.DBWriteChannel) + 1 {
+				if err := proxy.WriteLog("INFO", "late log"); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("wanted: late writes to return\ngot: blocked on DBWriteChannel")
+		}
+	})
+
+	t.Run("Shutdown should close idle keep-alive connections before it returns", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello Marasi"))
+		}))
+		defer upstream.Close()
+
+		proxy, err := New(
+			WithExtensions([]*domain.Extension{testExtensions["compass"], testExtensions["checkpoint"]}),
+			WithTrafficRepository(newTestTrafficRepo()),
+			WithRequestHandler(func(req domain.ProxyRequest) error { return nil }),
+			WithResponseHandler(func(res domain.ProxyResponse) error { return nil }),
+			WithBasePipeline(),
+			WithDefaultModifierPipeline(),
+		)
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("creating listener : %v", err)
+		}
+		go proxy.Serve(listener)
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("connecting to proxy : %v", err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.URL, strings.TrimPrefix(upstream.URL, "http://"))
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("reading response : %v", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := proxy.Shutdown(ctx); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		// The connection is idle, it is only closed by the proxy
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = reader.ReadByte()
+		var netErr net.Error
+		if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+			t.Fatalf("wanted: connection closed when Shutdown returned\ngot: %v", err)
+		}
+	})
+
+	t.Run("Shutdown should return the context error if requests are still active", func(t *testing.T) {
+		proxy, err := New()
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		proxy.activeRequests.Add(1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err = proxy.Shutdown(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("wanted: %v\ngot: %v", context.DeadlineExceeded, err)
+		}
+	})
+}
+
+func TestProxyBasePipelineInternalHeaders(t *testing.T) {
+	t.Run("internal headers should not reach the upstream when compass skips the request", func(t *testing.T) {
+		received := make(chan http.Header, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- r.Header.Clone()
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer upstream.Close()
+
+		proxy, err := New(
+			WithExtensions([]*domain.Extension{testExtensions["compass"], testExtensions["checkpoint"]}),
+			WithBasePipeline(),
+			WithDefaultModifierPipeline(),
+		)
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		proxy.SetScope(compass.NewScope(false))
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("creating listener : %v", err)
+		}
+		go proxy.Serve(listener)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			proxy.Shutdown(ctx)
+		}()
+
+		proxyURL, err := url.Parse("http://" + listener.Addr().String())
+		if err != nil {
+			t.Fatalf("parsing proxy url : %v", err)
+		}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		req, err := http.NewRequest(http.MethodGet, upstream.URL, nil)
+		if err != nil {
+			t.Fatalf("creating request : %v", err)
+		}
+		req.Header.Set("x-marasi-sni", "marasi.app")
+		req.Header.Set("x-marasi-header-order", "Host,User-Agent")
+		req.Header.Set("x-marasi-redirect-chain", `[{"url":"http://marasi.app","status_code":302}]`)
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		res.Body.Close()
+
+		var header http.Header
+		select {
+		case header = <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request did not reach the upstream server")
+		}
+
+		for _, name := range []string{"x-marasi-sni", "x-marasi-header-order", "x-marasi-redirect-chain"} {
+			if value := header.Get(name); value != "" {
+				t.Errorf("wanted: %s to be removed\ngot: %q", name, value)
+			}
+		}
+	})
+
+	t.Run("proxied requests should be recorded in the header order of the wire", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer upstream.Close()
+		upstreamURL, err := url.Parse(upstream.URL)
+		if err != nil {
+			t.Fatalf("parsing upstream url : %v", err)
+		}
+
+		requests := make(chan domain.ProxyRequest, 1)
+		proxy, err := New(
+			WithExtensions([]*domain.Extension{testExtensions["compass"], testExtensions["checkpoint"]}),
+			WithTrafficRepository(newTestTrafficRepo()),
+			WithRequestHandler(func(req domain.ProxyRequest) error {
+				requests <- req
+				return nil
+			}),
+			WithResponseHandler(func(res domain.ProxyResponse) error { return nil }),
+			WithBasePipeline(),
+			WithDefaultModifierPipeline(),
+		)
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("creating listener : %v", err)
+		}
+		go proxy.Serve(listener)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			proxy.Shutdown(ctx)
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dialing proxy : %v", err)
+		}
+		defer conn.Close()
+
+		// The order sent by a client in x-marasi-header-order is not trusted
+		raw := "GET http://" + upstreamURL.Host + "/order HTTP/1.1\r\nX-Zeta: 1\r\nHost: " + upstreamURL.Host + "\r\nAccept: */*\r\n" +
+			"x-marasi-header-order: Accept,Host,X-Zeta\r\n\r\n"
+		if _, err := conn.Write([]byte(raw)); err != nil {
+			t.Fatalf("writing request : %v", err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("reading response : %v", err)
+		}
+		res.Body.Close()
+
+		var req domain.ProxyRequest
+		select {
+		case req = <-requests:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request was not written")
+		}
+
+		want := "GET /order HTTP/1.1\r\nX-Zeta: 1\r\nHost: " + upstreamURL.Host + "\r\nAccept: */*\r\n"
+		if !strings.HasPrefix(string(req.Raw), want) {
+			t.Fatalf("wanted: %q\ngot: %q", want, req.Raw)
+		}
+	})
+}
+
+func TestProxyAddModifier(t *testing.T) {
+	t.Run("custom request modifier should run after the existing modifiers", func(t *testing.T) {
+		proxy := &Proxy{Modifiers: fifo.NewGroup()}
+		builtinRan := false
+		proxy.AddRequestModifier(func(proxy *Proxy, req *http.Request) error {
+			builtinRan = true
+			return nil
+		})
+		proxy.AddRequestModifier(func(proxy *Proxy, req *http.Request) error {
+			if !builtinRan {
+				t.Fatalf("wanted: built-in modifier to run first\ngot: custom modifier ran first")
+			}
+			req.Header.Set("x-custom-modifier", "true")
+			return nil
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		err := proxy.Modifiers.ModifyRequest(req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if got := req.Header.Get("x-custom-modifier"); got != "true" {
+			t.Fatalf("wanted: true\ngot: %q", got)
+		}
+	})
+
+	t.Run("custom response modifier should run after the existing modifiers", func(t *testing.T) {
+		proxy := &Proxy{Modifiers: fifo.NewGroup()}
+		proxy.AddResponseModifier(func(proxy *Proxy, res *http.Response) error {
+			return nil
+		})
+		proxy.AddResponseModifier(func(proxy *Proxy, res *http.Response) error {
+			res.Header.Set("x-custom-modifier", "true")
+			return nil
+		})
+
+		res := &http.Response{Header: make(http.Header)}
+		err := proxy.Modifiers.ModifyResponse(res)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		if got := res.Header.Get("x-custom-modifier"); got != "true" {
+			t.Fatalf("wanted: true\ngot: %q", got)
+		}
+	})
+
+	t.Run("custom request modifier should not run if the pipeline is skipped", func(t *testing.T) {
+		proxy := &Proxy{Modifiers: fifo.NewGroup()}
+		proxy.AddRequestModifier(func(proxy *Proxy, req *http.Request) error {
+			return ErrSkipPipeline
+		})
+		proxy.AddRequestModifier(func(proxy *Proxy, req *http.Request) error {
+			req.Header.Set("x-custom-modifier", "true")
+			return nil
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app", nil)
+		err := proxy.Modifiers.ModifyRequest(req)
+		if !errors.Is(err, ErrSkipPipeline) {
+			t.Fatalf("wanted: %v\ngot: %v", ErrSkipPipeline, err)
+		}
+
+		if got := req.Header.Get("x-custom-modifier"); got != "" {
+			t.Fatalf("wanted: empty header\ngot: %q", got)
+		}
+	})
+}
+
+func TestProxySetScope(t *testing.T) {
+	t.Run("GetScope should return the scope set by SetScope", func(t *testing.T) {
+		proxy := &Proxy{}
+		if _, err := proxy.GetScope(); !errors.Is(err, ErrScopeNotFound) {
+			t.Fatalf("wanted: %v\ngot: %v", ErrScopeNotFound, err)
+		}
+
+		scope := compass.NewScope(false)
+		proxy.SetScope(scope)
+
+		got, err := proxy.GetScope()
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if got != scope {
+			t.Fatalf("wanted: %p\ngot: %p", scope, got)
+		}
+	})
+
+	t.Run("GetScope and SetScope should share the Scope field", func(t *testing.T) {
+		field := compass.NewScope(true)
+		proxy := &Proxy{Scope: field}
+
+		got, err := proxy.GetScope()
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if got != field {
+			t.Fatalf("wanted: %p\ngot: %p", field, got)
+		}
+
+		scope := compass.NewScope(false)
+		proxy.SetScope(scope)
+		if proxy.Scope != scope {
+			t.Fatalf("wanted: %p\ngot: %p", scope, proxy.Scope)
+		}
+
+		proxy.Scope = field
+		got, err = proxy.GetScope()
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if got != field {
+			t.Fatalf("wanted: the Scope field set after SetScope %p\ngot: %p", field, got)
+		}
+	})
+
+	t.Run("swapping the scope while matching should not race", func(t *testing.T) {
+		proxy := &Proxy{}
+		proxy.SetScope(compass.NewScope(true))
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest(http.MethodGet, "https://marasi.app/path", nil)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					scope, err := proxy.GetScope()
+					if err != nil {
+						t.Errorf("wanted: nil\ngot: %v", err)
+						return
+					}
+					scope.Matches(req)
+				}
+			}()
+		}
+
+		for i := range 100 {
+			scope := compass.NewScope(i%2 == 0)
+			if err := scope.AddRule(`marasi\.app`, "host", false); err != nil {
+				t.Fatalf("adding rule : %v", err)
+			}
+			proxy.SetScope(scope)
+		}
+		close(stop)
+		wg.Wait()
+	})
+}
+
+func TestProxyDefaultAllow(t *testing.T) {
+	t.Run("toggled default allow should be restored when the proxy is created again", func(t *testing.T) {
+		repo := &testConfigRepo{config: make(map[string]string)}
+
+		proxy, err := New(WithConfigRepository(repo))
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		if err := proxy.SetDefaultAllow(false); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if repo.config[DefaultAllowConfigKey] != "false" {
+			t.Fatalf("wanted: false\ngot: %q", repo.config[DefaultAllowConfigKey])
+		}
+
+		restored, err := New(WithConfigRepository(repo))
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		scope, err := restored.GetScope()
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if scope.DefaultAllow {
+			t.Fatalf("wanted: false\ngot: true")
+		}
+	})
+
+	t.Run("WithDefaultAllow should be used when nothing was persisted", func(t *testing.T) {
+		repo := &testConfigRepo{config: make(map[string]string)}
+
+		proxy, err := New(WithConfigRepository(repo), WithDefaultAllow(false))
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		scope, err := proxy.GetScope()
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if scope.DefaultAllow {
+			t.Fatalf("wanted: false\ngot: true")
+		}
+	})
+
+	t.Run("persisted default allow should take precedence over WithDefaultAllow", func(t *testing.T) {
+		repo := &testConfigRepo{config: map[string]string{DefaultAllowConfigKey: "true"}}
+
+		proxy, err := New(WithConfigRepository(repo), WithDefaultAllow(false))
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		scope, err := proxy.GetScope()
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if !scope.DefaultAllow {
+			t.Fatalf("wanted: true\ngot: false")
+		}
+	})
+
+	t.Run("SetScope should persist the default allow of the scope", func(t *testing.T) {
+		repo := &testConfigRepo{config: make(map[string]string)}
+
+		proxy, err := New(WithConfigRepository(repo))
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		if err := proxy.SetScope(compass.NewScope(false)); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if repo.config[DefaultAllowConfigKey] != "false" {
+			t.Fatalf("wanted: false\ngot: %q", repo.config[DefaultAllowConfigKey])
+		}
+
+		restored, err := New(WithConfigRepository(repo))
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+		scope, err := restored.GetScope()
+		if err != nil {
+			t.Fatalf("getting scope : %v", err)
+		}
+		if scope.DefaultAllow {
+			t.Fatalf("wanted: false\ngot: true")
+		}
+	})
+
+	t.Run("ImportProfile should persist the default allow of the imported scope", func(t *testing.T) {
+		repo := &testConfigRepo{config: map[string]string{DefaultAllowConfigKey: "true"}}
+		proxy := &Proxy{ConfigRepo: repo, ProfileRepo: &testProfileRepo{}}
+		profile := `{"version": 1, "scope": {"default_allow": false, "rules": []}}`
+
+		if err := proxy.ImportProfile(strings.NewReader(profile)); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if repo.config[DefaultAllowConfigKey] != "false" {
+			t.Fatalf("wanted: false\ngot: %q", repo.config[DefaultAllowConfigKey])
+		}
+	})
+
+	t.Run("New should return an error if the persisted default allow is invalid", func(t *testing.T) {
+		repo := &testConfigRepo{config: map[string]string{DefaultAllowConfigKey: "sometimes"}}
+
+		if _, err := New(WithConfigRepository(repo)); err == nil {
+			t.Fatalf("wanted: error\ngot: nil")
+		}
+	})
+}
+
+func TestProxyLaunchVariables(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("parsing server url : %v", err)
+	}
+
+	launchpadID, err := uuid.NewV7()
+	if err != nil {
+		t.Fatalf("generating uuid : %v", err)
+	}
+
+	raw := "GET /api/{{version}}/users?csrf={{csrf}} HTTP/1.1\r\nHost: " + serverURL.Host + "\r\nAuthorization: Bearer {{token}}\r\n\r\n"
+
+	newLaunchProxy := func(strict bool) *Proxy {
+		return &Proxy{
+			Client:              server.Client(),
+			StrictLaunchpadVars: strict,
+			LaunchpadRepo: &testLaunchpadRepo{
+				variables: map[uuid.UUID]map[string]string{
+					launchpadID: {"version": "v2", "token": "secret-token"},
+				},
+			},
+		}
+	}
+
+	t.Run("Launch should substitute the launchpad variables and leave unknown placeholders intact", func(t *testing.T) {
+		proxy := newLaunchProxy(false)
+
+		err := proxy.Launch(raw, launchpadID.String(), false)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		select {
+		case req := <-received:
+			if req.URL.Path != "/api/v2/users" {
+				t.Errorf("wanted: /api/v2/users\ngot: %s", req.URL.Path)
+			}
+			if got := req.Header.Get("Authorization"); got != "Bearer secret-token" {
+				t.Errorf("wanted: Bearer secret-token\ngot: %s", got)
+			}
+			if got := req.URL.Query().Get("csrf"); got != "{{csrf}}" {
+				t.Errorf("wanted: {{csrf}}\ngot: %s", got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("wanted: request to be sent")
+		}
+	})
+
+	t.Run("Launch should return an error for unknown placeholders in strict mode", func(t *testing.T) {
+		proxy := newLaunchProxy(true)
+
+		err := proxy.Launch(raw, launchpadID.String(), false)
+		if !errors.Is(err, rawhttp.ErrUnknownVariable) {
+			t.Fatalf("wanted: %v\ngot: %v", rawhttp.ErrUnknownVariable, err)
+		}
+
+		select {
+		case <-received:
+			t.Fatalf("wanted: request to not be sent")
+		default:
+		}
+	})
+}
+
+func TestProxyClearTraffic(t *testing.T) {
+	t.Run("should return an error without a traffic repository", func(t *testing.T) {
+		proxy := newTestProxy(t)
+
+		err := proxy.ClearTraffic(ClearTrafficOptions{})
+		if !errors.Is(err, ErrTrafficRepoNotFound) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", ErrTrafficRepoNotFound, err)
+		}
+	})
+
+	t.Run("should clear the traffic repository", func(t *testing.T) {
+		proxy := newTestProxy(t)
+		repo := newTestTrafficRepo()
+		proxy.TrafficRepo = repo
+
+		id := uuid.Must(uuid.NewV7())
+		repo.InsertRequest(&domain.ProxyRequest{ID: id})
+		repo.InsertResponse(&domain.ProxyResponse{ID: id})
+
+		if err := proxy.ClearTraffic(ClearTrafficOptions{PreserveLaunchpad: true}); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if len(repo.requests) != 0 || len(repo.responses) != 0 {
+			t.Fatalf("\nwanted:\n0 requests and responses\ngot:\n%d requests %d responses", len(repo.requests), len(repo.responses))
+		}
+	})
+}
+
+func TestProxyReplaySequence(t *testing.T) {
+	type received struct {
+		path string
+		at   time.Time
+	}
+	receivedCh := make(chan received, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedCh <- received{path: r.URL.Path, at: time.Now()}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("parsing server url : %v", err)
+	}
+
+	launchpadID := uuid.Must(uuid.NewV7())
+	capturedAt := time.Now().Add(-time.Hour)
+	newRequest := func(path string, offset time.Duration) *domain.ProxyRequest {
+		return &domain.ProxyRequest{
+			ID:          uuid.Must(uuid.NewV7()),
+			Scheme:      "http",
+			Raw:         domain.RawField("GET " + path + " HTTP/1.1\r\nHost: " + serverURL.Host + "\r\n\r\n"),
+			RequestedAt: capturedAt.Add(offset),
+		}
+	}
+
+	newReplayProxy := func() *Proxy {
+		return &Proxy{
+			Client: server.Client(),
+			LaunchpadRepo: &testLaunchpadRepo{
+				variables: map[uuid.UUID]map[string]string{launchpadID: {}},
+				requests: map[uuid.UUID][]*domain.ProxyRequest{
+					launchpadID: {
+						newRequest("/login", 0),
+						newRequest("/mfa", 150*time.Millisecond),
+						newRequest("/account", 250*time.Millisecond),
+					},
+				},
+			},
+		}
+	}
+
+	collect := func(t *testing.T, n int) []received {
+		t.Helper()
+		got := make([]received, 0, n)
+		for range n {
+			select {
+			case r := <-receivedCh:
+				got = append(got, r)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("wanted: %d requests\ngot: %d", n, len(got))
+			}
+		}
+		return got
+	}
+
+	t.Run("ReplaySequence should send the requests in the launchpad order", func(t *testing.T) {
+		proxy := newReplayProxy()
+
+		start := time.Now()
+		if err := proxy.ReplaySequence(context.Background(), launchpadID, ReplayOptions{}); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed >= 250*time.Millisecond {
+			t.Errorf("wanted: no delay without PreserveTiming\ngot: %s", elapsed)
+		}
+
+		got := collect(t, 3)
+		for i, want := range []string{"/login", "/mfa", "/account"} {
+			if got[i].path != want {
+				t.Errorf("wanted: %s\ngot: %s", want, got[i].path)
+			}
+		}
+	})
+
+	t.Run("ReplaySequence should wait for the captured delays with PreserveTiming", func(t *testing.T) {
+		proxy := newReplayProxy()
+
+		if err := proxy.ReplaySequence(context.Background(), launchpadID, ReplayOptions{PreserveTiming: true}); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		got := collect(t, 3)
+		if gap := got[1].at.Sub(got[0].at); gap < 150*time.Millisecond {
+			t.Errorf("wanted: at least 150ms between /login and /mfa\ngot: %s", gap)
+		}
+		if gap := got[2].at.Sub(got[1].at); gap < 100*time.Millisecond {
+			t.Errorf("wanted: at least 100ms between /mfa and /account\ngot: %s", gap)
+		}
+	})
+
+	t.Run("ReplaySequence should stop when the context is cancelled", func(t *testing.T) {
+		proxy := newReplayProxy()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := proxy.ReplaySequence(ctx, launchpadID, ReplayOptions{PreserveTiming: true})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("wanted: %v\ngot: %v", context.DeadlineExceeded, err)
+		}
+
+		got := collect(t, 1)
+		if got[0].path != "/login" {
+			t.Errorf("wanted: /login\ngot: %s", got[0].path)
+		}
+		select {
+		case r := <-receivedCh:
+			t.Errorf("wanted: only /login to be sent\ngot: %s", r.path)
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("ReplaySequence should not link the replayed requests to the launchpad", func(t *testing.T) {
+		launchpadRepo := newReplayProxy().LaunchpadRepo
+		proxy, err := New(
+			WithExtensions([]*domain.Extension{testExtensions["compass"], testExtensions["checkpoint"]}),
+			WithTrafficRepository(newTestTrafficRepo()),
+			WithLaunchpadRepository(launchpadRepo),
+			WithRequestHandler(func(req domain.ProxyRequest) error { return nil }),
+			WithResponseHandler(func(res domain.ProxyResponse) error { return nil }),
+			WithBasePipeline(),
+			WithDefaultModifierPipeline(),
+		)
+		if err != nil {
+			t.Fatalf("creating proxy : %v", err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("creating listener : %v", err)
+		}
+		go proxy.Serve(listener)
+
+		proxyURL, err := url.Parse("http://" + listener.Addr().String())
+		if err != nil {
+			t.Fatalf("parsing proxy url : %v", err)
+		}
+		proxy.Client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		for range 2 {
+			if err := proxy.ReplaySequence(context.Background(), launchpadID, ReplayOptions{}); err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
+			collect(t, 3)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := proxy.Shutdown(ctx); err != nil {
+			t.Fatalf("shutting down proxy : %v", err)
+		}
+
+		requests, err := launchpadRepo.GetLaunchpadRequests(launchpadID)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if len(requests) != 3 {
+			t.Fatalf("wanted: 3 launchpad requests\ngot: %d", len(requests))
+		}
+	})
+
+	t.Run("ReplaySequence should return ErrLaunchpadRepoNotFound without a repository", func(t *testing.T) {
+		proxy := &Proxy{}
+
+		if err := proxy.ReplaySequence(context.Background(), launchpadID, ReplayOptions{}); !errors.Is(err, ErrLaunchpadRepoNotFound) {
+			t.Fatalf("wanted: %v\ngot: %v", ErrLaunchpadRepoNotFound, err)
+		}
+	})
+}
+
+func TestProxyLaunchHeaderOrder(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("parsing server url : %v", err)
+	}
+
+	raw := "GET /order HTTP/1.1\r\nX-Zeta: 1\r\nHost: " + serverURL.Host + "\r\nUser-Agent: marasi\r\nAccept: */*\r\n\r\n"
+	proxy := &Proxy{Client: server.Client(), internalToken: "marasi-test-token"}
+
+	if err := proxy.Launch(raw, "", false); err != nil {
+		t.Fatalf("wanted: nil\ngot: %v", err)
+	}
+
+	var launched *http.Request
+	select {
+	case launched = <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("wanted: request to be sent")
+	}
+
+	// The launched request goes through the pipeline, which records the order and removes the header
+	req := httptest.NewRequest(http.MethodGet, "http://"+serverURL.Host+"/order", nil)
+	req.Header = launched.Header.Clone()
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("applying martian context: %v", err)
+	}
+	defer remove()
+
+	if err := SetupRequestModifier(proxy, req); err != nil {
+		t.Fatalf("wanted: nil\ngot: %v", err)
+	}
+
+	want := []string{"X-Zeta", "Host", "User-Agent", "Accept"}
+	got, ok := core.HeaderOrderFromContext(req.Context())
+	if !ok || !reflect.DeepEqual(want, got) {
+		t.Fatalf("wanted: %v\ngot: %v", want, got)
+	}
+	if req.Header.Get("x-marasi-header-order") != "" {
+		t.Fatalf("expected x-marasi-header-order to be removed")
+	}
+
+	id, _ := core.RequestIDFromContext(req.Context())
+	proxyRequest, err := NewProxyRequest(req, id)
+	if err != nil {
+		t.Fatalf("wanted: nil\ngot: %v", err)
+	}
+	if !strings.HasPrefix(string(proxyRequest.Raw), "GET /order HTTP/1.1\r\n") {
+		t.Fatalf("wanted: origin-form request line\ngot: %q", proxyRequest.Raw)
+	}
+	// headers added by the client transport are not part of the order and follow the ordered ones sorted by name
+	wantRaw := append(want, "Accept-Encoding", "X-Launchpad-Id")
+	if got := rawhttp.HeaderOrder(proxyRequest.Raw); !reflect.DeepEqual(wantRaw, got) {
+		t.Fatalf("wanted: %v\ngot: %v", wantRaw, got)
+	}
+}
+
+func TestProxyLaunchWithCredentials(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("parsing server url : %v", err)
+	}
+
+	proxy, err := New(
+		WithExtensions([]*domain.Extension{testExtensions["compass"], testExtensions["checkpoint"]}),
+		WithTrafficRepository(newTestTrafficRepo()),
+		WithLogRepository(&testLogRepo{}),
+		WithRequestHandler(func(req domain.ProxyRequest) error { return nil }),
+		WithResponseHandler(func(res domain.ProxyResponse) error { return nil }),
+		WithProxyCredentials("tester", "secret"),
+		WithBasePipeline(),
+		WithDefaultModifierPipeline(),
+	)
+	if err != nil {
+		t.Fatalf("creating proxy : %v", err)
+	}
+
+	listener, err := proxy.GetListener("127.0.0.1", "0")
+	if err != nil {
+		t.Fatalf("creating listener : %v", err)
+	}
+	go proxy.Serve(listener)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		proxy.Shutdown(ctx)
+	}()
+
+	raw := "GET /launched HTTP/1.1\r\nHost: " + serverURL.Host + "\r\n\r\n"
+	if err := proxy.Launch(raw, "", false); err != nil {
+		t.Fatalf("wanted: nil\ngot: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if got != "/launched" {
+			t.Fatalf("wanted: /launched\ngot: %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("wanted: launched request to pass the proxy authentication\ngot: no request")
+	}
+}
+
+func TestProxyLaunchMaxConnsPerHost(t *testing.T) {
+	const limit = 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("launched"))
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("parsing server url : %v", err)
+	}
+
+	proxy, err := New(
+		WithExtensions([]*domain.Extension{testExtensions["compass"], testExtensions["checkpoint"]}),
+		WithTrafficRepository(newTestTrafficRepo()),
+		WithLogRepository(&testLogRepo{}),
+		WithRequestHandler(func(req domain.ProxyRequest) error { return nil }),
+		WithResponseHandler(func(res domain.ProxyResponse) error { return nil }),
+		WithMaxConnsPerHost(limit),
+		WithBasePipeline(),
+		WithDefaultModifierPipeline(),
+	)
+	if err != nil {
+		t.Fatalf("creating proxy : %v", err)
+	}
+
+	listener, err := proxy.GetListener("127.0.0.1", "0")
+	if err != nil {
+		t.Fatalf("creating listener : %v", err)
+	}
+	go proxy.Serve(listener)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		proxy.Shutdown(ctx)
+	}()
+
+	t.Run("proxy.Client should not limit the connections to the proxy", func(t *testing.T) {
+		transport, ok := proxy.Client.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("wanted: *http.Transport\ngot: %T", proxy.Client.Transport)
+		}
+		if transport.MaxConnsPerHost != 0 {
+			t.Errorf("wanted: 0\ngot: %d", transport.MaxConnsPerHost)
+		}
+	})
+
+	t.Run("should send more launches than the limit one after the other", func(t *testing.T) {
+		done := make(chan error, 1)
+		go func() {
+			raw := "GET /launched HTTP/1.1\r\nHost: " + serverURL.Host + "\r\n\r\n"
+			for range limit + 2 {
+				if err := proxy.Launch(raw, "", false); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("wanted: %d launches to finish\ngot: timeout", limit+2)
+		}
+	})
+}
+
+func TestProxyExtensionEgressRedirect(t *testing.T) {
+	blockedHit := make(chan struct{}, 1)
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blockedHit <- struct{}{}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer blocked.Close()
+
+	blockedURL, err := url.Parse(blocked.URL)
+	if err != nil {
+		t.Fatalf("parsing blocked server url : %v", err)
+	}
+	_, blockedPort, err := net.SplitHostPort(blockedURL.Host)
+	if err != nil {
+		t.Fatalf("splitting blocked server host : %v", err)
+	}
+
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+blockedPort+"/", http.StatusFound)
+	}))
+	defer allowed.Close()
+
+	ext := &domain.Extension{ID: uuid.Must(uuid.NewV7()), Name: "egress", LuaContent: `version = 1`}
+	proxy := newTestProxy(t, ext)
+	proxy.Client = &http.Client{CheckRedirect: recordRedirect}
+
+	policy := compass.NewScope(false)
+	if err := policy.AddRule(`^127\.0\.0\.1(:\d+)?$`, "host", false); err != nil {
+		t.Fatalf("adding egress rule : %v", err)
+	}
+	proxy.ExtensionEgressPolicy = policy
+
+	runtime, ok := proxy.GetExtension("egress")
+	if !ok {
+		t.Fatalf("wanted: egress extension\ngot: none")
+	}
+
+	err = runtime.ExecuteLua(fmt.Sprintf(`
+		local b = marasi:builder()
+		b:set_method("GET")
+		b:set_url("%s/start")
+		local res, err = b:send()
+		if res then error("response") end
+		error(err)
+	`, allowed.URL))
+	if err == nil || !strings.Contains(err.Error(), "blocked by the extension egress policy") {
+		t.Fatalf("wanted: error containing 'blocked by the extension egress policy'\ngot: %v", err)
+	}
+
+	select {
+	case <-blockedHit:
+		t.Fatalf("wanted: no request to the blocked host\ngot: request")
+	default:
+	}
+}
+
+func TestProxyReloadExtension(t *testing.T) {
+	first := &domain.Extension{ID: uuid.Must(uuid.NewV7()), Name: "first", LuaContent: `version = 1`}
+	second := &domain.Extension{ID: uuid.Must(uuid.NewV7()), Name: "second", LuaContent: `version = 1`}
+
+	t.Run("should return an error without an extension repository", func(t *testing.T) {
+		proxy := newTestProxy(t, first)
+
+		err := proxy.ReloadExtension("first")
+		if !errors.Is(err, ErrExtensionRepoNotFound) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", ErrExtensionRepoNotFound, err)
+		}
+	})
+
+	t.Run("should return an error for an extension that is not loaded", func(t *testing.T) {
+		proxy := newTestProxy(t, first)
+		proxy.ExtensionRepo = &testExtensionRepo{extensions: map[string]*domain.Extension{}}
+
+		err := proxy.ReloadExtension("missing")
+		if !errors.Is(err, ErrExtensionNotLoaded) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", ErrExtensionNotLoaded, err)
+		}
+	})
+
+	t.Run("should swap the runtime with the latest code and keep the load order", func(t *testing.T) {
+		proxy := newTestProxy(t, first, second)
+		proxy.ExtensionRepo = &testExtensionRepo{extensions: map[string]*domain.Extension{
+			"first": {ID: first.ID, Name: "first", LuaContent: `version = 2`},
+		}}
+
+		if err := proxy.ReloadExtension("first"); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if got := proxy.Extensions[0].Data.Name; got != "first" {
+			t.Fatalf("\nwanted:\nfirst\ngot:\n%s", got)
+		}
+
+		if got := proxy.Extensions[0].GetGlobal("version"); got != 2.0 {
+			t.Fatalf("\nwanted:\n2\ngot:\n%v", got)
+		}
+	})
+
+	t.Run("should close the old runtime after the swap", func(t *testing.T) {
+		proxy := newTestProxy(t, first)
+		proxy.ExtensionRepo = &testExtensionRepo{extensions: map[string]*domain.Extension{
+			"first": {ID: first.ID, Name: "first", LuaContent: `version = 2`},
+		}}
+		old, _ := proxy.GetExtension("first")
+
+		if err := proxy.ReloadExtension("first"); err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+
+		if err := old.ExecuteLua(`version = 3`); !errors.Is(err, extensions.ErrRuntimeClosed) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", extensions.ErrRuntimeClosed, err)
+		}
+	})
+
+	t.Run("should be safe to reload while the extensions are running", func(t *testing.T) {
+		proxy := newTestProxy(t, first, second)
+		proxy.ExtensionRepo = &testExtensionRepo{extensions: map[string]*domain.Extension{
+			"first": {ID: first.ID, Name: "first", LuaContent: `function processRequest(request) end`},
+		}}
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req, _ := http.NewRequest("GET", "https://marasi.app", nil)
+				for _, ext := range proxy.loadedExtensions() {
+					ext.CallRequestHandler(req)
+				}
+			}
+		}()
+
+		for range 20 {
+			if err := proxy.ReloadExtension("first"); err != nil {
+				t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+			}
+		}
+		close(stop)
+		<-done
+
+		if got := len(proxy.loadedExtensions()); got != 2 {
+			t.Fatalf("\nwanted:\n2 extensions\ngot:\n%d", got)
+		}
+	})
+
+	t.Run("should keep the old runtime when the reload fails", func(t *testing.T) {
+		proxy := newTestProxy(t, first)
+		proxy.ExtensionRepo = &testExtensionRepo{extensions: map[string]*domain.Extension{
+			"first": {ID: first.ID, Name: "first", LuaContent: `version = `},
+		}}
+		old, _ := proxy.GetExtension("first")
+
+		if err := proxy.ReloadExtension("first"); err == nil {
+			t.Fatalf("\nwanted:\nerror\ngot:\nnil")
+		}
+
+		ext, _ := proxy.GetExtension("first")
+		if ext != old {
+			t.Fatalf("\nwanted:\nold runtime\ngot:\nnew runtime")
+		}
+
+		if got := ext.GetGlobal("version"); got != 1.0 {
+			t.Fatalf("\nwanted:\n1\ngot:\n%v", got)
+		}
+	})
+}
+
+func TestProxySetWaypoint(t *testing.T) {
+	t.Run("SetWaypoint and RemoveWaypoint should update the repository and the proxy", func(t *testing.T) {
+		repo := &testWaypointRepo{waypoints: make(map[string]string)}
+		proxy := &Proxy{WaypointRepo: repo}
+
+		if err := proxy.SetWaypoint("marasi.app:443", "127.0.0.1:8443"); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if override, ok := proxy.waypoint("marasi.app:443"); !ok || override != "127.0.0.1:8443" {
+			t.Fatalf("wanted: %q\ngot: %q", "127.0.0.1:8443", override)
+		}
+		if repo.waypoints["marasi.app:443"] != "127.0.0.1:8443" {
+			t.Fatalf("wanted: %q\ngot: %q", "127.0.0.1:8443", repo.waypoints["marasi.app:443"])
+		}
+
+		if err := proxy.RemoveWaypoint("marasi.app:443"); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if _, ok := proxy.waypoint("marasi.app:443"); ok {
+			t.Fatalf("expected waypoint to be removed from the proxy")
+		}
+		if _, ok := repo.waypoints["marasi.app:443"]; ok {
+			t.Fatalf("expected waypoint to be removed from the repository")
+		}
+	})
+
+	t.Run("RemoveWaypoint should return the repository error", func(t *testing.T) {
+		proxy := &Proxy{WaypointRepo: &testWaypointRepo{waypoints: make(map[string]string)}}
+
+		if err := proxy.RemoveWaypoint("marasi.app:443"); err == nil {
+			t.Fatalf("wanted: error\ngot: nil")
+		}
+	})
+
+	t.Run("changing waypoints while requests are matched should not race", func(t *testing.T) {
+		proxy := &Proxy{WaypointRepo: &testWaypointRepo{waypoints: make(map[string]string)}}
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					req := httptest.NewRequest(http.MethodGet, "https://marasi.app/path", nil)
+					_, remove, err := martian.TestContext(req, nil, nil)
+					if err != nil {
+						t.Errorf("applying martian context : %v", err)
+						return
+					}
+					if err := SetupRequestModifier(proxy, req); err != nil {
+						t.Errorf("running SetupRequestModifier : %v", err)
+					}
+					if err := OverrideWaypointsModifier(proxy, req); err != nil {
+						t.Errorf("wanted: nil\ngot: %v", err)
+					}
+					remove()
+				}
+			}()
+		}
+
+		for i := range 100 {
+			if err := proxy.SetWaypoint("marasi.app:443", fmt.Sprintf("127.0.0.1:%d", 8000+i)); err != nil {
+				t.Fatalf("setting waypoint : %v", err)
+			}
+			if i%2 == 0 {
+				if err := proxy.RemoveWaypoint("marasi.app:443"); err != nil {
+					t.Fatalf("removing waypoint : %v", err)
+				}
+			}
+		}
+		close(stop)
+		wg.Wait()
+	})
+}
+
+func TestProxyProfile(t *testing.T) {
+	t.Run("a profile exported by one proxy should be imported by another", func(t *testing.T) {
+		source := &Proxy{
+			ProfileRepo: &testProfileRepo{profile: &domain.Profile{
+				Version:    domain.ProfileVersion,
+				Waypoints:  []domain.ProfileWaypoint{{Hostname: "marasi.app:443", Override: "127.0.0.1:8443"}},
+				Extensions: []domain.ProfileExtension{{Name: "custom", LuaContent: "function processRequest(req) end"}},
+				Config:     map[string]string{"theme": "dark"},
+			}},
+		}
+		scope := compass.NewScope(false)
+		if err := scope.AddRule(`marasi\.app`, "host", false); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		if err := scope.AddRuleWithPriority(`/logout`, "url", true, 10); err != nil {
+			t.Fatalf("adding rule : %v", err)
+		}
+		source.SetScope(scope)
+
+		var profile bytes.Buffer
+		if err := source.ExportProfile(&profile); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		destinationRepo := &testProfileRepo{}
+		destination := &Proxy{ProfileRepo: destinationRepo}
+		destination.SetScope(compass.NewScope(true))
+		if err := destination.ImportProfile(&profile); err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+
+		sourceProfile, _ := source.ProfileRepo.ExportProfile()
+		sourceProfile.Scope = scopeToProfile(scope)
+		destinationProfile := destinationRepo.profile
+		destinationScope, err := destination.GetScope()
+		if err != nil {
+			t.Fatalf("getting scope : %v", err)
+		}
+		destinationProfile.Scope = scopeToProfile(destinationScope)
+
+		if !reflect.DeepEqual(sourceProfile, destinationProfile) {
+			t.Fatalf("wanted:\n%+v\ngot:\n%+v", sourceProfile, destinationProfile)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "https://marasi.app/logout", nil)
+		if destinationScope.Matches(req) {
+			t.Fatalf("expected the imported exclude rule to take priority")
+		}
+	})
+
+	t.Run("an invalid scope should not be imported", func(t *testing.T) {
+		repo := &testProfileRepo{}
+		proxy := &Proxy{ProfileRepo: repo}
+		profile := `{"version": 1, "scope": {"default_allow": true, "rules": [{"pattern": "(", "match_type": "host"}]}}`
+
+		if err := proxy.ImportProfile(strings.NewReader(profile)); err == nil {
+			t.Fatalf("wanted: error\ngot: nil")
+		}
+		if repo.profile != nil {
+			t.Fatalf("expected the profile to not be imported")
+		}
+	})
+
+	t.Run("ExportProfile should return ErrProfileRepoNotFound without a repository", func(t *testing.T) {
+		proxy := &Proxy{}
+		if err := proxy.ExportProfile(io.Discard); !errors.Is(err, ErrProfileRepoNotFound) {
+			t.Fatalf("wanted: %v\ngot: %v", ErrProfileRepoNotFound, err)
+		}
+	})
+}
+
+func TestProxyDBHealth(t *testing.T) {
+	t.Run("DBHealth should return the health reported by the repository", func(t *testing.T) {
+		want := domain.DBHealth{OpenConnections: 1, JournalMode: "wal", WAL: true, Writable: true}
+		proxy := &Proxy{HealthRepo: &testHealthRepo{health: want}}
+
+		got, err := proxy.DBHealth(context.Background())
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if got != want {
+			t.Fatalf("wanted: %+v\ngot: %+v", want, got)
+		}
+	})
+
+	t.Run("DBHealth should return the repository error", func(t *testing.T) {
+		proxy := &Proxy{HealthRepo: &testHealthRepo{err: errors.New("database is locked")}}
+
+		if _, err := proxy.DBHealth(context.Background()); err == nil {
+			t.Fatalf("wanted: error\ngot: nil")
+		}
+	})
+
+	t.Run("DBHealth should return ErrHealthRepoNotFound without a repository", func(t *testing.T) {
+		proxy := &Proxy{}
+
+		if _, err := proxy.DBHealth(context.Background()); !errors.Is(err, ErrHealthRepoNotFound) {
+			t.Fatalf("wanted: %v\ngot: %v", ErrHealthRepoNotFound, err)
+		}
+	})
+}
+
+func TestProxyWriteToDB(t *testing.T) {
+	burst := func(n int) []any {
+		items := make([]any, 0, n*2)
+		for range n {
+			id := uuid.New()
+			items = append(items, &domain.ProxyRequest{ID: id, Metadata: map[string]any{}}, &domain.ProxyResponse{ID: id, Metadata: map[string]any{}})
+		}
+		return items
+	}
+
+	t.Run("WriteToDB should write a burst in fewer transactions than items and keep the order", func(t *testing.T) {
+		batchRepo := &testBatchRepo{}
+		proxy := &Proxy{
+			DBWriteChannel:    make(chan any, 100),
+			BatchRepo:         batchRepo,
+			DBWriteBatchSize:  10,
+			DBWriteBatchDelay: time.Second,
+		}
+
+		items := burst(50)
+		go func() {
+			for _, item := range items {
+				proxy.DBWriteChannel <- item
+			}
+			close(proxy.DBWriteChannel)
+		}()
+		proxy.WriteToDB()
+
+		if !reflect.DeepEqual(batchRepo.writes, items) {
+			t.Fatalf("wanted: %d items in order\ngot: %d items", len(items), len(batchRepo.writes))
+		}
+		if batchRepo.commits != len(items)/10 {
+			t.Fatalf("wanted: %d commits\ngot: %d", len(items)/10, batchRepo.commits)
+		}
+	})
+
+	t.Run("WriteToDB should write a batch without waiting for the delay when the channel is closed", func(t *testing.T) {
+		batchRepo := &testBatchRepo{}
+		proxy := &Proxy{
+			DBWriteChannel:    make(chan any, 10),
+			BatchRepo:         batchRepo,
+			DBWriteBatchDelay: time.Hour,
+		}
+
+		items := burst(2)
+		for _, item := range items {
+			proxy.DBWriteChannel <- item
+		}
+		close(proxy.DBWriteChannel)
+
+		done := make(chan struct{})
+		go func() {
+			proxy.WriteToDB()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("wanted: WriteToDB to return once the channel is closed\ngot: still waiting")
+		}
+
+		if batchRepo.commits != 1 || len(batchRepo.writes) != len(items) {
+			t.Fatalf("wanted: 1 commit of %d items\ngot: %d commits of %d items", len(items), batchRepo.commits, len(batchRepo.writes))
+		}
+	})
+
+	t.Run("WriteToDB should write the tags added while handling the response", func(t *testing.T) {
+		batchRepo := &testBatchRepo{}
+		proxy := &Proxy{
+			DBWriteChannel: make(chan any, 10),
+			BatchRepo:      batchRepo,
+		}
+
+		id := uuid.New()
+		proxy.DBWriteChannel <- &domain.ProxyRequest{ID: id, Metadata: map[string]any{}, Tags: []string{"reviewed"}}
+		proxy.DBWriteChannel <- &domain.ProxyResponse{ID: id, Metadata: map[string]any{}, Tags: []string{"reviewed", "sqli-candidate"}}
+		close(proxy.DBWriteChannel)
+		proxy.WriteToDB()
+
+		want := []string{"reviewed", "sqli-candidate"}
+		if !reflect.DeepEqual(batchRepo.tags[id], want) {
+			t.Fatalf("wanted: %v\ngot: %v", want, batchRepo.tags[id])
+		}
+	})
+
+	t.Run("WriteToDB should write the note set while handling the response", func(t *testing.T) {
+		batchRepo := &testBatchRepo{}
+		proxy := &Proxy{
+			DBWriteChannel: make(chan any, 10),
+			BatchRepo:      batchRepo,
+		}
+
+		requestNote, responseNote := "check the id parameter", "reflected in the response"
+		id, untouched := uuid.New(), uuid.New()
+		proxy.DBWriteChannel <- &domain.ProxyRequest{ID: id, Metadata: map[string]any{}, Note: &requestNote}
+		proxy.DBWriteChannel <- &domain.ProxyResponse{ID: id, Metadata: map[string]any{}, Note: &responseNote}
+		proxy.DBWriteChannel <- &domain.ProxyRequest{ID: untouched, Metadata: map[string]any{}}
+		proxy.DBWriteChannel <- &domain.ProxyResponse{ID: untouched, Metadata: map[string]any{}}
+		close(proxy.DBWriteChannel)
+		proxy.WriteToDB()
+
+		if batchRepo.notes[id] != responseNote {
+			t.Fatalf("wanted: %s\ngot: %s", responseNote, batchRepo.notes[id])
+		}
+		if note, ok := batchRepo.notes[untouched]; ok {
+			t.Fatalf("wanted: no note\ngot: %s", note)
+		}
+	})
+
+	t.Run("WriteToDB should roll back the batch and write the items one by one when an item fails", func(t *testing.T) {
+		trafficRepo := newTestTrafficRepo()
+		batchRepo := &testBatchRepo{itemErr: errors.New("constraint failed")}
+		proxy := &Proxy{
+			DBWriteChannel: make(chan any, 10),
+			BatchRepo:      batchRepo,
+			TrafficRepo:    trafficRepo,
+		}
+
+		items := burst(3)
+		for _, item := range items {
+			proxy.DBWriteChannel <- item
+		}
+		close(proxy.DBWriteChannel)
+		proxy.WriteToDB()
+
+		if batchRepo.commits != 0 || len(batchRepo.writes) != 0 {
+			t.Fatalf("wanted: no committed batch\ngot: %d commits of %d items", batchRepo.commits, len(batchRepo.writes))
+		}
+		if len(trafficRepo.requests) != 3 || len(trafficRepo.responses) != 3 {
+			t.Fatalf("wanted: 3 requests and 3 responses\ngot: %d requests and %d responses", len(trafficRepo.requests), len(trafficRepo.responses))
+		}
+	})
+
+	t.Run("WriteToDB should write the items one by one when the transaction fails", func(t *testing.T) {
+		trafficRepo := newTestTrafficRepo()
+		var logged []domain.Log
+		proxy := &Proxy{
+			DBWriteChannel: make(chan any, 10),
+			BatchRepo:      &testBatchRepo{err: errors.New("database is locked")},
+			TrafficRepo:    trafficRepo,
+			LogRepo:        &testLogRepo{},
+			OnLog: func(log domain.Log) error {
+				logged = append(logged, log)
+				return nil
+			},
+		}
+
+		items := burst(3)
+		for _, item := range items {
+			proxy.DBWriteChannel <- item
+		}
+		proxy.DBWriteChannel <- &domain.Log{ID: uuid.New(), Message: "done"}
+		close(proxy.DBWriteChannel)
+		proxy.WriteToDB()
+
+		if len(trafficRepo.requests) != 3 || len(trafficRepo.responses) != 3 {
+			t.Fatalf("wanted: 3 requests and 3 responses\ngot: %d requests and %d responses", len(trafficRepo.requests), len(trafficRepo.responses))
+		}
+		if len(logged) != 1 || logged[0].Message != "done" {
+			t.Fatalf("wanted: OnLog to be called with the log\ngot: %v", logged)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package rawhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"unicode/utf8"
+)
+
+// hopByHopHeaders are connection specific headers that are not forwarded by curl
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ToCurl reconstructs a curl command line from a raw request, the scheme is used when the request target is not absolute
+// Hop-by-hop headers, Host and Content-Length are omitted since curl derives them from the URL and the body
+// Text bodies are sent with --data-raw, any other body is piped from printf to --data-binary @- since
+// shell arguments cannot hold NUL bytes
+func ToCurl(raw []byte, scheme string) (string, error) {
+	// the body is kept exactly as captured, only the head is split on either line ending
+	head, body, found := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !found {
+		head, body, _ = bytes.Cut(raw, []byte("\n\n"))
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	requestLine := strings.Fields(lines[0])
+	if len(requestLine) < 2 {
+		return "", fmt.Errorf("malformed request line : %q", lines[0])
+	}
+	method, target := requestLine[0], requestLine[1]
+
+	header := make(http.Header)
+	names := make([]string, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return "", fmt.Errorf("malformed header line : %q", line)
+		}
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		names = append(names, name)
+		header.Add(name, value)
+	}
+
+	excluded := map[string]bool{"Host": true, "Content-Length": true}
+	for _, name := range hopByHopHeaders {
+		excluded[name] = true
+	}
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			excluded[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	if strings.EqualFold(header.Get("Transfer-Encoding"), "chunked") {
+		decoded, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		if err != nil {
+			return "", fmt.Errorf("decoding chunked body : %w", err)
+		}
+		body = decoded
+	}
+
+	url := target
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		host := header.Get("Host")
+		if host == "" {
+			return "", fmt.Errorf("missing host header")
+		}
+		url = fmt.Sprintf("%s://%s%s", scheme, host, target)
+	}
+
+	var builder strings.Builder
+	binary := len(body) > 0 && !isText(body)
+	if binary {
+		fmt.Fprintf(&builder, "printf %s | ", printfQuote(body))
+	}
+	builder.WriteString("curl")
+	if method != http.MethodGet {
+		fmt.Fprintf(&builder, " -X %s", shellQuote(method))
+	}
+	fmt.Fprintf(&builder, " %s", shellQuote(url))
+
+	// each header is written once with its values in captured order
+	seen := make(map[string]bool)
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if excluded[canonical] || seen[canonical] {
+			continue
+		}
+		seen[canonical] = true
+		for _, value := range header.Values(canonical) {
+			fmt.Fprintf(&builder, " -H %s", shellQuote(name+": "+value))
+		}
+	}
+
+	if binary {
+		builder.WriteString(" --data-binary @-")
+	} else if len(body) > 0 {
+		fmt.Fprintf(&builder, " --data-raw %s", shellQuote(string(body)))
+	}
+
+	return builder.String(), nil
+}
+
+// isText reports whether the body is valid UTF-8 without control characters other than tabs and line breaks
+func isText(body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, b := range body {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote wraps s in single quotes so that it is passed literally by POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// printfQuote encodes b as a single quoted printf format, printable bytes are kept and every other byte
+// along with the quote, backslash and percent characters is written as an octal escape
+func printfQuote(b []byte) string {
+	var builder strings.Builder
+	builder.WriteString("'")
+	for _, c := range b {
+		if c >= 0x20 && c < 0x7f && c != '\'' && c != '\\' && c != '%' {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, `\%03o`, c)
+		}
+	}
+	builder.WriteString("'")
+	return builder.String()
+}
@@ -0,0 +1,76 @@
+package rawhttp
+
+import (
+	"testing"
+)
+
+func TestToCurl(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		scheme  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "GET should omit the method and hop-by-hop headers",
+			raw:    "GET /search?q=marasi&page=2 HTTP/1.1\r\nHost: marasi.app\r\nUser-Agent: marasi\r\nConnection: keep-alive, X-Hop\r\nX-Hop: drop\r\nAccept: */*\r\n\r\n",
+			scheme: "https",
+			want:   `curl 'https://marasi.app/search?q=marasi&page=2' -H 'User-Agent: marasi' -H 'Accept: */*'`,
+		},
+		{
+			name:   "POST with a text body should use --data-raw and escape single quotes",
+			raw:    "POST /login HTTP/1.1\r\nHost: marasi.app:8443\r\nContent-Type: application/json\r\nContent-Length: 38\r\n\r\n{\"user\":\"o'brien\",\"cmd\":\"$(id) `id`\"}",
+			scheme: "https",
+			want:   `curl -X 'POST' 'https://marasi.app:8443/login' -H 'Content-Type: application/json' --data-raw '{"user":"o'\''brien","cmd":"$(id) ` + "`id`" + `"}'`,
+		},
+		{
+			name:   "binary body should be piped from printf to --data-binary",
+			raw:    "PUT /upload HTTP/1.1\r\nHost: marasi.app\r\nContent-Type: application/octet-stream\r\n\r\n\x00\x01'\\%\xff",
+			scheme: "http",
+			want:   `printf '\000\001\047\134\045\377' | curl -X 'PUT' 'http://marasi.app/upload' -H 'Content-Type: application/octet-stream' --data-binary @-`,
+		},
+		{
+			name:   "chunked body should be decoded",
+			raw:    "POST /chunked HTTP/1.1\r\nHost: marasi.app\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			scheme: "https",
+			want:   `curl -X 'POST' 'https://marasi.app/chunked' --data-raw 'hello'`,
+		},
+		{
+			name:   "absolute target should be used as is and repeated headers kept",
+			raw:    "GET http://marasi.app/ HTTP/1.1\r\nHost: marasi.app\r\nCookie: a=1\r\nCookie: b=2\r\n\r\n",
+			scheme: "https",
+			want:   `curl 'http://marasi.app/' -H 'Cookie: a=1' -H 'Cookie: b=2'`,
+		},
+		{
+			name:    "missing host should return an error",
+			raw:     "GET / HTTP/1.1\r\n\r\n",
+			scheme:  "https",
+			wantErr: true,
+		},
+		{
+			name:    "malformed request line should return an error",
+			raw:     "GARBAGE\r\n\r\n",
+			scheme:  "https",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToCurl([]byte(tt.raw), tt.scheme)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("wanted: error\ngot: nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("wanted: nil\ngot: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("wanted:\n%s\ngot:\n%s", tt.want, got)
+			}
+		})
+	}
+}
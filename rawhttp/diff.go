@@ -0,0 +1,114 @@
+package rawhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DiffOptions controls how two bodies are compared by DiffBodies
+type DiffOptions struct {
+	NormalizeJSON bool // Canonicalize JSON bodies (sorted keys, consistent indentation) before diffing
+}
+
+// NormalizeJSON canonicalizes a JSON body by sorting the object keys and re-indenting it.
+// Numbers are kept as they were written to avoid float precision changes.
+// It returns false if the body is not valid JSON.
+func NormalizeJSON(body []byte) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(bytes.TrimSpace(body)))
+	decoder.UseNumber()
+
+	var jsonData any
+	if err := decoder.Decode(&jsonData); err != nil {
+		return nil, false
+	}
+	// Trailing data means the body is not a single JSON value
+	if decoder.More() {
+		return nil, false
+	}
+
+	normalized, err := json.MarshalIndent(jsonData, "", "  ")
+	if err != nil {
+		return nil, false
+	}
+	return normalized, true
+}
+
+// DiffBodies returns a line based diff between two bodies, removed lines are prefixed with "- " and added lines with "+ ".
+// If options.NormalizeJSON is set and both bodies are valid JSON they are normalized with NormalizeJSON first so
+// key order and whitespace changes are ignored, otherwise the raw bodies are compared.
+// An empty string is returned when there are no differences.
+func DiffBodies(original, modified []byte, options DiffOptions) string {
+	if options.NormalizeJSON {
+		normalizedOriginal, okOriginal := NormalizeJSON(original)
+		normalizedModified, okModified := NormalizeJSON(modified)
+		if okOriginal && okModified {
+			original, modified = normalizedOriginal, normalizedModified
+		}
+	}
+
+	if bytes.Equal(original, modified) {
+		return ""
+	}
+
+	return diffLines(splitLines(original), splitLines(modified))
+}
+
+// splitLines splits a body into lines, normalizing CRLF line endings
+func splitLines(body []byte) []string {
+	if len(body) == 0 {
+		return []string{}
+	}
+	normalized := strings.ReplaceAll(string(body), "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(normalized, "\n"), "\n")
+}
+
+// diffLines computes the longest common subsequence of the lines after trimming the common prefix and suffix
+// and returns the removed and added lines in order
+func diffLines(a, b []string) string {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	// lcs[i][j] holds the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&diff, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&diff, "+ %s\n", b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		fmt.Fprintf(&diff, "- %s\n", a[i])
+	}
+	for ; j < len(b); j++ {
+		fmt.Fprintf(&diff, "+ %s\n", b[j])
+	}
+	return diff.String()
+}
@@ -0,0 +1,76 @@
+package rawhttp
+
+import (
+	"testing"
+)
+
+func TestNormalizeJSON(t *testing.T) {
+	t.Run("should sort keys and indent JSON", func(t *testing.T) {
+		want := "{\n  \"a\": 1.50,\n  \"b\": {\n    \"c\": true,\n    \"d\": null\n  }\n}"
+		got, ok := NormalizeJSON([]byte(`  {"b": {"d": null, "c": true}, "a": 1.50}  `))
+		if !ok {
+			t.Fatalf("wanted: true\ngot: %t", ok)
+		}
+		if string(got) != want {
+			t.Fatalf("wanted:\n%q\ngot:\n%q", want, got)
+		}
+	})
+
+	t.Run("should return false for non JSON body", func(t *testing.T) {
+		_, ok := NormalizeJSON([]byte(`<html></html>`))
+		if ok {
+			t.Fatalf("wanted: false\ngot: %t", ok)
+		}
+	})
+
+	t.Run("should return false for multiple JSON values", func(t *testing.T) {
+		_, ok := NormalizeJSON([]byte(`{"a":1}{"b":2}`))
+		if ok {
+			t.Fatalf("wanted: false\ngot: %t", ok)
+		}
+	})
+}
+
+func TestDiffBodies(t *testing.T) {
+	t.Run("semantically equal JSON bodies with different key order should produce an empty diff", func(t *testing.T) {
+		original := []byte(`{"user":{"name":"marasi","roles":["admin","user"]},"id":1}`)
+		modified := []byte("{\n  \"id\": 1,\n  \"user\": {\"roles\": [\"admin\", \"user\"], \"name\": \"marasi\"}\n}")
+
+		got := DiffBodies(original, modified, DiffOptions{NormalizeJSON: true})
+		if got != "" {
+			t.Fatalf("wanted: empty diff\ngot:\n%s", got)
+		}
+	})
+
+	t.Run("JSON bodies with a changed value should only show the changed line", func(t *testing.T) {
+		original := []byte(`{"id":1,"name":"marasi"}`)
+		modified := []byte(`{"name":"marasi","id":2}`)
+
+		want := "-   \"id\": 1,\n+   \"id\": 2,\n"
+		got := DiffBodies(original, modified, DiffOptions{NormalizeJSON: true})
+		if got != want {
+			t.Fatalf("wanted:\n%q\ngot:\n%q", want, got)
+		}
+	})
+
+	t.Run("JSON bodies with different key order should differ without normalization", func(t *testing.T) {
+		original := []byte(`{"a":1,"b":2}`)
+		modified := []byte(`{"b":2,"a":1}`)
+
+		got := DiffBodies(original, modified, DiffOptions{})
+		if got == "" {
+			t.Fatalf("wanted: diff\ngot: empty diff")
+		}
+	})
+
+	t.Run("non JSON bodies should fall back to a raw line diff", func(t *testing.T) {
+		original := []byte("line one\r\nline two\r\nline three")
+		modified := []byte("line one\nline 2\nline three\nline four")
+
+		want := "- line two\n+ line 2\n+ line four\n"
+		got := DiffBodies(original, modified, DiffOptions{NormalizeJSON: true})
+		if got != want {
+			t.Fatalf("wanted:\n%q\ngot:\n%q", want, got)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package rawhttp
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// HeaderOrder returns the canonical header names of a raw request or response in the order they first appear
+func HeaderOrder(raw []byte) []string {
+	head, _, found := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !found {
+		head, _, _ = bytes.Cut(raw, []byte("\n\n"))
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	order := make([]string, 0, len(lines))
+	for _, line := range lines[1:] {
+		name, _, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name != "" && !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// DumpRequestOrdered dumps req like DumpRequest, with the request line in origin-form and the headers written in the given order
+// Host is written where it appears in the order. Headers that are not part of the order, such as the Accept-Encoding added by
+// the client transport or X-Launchpad-Id, follow the ordered ones sorted by name
+func DumpRequestOrdered(req *http.Request, order []string) (rawDump []byte, prettyDump string, err error) {
+	header := req.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	host := req.Host
+	if host == "" && req.URL != nil {
+		host = req.URL.Host
+	}
+	if host != "" {
+		header.Set("Host", host)
+	}
+	if len(req.TransferEncoding) > 0 {
+		header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+
+	proto := req.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s %s\r\n", req.Method, req.URL.RequestURI(), proto)
+
+	writeHeader := func(name string) {
+		for _, value := range header[name] {
+			fmt.Fprintf(&head, "%s: %s\r\n", name, value)
+		}
+		delete(header, name)
+	}
+	for _, name := range order {
+		writeHeader(http.CanonicalHeaderKey(name))
+	}
+
+	remaining := slices.Sorted(maps.Keys(header))
+	for _, name := range remaining {
+		writeHeader(name)
+	}
+	head.WriteString("\r\n")
+
+	return appendRequestBody(req, head.Bytes())
+}
@@ -0,0 +1,48 @@
+package rawhttp
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderOrder(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nHost: marasi.app\r\nuser-agent: marasi\r\nAccept: */*\r\nCookie: a=1\r\nCookie: b=2\r\n\r\nbody: not a header"
+
+	want := []string{"Host", "User-Agent", "Accept", "Cookie"}
+	got := HeaderOrder([]byte(raw))
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("wanted:\n%v\ngot:\n%v", want, got)
+	}
+}
+
+func TestDumpRequestOrdered(t *testing.T) {
+	t.Run("headers should follow the order with Host in place and the remaining headers sorted after them", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "https://marasi.app/path?q=1", strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("creating request : %v", err)
+		}
+		req.Header.Set("User-Agent", "marasi")
+		req.Header.Add("Cookie", "a=1")
+		req.Header.Add("Cookie", "b=2")
+		req.Header.Set("X-Launchpad-Id", "id")
+		req.Header.Set("Accept-Encoding", "gzip")
+		order := []string{"user-agent", "Host", "Cookie"}
+
+		want := "POST /path?q=1 HTTP/1.1\r\nUser-Agent: marasi\r\nHost: marasi.app\r\nCookie: a=1\r\nCookie: b=2\r\nAccept-Encoding: gzip\r\nX-Launchpad-Id: id\r\n\r\nbody"
+		got, _, err := DumpRequestOrdered(req, order)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("wanted:\n%q\ngot:\n%q", want, got)
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil || string(body) != "body" {
+			t.Fatalf("wanted: body to be readable\ngot: %q, %v", body, err)
+		}
+	})
+}
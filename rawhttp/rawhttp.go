@@ -105,6 +105,15 @@ func DumpRequest(req *http.Request) (rawDump []byte, prettyDump string, err erro
 	if err != nil {
 		return []byte{}, "", fmt.Errorf("dumping request : %w", err)
 	}
+	return appendRequestBody(req, requestDump)
+}
+
+// appendRequestBody appends the body of req to the dumped request line and headers and resets the body so it can be consumed
+// Returns the full dump, prettified dump and an error
+func appendRequestBody(req *http.Request, requestDump []byte) (rawDump []byte, prettyDump string, err error) {
+	if req.Body == nil {
+		return requestDump, "", nil
+	}
 	bodyBytes, err := io.ReadAll(req.Body)
 	if err != nil {
 		return []byte{}, "", fmt.Errorf("reading request body: %w", err)
@@ -156,6 +165,8 @@ func RecalculateContentLength(raw []byte) (updated []byte, err error) {
 }
 
 // RebuildRequest creates a new *http.Request from a raw request slice, it takes the original request context and scheme
+// Proto and Close are taken from the raw request, so an HTTP/1.0 request without keep-alive or a request with
+// `Connection: close` closes the upstream connection instead of reusing it
 func RebuildRequest(raw []byte, originalRequest *http.Request) (req *http.Request, err error) {
 	updated, err := RecalculateContentLength(raw)
 	if err != nil {
@@ -395,6 +395,25 @@ func TestDumpRequest(t *testing.T) {
 			t.Errorf("expected error message to contain %s but got: %v", wantedContext, err)
 		}
 	})
+
+	t.Run("DumpRequest with nil Body", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "https://marasi.app/", nil)
+		if err != nil {
+			t.Fatalf("creating new request: %v", err)
+		}
+		req.Body = nil
+
+		rawDump, prettyDump, err := DumpRequest(req)
+		if err != nil {
+			t.Fatalf("dumping request: %v", err)
+		}
+		if !bytes.HasPrefix(rawDump, []byte("GET / HTTP/1.1\r\n")) || !bytes.HasSuffix(rawDump, []byte("\r\n\r\n")) {
+			t.Errorf("expected raw dump to only contain the request head but got\n%q", rawDump)
+		}
+		if prettyDump != "" {
+			t.Errorf("expected empty pretty dump but got\n%q", prettyDump)
+		}
+	})
 }
 
 func TestDumpResponse(t *testing.T) {
@@ -626,6 +645,60 @@ func TestRebuildRequest(t *testing.T) {
 		}
 	})
 
+	t.Run("RebuildRequest (Connection Semantics Preserved)", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			raw        string
+			protoMinor int
+			close      bool
+		}{
+			{
+				name:       "HTTP/1.0 closes by default",
+				raw:        "GET /test HTTP/1.0\r\nHost: example.com\r\n\r\n",
+				protoMinor: 0,
+				close:      true,
+			},
+			{
+				name:       "HTTP/1.0 with keep-alive",
+				raw:        "GET /test HTTP/1.0\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n",
+				protoMinor: 0,
+				close:      false,
+			},
+			{
+				name:       "HTTP/1.1 with Connection close",
+				raw:        "GET /test HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+				protoMinor: 1,
+				close:      true,
+			},
+			{
+				name:       "HTTP/1.1 keeps the connection alive by default",
+				raw:        "GET /test HTTP/1.1\r\nHost: example.com\r\n\r\n",
+				protoMinor: 1,
+				close:      false,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				// The original request is keep-alive HTTP/1.1, the raw request should take precedence
+				originalRequest, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+
+				newReq, err := RebuildRequest([]byte(tt.raw), originalRequest)
+				if err != nil {
+					t.Fatalf("rebuilding request: %v", err)
+				}
+
+				if newReq.ProtoMajor != 1 || newReq.ProtoMinor != tt.protoMinor {
+					t.Errorf("expected HTTP/1.%d, got %s", tt.protoMinor, newReq.Proto)
+				}
+
+				if newReq.Close != tt.close {
+					t.Errorf("expected Close to be %t, got %t", tt.close, newReq.Close)
+				}
+			})
+		}
+	})
+
 	t.Run("RebuildRequest (RecalculateContentLength Fails)", func(t *testing.T) {
 		// Malformed: no \r\n\r\n
 		rawRequest := "GET /test HTTP/1.1\r\nHost: example.com"
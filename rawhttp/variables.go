@@ -0,0 +1,32 @@
+package rawhttp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ErrUnknownVariable is returned by SubstituteVariables in strict mode when a placeholder has no matching variable
+var ErrUnknownVariable = errors.New("unknown variable")
+
+// variablePattern matches {{name}} placeholders, whitespace around the name is allowed
+var variablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// SubstituteVariables replaces the {{name}} placeholders in a raw request / response with their value in variables.
+// Placeholders without a matching variable are left intact, unless strict is set in which case ErrUnknownVariable is returned.
+func SubstituteVariables(raw []byte, variables map[string]string, strict bool) ([]byte, error) {
+	var unknown []string
+	substituted := variablePattern.ReplaceAllFunc(raw, func(match []byte) []byte {
+		name := string(variablePattern.FindSubmatch(match)[1])
+		if value, ok := variables[name]; ok {
+			return []byte(value)
+		}
+		unknown = append(unknown, name)
+		return match
+	})
+
+	if strict && len(unknown) > 0 {
+		return nil, fmt.Errorf("%w : %v", ErrUnknownVariable, unknown)
+	}
+	return substituted, nil
+}
@@ -0,0 +1,58 @@
+package rawhttp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSubstituteVariables(t *testing.T) {
+	raw := "POST /api/{{ version }}/users HTTP/1.1\r\nHost: marasi.app\r\nAuthorization: Bearer {{token}}\r\n\r\n{\"csrf\":\"{{csrf}}\"}"
+	variables := map[string]string{
+		"version": "v2",
+		"token":   "secret-token",
+	}
+
+	t.Run("should replace known variables and leave unknown placeholders intact", func(t *testing.T) {
+		want := "POST /api/v2/users HTTP/1.1\r\nHost: marasi.app\r\nAuthorization: Bearer secret-token\r\n\r\n{\"csrf\":\"{{csrf}}\"}"
+		got, err := SubstituteVariables([]byte(raw), variables, false)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("wanted:\n%q\ngot:\n%q", want, got)
+		}
+	})
+
+	t.Run("should return ErrUnknownVariable for unknown placeholders in strict mode", func(t *testing.T) {
+		_, err := SubstituteVariables([]byte(raw), variables, true)
+		if !errors.Is(err, ErrUnknownVariable) {
+			t.Fatalf("wanted: %v\ngot: %v", ErrUnknownVariable, err)
+		}
+		if !strings.Contains(err.Error(), "csrf") {
+			t.Fatalf("wanted: error containing csrf\ngot: %v", err)
+		}
+	})
+
+	t.Run("should substitute every variable in strict mode when all are known", func(t *testing.T) {
+		want := "GET /?q=a HTTP/1.1\r\nHost: marasi.app\r\n\r\n"
+		got, err := SubstituteVariables([]byte("GET /?q={{q}} HTTP/1.1\r\nHost: {{host}}\r\n\r\n"), map[string]string{"q": "a", "host": "marasi.app"}, true)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("wanted:\n%q\ngot:\n%q", want, got)
+		}
+	})
+
+	t.Run("should not change requests without placeholders", func(t *testing.T) {
+		input := "GET / HTTP/1.1\r\nHost: marasi.app\r\n\r\n{\"a\":{\"b\":1}}"
+		got, err := SubstituteVariables([]byte(input), nil, true)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		if string(got) != input {
+			t.Fatalf("wanted:\n%q\ngot:\n%q", input, got)
+		}
+	})
+}
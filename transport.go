@@ -3,30 +3,53 @@ package marasi
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	stdtls "crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"slices"
+	"strings"
 
 	tls "github.com/refraction-networking/utls"
 	utls "github.com/refraction-networking/utls"
+	"github.com/tfkr-ae/marasi/core"
 )
 
+// ErrCertificatePinMismatch is returned when the upstream certificate does not match the pinned SHA-256 fingerprint of the host
+var ErrCertificatePinMismatch = errors.New("certificate pin mismatch")
+
 // marasiRoundTripper will intercept requests to marasi.cert and serve the CA certificate
 // Other requests will use the base RoundTripper
+// Requests with an SNI override are sent through sniBase, which does not pool connections
+// so a connection is never reused with a different server name
 type marasiRoundTripper struct {
-	cert *x509.Certificate
-	base http.RoundTripper
+	cert    *x509.Certificate
+	base    http.RoundTripper
+	sniBase http.RoundTripper
 }
 
 // newMarasiTransport will create marasi's roundtripper
 // It will define the base transport with the upstream TLSConfig using utls to mimic Chrome,
 // waypoint aware DialContext and marasiRoundTripper to serve the certificate
-func newMarasiTransport(cert *x509.Certificate) http.RoundTripper {
-	transport := &http.Transport{}
+// maxConnsPerHost limits the upstream connections per host, 0 means no limit
+// pinnedCerts maps hostnames to the expected SHA-256 fingerprint of their leaf certificate
+// The server name of the handshake is taken from the request context when set (core.ContextWithSNI), otherwise from the dialed host
+func newMarasiTransport(cert *x509.Certificate, maxConnsPerHost int, pinnedCerts map[string]string) http.RoundTripper {
+	pins := make(map[string]string, len(pinnedCerts))
+	for host, fingerprint := range maps.All(pinnedCerts) {
+		pins[strings.ToLower(host)] = normalizeFingerprint(fingerprint)
+	}
+
+	transport := &http.Transport{
+		MaxConnsPerHost: maxConnsPerHost,
+	}
 	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		tcpConn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
 		if err != nil {
@@ -36,11 +59,18 @@ func newMarasiTransport(cert *x509.Certificate) http.RoundTripper {
 		if err != nil {
 			sniHost = addr
 		}
+		if sni, ok := core.SNIFromContext(ctx); ok {
+			sniHost = sni
+		}
 
 		uTlsConfig := &utls.Config{
 			ServerName: sniHost,
 		}
 
+		if pin, ok := pins[strings.ToLower(sniHost)]; ok {
+			uTlsConfig.VerifyConnection = verifyPinnedCert(sniHost, pin)
+		}
+
 		if transport.TLSClientConfig != nil {
 			uTlsConfig.InsecureSkipVerify = transport.TLSClientConfig.InsecureSkipVerify
 		}
@@ -69,15 +99,48 @@ func newMarasiTransport(cert *x509.Certificate) http.RoundTripper {
 
 		if err := uConn.HandshakeContext(ctx); err != nil {
 			tcpConn.Close()
+			// The metadata map is shared with the request, so the error is visible to the response pipeline
+			if errors.Is(err, ErrCertificatePinMismatch) {
+				if metadata, ok := core.MetadataFromContext(ctx); ok {
+					metadata["certificate_pin_error"] = err.Error()
+				}
+			}
 			return nil, err
 		}
 
 		return uConn, nil
 	}
 
+	sniTransport := &http.Transport{
+		MaxConnsPerHost:   maxConnsPerHost,
+		DisableKeepAlives: true,
+		DialTLSContext:    transport.DialTLSContext,
+	}
+
 	return &marasiRoundTripper{
-		cert: cert,
-		base: transport,
+		cert:    cert,
+		base:    transport,
+		sniBase: sniTransport,
+	}
+}
+
+// normalizeFingerprint lowercases a hex fingerprint and removes the ':' separators and spaces
+func normalizeFingerprint(fingerprint string) string {
+	return strings.NewReplacer(":", "", " ", "").Replace(strings.ToLower(fingerprint))
+}
+
+// verifyPinnedCert returns a VerifyConnection callback that compares the SHA-256 fingerprint of the leaf certificate
+// with the pinned fingerprint, it returns ErrCertificatePinMismatch if they differ
+func verifyPinnedCert(host string, pin string) func(utls.ConnectionState) error {
+	return func(state utls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("%w for %s : no peer certificate", ErrCertificatePinMismatch, host)
+		}
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		if fingerprint := hex.EncodeToString(sum[:]); fingerprint != pin {
+			return fmt.Errorf("%w for %s : wanted %s got %s", ErrCertificatePinMismatch, host, pin, fingerprint)
+		}
+		return nil
 	}
 }
 
@@ -107,5 +170,50 @@ func (m *marasiRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 		req.Header.Set("User-Agent", "")
 	}
 
-	return m.base.RoundTrip(req)
+	// http.Transport only fills res.TLS for *crypto/tls.Conn, the utls connection is captured through
+	// the client trace so the negotiated parameters can be copied onto the response.
+	// The remote address of the connection is recorded as well to identify the upstream behind load balancers.
+	// The trace is attached in place rather than on a copy, martian looks up its context by the request pointer
+	// and res.Request has to remain the request it is registered under
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn
+		},
+	}
+	*req = *req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	base := m.base
+	if _, ok := core.SNIFromContext(req.Context()); ok && m.sniBase != nil {
+		base = m.sniBase
+	}
+
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// GotConn runs on the transport's dial goroutine, the metadata is only written here once RoundTrip returned
+	if metadata, ok := core.MetadataFromContext(req.Context()); ok && conn != nil && conn.RemoteAddr() != nil {
+		metadata["upstream_addr"] = conn.RemoteAddr().String()
+	}
+
+	if uConn, ok := conn.(*utls.UConn); ok && res.TLS == nil {
+		res.TLS = toConnectionState(uConn.ConnectionState())
+	}
+	return res, nil
+}
+
+// toConnectionState converts the utls connection state to the crypto/tls connection state used by `http.Response`
+func toConnectionState(state utls.ConnectionState) *stdtls.ConnectionState {
+	return &stdtls.ConnectionState{
+		Version:            state.Version,
+		HandshakeComplete:  state.HandshakeComplete,
+		DidResume:          state.DidResume,
+		CipherSuite:        state.CipherSuite,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		ServerName:         state.ServerName,
+		PeerCertificates:   state.PeerCertificates,
+		VerifiedChains:     state.VerifiedChains,
+	}
 }
@@ -5,17 +5,25 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"errors"
 	"io"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/tfkr-ae/marasi/core"
 )
 
 func testCert(t *testing.T) *x509.Certificate {
@@ -223,7 +231,7 @@ func TestMarasiRoundTripper(t *testing.T) {
 
 func TestMarasiTransportDialTLSContext(t *testing.T) {
 	marasiCert := testCert(t)
-	transport := newMarasiTransport(marasiCert)
+	transport := newMarasiTransport(marasiCert, 0, nil)
 
 	t.Run("request to standard HTTPS server should pass through", func(t *testing.T) {
 		testTLSServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -265,6 +273,47 @@ func TestMarasiTransportDialTLSContext(t *testing.T) {
 		}
 	})
 
+	t.Run("response should carry the utls connection state and the original request", func(t *testing.T) {
+		testTLSServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		testTLSServer.EnableHTTP2 = true
+		// Like most h2 servers, h2 is preferred and http/1.1 is offered as well
+		testTLSServer.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+		testTLSServer.StartTLS()
+		defer testTLSServer.Close()
+
+		req := httptest.NewRequest(http.MethodGet, testTLSServer.URL, nil)
+		req.RequestURI = ""
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("wanted: nil\ngot: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Request != req {
+			t.Errorf("wanted: response for the original request\ngot: %p", resp.Request)
+		}
+
+		if resp.TLS == nil {
+			t.Fatalf("wanted: TLS connection state\ngot: nil")
+		}
+
+		// The h2 capable server negotiates http/1.1 as the transport only offers HTTP/1.1
+		if resp.TLS.NegotiatedProtocol != "http/1.1" {
+			t.Errorf("wanted: %q\ngot: %q", "http/1.1", resp.TLS.NegotiatedProtocol)
+		}
+
+		if !resp.TLS.HandshakeComplete || resp.TLS.Version != tls.VersionTLS13 || resp.TLS.CipherSuite == 0 {
+			t.Errorf("wanted: completed TLS 1.3 handshake\ngot: %+v", resp.TLS)
+		}
+
+		if len(resp.TLS.PeerCertificates) == 0 || !resp.TLS.PeerCertificates[0].Equal(testTLSServer.Certificate()) {
+			t.Errorf("wanted: the server certificate in the peer certificates\ngot: %d certificates", len(resp.TLS.PeerCertificates))
+		}
+	})
+
 	t.Run("requests to closed ports should fail", func(t *testing.T) {
 		testClient := &http.Client{
 			Transport: transport,
@@ -278,3 +327,196 @@ func TestMarasiTransportDialTLSContext(t *testing.T) {
 		}
 	})
 }
+
+func TestMarasiTransportMaxConnsPerHost(t *testing.T) {
+	const limit = 2
+
+	var active, peak atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := active.Add(1)
+		defer active.Add(-1)
+
+		for {
+			seen := peak.Load()
+			if current <= seen || peak.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: newMarasiTransport(testCert(t), limit, nil),
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				errs <- err
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+	}
+
+	if got := peak.Load(); got > limit {
+		t.Fatalf("\nwanted:\nat most %d concurrent requests\ngot:\n%d", limit, got)
+	}
+}
+
+func TestMarasiTransportPinnedCerts(t *testing.T) {
+	testTLSServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pinned"))
+	}))
+	defer testTLSServer.Close()
+
+	serverURL, err := url.Parse(testTLSServer.URL)
+	if err != nil {
+		t.Fatalf("parsing server url: %v", err)
+	}
+	sum := sha256.Sum256(testTLSServer.Certificate().Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	newClient := func(pin string) *http.Client {
+		transport := newMarasiTransport(testCert(t), 0, map[string]string{serverURL.Hostname(): pin})
+		if mrt, ok := transport.(*marasiRoundTripper); ok {
+			if ht, ok := mrt.base.(*http.Transport); ok {
+				ht.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			}
+		}
+		return &http.Client{Transport: transport}
+	}
+
+	t.Run("correct pin should connect", func(t *testing.T) {
+		resp, err := newClient(strings.ToUpper(fingerprint)).Get(testTLSServer.URL)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading response body: %v", err)
+		}
+		if string(body) != "pinned" {
+			t.Fatalf("\nwanted:\n%q\ngot:\n%q", "pinned", body)
+		}
+	})
+
+	t.Run("incorrect pin should abort the connection and record metadata", func(t *testing.T) {
+		metadata := make(map[string]any)
+		req := httptest.NewRequest("GET", testTLSServer.URL, nil)
+		req.RequestURI = ""
+		req = core.ContextWithMetadata(req, metadata)
+
+		_, err := newClient(strings.Repeat("00", sha256.Size)).Do(req)
+		if !errors.Is(err, ErrCertificatePinMismatch) {
+			t.Fatalf("\nwanted:\n%v\ngot:\n%v", ErrCertificatePinMismatch, err)
+		}
+
+		got, ok := metadata["certificate_pin_error"].(string)
+		if !ok || !strings.Contains(got, fingerprint) {
+			t.Fatalf("\nwanted:\npin error containing %s\ngot:\n%v", fingerprint, metadata["certificate_pin_error"])
+		}
+	})
+}
+
+func TestMarasiTransportUpstreamAddr(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer testServer.Close()
+
+	metadata := make(map[string]any)
+	req := httptest.NewRequest("GET", testServer.URL, nil)
+	req.RequestURI = ""
+	req = core.ContextWithMetadata(req, metadata)
+
+	client := &http.Client{Transport: newMarasiTransport(testCert(t), 0, nil)}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+	}
+	resp.Body.Close()
+
+	want := testServer.Listener.Addr().String()
+	if got := metadata["upstream_addr"]; got != want {
+		t.Fatalf("\nwanted:\n%s\ngot:\n%v", want, got)
+	}
+}
+
+func TestMarasiTransportSNI(t *testing.T) {
+	// The TLS server routes to a virtual host by the SNI of the handshake, the Host header is echoed back
+	virtualHosts := map[string]string{
+		"front.marasi.app":  "front",
+		"origin.marasi.app": "origin",
+	}
+	testTLSServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Host", r.Host)
+		w.Write([]byte(virtualHosts[r.TLS.ServerName]))
+	}))
+	defer testTLSServer.Close()
+
+	transport := newMarasiTransport(testCert(t), 0, nil)
+	if mrt, ok := transport.(*marasiRoundTripper); ok {
+		if ht, ok := mrt.base.(*http.Transport); ok {
+			ht.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+	}
+	client := &http.Client{Transport: transport}
+
+	send := func(t *testing.T, sni string) (string, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", testTLSServer.URL, nil)
+		req.RequestURI = ""
+		req.Host = "origin.marasi.app"
+		if sni != "" {
+			req = core.ContextWithSNI(req, sni)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("\nwanted:\nnil\ngot:\n%v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading response body: %v", err)
+		}
+		return string(body), resp.Header.Get("X-Host")
+	}
+
+	t.Run("handshake should use the sni while the host header differs", func(t *testing.T) {
+		target, host := send(t, "front.marasi.app")
+		if target != "front" {
+			t.Fatalf("\nwanted:\n%q\ngot:\n%q", "front", target)
+		}
+		if host != "origin.marasi.app" {
+			t.Fatalf("\nwanted:\n%q\ngot:\n%q", "origin.marasi.app", host)
+		}
+	})
+
+	t.Run("request without sni should not reuse the overridden connection", func(t *testing.T) {
+		send(t, "front.marasi.app")
+		target, _ := send(t, "")
+		if target == "front" {
+			t.Fatalf("\nwanted:\nconnection without the front sni\ngot:\n%q", target)
+		}
+	})
+}